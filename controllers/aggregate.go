@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"vartrick/helpers"
+)
+
+var aliasPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Aggregate runs grouped aggregate functions over a table.
+//
+//	{
+//	    "table": "sales",
+//	    "group_by": ["region"],
+//	    "aggregates": [{"function": "sum", "column": "amount", "as": "total"}, {"function": "count", "column": "*"}],
+//	    "filter": {"column": "year", "op": "eq", "value": 2024},
+//	    "having": {"column": "total", "op": "gt", "value": 1000}
+//	}
+//
+// Supported functions: count, sum, avg, min, max; "distinct": true applies to the column.
+func Aggregate(options map[string]interface{}) map[string]interface{} {
+	table, ok := options["table"].(string)
+	if !ok || table == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Table name is required",
+		}
+	}
+
+	groupBy := helpers.SelectColumns(options["group_by"])
+	condition, _ := options["condition"].(map[string]interface{})
+	orCondition, _ := options["or_condition"].(map[string]interface{})
+	if err := helpers.ValidateAccess(table, false, groupBy, helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateLookup([]string{table}, helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// Grouping by a redacted column would return its values
+	for _, column := range groupBy {
+		if helpers.IsRedacted([]string{table}, column) {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Column '%s' is redacted", column),
+			}
+		}
+	}
+
+	// Build the aggregate expressions, having may refer to them by alias
+	aggregates, ok := options["aggregates"].([]interface{})
+	if !ok || len(aggregates) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "At least one aggregate is required",
+		}
+	}
+	var selectParts []string
+	var counts []string
+	expressions := map[string]string{}
+	for _, column := range groupBy {
+		selectParts = append(selectParts, helpers.EscapeId(column))
+		expressions[column] = helpers.EscapeId(column)
+	}
+	for _, raw := range aggregates {
+		aggregate, ok := raw.(map[string]interface{})
+		if !ok {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Each aggregate must be an object with function and column",
+			}
+		}
+		function, _ := aggregate["function"].(string)
+		function = strings.ToLower(function)
+		column, _ := aggregate["column"].(string)
+		if column == "" {
+			column = "*"
+		}
+		switch function {
+		case "count":
+		case "sum", "avg", "min", "max":
+			if column == "*" {
+				return map[string]interface{}{
+					"success": false,
+					"message": fmt.Sprintf("Aggregate '%s' requires a column", function),
+				}
+			}
+		default:
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Unsupported aggregate function '%s'", function),
+			}
+		}
+		if err := helpers.ValidateColumns([]string{table}, []string{column}); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+
+		// min/max/sum/avg would expose redacted values, counting them is fine
+		if function != "count" && helpers.IsRedacted([]string{table}, column) {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Column '%s' is redacted", column),
+			}
+		}
+
+		argument := "*"
+		if column != "*" {
+			argument = helpers.EscapeId(column)
+			if distinct, _ := aggregate["distinct"].(bool); distinct {
+				argument = "DISTINCT " + argument
+			}
+		}
+		alias, _ := aggregate["as"].(string)
+		if alias == "" {
+			alias = function + "_" + strings.ReplaceAll(column, "*", "all")
+		}
+		if !aliasPattern.MatchString(alias) {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Invalid aggregate alias '%s'", alias),
+			}
+		}
+		if _, exists := expressions[alias]; exists {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Duplicate aggregate alias '%s'", alias),
+			}
+		}
+		expression := fmt.Sprintf("%s(%s)", strings.ToUpper(function), argument)
+		expressions[alias] = expression
+		if function == "count" {
+			counts = append(counts, alias)
+		}
+		selectParts = append(selectParts, fmt.Sprintf("%s AS %s", expression, helpers.EscapeId(alias)))
+	}
+
+	// Build WHERE clause
+	whereClause, params := "1=1", []interface{}{}
+	if len(condition) > 0 || len(orCondition) > 0 {
+		var err error
+		if whereClause, params, err = helpers.BuildWhere(condition, orCondition); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+	}
+	whereClause, params, err := helpers.AppendFilter(whereClause, params, options["filter"], []string{table})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// Restrict tenant scoped tables to the caller's tenant
+	whereClause, params, err = helpers.ScopeWhere(options, table, whereClause, params)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", strings.Join(selectParts, ", "), helpers.EscapeId(table), whereClause)
+	if len(groupBy) > 0 {
+		query += " GROUP BY " + strings.Join(helpers.EscapeIds(groupBy), ", ")
+	}
+
+	// HAVING uses the expressions instead of aliases, PostgreSQL can't reference aliases there
+	if having, ok := options["having"]; ok && having != nil {
+		havingClause, havingParams, err := helpers.GenerateHaving(having, expressions)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		query += " HAVING " + havingClause
+		params = append(params, havingParams...)
+	}
+	if len(groupBy) > 0 {
+		query += " ORDER BY " + strings.Join(helpers.EscapeIds(groupBy), ", ")
+	}
+
+	rows, err := db.Query(helpers.Rebind(query), params...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	defer rows.Close()
+	results, err := helpers.ScanRowsWith(rows, helpers.ScanOptionsFrom(options))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	// Some drivers return counts as text, other aggregates keep the type of their column
+	for _, row := range results {
+		for _, alias := range counts {
+			row[alias] = countValue(row[alias])
+		}
+	}
+	if results == nil {
+		results = []map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": results,
+	}
+}
+
+// countValue converts a textual count to int64, other values are returned unchanged
+func countValue(value interface{}) interface{} {
+	text, ok := value.(string)
+	if !ok {
+		return value
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i
+	}
+	return value
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"fmt"
+	"vartrick/helpers"
+)
+
+// Login verifies a username and password against the auth table (AUTH_TABLE).
+// Accepts {"user_name": "...", "password": "..."} or the older {"condition": {...}} body.
+// Unknown users and wrong passwords get the same message and take the same time.
+func Login(options map[string]interface{}) map[string]interface{} {
+	table, usernameColumn, passwordColumn := helpers.AuthColumns()
+	credentials := options
+	if condition, ok := options["condition"].(map[string]interface{}); ok {
+		credentials = condition
+	}
+	username, _ := credentials[usernameColumn].(string)
+	password, _ := credentials[passwordColumn].(string)
+	if username == "" || password == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Username and password are required",
+		}
+	}
+	failure := map[string]interface{}{
+		"success": false,
+		"message": "Invalid username or password",
+	}
+
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s = ?", helpers.EscapeId(table), helpers.DBDialect.CaseSensitive(helpers.EscapeId(usernameColumn)))
+	rows, err := db.Query(helpers.Rebind(query), username)
+	if err != nil {
+		helpers.LogJSON(false, "Login lookup failed: "+err.Error())
+		return failure
+	}
+	defer rows.Close()
+	users, err := helpers.ScanRowsWith(rows, helpers.ScanOptions{Unredacted: true})
+	if err != nil || len(users) != 1 {
+		helpers.VerifyDummyPassword(password)
+		return failure
+	}
+	user := users[0]
+
+	stored, _ := user[passwordColumn].(string)
+	valid, needsRehash := helpers.VerifyPassword(stored, password)
+	if !valid {
+		return failure
+	}
+
+	// Upgrade plaintext or outdated hashes now that the password is known
+	if needsRehash {
+		if hash, err := helpers.HashPassword(password); err == nil {
+			update := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ? AND %s = ?", helpers.EscapeId(table), helpers.EscapeId(passwordColumn),
+				helpers.DBDialect.CaseSensitive(helpers.EscapeId(usernameColumn)), helpers.DBDialect.CaseSensitive(helpers.EscapeId(passwordColumn)))
+			if _, err := db.Exec(helpers.Rebind(update), hash, username, stored); err != nil {
+				helpers.LogJSON(false, "Password rehash failed: "+err.Error())
+			}
+		}
+	}
+
+	delete(user, passwordColumn)
+	return map[string]interface{}{
+		"success": true,
+		"message": helpers.RedactRows([]map[string]interface{}{user}, []string{table}),
+	}
+}
+
+// SendLoginOTP sends a one-time code for the second login step by email or SMS:
+// {"challenge_token": "...", "channel": "email"|"sms"}
+func SendLoginOTP(options map[string]interface{}) map[string]interface{} {
+	token, _ := options["challenge_token"].(string)
+	channel, _ := options["channel"].(string)
+	generated := GenerateOTP(map[string]interface{}{"length": 6})
+	data, _ := generated["message"].(map[string]interface{})
+	code, _ := data["otp"].(string)
+	if success, _ := generated["success"].(bool); !success || code == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to generate OTP",
+		}
+	}
+	recipient, err := helpers.StoreTwoFactorOTP(token, channel, code)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	message := fmt.Sprintf("Dear user,\n\nYour login code is: %s\n\nIf you did not try to log in, please change your password.", code)
+	var sent map[string]interface{}
+	if channel == helpers.MethodSMS {
+		sent = SendMessage(map[string]interface{}{"to": []string{recipient}, "message": message})
+	} else {
+		sent = SendMail(map[string]interface{}{"to": []string{recipient}, "message": message, "subject": "Your login code"})
+	}
+	if success, _ := sent["success"].(bool); !success {
+		helpers.WithdrawTwoFactorOTP(recipient)
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Failed to send the login code by %s", channel),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Login code sent by %s", channel),
+	}
+}
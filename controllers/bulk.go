@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"vartrick/helpers"
+)
+
+// maxInsertParams keeps multi-row INSERTs below the bind parameter limit of every engine
+const maxInsertParams = 30000
+
+// insertGroup collects bulk records that can share one multi-row INSERT
+type insertGroup struct {
+	table    string
+	columns  []string
+	ignore   bool
+	target   []string
+	update   []string
+	records  []map[string]interface{}
+	indexes  []int // position of each record in the request
+	rowLimit int
+}
+
+// groupInserts validates every bulk create item and groups them by table, columns and on_conflict.
+// Items that fail validation are returned as failures with their request index.
+func groupInserts(options []map[string]interface{}) ([]*insertGroup, []map[string]interface{}) {
+	var groups []*insertGroup
+	var failed []map[string]interface{}
+	byKey := map[string]*insertGroup{}
+	for i, opt := range options {
+		table, ok := opt["table"].(string)
+		if !ok || table == "" {
+			failed = append(failed, map[string]interface{}{"success": false, "index": i, "message": "Table name is required"})
+			continue
+		}
+		data, ok := opt["data"].(map[string]interface{})
+		if !ok || len(data) == 0 {
+			failed = append(failed, map[string]interface{}{"success": false, "index": i, "message": "Invalid data format"})
+			continue
+		}
+		if err := helpers.ScopeData(opt, table, data); err != nil {
+			failed = append(failed, map[string]interface{}{"success": false, "index": i, "message": err.Error()})
+			continue
+		}
+		columns := helpers.MapKeys(data)
+		sort.Strings(columns)
+		if err := helpers.ValidateAccess(table, true, columns); err != nil {
+			failed = append(failed, map[string]interface{}{"success": false, "index": i, "message": err.Error()})
+			continue
+		}
+		if err := helpers.HashPasswordColumns(table, data); err != nil {
+			failed = append(failed, map[string]interface{}{"success": false, "index": i, "message": err.Error()})
+			continue
+		}
+		ignore, target, update, err := parseOnConflict(table, opt["on_conflict"])
+		if err != nil {
+			failed = append(failed, map[string]interface{}{"success": false, "index": i, "message": err.Error()})
+			continue
+		}
+
+		key := fmt.Sprintf("%s|%s|%t|%s|%s", table, strings.Join(columns, ","), ignore, strings.Join(target, ","), strings.Join(update, ","))
+		group, ok := byKey[key]
+		if !ok {
+			group = &insertGroup{table: table, columns: columns, ignore: ignore, target: target, update: update}
+			group.rowLimit = maxInsertParams / len(columns)
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.records = append(group.records, data)
+		group.indexes = append(group.indexes, i)
+	}
+	return groups, failed
+}
+
+// parseOnConflict reads "ignore" or {"update": [...], "target": [...]}, target defaults to the primary key.
+// Updates are refused on tenant scoped tables, the conflicting row may belong to another tenant.
+func parseOnConflict(table string, value interface{}) (bool, []string, []string, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil, nil, nil
+	case string:
+		if v == "ignore" {
+			return true, nil, nil, nil
+		}
+		return false, nil, nil, fmt.Errorf("Invalid on_conflict '%s', expected \"ignore\" or {\"update\": [columns]}", v)
+	case map[string]interface{}:
+		if helpers.TenantColumn(table) != "" {
+			return false, nil, nil, fmt.Errorf("on_conflict update is not allowed on tenant scoped table '%s'", table)
+		}
+		update := helpers.SelectColumns(v["update"])
+		if len(update) == 0 {
+			return false, nil, nil, fmt.Errorf("on_conflict update requires a list of columns")
+		}
+		target := helpers.SelectColumns(v["target"])
+		if len(target) == 0 {
+			if schema := helpers.GetTableSchema(table); schema != nil {
+				target = schema.PrimaryKey()
+			}
+		}
+		if len(target) == 0 {
+			return false, nil, nil, fmt.Errorf("on_conflict update requires a target for table '%s'", table)
+		}
+		if err := helpers.ValidateColumns([]string{table}, append(append([]string{}, update...), target...)); err != nil {
+			return false, nil, nil, err
+		}
+		return false, target, update, nil
+	default:
+		return false, nil, nil, fmt.Errorf("Invalid on_conflict option")
+	}
+}
+
+// insertBatch writes one chunk of a group with a single multi-row INSERT
+func insertBatch(q helpers.Querier, group *insertGroup, records []map[string]interface{}, indexes []int) map[string]interface{} {
+	verb, suffix := helpers.DBDialect.OnConflict(group.ignore, group.target, group.update)
+	valuesClause, params := helpers.GenerateInsertRows(group.columns, records)
+	query := fmt.Sprintf("%s %s %s%s", verb, helpers.EscapeId(group.table), valuesClause, suffix)
+
+	exactRange := !group.ignore && len(group.update) == 0
+	affected, firstID, lastID, err := helpers.InsertRows(q, query, params, len(records), exactRange)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"table":   group.table,
+			"indexes": indexes,
+			"message": createErrorMessage(err),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"table":    group.table,
+			"rows":     len(records),
+			"affected": affected,
+			"first_id": firstID,
+			"last_id":  lastID,
+		},
+	}
+}
+
+// createErrorMessage maps insert errors to the messages Create returns
+func createErrorMessage(err error) string {
+	if kind, message, ok := helpers.ClassifyDBError(err); ok {
+		switch kind {
+		case helpers.DBErrorDuplicate: // duplicate key
+			return "Duplicate entry. A record with the same key already exists"
+		case helpers.DBErrorForeignKey: // foreign key error
+			return "Referenced foreign key does not exist in parent table"
+		default:
+			return message
+		}
+	}
+	return "Error occur Unable to create data"
+}
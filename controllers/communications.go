@@ -74,7 +74,7 @@ func GenerateOTP(options map[string]interface{}) map[string]interface{} {
 	}
 }
 
-// send OTP via either mail or phone
+// send OTP via either mail or phone, the code is stored for VerifyOTP and never returned
 func SendOTP(options map[string]interface{}) map[string]interface{} {
 	otpLength := 4
 	// Handle OTP length
@@ -90,6 +90,18 @@ func SendOTP(options map[string]interface{}) map[string]interface{} {
 			}
 		}
 	}
+	purpose, _ := options["purpose"].(string)
+	if purpose == "" {
+		purpose = "verification"
+	}
+	email, _ := options["email"].(string)
+	phone, _ := options["phone"].(string)
+	if email == "" && phone == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Email or phone number is required",
+		}
+	}
 	// Generate OTP
 	result := GenerateOTP(map[string]interface{}{
 		"length": otpLength,
@@ -101,38 +113,50 @@ func SendOTP(options map[string]interface{}) map[string]interface{} {
 			return map[string]interface{}{
 				"success": false,
 				"message": "OTP generation response format error",
-				"error":   result,
 			}
 		}
 		otpCode, ok := msgData["otp"].(string)
+		if !ok {
+			return map[string]interface{}{
+				"success": false,
+				"message": "OTP value missing",
+			}
+		}
 		message := fmt.Sprintf(
 			"Dear user,\n\nYour One-Time Password (OTP) is: %s\n\n"+
 				"Please use this code to complete your verification. "+
 				"Thank you,",
 			otpCode,
 		)
-		if !ok {
-			return map[string]interface{}{
-				"success": false,
-				"message": "OTP value missing",
-				"error":   result,
+		var emailStatus, phoneStatus map[string]interface{}
+		var retryAfter time.Duration
+		// issue stores the code for a recipient, answering the cooldown instead of sending again.
+		// A code that could not be delivered is withdrawn.
+		issue := func(recipient string, send func() map[string]interface{}) map[string]interface{} {
+			if err := helpers.IssueOTP(clientOTPPurpose(purpose), recipient, otpCode); err != nil {
+				if cooldown, ok := err.(*helpers.OTPCooldownError); ok && cooldown.RetryAfter > retryAfter {
+					retryAfter = cooldown.RetryAfter
+				}
+				return map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}
+			}
+			status := send()
+			if sent, _ := status["success"].(bool); !sent {
+				helpers.WithdrawOTP(clientOTPPurpose(purpose), recipient)
 			}
+			return status
 		}
-		var emailStatus, phoneStatus map[string]interface{}
 		// Send via email
-		if emailVal, ok := options["email"]; ok {
-			if email, ok := emailVal.(string); ok && email != "" {
-				emailStatus = SendMail(map[string]interface{}{
-					"to":      email,
+		if email != "" {
+			emailStatus = issue(email, func() map[string]interface{} {
+				return SendMail(map[string]interface{}{
+					"to":      []string{email},
 					"message": message,
 					"subject": "Your One-Time Password (OTP)",
 				})
-			} else {
-				emailStatus = map[string]interface{}{
-					"success": false,
-					"message": "Invalid email format",
-				}
-			}
+			})
 		} else {
 			emailStatus = map[string]interface{}{
 				"success": false,
@@ -140,31 +164,43 @@ func SendOTP(options map[string]interface{}) map[string]interface{} {
 			}
 		}
 		// Send via phone
-		if phoneVal, ok := options["phone"]; ok {
-			if phone, ok := phoneVal.(string); ok && phone != "" {
-				phoneStatus = SendMessage(map[string]interface{}{
-					"to":      phone,
+		if phone != "" {
+			phoneStatus = issue(phone, func() map[string]interface{} {
+				return SendMessage(map[string]interface{}{
+					"to":      []string{phone},
 					"message": message,
 				})
-			} else {
-				phoneStatus = map[string]interface{}{
-					"success": false,
-					"message": "Invalid phone format",
-				}
-			}
+			})
 		} else {
 			phoneStatus = map[string]interface{}{
 				"success": false,
 				"message": "Phone number not provided",
 			}
 		}
+		emailSent, _ := emailStatus["success"].(bool)
+		phoneSent, _ := phoneStatus["success"].(bool)
+		if !emailSent && !phoneSent {
+			response := map[string]interface{}{
+				"success": false,
+				"message": map[string]interface{}{
+					"status": "Failed to send OTP",
+					"email":  emailStatus,
+					"phone":  phoneStatus,
+				},
+			}
+			if retryAfter > 0 {
+				response["retry_after"] = int(retryAfter.Seconds() + 0.5)
+			}
+			return response
+		}
 		return map[string]interface{}{
 			"success": true,
 			"message": map[string]interface{}{
-				"status": "OTP generated and sent successfully",
-				"otp":    message,
-				"email":  emailStatus,
-				"phone":  phoneStatus,
+				"status":     "OTP generated and sent successfully",
+				"purpose":    purpose,
+				"expires_in": int(helpers.OTPExpiry().Seconds()),
+				"email":      emailStatus,
+				"phone":      phoneStatus,
 			},
 		}
 	}
@@ -172,7 +208,41 @@ func SendOTP(options map[string]interface{}) map[string]interface{} {
 	return map[string]interface{}{
 		"success": false,
 		"message": "Failed to generate or send OTP",
-		"error":   result,
+	}
+}
+
+// clientOTPPurpose keeps the purposes clients pick apart from the ones the server uses itself, a client
+// asking for purpose "login" must not reach the codes of a 2FA login challenge
+func clientOTPPurpose(purpose string) string {
+	return "client:" + purpose
+}
+
+// VerifyOTP checks a code sent by SendOTP: {"purpose": "verification", "email"|"phone": "...", "code": "1234"}
+func VerifyOTP(options map[string]interface{}) map[string]interface{} {
+	purpose, _ := options["purpose"].(string)
+	if purpose == "" {
+		purpose = "verification"
+	}
+	recipient, _ := options["email"].(string)
+	if recipient == "" {
+		recipient, _ = options["phone"].(string)
+	}
+	code, _ := options["code"].(string)
+	if recipient == "" || code == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Email or phone number and code are required",
+		}
+	}
+	if err := helpers.VerifyOTP(clientOTPPurpose(purpose), recipient, code); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "OTP verified successfully",
 	}
 }
 
@@ -8,8 +8,6 @@ import (
 	"strings"
 	"time"
 	"vartrick/helpers"
-
-	"github.com/go-sql-driver/mysql"
 )
 
 var db *sql.DB
@@ -49,8 +47,8 @@ func Backup(options map[string]interface{}) map[string]interface{} {
 	defer file.Close()
 
 	// 1. Get all tables
-	query := fmt.Sprintf("SELECT table_name FROM information_schema.tables WHERE table_schema='%s'", helpers.DatabaseName)
-	rows, err := db.Query(query)
+	query, queryParams := helpers.DBDialect.ListTablesQuery()
+	rows, err := db.Query(helpers.Rebind(query), queryParams...)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -74,19 +72,18 @@ func Backup(options map[string]interface{}) map[string]interface{} {
 	// 2. Iterate over each table: dump structure + data
 	for _, table := range tables {
 		// Table structure
-		var tName, createStmt string
-		err := db.QueryRow(fmt.Sprintf("SHOW CREATE TABLE `%s`", table)).Scan(&tName, &createStmt)
+		createStmt, err := helpers.DBDialect.CreateTableStatement(db, table)
 		if err != nil {
 			return map[string]interface{}{
 				"success": false,
 				"message": fmt.Sprintf("Failed to get CREATE TABLE for %s: %s", table, err.Error()),
 			}
 		}
-		file.WriteString(fmt.Sprintf("-- Table structure for `%s`\n", table))
+		file.WriteString(fmt.Sprintf("-- Table structure for %s\n", helpers.EscapeId(table)))
 		file.WriteString(fmt.Sprintf("%s;\n\n", createStmt))
 
 		// Table data
-		dataRows, err := db.Query(fmt.Sprintf("SELECT * FROM `%s`", table))
+		dataRows, err := db.Query(fmt.Sprintf("SELECT * FROM %s", helpers.EscapeId(table)))
 		if err != nil {
 			return map[string]interface{}{
 				"success": false,
@@ -112,9 +109,9 @@ func Backup(options map[string]interface{}) map[string]interface{} {
 				}
 			}
 
-			insertStmt := fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s);\n",
-				table,
-				strings.Join(cols, ", "),
+			insertStmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);\n",
+				helpers.EscapeId(table),
+				strings.Join(helpers.EscapeIds(cols), ", "),
 				strings.Join(valStrings, ", "),
 			)
 			file.WriteString(insertStmt)
@@ -167,8 +164,38 @@ func Read(options map[string]interface{}) map[string]interface{} {
 	// Parse "condition" and "or_condition"
 	condMap, _ := options["condition"].(map[string]interface{})
 	orCondMap, _ := options["or_condition"].(map[string]interface{})
-	whereClause, params, err := helpers.BuildWhere(condMap, orCondMap)
-	// Build and execute whereClause
+	// Reject unknown tables/columns before any SQL is built
+	if err := helpers.ValidateAccess(table, false, helpers.SelectColumns(options["select"]), helpers.MapKeys(condMap), helpers.MapKeys(orCondMap)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateLookup([]string{table}, helpers.MapKeys(condMap), helpers.MapKeys(orCondMap)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// Build whereClause from condition, or_condition and filter
+	whereClause, params, err := helpers.BuildFilteredWhere(condMap, orCondMap, options["filter"], []string{table})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// Restrict tenant scoped tables to the caller's tenant
+	whereClause, params, err = helpers.ScopeWhere(options, table, whereClause, params)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	// Parse ORDER BY, columns are validated like select
+	orderBy, err := helpers.ParseOrderBy(options["order_by"], []string{table})
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -176,10 +203,10 @@ func Read(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", selectFields, table, whereClause)
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s%s", selectFields, helpers.EscapeId(table), whereClause, helpers.GenerateOrderBy(orderBy))
 	fmt.Println(query)
 	fmt.Println(params)
-	return helpers.ExecuteSelect(query, params...)
+	return helpers.ExecuteSelectWith(helpers.ScanOptionsFrom(options), query, params...)
 
 }
 
@@ -194,10 +221,78 @@ func ReadJoin(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	// Handle SELECT fields
-	selectFields := "*"
-	if sel, ok := options["select"]; ok {
-		selectFields = helpers.GenerateSelect(sel)
+	if err := helpers.ValidateTable(baseTable, false); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	// Handle JOINs (expects options["joins"] as array of {"type", "table", "on"})
+	tables := []string{baseTable}
+	joinClause := ""
+	var joinParams []interface{}
+	if joins, ok := options["joins"].([]interface{}); ok {
+		for _, j := range joins {
+			joinMap, ok := j.(map[string]interface{})
+			if !ok {
+				return map[string]interface{}{
+					"success": false,
+					"message": "Each join must be an object with type, table and on",
+				}
+			}
+			joinType, err := helpers.JoinType(joinMap["type"])
+			if err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}
+			}
+			tableName, _ := joinMap["table"].(string)
+			if err := helpers.ValidateTable(tableName, false); err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}
+			}
+			tables = append(tables, tableName)
+			pairs, err := helpers.JoinOn(joinMap["on"])
+			if err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}
+			}
+			var onParts []string
+			for _, pair := range pairs {
+				if err := helpers.ValidateColumns(tables, pair[:]); err != nil {
+					return map[string]interface{}{
+						"success": false,
+						"message": err.Error(),
+					}
+				}
+				if err := helpers.ValidateLookup(tables, pair[:]); err != nil {
+					return map[string]interface{}{
+						"success": false,
+						"message": err.Error(),
+					}
+				}
+				onParts = append(onParts, fmt.Sprintf("%s = %s", helpers.EscapeId(pair[0]), helpers.EscapeId(pair[1])))
+			}
+			// Joined tenant scoped tables are restricted in ON so outer joins keep their rows
+			column, tenant, err := helpers.TenantScope(options, tableName)
+			if err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}
+			}
+			if column != "" {
+				onParts = append(onParts, fmt.Sprintf("%s = ?", helpers.EscapeId(tableName+"."+column)))
+				joinParams = append(joinParams, tenant)
+			}
+			joinClause += fmt.Sprintf(" %s %s ON %s", joinType, helpers.EscapeId(tableName), strings.Join(onParts, " AND "))
+		}
 	}
 
 	// Handle conditions
@@ -209,6 +304,26 @@ func ReadJoin(options map[string]interface{}) map[string]interface{} {
 	if orCond, ok := options["or_condition"].(map[string]interface{}); ok {
 		orCondition = orCond
 	}
+	for _, columns := range [][]string{helpers.SelectColumns(options["select"]), helpers.MapKeys(condition), helpers.MapKeys(orCondition)} {
+		if err := helpers.ValidateColumns(tables, columns); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+	}
+	if err := helpers.ValidateLookup(tables, helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	// Handle SELECT fields
+	selectFields := "*"
+	if sel, ok := options["select"]; ok {
+		selectFields = helpers.GenerateSelect(sel)
+	}
 
 	// Build WHERE clause
 	whereClause, params := "", []interface{}{}
@@ -226,29 +341,30 @@ func ReadJoin(options map[string]interface{}) map[string]interface{} {
 	default:
 		whereClause = "1=1"
 	}
+	whereClause, params, err := helpers.ScopeWhere(options, baseTable, whereClause, params)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// ON parameters come before the WHERE parameters
+	params = append(joinParams, params...)
 
-	// Handle JOINs (expects options["joins"] as array of map[string]interface{})
-	joinClause := ""
-	if joins, ok := options["joins"].([]interface{}); ok {
-		for _, j := range joins {
-			if joinMap, ok := j.(map[string]interface{}); ok {
-				joinType := "INNER JOIN"
-				if jt, ok := joinMap["type"].(string); ok {
-					joinType = jt
-				}
-				tableName, ok1 := joinMap["table"].(string)
-				onClause, ok2 := joinMap["on"].(string)
-				if ok1 && ok2 {
-					joinClause += fmt.Sprintf(" %s %s ON %s", joinType, tableName, onClause)
-				}
-			}
+	// Parse ORDER BY, columns are validated like select
+	orderBy, err := helpers.ParseOrderBy(options["order_by"], tables)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
 	}
+
 	// Build query
-	query := fmt.Sprintf("SELECT %s FROM %s%s WHERE %s", selectFields, baseTable, joinClause, whereClause)
+	query := fmt.Sprintf("SELECT %s FROM %s%s WHERE %s%s", selectFields, helpers.EscapeId(baseTable), joinClause, whereClause, helpers.GenerateOrderBy(orderBy))
 
 	// Execute query
-	rows, err := db.Query(query, params...)
+	rows, err := db.Query(helpers.Rebind(query), params...)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -256,45 +372,14 @@ func ReadJoin(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 	defer rows.Close()
-	columns, err := rows.Columns()
+	results, err := helpers.ScanRowsWith(rows, helpers.ScanOptionsFrom(options))
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
 		}
 	}
-	var results []map[string]interface{}
-	for rows.Next() {
-		columnValues := make([]interface{}, len(columns))
-		columnPointers := make([]interface{}, len(columns))
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
-		}
-		if err := rows.Scan(columnPointers...); err != nil {
-			return map[string]interface{}{
-				"success": false,
-				"message": err.Error(),
-			}
-		}
-		rowMap := make(map[string]interface{})
-		for i, col := range columns {
-			val := columnPointers[i].(*interface{})
-			rowMap[col] = *val
-		}
-		results = append(results, rowMap)
-	}
-	// Convert []uint8 (MySQL bytes) to string for JSON compatibility
-	for i, row := range results {
-		newRow := make(map[string]interface{})
-		for k, v := range row {
-			if byteVal, ok := v.([]uint8); ok {
-				newRow[k] = string(byteVal)
-			} else {
-				newRow[k] = v
-			}
-		}
-		results[i] = newRow
-	}
+
 	if len(results) == 0 {
 		return map[string]interface{}{
 			"success": false,
@@ -372,24 +457,54 @@ func Count(options map[string]interface{}) map[string]interface{} {
 	}
 
 	// Validate condition
-	condition, ok := options["condition"].(map[string]interface{})
-	if !ok || len(condition) == 0 {
+	condition, _ := options["condition"].(map[string]interface{})
+	if len(condition) == 0 && options["filter"] == nil {
 		return map[string]interface{}{
 			"success": false,
 			"name":    table,
-			"message": "At least one condition or or_condition is required",
+			"message": "At least one condition or filter is required",
+		}
+	}
+
+	if err := helpers.ValidateAccess(table, false, helpers.MapKeys(condition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"name":    table,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateLookup([]string{table}, helpers.MapKeys(condition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"name":    table,
+			"message": err.Error(),
 		}
 	}
 
 	// Generate WHERE clause using helper
-	whereClause, params := helpers.GenerateWhere(condition)
+	whereClause, params, err := helpers.BuildFilteredWhere(condition, nil, options["filter"], []string{table})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"name":    table,
+			"message": err.Error(),
+		}
+	}
+	whereClause, params, err = helpers.ScopeWhere(options, table, whereClause, params)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"name":    table,
+			"message": err.Error(),
+		}
+	}
 
 	// Prepare query
 	query := fmt.Sprintf("SELECT COUNT(*) AS total FROM %s WHERE %s", helpers.EscapeId(table), whereClause)
 
 	// Execute query
 	var total int
-	err := db.QueryRow(query, params...).Scan(&total)
+	err = db.QueryRow(helpers.Rebind(query), params...).Scan(&total)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -469,10 +584,22 @@ func Search(options map[string]interface{}) map[string]interface{} {
 	condition, _ := options["condition"].(map[string]interface{})
 	orCondition, _ := options["or_condition"].(map[string]interface{})
 
-	if len(condition) == 0 && len(orCondition) == 0 {
+	if len(condition) == 0 && len(orCondition) == 0 && options["filter"] == nil {
 		return map[string]interface{}{
 			"success": false,
-			"message": "At least one of 'condition' or 'or_condition' is required",
+			"message": "At least one of 'condition', 'or_condition' or 'filter' is required",
+		}
+	}
+	if err := helpers.ValidateAccess(table, false, helpers.SelectColumns(options["select"]), helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateLookup([]string{table}, helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
 	}
 
@@ -500,64 +627,55 @@ func Search(options map[string]interface{}) map[string]interface{} {
 	default:
 		whereClause = "1=1" // fallback: no condition, selects all
 	}
-
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", selectFields, table, whereClause)
-
-	rows, err := db.Query(query, params...)
+	whereClause, params, err := helpers.AppendFilter(whereClause, params, options["filter"], []string{table})
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
 		}
 	}
-	defer rows.Close()
-	columns, err := rows.Columns()
+	// Restrict tenant scoped tables to the caller's tenant
+	whereClause, params, err = helpers.ScopeWhere(options, table, whereClause, params)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
 		}
 	}
-	var results []map[string]interface{}
-	for rows.Next() {
-		columnValues := make([]interface{}, len(columns))
-		columnPointers := make([]interface{}, len(columns))
-		for i := range columnValues {
 
-			columnPointers[i] = &columnValues[i]
+	// Parse ORDER BY, columns are validated like select
+	orderBy, err := helpers.ParseOrderBy(options["order_by"], []string{table})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
-		if err := rows.Scan(columnPointers...); err != nil {
-			return map[string]interface{}{
-				"success": false,
-				"message": err.Error(),
-			}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s%s", selectFields, helpers.EscapeId(table), whereClause, helpers.GenerateOrderBy(orderBy))
+
+	rows, err := db.Query(helpers.Rebind(query), params...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
-		rowMap := make(map[string]interface{})
-		for i, col := range columns {
-			val := columnPointers[i].(*interface{})
-			rowMap[col] = *val
-		}
-		results = append(results, rowMap)
-	}
-	// Convert []uint8 (MySQL bytes) to string for JSON compatibility
-	for i, row := range results {
-		newRow := make(map[string]interface{})
-		for k, v := range row {
-			if byteVal, ok := v.([]uint8); ok {
-				newRow[k] = string(byteVal)
-			} else {
-				newRow[k] = v
-			}
+	}
+	defer rows.Close()
+	results, err := helpers.ScanRowsWith(rows, helpers.ScanOptionsFrom(options))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
-		results[i] = newRow
 	}
+
 	if len(results) == 0 {
 		return map[string]interface{}{
 			"success": false,
 			"message": "No data found",
 		}
 	}
-	//if result contain password password delete it
 	return map[string]interface{}{
 		"success": true,
 		"message": results,
@@ -594,6 +712,18 @@ func SearchBetween(options map[string]interface{}) map[string]interface{} {
 			"message": "Missing condition(s)",
 		}
 	}
+	if err := helpers.ValidateAccess(table, false, []string{column}, helpers.SelectColumns(options["select"]), helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateLookup([]string{table}, []string{column}, helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
 
 	// Handle SELECT fields using helpers.GenerateSelect
 	selectFields := "*"
@@ -613,39 +743,51 @@ func SearchBetween(options map[string]interface{}) map[string]interface{} {
 		params = append(params, params1...)
 		params = append(params, params2...)
 	case len(condition) > 0:
-		whereClause, params = helpers.GenerateWhere(condition)
+		where, whereParams := helpers.GenerateWhere(condition)
+		whereClause = where
+		params = append(params, whereParams...)
 	case len(orCondition) > 0:
-		whereClause, params = helpers.GenerateWhereOr(orCondition)
+		where, whereParams := helpers.GenerateWhereOr(orCondition)
+		whereClause = where
+		params = append(params, whereParams...)
 	default:
 		whereClause = "1=1" // fallback: no condition, selects all
 	}
+	// Restrict tenant scoped tables to the caller's tenant
+	whereClause, params, err := helpers.ScopeWhere(options, table, whereClause, params)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
 
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s BETWEEN ? AND ? AND %s", selectFields, table, column, whereClause)
-
-	rows, err := db.Query(query, params...)
+	// Parse ORDER BY, columns are validated like select
+	orderBy, err := helpers.ParseOrderBy(options["order_by"], []string{table})
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
 		}
 	}
-	defer rows.Close()
 
-	results := []map[string]interface{}{}
-	cols, _ := rows.Columns()
-	for rows.Next() {
-		vals := make([]interface{}, len(cols))
-		valPtrs := make([]interface{}, len(cols))
-		for i := range vals {
-			valPtrs[i] = &vals[i]
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s BETWEEN ? AND ? AND %s%s", selectFields, helpers.EscapeId(table), helpers.EscapeId(column), whereClause, helpers.GenerateOrderBy(orderBy))
+
+	rows, err := db.Query(helpers.Rebind(query), params...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
-		rows.Scan(valPtrs...)
+	}
+	defer rows.Close()
 
-		rowMap := map[string]interface{}{}
-		for i, col := range cols {
-			rowMap[col] = vals[i]
+	results, err := helpers.ScanRowsWith(rows, helpers.ScanOptionsFrom(options))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
-		results = append(results, rowMap)
 	}
 
 	if len(results) == 0 {
@@ -675,6 +817,18 @@ func List(options map[string]interface{}) map[string]interface{} {
 	// Conditions
 	condition, _ := options["condition"].(map[string]interface{})
 	orCondition, _ := options["or_condition"].(map[string]interface{})
+	if err := helpers.ValidateAccess(table, false, helpers.SelectColumns(options["select"]), helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateLookup([]string{table}, helpers.MapKeys(condition), helpers.MapKeys(orCondition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
 
 	// Pagination
 	pageFloat, ok := options["page"].(float64)
@@ -712,11 +866,40 @@ func List(options map[string]interface{}) map[string]interface{} {
 	default:
 		whereClause = "1=1"
 	}
+	whereClause, params, err := helpers.AppendFilter(whereClause, params, options["filter"], []string{table})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// Restrict tenant scoped tables to the caller's tenant
+	whereClause, params, err = helpers.ScopeWhere(options, table, whereClause, params)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	// Parse ORDER BY, columns are validated like select
+	orderBy, err := helpers.ParseOrderBy(options["order_by"], []string{table})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	// Cursor (keyset) mode replaces OFFSET and only counts when asked to
+	if mode, _ := options["mode"].(string); mode == "cursor" || options["cursor"] != nil {
+		return listByCursor(options, table, whereClause, params, helpers.StableOrder(orderBy, table), pageSize)
+	}
 
 	// Query total records for pagination
-	totalQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", table, whereClause)
+	totalQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", helpers.EscapeId(table), whereClause)
 	var totalRecords int
-	if err := db.QueryRow(totalQuery, params...).Scan(&totalRecords); err != nil {
+	if err := db.QueryRow(helpers.Rebind(totalQuery), params...).Scan(&totalRecords); err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
@@ -724,9 +907,10 @@ func List(options map[string]interface{}) map[string]interface{} {
 	}
 
 	// Query actual data with LIMIT/OFFSET
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s LIMIT ? OFFSET ?", selectFields, table, whereClause)
+	// Rows are always ordered, by default on the primary key, so pages don't shift between calls
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s%s LIMIT ? OFFSET ?", selectFields, helpers.EscapeId(table), whereClause, helpers.GenerateOrderBy(helpers.StableOrder(orderBy, table)))
 	params = append(params, pageSize, offset)
-	rows, err := db.Query(query, params...)
+	rows, err := db.Query(helpers.Rebind(query), params...)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -735,7 +919,7 @@ func List(options map[string]interface{}) map[string]interface{} {
 	}
 	defer rows.Close()
 
-	columns, err := rows.Columns()
+	results, err := helpers.ScanRowsWith(rows, helpers.ScanOptionsFrom(options))
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -743,32 +927,6 @@ func List(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	var results []map[string]interface{}
-	for rows.Next() {
-		columnValues := make([]interface{}, len(columns))
-		columnPointers := make([]interface{}, len(columns))
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
-		}
-		if err := rows.Scan(columnPointers...); err != nil {
-			return map[string]interface{}{
-				"success": false,
-				"message": err.Error(),
-			}
-		}
-
-		rowMap := make(map[string]interface{})
-		for i, col := range columns {
-			val := columnPointers[i].(*interface{})
-			if byteVal, ok := (*val).([]uint8); ok {
-				rowMap[col] = string(byteVal)
-			} else {
-				rowMap[col] = *val
-			}
-		}
-		results = append(results, rowMap)
-	}
-
 	// Build pagination metadata
 	totalPages := totalRecords / pageSize
 	if totalRecords%pageSize > 0 {
@@ -805,6 +963,148 @@ func List(options map[string]interface{}) map[string]interface{} {
 	}
 }
 
+// listByCursor pages through a table with keyset pagination, returning opaque next_cursor/prev_cursor
+func listByCursor(options map[string]interface{}, table, whereClause string, params []interface{}, order []helpers.OrderColumn, pageSize int) map[string]interface{} {
+	if len(order) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Cursor pagination requires order_by or a primary key",
+		}
+	}
+	if err := helpers.CheckCursorOrder(table, order); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if pageSize > helpers.MaxCursorPageSize {
+		pageSize = helpers.MaxCursorPageSize
+	}
+
+	// Total is optional because COUNT(*) is what makes large tables slow
+	var totalRecords interface{}
+	if withTotal, _ := options["with_total"].(bool); withTotal {
+		var total int
+		totalQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", helpers.EscapeId(table), whereClause)
+		if err := db.QueryRow(helpers.Rebind(totalQuery), params...).Scan(&total); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		totalRecords = total
+	}
+
+	// Continue after (or before) the cursor position
+	backward := false
+	hasCursor := false
+	if raw, _ := options["cursor"].(string); raw != "" {
+		cursor, err := helpers.DecodeCursor(raw, order)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		hasCursor = true
+		backward = cursor.Direction == helpers.CursorPrev
+		keysetClause, keysetParams := helpers.KeysetWhere(order, cursor.Values, backward)
+		whereClause = fmt.Sprintf("( %s ) AND ( %s )", whereClause, keysetClause)
+		params = append(params, keysetParams...)
+	}
+	queryOrder := order
+	if backward {
+		queryOrder = helpers.ReverseOrder(order)
+	}
+
+	// Sort columns must be selected to build the next cursors, extra ones are removed again
+	selectColumns := helpers.SelectColumns(options["select"])
+	var extraColumns []string
+	if len(selectColumns) > 0 {
+		for _, o := range order {
+			found := false
+			for _, column := range selectColumns {
+				if column == o.Column || column == "*" {
+					found = true
+					break
+				}
+			}
+			if !found {
+				extraColumns = append(extraColumns, o.Column)
+			}
+		}
+		selectColumns = append(selectColumns, extraColumns...)
+	}
+
+	// One extra row tells whether another page exists
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s%s LIMIT ?", helpers.GenerateSelect(selectColumns), helpers.EscapeId(table), whereClause, helpers.GenerateOrderBy(queryOrder))
+	params = append(params, pageSize+1)
+	rows, err := db.Query(helpers.Rebind(query), params...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	defer rows.Close()
+	results, err := helpers.ScanRowsWith(rows, helpers.ScanOptionsFrom(options))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	hasMore := len(results) > pageSize
+	if hasMore {
+		results = results[:pageSize]
+	}
+	if backward {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+
+	// Build cursors from the first and last row of the page
+	var nextCursor, prevCursor interface{}
+	if len(results) > 0 {
+		if hasMore || backward {
+			if nextCursor, err = helpers.EncodeCursor(helpers.CursorNext, table, order, results[len(results)-1]); err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}
+			}
+		}
+		if (hasMore && backward) || (hasCursor && !backward) {
+			if prevCursor, err = helpers.EncodeCursor(helpers.CursorPrev, table, order, results[0]); err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}
+			}
+		}
+	}
+	for _, row := range results {
+		for _, column := range extraColumns {
+			delete(row, column)
+		}
+	}
+	if results == nil {
+		results = []map[string]interface{}{}
+	}
+
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"data":         results,
+			"pageSize":     pageSize,
+			"totalRecords": totalRecords,
+			"next_cursor":  nextCursor,
+			"prev_cursor":  prevCursor,
+		},
+	}
+}
+
 // ListAll returns all records from a table
 func ListAll(options map[string]interface{}) map[string]interface{} {
 	table, ok := options["table"].(string)
@@ -814,62 +1114,55 @@ func ListAll(options map[string]interface{}) map[string]interface{} {
 			"message": "Table name is required",
 		}
 	}
+	if err := helpers.ValidateAccess(table, false, helpers.SelectColumns(options["select"])); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
 	// Handle SELECT fields using helpers.GenerateSelect
 	selectFields := "*"
 	if select_data, ok := options["select"]; ok {
 		selectFields = helpers.GenerateSelect(select_data)
 	}
 
-	query := fmt.Sprintf("SELECT %s FROM %s", selectFields, table)
-	rows, err := db.Query(query)
+	// Parse ORDER BY, columns are validated like select
+	orderBy, err := helpers.ParseOrderBy(options["order_by"], []string{table})
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
 		}
 	}
-	defer rows.Close()
 
-	columns, err := rows.Columns()
+	// Restrict tenant scoped tables to the caller's tenant
+	whereClause, params, err := helpers.ScopeWhere(options, table, "", nil)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
 		}
 	}
+	if whereClause != "" {
+		whereClause = " WHERE " + whereClause
+	}
 
-	var results []map[string]interface{}
-	for rows.Next() {
-		columnValues := make([]interface{}, len(columns))
-		columnPointers := make([]interface{}, len(columns))
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
-		}
-		if err := rows.Scan(columnPointers...); err != nil {
-			return map[string]interface{}{
-				"success": false,
-				"message": err.Error(),
-			}
-		}
-
-		rowMap := make(map[string]interface{})
-		for i, col := range columns {
-			val := columnPointers[i].(*interface{})
-			rowMap[col] = *val
+	query := fmt.Sprintf("SELECT %s FROM %s%s%s", selectFields, helpers.EscapeId(table), whereClause, helpers.GenerateOrderBy(orderBy))
+	rows, err := db.Query(helpers.Rebind(query), params...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
-		results = append(results, rowMap)
 	}
+	defer rows.Close()
 
-	for i, row := range results {
-		newRow := make(map[string]interface{})
-		for k, v := range row {
-			if byteVal, ok := v.([]uint8); ok {
-				newRow[k] = string(byteVal)
-			} else {
-				newRow[k] = v
-			}
+	results, err := helpers.ScanRowsWith(rows, helpers.ScanOptionsFrom(options))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
 		}
-		results[i] = newRow
 	}
 
 	if len(results) == 0 {
@@ -887,6 +1180,11 @@ func ListAll(options map[string]interface{}) map[string]interface{} {
 
 // create mysql
 func Create(options map[string]interface{}) map[string]interface{} {
+	return createWith(db, options)
+}
+
+// createWith inserts one record using q, which is the pool or an open transaction
+func createWith(q helpers.Querier, options map[string]interface{}) map[string]interface{} {
 	// Validate table
 	table, ok := options["table"].(string)
 	if !ok || table == "" {
@@ -911,40 +1209,42 @@ func Create(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	// Build SET clause
-	setClause, params := helpers.GenerateSet(data)
-	query := fmt.Sprintf("INSERT INTO %s SET %s", table, setClause)
+	// Rows of tenant scoped tables always belong to the caller's tenant
+	if err := helpers.ScopeData(options, table, data); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateAccess(table, true, helpers.MapKeys(data)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// Password columns are never stored in plaintext
+	if err := helpers.HashPasswordColumns(table, data); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
+	// Build column/value list
+	valuesClause, params := helpers.GenerateInsert(data)
+	query := fmt.Sprintf("INSERT INTO %s %s", helpers.EscapeId(table), valuesClause)
 
 	// Execute query
-	result, err := db.Exec(query, params...)
+	id, err := helpers.InsertReturningID(q, query, params...)
 	if err != nil {
-		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
-			switch mysqlErr.Number {
-			case 1062: // duplicate key
-				return map[string]interface{}{
-					"success": false,
-					"message": "Duplicate entry. A record with the same key already exists",
-				}
-			case 1452: // foreign key error
-				return map[string]interface{}{
-					"success": false,
-					"message": "Referenced foreign key does not exist in parent table",
-				}
-			default:
-				return map[string]interface{}{
-					"success": false,
-					"message": mysqlErr.Message,
-				}
-			}
-		}
 		return map[string]interface{}{
 			"success": false,
-			"message": "Error occur Unable to create data",
+			"message": createErrorMessage(err),
 		}
 	}
 
-	// Handle last insert ID
-	if id, err := result.LastInsertId(); err == nil && id > 0 {
+	// Handle generated ID
+	if id != nil {
 		// Table has AUTO_INCREMENT primary key
 		data["id"] = id
 	} else {
@@ -957,7 +1257,7 @@ func Create(options map[string]interface{}) map[string]interface{} {
 	return map[string]interface{}{
 		"success": true,
 		"message": map[string]interface{}{
-			"data": data,
+			"data": helpers.RedactRows([]map[string]interface{}{data}, []string{table})[0],
 		},
 	}
 
@@ -983,14 +1283,73 @@ func CreateBulk(options []map[string]interface{}) map[string]interface{} {
 		}
 	}
 
+	// Records are grouped per table and columns into multi-row INSERTs
+	batchSize := helpers.BulkBatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
 	for _, opt := range options {
-		result := Create(opt)
-		if success, ok := result["success"].(bool); ok && success {
-			created = append(created, result)
-		} else {
+		if size, ok := opt["batch_size"].(float64); ok && size > 0 {
+			batchSize = int(size)
+		}
+	}
+	groups, failed := groupInserts(options)
+
+	// "atomic": true on any item runs every batch in one transaction
+	atomic := atomicBatch(options)
+	if atomic && len(failed) > 0 {
+		return map[string]interface{}{
+			"success": false,
+			"message": failed,
+		}
+	}
+	var q helpers.Querier = db
+	var tx *sql.Tx
+	if atomic {
+		var err error
+		if tx, err = db.Begin(); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Unable to start transaction: " + err.Error(),
+			}
+		}
+		q = tx
+	}
+
+	for _, group := range groups {
+		size := batchSize
+		if size > group.rowLimit {
+			size = group.rowLimit
+		}
+		for start := 0; start < len(group.records); start += size {
+			end := start + size
+			if end > len(group.records) {
+				end = len(group.records)
+			}
+			result := insertBatch(q, group, group.records[start:end], group.indexes[start:end])
+			if success, ok := result["success"].(bool); ok && success {
+				created = append(created, result)
+				continue
+			}
+			if atomic {
+				tx.Rollback()
+				return map[string]interface{}{
+					"success": false,
+					"message": fmt.Sprintf("Transaction rolled back: %v", result["message"]),
+					"steps":   append(created, result),
+				}
+			}
 			failed = append(failed, result)
 		}
 	}
+	if atomic {
+		if err := tx.Commit(); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Transaction commit failed: " + err.Error(),
+			}
+		}
+	}
 
 	switch {
 	case len(failed) == 0 && len(created) > 0:
@@ -1019,6 +1378,11 @@ func CreateBulk(options []map[string]interface{}) map[string]interface{} {
 
 // update mysql
 func Update(options map[string]interface{}) map[string]interface{} {
+	return updateWith(db, options)
+}
+
+// updateWith updates matching records using q, which is the pool or an open transaction
+func updateWith(q helpers.Querier, options map[string]interface{}) map[string]interface{} {
 	// Extract and validate table name
 	table, ok := options["table"].(string)
 	if !ok || table == "" {
@@ -1044,44 +1408,83 @@ func Update(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	// Extract and validate condition
+	// Extract and validate condition, a filter may replace it but never both be missing
 	condRaw, ok := options["condition"]
-	if !ok {
+	if !ok && options["filter"] == nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": "Condition is required",
 		}
 	}
-	condition, ok := condRaw.(map[string]interface{})
-	if !ok || len(condition) == 0 {
+	condition, isMap := condRaw.(map[string]interface{})
+	if ok && (!isMap || (len(condition) == 0 && options["filter"] == nil)) {
 		return map[string]interface{}{
 			"success": false,
 			"message": "Invalid condition format",
 		}
 	}
 
+	// Rows of tenant scoped tables can't be moved to another tenant
+	if err := helpers.ScopeData(options, table, data); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateAccess(table, true, helpers.MapKeys(data), helpers.MapKeys(condition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if err := helpers.ValidateLookup([]string{table}, helpers.MapKeys(condition)); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// Password columns are never stored in plaintext
+	if err := helpers.HashPasswordColumns(table, data); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+
 	// Build SET and WHERE clause
 	setClause, setParams := helpers.GenerateSet(data)
-	whereClause, whereParams := helpers.GenerateWhere(condition)
+	whereClause, whereParams, err := helpers.BuildFilteredWhere(condition, nil, options["filter"], []string{table})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	whereClause, whereParams, err = helpers.ScopeWhere(options, table, whereClause, whereParams)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
 
 	// Correct order: set params first, then where params
 	params := append(setParams, whereParams...)
 
 	// Build query
-	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, setClause, whereClause)
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", helpers.EscapeId(table), setClause, whereClause)
 
 	// Execute
-	// Execute
-	result, err := db.Exec(query, params...)
+	result, err := q.Exec(helpers.Rebind(query), params...)
 	if err != nil {
-		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
-			switch mysqlErr.Number {
-			case 1062: // duplicate key
+		if kind, message, ok := helpers.ClassifyDBError(err); ok {
+			switch kind {
+			case helpers.DBErrorDuplicate: // duplicate key
 				return map[string]interface{}{
 					"success": false,
 					"message": "Duplicate entry. A record with the same unique key already exists",
 				}
-			case 1452: // foreign key error
+			case helpers.DBErrorForeignKey: // foreign key error
 				return map[string]interface{}{
 					"success": false,
 					"message": "Referenced foreign key does not exist in parent table",
@@ -1089,7 +1492,7 @@ func Update(options map[string]interface{}) map[string]interface{} {
 			default:
 				return map[string]interface{}{
 					"success": false,
-					"message": mysqlErr.Message,
+					"message": message,
 				}
 			}
 		}
@@ -1132,6 +1535,11 @@ func UpdateBulk(options []map[string]interface{}) map[string]interface{} {
 		}
 	}
 
+	// "atomic": true on any item runs the whole batch in one transaction
+	if atomicBatch(options) {
+		return runTransaction(options, "update")
+	}
+
 	for _, opt := range options {
 		result := Update(opt)
 		if success, ok := result["success"].(bool); ok && success {
@@ -1167,6 +1575,11 @@ func UpdateBulk(options []map[string]interface{}) map[string]interface{} {
 
 // Delete mysql
 func Delete(options map[string]interface{}) map[string]interface{} {
+	return deleteWith(db, options)
+}
+
+// deleteWith deletes matching records using q, which is the pool or an open transaction
+func deleteWith(q helpers.Querier, options map[string]interface{}) map[string]interface{} {
 	// Validate table name
 	table, ok := options["table"].(string)
 	if !ok || table == "" {
@@ -1178,22 +1591,36 @@ func Delete(options map[string]interface{}) map[string]interface{} {
 
 	// Validate condition
 	condRaw, ok := options["condition"]
-	if !ok {
+	if !ok && options["filter"] == nil {
 		return map[string]interface{}{"success": false, "message": "Condition is required"}
 	}
-	condition, ok := condRaw.(map[string]interface{})
-	if !ok || len(condition) == 0 {
+	condition, isMap := condRaw.(map[string]interface{})
+	if ok && (!isMap || (len(condition) == 0 && options["filter"] == nil)) {
 		return map[string]interface{}{"success": false, "message": "Invalid condition format"}
 	}
 
+	if err := helpers.ValidateAccess(table, true, helpers.MapKeys(condition)); err != nil {
+		return map[string]interface{}{"success": false, "message": err.Error()}
+	}
+	if err := helpers.ValidateLookup([]string{table}, helpers.MapKeys(condition)); err != nil {
+		return map[string]interface{}{"success": false, "message": err.Error()}
+	}
+
 	// Build WHERE clause
-	whereClause, whereParams := helpers.GenerateWhere(condition)
+	whereClause, whereParams, err := helpers.BuildFilteredWhere(condition, nil, options["filter"], []string{table})
+	if err != nil {
+		return map[string]interface{}{"success": false, "message": err.Error()}
+	}
+	whereClause, whereParams, err = helpers.ScopeWhere(options, table, whereClause, whereParams)
+	if err != nil {
+		return map[string]interface{}{"success": false, "message": err.Error()}
+	}
 
 	// Final SQL delete query
-	query := fmt.Sprintf("DELETE FROM %s WHERE %s", table, whereClause)
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", helpers.EscapeId(table), whereClause)
 
 	// Execute query
-	result, err := db.Exec(query, whereParams...)
+	result, err := q.Exec(helpers.Rebind(query), whereParams...)
 	if err != nil {
 		return map[string]interface{}{"success": false, "message": err.Error()}
 	}
@@ -1220,6 +1647,11 @@ func DelateBulk(options []map[string]interface{}) map[string]interface{} {
 		}
 	}
 
+	// "atomic": true on any item runs the whole batch in one transaction
+	if atomicBatch(options) {
+		return runTransaction(options, "delete")
+	}
+
 	for _, opt := range options {
 		result := Delete(opt)
 
@@ -1272,6 +1704,13 @@ func Query(options map[string]interface{}) map[string]interface{} {
 			"message": "Invalid query string",
 		}
 	}
+	// Raw SQL can't be scoped, tenant callers are limited to the generated queries
+	if _, ok := options[helpers.TenantOption].(helpers.Tenant); ok && helpers.HasTenantTables() {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Raw queries are not available to tenant scoped users",
+		}
+	}
 	// Optional: Get query params
 	var params []interface{}
 	if p, ok := options["params"].([]interface{}); ok {
@@ -1285,38 +1724,17 @@ func Query(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 	defer rows.Close()
-	columns, err := rows.Columns()
+	// Raw queries can read any table, so every table's redaction rules apply
+	scan := helpers.ScanOptionsFrom(options)
+	scan.Tables = nil
+	results, err := helpers.ScanRowsWith(rows, scan)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": err.Error(),
 		}
 	}
-	var results []map[string]interface{}
-	for rows.Next() {
-		columnValues := make([]interface{}, len(columns))
-		columnPointers := make([]interface{}, len(columns))
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
-		}
-		if err := rows.Scan(columnPointers...); err != nil {
-			return map[string]interface{}{
-				"success": false,
-				"message": err.Error(),
-			}
-		}
-		row := make(map[string]interface{})
-		for i, col := range columns {
-			val := columnPointers[i].(*interface{})
-			switch v := (*val).(type) {
-			case []byte:
-				row[col] = string(v)
-			default:
-				row[col] = v
-			}
-		}
-		results = append(results, row)
-	}
+
 	if len(results) == 0 {
 		return map[string]interface{}{
 			"success": false,
@@ -1343,6 +1761,14 @@ func DatabaseHandler(options map[string]interface{}) map[string]interface{} {
 	var query string
 	var successMessage string
 
+	// SQLite has a single database per file
+	if (action == "create_db" || action == "delete_db" || action == "update_db") && !helpers.DBDialect.SupportsDatabases() {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Action '%s' is not supported by %s", action, helpers.DBDialect.Name()),
+		}
+	}
+
 	switch action {
 
 	// ---------------- DATABASE ACTIONS ----------------
@@ -1377,7 +1803,13 @@ func DatabaseHandler(options map[string]interface{}) map[string]interface{} {
 				"message": "Both old and new database_name are required",
 			}
 		}
-		// Note: MySQL does not support rename database directly
+		// Note: MySQL does not support rename database directly, the statement below is MySQL only
+		if helpers.DBDialect.DriverName() != "mysql" {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Action '%s' is not supported by %s", action, helpers.DBDialect.Name()),
+			}
+		}
 		query = fmt.Sprintf("ALTER DATABASE %s UPGRADE DATA DIRECTORY NAME", helpers.EscapeId(database))
 		successMessage = fmt.Sprintf("Database '%s' updated successfully", database)
 
@@ -1453,7 +1885,14 @@ func DatabaseHandler(options map[string]interface{}) map[string]interface{} {
 				"message": "table_name, column and newColumn are required",
 			}
 		}
-		query = fmt.Sprintf("ALTER TABLE %s CHANGE %s %s", helpers.EscapeId(table), helpers.EscapeId(column), newColumn)
+		changeQuery, err := helpers.DBDialect.ChangeColumn(table, column, newColumn)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		query = changeQuery
 		successMessage = fmt.Sprintf("Column '%s' updated in table '%s' successfully", column, table)
 
 	case "delete_column":
@@ -1485,6 +1924,9 @@ func DatabaseHandler(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 
+	// Keep the table/column allow-list in sync with the new structure
+	helpers.RefreshSchema()
+
 	return map[string]interface{}{
 		"success": true,
 		"message": successMessage,
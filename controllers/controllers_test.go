@@ -0,0 +1,462 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"vartrick/helpers"
+)
+
+// openTestDB connects the controllers to a SQLite file of the test with the given tables
+func openTestDB(t *testing.T, statements ...string) {
+	t.Helper()
+	driver, name, previous, dialect := helpers.DatabaseDriver, helpers.DatabaseName, helpers.DB, helpers.DBDialect
+	helpers.DatabaseDriver = "sqlite"
+	helpers.DatabaseName = filepath.Join(t.TempDir(), "test.db")
+	if res := helpers.InitDBConnection(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	SetDB(helpers.DB)
+	t.Cleanup(func() {
+		helpers.DB.Close()
+		helpers.DatabaseDriver, helpers.DatabaseName, helpers.DB, helpers.DBDialect = driver, name, previous, dialect
+		SetDB(previous)
+	})
+	for _, statement := range statements {
+		if _, err := helpers.DB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res := helpers.LoadSchema(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+}
+
+// useSchemaConfig loads a schema config file of the test, the default config is restored afterwards
+func useSchemaConfig(t *testing.T, content string) {
+	t.Helper()
+	path := helpers.SchemaConfigPath
+	t.Cleanup(func() {
+		helpers.SchemaConfigPath = filepath.Join(t.TempDir(), "empty.json")
+		os.WriteFile(helpers.SchemaConfigPath, []byte(`{}`), 0o600)
+		helpers.LoadSchemaConfig()
+		helpers.SchemaConfigPath = path
+	})
+	helpers.SchemaConfigPath = filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(helpers.SchemaConfigPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if res := helpers.LoadSchemaConfig(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+}
+
+// bodyJSON decodes a request body the way the routes do
+func bodyJSON(t *testing.T, content string, body interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(content), body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// names returns the name column of the people table by id
+func names(t *testing.T) map[int64]string {
+	t.Helper()
+	rows, err := helpers.DB.Query(`SELECT id, name FROM people`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	result := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var name string
+		rows.Scan(&id, &name)
+		result[id] = name
+	}
+	return result
+}
+
+func TestCreateBulkOnConflict(t *testing.T) {
+	openTestDB(t, `CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT NOT NULL, email TEXT UNIQUE)`,
+		`INSERT INTO people (id, name, email) VALUES (1, 'ann', 'ann@x.io')`)
+
+	var plain []map[string]interface{}
+	bodyJSON(t, `[{"table": "people", "data": {"name": "bob", "email": "bob@x.io"}},
+		{"table": "people", "data": {"name": "cid", "email": "cid@x.io"}}]`, &plain)
+	res := CreateBulk(plain)
+	if !res["success"].(bool) {
+		t.Fatalf("CreateBulk = %v", res)
+	}
+	batch := res["message"].([]map[string]interface{})[0]["message"].(map[string]interface{})
+	if batch["rows"] != 2 || batch["first_id"] != int64(2) || batch["last_id"] != int64(3) {
+		t.Errorf("CreateBulk batch = %v, want rows 2 with ids 2 to 3", batch)
+	}
+
+	var ignore []map[string]interface{}
+	bodyJSON(t, `[{"table": "people", "data": {"id": 1, "name": "ann2", "email": "a2@x.io"}, "on_conflict": "ignore"},
+		{"table": "people", "data": {"id": 4, "name": "dan", "email": "dan@x.io"}, "on_conflict": "ignore"}]`, &ignore)
+	if res := CreateBulk(ignore); !res["success"].(bool) {
+		t.Fatalf("CreateBulk ignore = %v", res)
+	}
+	if got := names(t); got[1] != "ann" || got[4] != "dan" {
+		t.Errorf("after ignore: %v", got)
+	}
+
+	var upsert []map[string]interface{}
+	bodyJSON(t, `[{"table": "people", "data": {"id": 1, "name": "anna", "email": "x@x.io"}, "on_conflict": {"update": ["name"]}},
+		{"table": "people", "data": {"id": 5, "name": "eve", "email": "eve@x.io"}, "on_conflict": {"update": ["name"]}}]`, &upsert)
+	if res := CreateBulk(upsert); !res["success"].(bool) {
+		t.Fatalf("CreateBulk update = %v", res)
+	}
+	var email string
+	helpers.DB.QueryRow(`SELECT email FROM people WHERE id = 1`).Scan(&email)
+	if got := names(t); got[1] != "anna" || got[5] != "eve" || email != "ann@x.io" {
+		t.Errorf("after update: %v, email %s", got, email)
+	}
+
+	var invalid []map[string]interface{}
+	bodyJSON(t, `[{"table": "people", "data": {"name": "x"}, "on_conflict": {"update": ["nope"]}}]`, &invalid)
+	if res := CreateBulk(invalid); res["success"].(bool) {
+		t.Errorf("CreateBulk accepted an unknown update column")
+	}
+
+	// Atomic batches roll back every row when one fails
+	var atomic []map[string]interface{}
+	bodyJSON(t, `[{"table": "people", "data": {"name": "fay", "email": "fay@x.io"}, "atomic": true},
+		{"table": "people", "data": {"id": 1, "name": "dup"}}]`, &atomic)
+	if res := CreateBulk(atomic); res["success"].(bool) {
+		t.Errorf("atomic CreateBulk with a duplicate = %v", res)
+	}
+	for _, name := range names(t) {
+		if name == "fay" {
+			t.Errorf("atomic CreateBulk kept a row of the failed batch")
+		}
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	openTestDB(t, `CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT NOT NULL, score INTEGER NOT NULL)`)
+	for id := 1; id <= 7; id++ {
+		if _, err := helpers.DB.Exec(`INSERT INTO people (id, name, score) VALUES (?, ?, ?)`, id, fmt.Sprint("p", id), id%2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(cursor interface{}) ([]interface{}, map[string]interface{}) {
+		var options map[string]interface{}
+		bodyJSON(t, `{"table": "people", "mode": "cursor", "page_size": 3, "order_by": "-score", "select": ["name"], "with_total": true}`, &options)
+		if cursor != nil {
+			options["cursor"] = cursor
+		}
+		res := List(options)
+		if !res["success"].(bool) {
+			t.Fatalf("List = %v", res)
+		}
+		message := res["message"].(map[string]interface{})
+		var page []interface{}
+		for _, row := range message["data"].([]map[string]interface{}) {
+			if _, ok := row["score"]; ok {
+				t.Errorf("List returned the sort column that was not selected: %v", row)
+			}
+			page = append(page, row["name"])
+		}
+		return page, message
+	}
+
+	// score desc, then the primary key keeps equal scores in a fixed order
+	want := [][]interface{}{{"p1", "p3", "p5"}, {"p7", "p2", "p4"}, {"p6"}}
+	var cursors []interface{}
+	var cursor interface{}
+	for i, expected := range want {
+		page, message := list(cursor)
+		if !reflect.DeepEqual(page, expected) {
+			t.Fatalf("page %d = %v, want %v", i+1, page, expected)
+		}
+		if message["totalRecords"] != 7 {
+			t.Errorf("totalRecords = %v", message["totalRecords"])
+		}
+		cursors = append(cursors, message["prev_cursor"])
+		cursor = message["next_cursor"]
+	}
+	if cursor != nil {
+		t.Errorf("last page has a next_cursor")
+	}
+	if cursors[0] != nil {
+		t.Errorf("first page has a prev_cursor")
+	}
+	if page, _ := list(cursors[2]); !reflect.DeepEqual(page, want[1]) {
+		t.Errorf("prev page = %v, want %v", page, want[1])
+	}
+	var options map[string]interface{}
+	bodyJSON(t, `{"table": "people", "mode": "cursor", "order_by": "name"}`, &options)
+	options["cursor"] = cursors[2]
+	if res := List(options); res["success"].(bool) {
+		t.Errorf("List accepted a cursor of another order_by")
+	}
+}
+
+func TestDatabaseHandlerSQLite(t *testing.T) {
+	openTestDB(t)
+	for _, action := range []string{"create_db", "delete_db", "update_db"} {
+		res := DatabaseHandler(map[string]interface{}{"action": action, "database": "other", "newtable": "renamed"})
+		if res["success"].(bool) || res["message"] != fmt.Sprintf("Action '%s' is not supported by SQLite", action) {
+			t.Errorf("%s = %v", action, res)
+		}
+	}
+	// The rename statement is MySQL only
+	helpers.DBDialect, _ = helpers.DialectFor("postgres")
+	res := DatabaseHandler(map[string]interface{}{"action": "update_db", "database": "other", "newtable": "renamed"})
+	if res["success"].(bool) || res["message"] != "Action 'update_db' is not supported by PostgreSQL" {
+		t.Errorf("PostgreSQL update_db = %v", res)
+	}
+}
+
+func TestAggregateKeepsColumnTypes(t *testing.T) {
+	openTestDB(t, `CREATE TABLE items (id INTEGER PRIMARY KEY, region TEXT, code TEXT, price TEXT)`,
+		`INSERT INTO items (id, region, code, price) VALUES (1, 'north', '00123', '10.50'), (2, 'north', '00456', '7.25'), (3, 'south', '00789', '1.00')`)
+
+	var options map[string]interface{}
+	bodyJSON(t, `{"table": "items", "group_by": ["region"], "aggregates": [
+		{"function": "count", "as": "items"},
+		{"function": "min", "column": "code", "as": "first_code"},
+		{"function": "max", "column": "price", "as": "top_price"}
+	]}`, &options)
+	res := Aggregate(options)
+	if !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	// Counts are numbers, MIN/MAX of text keep leading zeros and the exact decimal text
+	want := []map[string]interface{}{
+		{"region": "north", "items": int64(2), "first_code": "00123", "top_price": "7.25"},
+		{"region": "south", "items": int64(1), "first_code": "00789", "top_price": "1.00"},
+	}
+	if !reflect.DeepEqual(res["message"], want) {
+		t.Errorf("Aggregate = %#v, want %#v", res["message"], want)
+	}
+}
+
+func TestListCursorNullable(t *testing.T) {
+	openTestDB(t, `CREATE TABLE readings (id INTEGER PRIMARY KEY, meter TEXT NOT NULL, taken_at TEXT)`,
+		`INSERT INTO readings (id, meter, taken_at) VALUES (1, 'a', '2024-01-01'), (2, 'b', NULL)`)
+	// Rows with a NULL taken_at would never match the keyset condition and drop out of the pages
+	for _, order := range []string{`"taken_at"`, `"-taken_at"`, `["meter", "taken_at"]`} {
+		var options map[string]interface{}
+		bodyJSON(t, fmt.Sprintf(`{"table": "readings", "mode": "cursor", "order_by": %s}`, order), &options)
+		if res := List(options); res["success"].(bool) || !strings.Contains(fmt.Sprint(res["message"]), "nullable column 'taken_at'") {
+			t.Errorf("List in cursor mode sorted on the nullable taken_at (%s): %v", order, res["message"])
+		}
+	}
+	var options map[string]interface{}
+	bodyJSON(t, `{"table": "readings", "mode": "cursor", "order_by": "meter"}`, &options)
+	if res := List(options); !res["success"].(bool) {
+		t.Errorf("List in cursor mode on NOT NULL columns = %v", res["message"])
+	}
+}
+
+func TestRedactReadResponses(t *testing.T) {
+	openTestDB(t, `CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL, password TEXT, api_secret TEXT, pin TEXT)`,
+		`CREATE TABLE posts (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, title TEXT NOT NULL)`,
+		`INSERT INTO users (id, name, password, api_secret, pin) VALUES (1, 'ann', 'hash', 's3cret', '1234')`,
+		`INSERT INTO posts (id, user_id, title) VALUES (1, 1, 'hello')`)
+	useSchemaConfig(t, `{"tables": {"users": {"redact": ["pin"]}}}`)
+
+	requests := map[string]func(map[string]interface{}) map[string]interface{}{
+		`{"table": "users", "condition": {"id": 1}}`:       Read,
+		`{"table": "users"}`:                               ListAll,
+		`{"table": "users", "condition": {"name": "ann"}}`: Search,
+		`{"table": "users", "select": ["name", "password", "pin"], "condition": {"name": "ann"}}`: Search,
+		`{"table": "posts", "joins": [{"table": "users", "on": "posts.user_id = users.id"}]}`:     ReadJoin,
+		`{"query": "SELECT * FROM users"}`: Query,
+	}
+	for content, handler := range requests {
+		var options map[string]interface{}
+		bodyJSON(t, content, &options)
+		res := handler(options)
+		rows, ok := res["message"].([]map[string]interface{})
+		if !ok || len(rows) != 1 {
+			t.Errorf("%s = %v", content, res)
+			continue
+		}
+		for _, column := range []string{"password", "api_secret", "pin"} {
+			if _, ok := rows[0][column]; ok {
+				t.Errorf("%s returned the redacted column %s: %v", content, column, rows[0])
+			}
+		}
+		if rows[0]["name"] != "ann" {
+			t.Errorf("%s dropped the name column: %v", content, rows[0])
+		}
+	}
+	var options map[string]interface{}
+	bodyJSON(t, `{"table": "users", "page_size": 10}`, &options)
+	page := List(options)["message"].(map[string]interface{})["data"].([]map[string]interface{})
+	if _, ok := page[0]["password"]; ok || len(page) != 1 {
+		t.Errorf("List returned the password column: %v", page)
+	}
+	bodyJSON(t, `{"table": "users", "data": {"name": "bob", "pin": "9999"}}`, &options)
+	if created := Create(options)["message"].(map[string]interface{})["data"].(map[string]interface{}); created["pin"] != nil {
+		t.Errorf("Create echoed the redacted pin: %v", created)
+	}
+
+	// Matching or sorting on a redacted column would reveal it one guess at a time
+	for _, content := range []string{
+		`{"table": "users", "condition": {"password": "hash"}}`,
+		`{"table": "users", "order_by": "-pin"}`,
+	} {
+		var options map[string]interface{}
+		bodyJSON(t, content, &options)
+		if res := Read(options); res["success"].(bool) {
+			t.Errorf("Read(%s) matched on a redacted column", content)
+		}
+	}
+}
+
+func TestTenantScoping(t *testing.T) {
+	openTestDB(t, `CREATE TABLE orders (id INTEGER PRIMARY KEY, org_id INTEGER NOT NULL, item TEXT NOT NULL)`,
+		`INSERT INTO orders (id, org_id, item) VALUES (1, 1, 'acme-a'), (2, 1, 'acme-b'), (3, 2, 'globex-a')`)
+	useSchemaConfig(t, `{"tables": {"orders": {"tenant_column": "org_id"}}}`)
+	request := func(tenant interface{}, content string) map[string]interface{} {
+		var options map[string]interface{}
+		bodyJSON(t, content, &options)
+		if tenant != nil {
+			options[helpers.TenantOption] = helpers.Tenant{Value: tenant}
+		}
+		return options
+	}
+	items := func(res map[string]interface{}) []interface{} {
+		var result []interface{}
+		rows, _ := res["message"].([]map[string]interface{})
+		for _, row := range rows {
+			result = append(result, row["item"])
+		}
+		return result
+	}
+
+	// Reads only see the caller's rows, whatever the condition asks for
+	if got := items(ListAll(request(1, `{"table": "orders", "order_by": "id"}`))); !reflect.DeepEqual(got, []interface{}{"acme-a", "acme-b"}) {
+		t.Errorf("Read of tenant 1 = %v", got)
+	}
+	if got := items(Search(request(1, `{"table": "orders", "condition": {"org_id": 2}}`))); got != nil {
+		t.Errorf("Search of tenant 1 for tenant 2 rows = %v", got)
+	}
+	if res := ListAll(request(nil, `{"table": "orders"}`)); res["success"].(bool) {
+		t.Errorf("Read of a tenant scoped table without a tenant = %v", res)
+	}
+	// A client sending "$tenant" in its body is not a tenant
+	spoofed := request(nil, `{"table": "orders", "$tenant": 2}`)
+	if res := ListAll(spoofed); res["success"].(bool) {
+		t.Errorf("Read with a client supplied $tenant = %v", res)
+	}
+
+	// Writes are forced into the caller's tenant and can't touch other tenants' rows
+	if res := Create(request(2, `{"table": "orders", "data": {"org_id": 1, "item": "globex-b"}}`)); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	if res := Update(request(1, `{"table": "orders", "data": {"item": "taken"}, "condition": {"id": 3}}`)); res["success"].(bool) {
+		t.Errorf("tenant 1 updated a row of tenant 2: %v", res)
+	}
+	if res := Update(request(2, `{"table": "orders", "data": {"org_id": 1}, "condition": {"id": 3}}`)); !res["success"].(bool) {
+		t.Errorf("tenant 2 update of its own row = %v", res)
+	}
+	if res := Delete(request(1, `{"table": "orders", "condition": {"id": 3}}`)); res["success"].(bool) {
+		t.Errorf("tenant 1 deleted a row of tenant 2: %v", res)
+	}
+	if got := items(ListAll(request(2, `{"table": "orders", "order_by": "id"}`))); !reflect.DeepEqual(got, []interface{}{"globex-a", "globex-b"}) {
+		t.Errorf("rows of tenant 2 after the writes = %v", got)
+	}
+	if res := Query(request(1, `{"query": "SELECT * FROM orders"}`)); res["success"].(bool) {
+		t.Errorf("a tenant ran a raw query: %v", res)
+	}
+}
+
+func TestSchemaAllowList(t *testing.T) {
+	openTestDB(t, `CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT NOT NULL)`,
+		`CREATE TABLE sessions (id INTEGER PRIMARY KEY, token TEXT)`,
+		`CREATE TABLE audit_log (id INTEGER PRIMARY KEY, event TEXT)`,
+		`INSERT INTO people (id, name) VALUES (1, 'ann')`,
+		`INSERT INTO audit_log (id, event) VALUES (1, 'login')`)
+	useSchemaConfig(t, `{"tables": {"sessions": {"exposure": "hidden"}, "audit_log": {"exposure": "read-only"}}}`)
+	tests := []struct {
+		handler func(map[string]interface{}) map[string]interface{}
+		options string
+		ok      bool
+	}{
+		{ListAll, `{"table": "people"}`, true},
+		{ListAll, `{"table": "nobody"}`, false},
+		{ListAll, `{"table": "people; DROP TABLE people"}`, false},
+		{Read, `{"table": "people", "condition": {"email": "ann@x.io"}}`, false},
+		{Read, `{"table": "people", "condition": {"name = name OR 1": 1}}`, false},
+		{ListAll, `{"table": "people", "select": ["name", "(SELECT token FROM sessions)"]}`, false},
+		{ListAll, `{"table": "people", "order_by": "missing"}`, false},
+		{ReadJoin, `{"table": "people", "joins": [{"table": "audit_log", "on": "people.id = audit_log.id"}]}`, true},
+		{ReadJoin, `{"table": "people", "joins": [{"table": "audit_log", "on": "1 = 1"}]}`, false},
+		{ReadJoin, `{"table": "people", "joins": [{"table": "audit_log", "type": "CROSS", "on": "people.id = audit_log.id"}]}`, false},
+		{ReadJoin, `{"table": "people", "joins": [{"table": "sessions", "on": "people.id = sessions.id"}]}`, false},
+		{ListAll, `{"table": "sessions"}`, false},
+		{ListAll, `{"table": "audit_log"}`, true},
+		{Create, `{"table": "audit_log", "data": {"event": "forged"}}`, false},
+		{Delete, `{"table": "audit_log", "condition": {"id": 1}}`, false},
+		{Create, `{"table": "people", "data": {"name": "bob", "role": "admin"}}`, false},
+	}
+	for _, tt := range tests {
+		var options map[string]interface{}
+		bodyJSON(t, tt.options, &options)
+		if res := tt.handler(options); res["success"].(bool) != tt.ok {
+			t.Errorf("%s = %v, want success %t", tt.options, res["message"], tt.ok)
+		}
+	}
+
+	// DDL through DatabaseHandler refreshes the registry
+	search := map[string]interface{}{"table": "people", "condition": map[string]interface{}{"note": "x"}}
+	if res := Read(search); strings.Contains(fmt.Sprint(res["message"]), "No data found") {
+		t.Fatalf("Read of a column that doesn't exist yet = %v", res)
+	}
+	if res := DatabaseHandler(map[string]interface{}{"action": "create_column", "table": "people", "column": "note TEXT"}); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	if res := Read(search); res["message"] != "No data found" {
+		t.Errorf("Read of the added column = %v", res)
+	}
+}
+
+func TestAggregateHaving(t *testing.T) {
+	openTestDB(t, `CREATE TABLE sales (id INTEGER PRIMARY KEY, region TEXT NOT NULL, year INTEGER NOT NULL, amount INTEGER NOT NULL)`,
+		`INSERT INTO sales (id, region, year, amount) VALUES (1, 'north', 2024, 600), (2, 'north', 2024, 500), (3, 'south', 2024, 300), (4, 'south', 2023, 900), (5, 'east', 2024, 50)`)
+
+	var options map[string]interface{}
+	bodyJSON(t, `{"table": "sales", "group_by": ["region"],
+		"aggregates": [{"function": "sum", "column": "amount", "as": "total"}, {"function": "avg", "column": "amount", "as": "mean"}, {"function": "count"}],
+		"filter": {"column": "year", "op": "eq", "value": 2024},
+		"having": {"column": "total", "op": "gt", "value": 100}}`, &options)
+	res := Aggregate(options)
+	if !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	rows := res["message"].([]map[string]interface{})
+	got := map[interface{}][]interface{}{}
+	for _, row := range rows {
+		got[row["region"]] = []interface{}{row["total"], row["mean"], row["count_all"]}
+	}
+	want := map[interface{}][]interface{}{"north": {int64(1100), float64(550), int64(2)}, "south": {int64(300), float64(300), int64(1)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Aggregate = %v, want %v", got, want)
+	}
+
+	for _, content := range []string{
+		`{"table": "sales", "aggregates": [{"function": "sum", "column": "amount"}], "having": {"column": "amount", "op": "gt", "value": 1}}`,
+		`{"table": "sales", "aggregates": [{"function": "sum", "column": "price"}]}`,
+		`{"table": "sales", "aggregates": [{"function": "sum"}]}`,
+		`{"table": "sales", "aggregates": [{"function": "median", "column": "amount"}]}`,
+		`{"table": "sales", "aggregates": [{"function": "max", "column": "amount", "as": "x) FROM sales --"}]}`,
+		`{"table": "sales", "group_by": ["missing"], "aggregates": [{"function": "count"}]}`,
+	} {
+		var options map[string]interface{}
+		bodyJSON(t, content, &options)
+		if res := Aggregate(options); res["success"].(bool) {
+			t.Errorf("Aggregate(%s) succeeded: %v", content, res["message"])
+		}
+	}
+}
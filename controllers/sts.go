@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+	"vartrick/helpers"
+)
+
+// stsTokenTypes names the token types an STS meter accepts, by class and subclass
+var stsTokenTypes = map[[2]int]string{
+	{helpers.STSClassManagement, helpers.STSSubclassSetMaxPower}:     "set_max_power",
+	{helpers.STSClassManagement, helpers.STSSubclassClearCredit}:     "clear_credit",
+	{helpers.STSClassManagement, helpers.STSSubclassSetTariffRate}:   "set_tariff_rate",
+	{helpers.STSClassManagement, helpers.STSSubclassKeyChangeFirst}:  "key_change_1",
+	{helpers.STSClassManagement, helpers.STSSubclassKeyChangeSecond}: "key_change_2",
+	{helpers.STSClassManagement, helpers.STSSubclassClearTamper}:     "clear_tamper",
+}
+
+// stsTokenType names a token, every class 0 subclass is a credit transfer (0 electricity, 1 water, ...)
+func stsTokenType(class, subclass int) string {
+	if class == helpers.STSClassTransfer {
+		return "credit"
+	}
+	return stsTokenTypes[[2]int{class, subclass}]
+}
+
+// tokenIntOption reads a whole number option, a JSON number or a digit string (query parameters)
+func tokenIntOption(options map[string]interface{}, key string, fallback int) (int, error) {
+	switch value := options[key].(type) {
+	case nil:
+		return fallback, nil
+	case int:
+		return value, nil
+	case float64:
+		if value == float64(int(value)) {
+			return int(value), nil
+		}
+	case string:
+		if value == "" {
+			return fallback, nil
+		}
+		if number, err := strconv.Atoi(value); err == nil {
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be a whole number", key)
+}
+
+// encript STS token, the type is selected by class and subclass:
+//
+//	class 0: credit transfer of "amount" units, the subclass selects the utility
+//	class 2 subclass 0: set maximum power limit, "power_limit" in watts
+//	class 2 subclass 1: clear credit, "register" (0 electricity, 65535 all registers)
+//	class 2 subclass 2: set tariff rate, "rate"
+//	class 2 subclass 3: key change token pair, "new_supply_group_code", "new_tariff_index",
+//	                    "new_key_revision", "new_key_type", "key_expiry_number" and "rollover"
+//	class 2 subclass 5: clear tamper condition
+func encriptSTSToken(meter helpers.Meter, options map[string]interface{}) map[string]interface{} {
+	class, err := tokenIntOption(options, "class", helpers.STSClassTransfer)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	subclass, err := tokenIntOption(options, "subclass", 0)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if class == helpers.STSClassTransfer {
+		return encriptSTSCredit(meter, subclass, options)
+	}
+	if class != helpers.STSClassManagement {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Token class %d is not supported for STS meters.", class),
+		}
+	}
+	switch subclass {
+	case helpers.STSSubclassSetMaxPower:
+		return encriptSTSRegister(meter, subclass, "power_limit", true, options)
+	case helpers.STSSubclassClearCredit:
+		return encriptSTSRegister(meter, subclass, "register", false, options)
+	case helpers.STSSubclassSetTariffRate:
+		return encriptSTSRegister(meter, subclass, "rate", true, options)
+	case helpers.STSSubclassClearTamper:
+		return encriptSTSRegister(meter, subclass, "", false, options)
+	case helpers.STSSubclassKeyChangeFirst:
+		return encriptSTSKeyChange(meter, options)
+	case helpers.STSSubclassKeyChangeSecond:
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key change tokens are issued as a pair, request class 2 subclass 3.",
+		}
+	}
+	return map[string]interface{}{
+		"success": false,
+		"message": fmt.Sprintf("Token subclass %d of class 2 is not supported.", subclass),
+	}
+}
+
+// encript STS credit transfer token (class 0): random (4 bits) + TID (24 bits) + amount (16 bits)
+func encriptSTSCredit(meter helpers.Meter, subclass int, options map[string]interface{}) map[string]interface{} {
+	amount, errRes := tokenAmount(options)
+	if errRes != nil {
+		return errRes
+	}
+	amtRes := helpers.EncodeSTSUnits(amount)
+	if !amtRes["success"].(bool) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to encode units: " + amtRes["message"].(string),
+		}
+	}
+	amtBlock := amtRes["message"].(string)
+	result := sealSTSWithTID(meter, helpers.STSClassTransfer, subclass, amtBlock, tokenIssueTime(options))
+	if message, ok := result["message"].(map[string]interface{}); ok {
+		message["units"] = amount
+		message["unitsDecoded"] = helpers.DecodeSTSUnits(amtBlock)["message"]
+	}
+	return result
+}
+
+// encript STS management token carrying a 16-bit register value after random (4 bits) + TID (24 bits).
+// field names the option holding the value, clear tamper tokens carry zeros.
+func encriptSTSRegister(meter helpers.Meter, subclass int, field string, required bool, options map[string]interface{}) map[string]interface{} {
+	value := 0
+	if field != "" {
+		if _, ok := options[field]; required && (!ok || options[field] == "") {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("%s is required", field),
+			}
+		}
+		number, err := tokenIntOption(options, field, 0)
+		if err != nil || number < 0 || number > 0xFFFF {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("%s must be a whole number between 0 and 65535", field),
+			}
+		}
+		value = number
+	}
+	result := sealSTSWithTID(meter, helpers.STSClassManagement, subclass, helpers.DecToBin(value, 16), tokenIssueTime(options))
+	if message, ok := result["message"].(map[string]interface{}); ok && field != "" {
+		message[field] = value
+	}
+	return result
+}
+
+// sealSTSWithTID builds the tokens that carry random (4 bits) + TID (24 bits) + a 16-bit value
+func sealSTSWithTID(meter helpers.Meter, class, subclass int, value string, issueTime time.Time) map[string]interface{} {
+	tidRes := helpers.STSTokenID(issueTime)
+	if !tidRes["success"].(bool) {
+		return tidRes
+	}
+	tid := tidRes["message"].(int64)
+	randRes := helpers.GenerateRandomBits(4)
+	if !randRes["success"].(bool) {
+		return randRes
+	}
+	randomBits := randRes["message"].(string)
+	tokenRes := helpers.SealSTSToken(meter, class, subclass, randomBits+helpers.DecToBin(int(tid), 24)+value)
+	if !tokenRes["success"].(bool) {
+		return tokenRes
+	}
+	// TIDs have minute resolution, the issue time reported is the one the meter sees
+	issued := helpers.STSBaseDate().Add(time.Duration(tid) * time.Minute)
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"token":        tokenRes["message"],
+			"meter_number": meter.Number,
+			"format":       helpers.TokenFormatSTS,
+			"type":         stsTokenType(class, subclass),
+			"class":        class,
+			"subclass":     subclass,
+			"issued_date":  issued.Format(time.RFC3339),
+			"identifier":   tid,
+			"random_bits":  randomBits,
+		},
+	}
+}
+
+// keyChangeOption holds the registry update of a key change in its response, vendToken runs it in the
+// ledger transaction. JSON can't produce the type, so it only comes from encriptSTSKeyChange.
+const keyChangeOption = "$key_change"
+
+// encript STS key change token pair (class 2, subclasses 3 and 4), both encrypted under the meter's
+// current key. The registry moves to the new key parameters when the pair is recorded in the vending
+// ledger, tokens vended afterwards use the new key.
+func encriptSTSKeyChange(meter helpers.Meter, options map[string]interface{}) map[string]interface{} {
+	newMeter, err := helpers.ChangeKeyParameters(meter, options)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if newMeter == meter {
+		return map[string]interface{}{
+			"success": false,
+			"message": "A key change needs at least one new key parameter.",
+		}
+	}
+	keyExpiry, err := tokenIntOption(options, "key_expiry_number", 255)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	rollover := options["rollover"] == true || options["rollover"] == "true"
+	dataRes := helpers.STSKeyChangeData(newMeter, keyExpiry, rollover)
+	if !dataRes["success"].(bool) {
+		return dataRes
+	}
+	data := dataRes["message"].(map[string]interface{})
+	first := helpers.SealSTSToken(meter, helpers.STSClassManagement, helpers.STSSubclassKeyChangeFirst, data["first"].(string))
+	if !first["success"].(bool) {
+		return first
+	}
+	second := helpers.SealSTSToken(meter, helpers.STSClassManagement, helpers.STSSubclassKeyChangeSecond, data["second"].(string))
+	if !second["success"].(bool) {
+		return second
+	}
+	newMeter.UpdatedAt = time.Now()
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"tokens":            []interface{}{first["message"], second["message"]},
+			"meter_number":      meter.Number,
+			"format":            helpers.TokenFormatSTS,
+			"type":              "key_change",
+			"class":             helpers.STSClassManagement,
+			"subclass":          []int{helpers.STSSubclassKeyChangeFirst, helpers.STSSubclassKeyChangeSecond},
+			"supply_group_code": newMeter.SupplyGroupCode,
+			"tariff_index":      newMeter.TariffIndex,
+			"key_revision":      newMeter.KeyRevision,
+			"key_type":          newMeter.KeyType,
+			"key_expiry_number": keyExpiry,
+			"rollover":          rollover,
+			"status":            "Enter both tokens in order, later tokens use the new key.",
+			keyChangeOption: func(q helpers.Querier) error {
+				return helpers.ChangeMeterKey(q, meter, newMeter)
+			},
+		},
+	}
+}
+
+// decript STS token of a meter, the payload is decoded by class and subclass
+func decriptSTSToken(meter helpers.Meter, token string) map[string]interface{} {
+	openRes := helpers.OpenSTSToken(meter, token)
+	if !openRes["success"].(bool) {
+		return openRes
+	}
+	parts := openRes["message"].(map[string]interface{})
+	class := parts["class"].(int)
+	subclass := parts["subclass"].(int)
+	data := parts["data"].(string)
+	tokenType := stsTokenType(class, subclass)
+	if tokenType == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Token class %d subclass %d is not supported.", class, subclass),
+		}
+	}
+	result := map[string]interface{}{
+		"meter_number": meter.Number,
+		"format":       helpers.TokenFormatSTS,
+		"type":         tokenType,
+		"class":        class,
+		"subclass":     subclass,
+		"crc":          helpers.BinStrToDecimal(parts["crc"].(string)),
+		"status":       "Token successfully decrypted and parsed.",
+	}
+	switch {
+	case tokenType == "key_change_1":
+		// The new key bits are not echoed
+		keyExpiry := helpers.BinStrToDecimal(data[:4])
+		result["key_expiry_number_high"] = keyExpiry
+		result["key_revision"] = helpers.BinStrToDecimal(data[4:8])
+		result["rollover"] = data[8] == '1'
+		result["key_type"] = helpers.BinStrToDecimal(data[10:12])
+	case tokenType == "key_change_2":
+		result["key_expiry_number_low"] = helpers.BinStrToDecimal(data[:4])
+		result["tariff_index"] = helpers.BinStrToDecimal(data[4:12])
+	default:
+		tid := helpers.BinStrToDecimal(data[4:28])
+		result["random"] = helpers.BinStrToDecimal(data[:4])
+		result["identifier_minutes"] = tid
+		result["issued_date"] = helpers.STSBaseDate().Add(time.Duration(tid) * time.Minute).Format(time.RFC3339)
+		result["base_date"] = helpers.STSBaseDate()
+		value := data[28:44]
+		switch tokenType {
+		case "credit":
+			result["units"] = helpers.DecodeSTSUnits(value)["message"]
+		case "set_max_power":
+			result["power_limit"] = helpers.BinStrToDecimal(value)
+		case "clear_credit":
+			result["register"] = helpers.BinStrToDecimal(value)
+		case "set_tariff_rate":
+			result["rate"] = helpers.BinStrToDecimal(value)
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": result,
+	}
+}
@@ -9,8 +9,8 @@ import (
 	"vartrick/helpers"
 )
 
-// decript token
-func DecriptToken(options map[string]interface{}) map[string]interface{} {
+// decodeToken decrypts and parses a token of a registered meter
+func decodeToken(options map[string]interface{}) map[string]interface{} {
 	// Validate token field
 	tokenRaw, ok := options["token"]
 	if !ok {
@@ -35,6 +35,17 @@ func DecriptToken(options map[string]interface{}) map[string]interface{} {
 			"message": "Invalid token format. Must be 20 digits (dashes allowed).",
 		}
 	}
+	// Tokens only decode with the key of the meter they were vended for
+	meter, err := helpers.LookupMeter(options)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if meter.TokenFormat == helpers.TokenFormatSTS {
+		return decriptSTSToken(*meter, tokenStr)
+	}
 	// Convert token string to integer
 	// Convert to *big.Int
 	tokenBigInt := new(big.Int)
@@ -48,8 +59,8 @@ func DecriptToken(options map[string]interface{}) map[string]interface{} {
 	// Convert to binary with 66 bits
 	tokenBin := fmt.Sprintf("%066b", tokenBigInt)
 	//tokenBin := helpers.DecToBin(token,)
-	// Generate decoder key (already returns bin string)
-	keyRes := helpers.GenerateDecoderKey()
+	// Generate decoder key of the meter (already returns bin string)
+	keyRes := helpers.GenerateDecoderKey(*meter)
 	if !keyRes["success"].(bool) {
 		return map[string]interface{}{
 			"success": false,
@@ -178,6 +189,7 @@ func DecriptToken(options map[string]interface{}) map[string]interface{} {
 	units := unitsRes["message"]
 	// Assemble result
 	result := map[string]interface{}{
+		"meter_number":       meter.Number,
 		"crc":                helpers.BinStrToDecimal(crcBlock),
 		"class":              helpers.BinStrToDecimal(classBits),
 		"identifier_minutes": tidMinutes,
@@ -194,12 +206,11 @@ func DecriptToken(options map[string]interface{}) map[string]interface{} {
 	}
 }
 
-// encript token
-func EncriptToken(options map[string]interface{}) map[string]interface{} {
-	// Validate required fields
+// tokenAmount reads the "amount" option, a number in a string
+func tokenAmount(options map[string]interface{}) (float64, map[string]interface{}) {
 	amountRaw, ok := options["amount"]
 	if !ok {
-		return map[string]interface{}{
+		return 0, map[string]interface{}{
 			"success": false,
 			"message": "Amount field is required.",
 		}
@@ -207,7 +218,7 @@ func EncriptToken(options map[string]interface{}) map[string]interface{} {
 	// First, assert that amountRaw is a string
 	amountStr, ok := amountRaw.(string)
 	if !ok {
-		return map[string]interface{}{
+		return 0, map[string]interface{}{
 			"success": false,
 			"message": "Amount must be a string.",
 		}
@@ -215,13 +226,16 @@ func EncriptToken(options map[string]interface{}) map[string]interface{} {
 	// Then parse the string to float64
 	amountNumber, err := strconv.ParseFloat(amountStr, 64)
 	if err != nil {
-		return map[string]interface{}{
+		return 0, map[string]interface{}{
 			"success": false,
 			"message": "Amount must be a valid number.",
 		}
 	}
-	// Use amountNumber as needed
-	amount := amountNumber
+	return amountNumber, nil
+}
+
+// tokenIssueTime reads the "issued_time" option (RFC 3339), now when it is missing or invalid
+func tokenIssueTime(options map[string]interface{}) time.Time {
 	issueTime := time.Now()
 	if t, ok := options["issued_time"]; ok {
 		if tStr, ok := t.(string); ok {
@@ -231,6 +245,44 @@ func EncriptToken(options map[string]interface{}) map[string]interface{} {
 			}
 		}
 	}
+	return issueTime
+}
+
+// issueToken builds a token for a registered meter, EncriptToken records it in the vending ledger
+func issueToken(options map[string]interface{}) map[string]interface{} {
+	// Tokens are encrypted with the decoder key of the meter they are vended for
+	meter, err := helpers.LookupMeter(options)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if meter.TokenFormat == helpers.TokenFormatSTS {
+		return encriptSTSToken(*meter, options)
+	}
+	// The original format only carries credit, a class or subclass would be ignored by the payload
+	for _, key := range []string{"class", "subclass"} {
+		value, err := tokenIntOption(options, key, 0)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		if value != 0 {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Meter %s uses the legacy token format, which only issues credit tokens (class 0, subclass 0).", meter.Number),
+			}
+		}
+	}
+	// Validate required fields
+	amount, errRes := tokenAmount(options)
+	if errRes != nil {
+		return errRes
+	}
+	issueTime := tokenIssueTime(options)
 	// Calculate TID (minutes since base date)
 	tidMinutes := int64(issueTime.Sub(helpers.BaseDate).Minutes())
 	tidBin := fmt.Sprintf("%022b", tidMinutes)
@@ -279,8 +331,8 @@ func EncriptToken(options map[string]interface{}) map[string]interface{} {
 	fullBin := dataBin + crcBin
 	// Convert to byte array
 	fullBytes := helpers.BinStrToBytes(fullBin)
-	// Generate decoder key
-	keyRes := helpers.GenerateDecoderKey()
+	// Generate decoder key of the meter
+	keyRes := helpers.GenerateDecoderKey(*meter)
 	if !keyRes["success"].(bool) {
 		return map[string]interface{}{
 			"success": false,
@@ -307,15 +359,8 @@ func EncriptToken(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	// Add class bits (assume class provided in options or default to 0)
+	// Add class bits, credit tokens are class 0
 	classInt := 0
-	if c, ok := options["class"]; ok {
-		if cInt, ok := c.(int); ok {
-			classInt = cInt
-		} else if cFloat, ok := c.(float64); ok {
-			classInt = int(cFloat)
-		}
-	}
 	classBitsRes := helpers.GenerateClassBits(classInt)
 	if !classBitsRes["success"].(bool) {
 		return map[string]interface{}{
@@ -349,6 +394,11 @@ func EncriptToken(options map[string]interface{}) map[string]interface{} {
 		"message": map[string]interface{}{
 			//"token":         tokenStr,
 			"token":            token,
+			"meter_number":     meter.Number,
+			"format":           helpers.TokenFormatLegacy,
+			"type":             "credit",
+			"class":            classInt,
+			"subclass":         0,
 			"issued_date":      issueTime.Format(time.RFC3339),
 			"expired_datetime": issueTime.AddDate(1, 0, 0).Format(time.RFC3339),
 			"identifier":       tidMinutes,
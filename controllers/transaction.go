@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"fmt"
+)
+
+// Transaction runs a mixed sequence of create/update/delete operations all-or-nothing.
+//
+//	[
+//	    {"action": "create", "name": "order", "table": "orders", "data": {"total": 10}},
+//	    {"action": "create", "table": "order_items", "data": {"order_id": {"$ref": "order"}, "qty": 2}}
+//	]
+//
+// {"$ref": "order"} (or {"$ref": 0} by step index) is replaced with the id inserted by that earlier step.
+func Transaction(options []map[string]interface{}) map[string]interface{} {
+	if len(options) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Body can't be empty",
+		}
+	}
+	return runTransaction(options, "")
+}
+
+// atomicBatch reports whether a bulk request asked for all-or-nothing execution
+func atomicBatch(options []map[string]interface{}) bool {
+	for _, opt := range options {
+		if atomic, ok := opt["atomic"].(bool); ok && atomic {
+			return true
+		}
+	}
+	return false
+}
+
+// runTransaction executes every step in one sql.Tx and rolls back on the first failure.
+// defaultAction is used for steps without an "action" (bulk endpoints).
+func runTransaction(steps []map[string]interface{}, defaultAction string) map[string]interface{} {
+	tx, err := db.Begin()
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to start transaction: " + err.Error(),
+		}
+	}
+
+	report := make([]map[string]interface{}, 0, len(steps))
+	insertedIDs := make([]interface{}, len(steps))
+	stepNames := map[string]int{}
+
+	// fail rolls back and reports the step that stopped the transaction
+	fail := func(index int, message interface{}) map[string]interface{} {
+		tx.Rollback()
+		report = append(report, map[string]interface{}{
+			"step":    index,
+			"success": false,
+			"message": message,
+		})
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Transaction rolled back at step %d: %v", index, message),
+			"steps":   report,
+		}
+	}
+
+	for i, step := range steps {
+		action, _ := step["action"].(string)
+		if action == "" {
+			action = defaultAction
+		}
+
+		resolved, err := resolveRefs(step, insertedIDs, stepNames, i)
+		if err != nil {
+			return fail(i, err.Error())
+		}
+		options := resolved.(map[string]interface{})
+
+		var result map[string]interface{}
+		switch action {
+		case "create":
+			result = createWith(tx, options)
+		case "update":
+			result = updateWith(tx, options)
+		case "delete":
+			result = deleteWith(tx, options)
+		default:
+			return fail(i, fmt.Sprintf("Invalid action '%s', expected create, update or delete", action))
+		}
+		if success, ok := result["success"].(bool); !ok || !success {
+			return fail(i, result["message"])
+		}
+
+		if action == "create" {
+			if message, ok := result["message"].(map[string]interface{}); ok {
+				if data, ok := message["data"].(map[string]interface{}); ok {
+					insertedIDs[i] = data["id"]
+				}
+			}
+		}
+		if name, ok := step["name"].(string); ok && name != "" {
+			stepNames[name] = i
+		}
+		result["step"] = i
+		report = append(report, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Transaction commit failed: " + err.Error(),
+			"steps":   report,
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": report,
+	}
+}
+
+// resolveRefs replaces {"$ref": name|index} values with the id inserted by an earlier step
+func resolveRefs(value interface{}, insertedIDs []interface{}, stepNames map[string]int, current int) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"]; ok && len(v) == 1 {
+			index := -1
+			switch r := ref.(type) {
+			case string:
+				if i, ok := stepNames[r]; ok {
+					index = i
+				}
+			case float64:
+				index = int(r)
+			case int:
+				index = r
+			}
+			if index < 0 || index >= current {
+				return nil, fmt.Errorf("Reference %v does not point to an earlier step", ref)
+			}
+			if insertedIDs[index] == nil {
+				return nil, fmt.Errorf("Step %d did not insert a record with an id", index)
+			}
+			return insertedIDs[index], nil
+		}
+		resolved := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			r, err := resolveRefs(item, insertedIDs, stepNames, current)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = r
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := resolveRefs(item, insertedIDs, stepNames, current)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,273 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"vartrick/helpers"
+)
+
+// EncriptToken issues a token and records it in the vending ledger under the caller of claims.
+// "request_id" makes the request safe to retry, a known id returns the tokens it issued instead of new ones.
+func EncriptToken(claims map[string]interface{}, options map[string]interface{}) map[string]interface{} {
+	return vendToken(claims, options, nil)
+}
+
+// vendToken issues and records a token, extra is added to the response and kept for reprints.
+// apply runs in the ledger transaction, the tokens are only issued when it succeeds.
+func vendToken(claims map[string]interface{}, options map[string]interface{}, extra map[string]interface{}, apply ...func(helpers.Querier) error) map[string]interface{} {
+	requestID, _ := options["request_id"].(string)
+	if len(requestID) > 64 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "request_id must be at most 64 characters",
+		}
+	}
+	if requestID != "" {
+		if replay := replayVendRequest(requestID, options); replay != nil {
+			return replay
+		}
+	} else {
+		id, err := helpers.NewVendRequestID()
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Unable to create request id: " + err.Error(),
+			}
+		}
+		requestID = id
+	}
+	result := issueToken(options)
+	if success, ok := result["success"].(bool); !ok || !success {
+		return result
+	}
+	message := result["message"].(map[string]interface{})
+	for key, value := range extra {
+		message[key] = value
+	}
+	// A key change moves the meter registry together with the ledger entry
+	if change, ok := message[keyChangeOption].(func(helpers.Querier) error); ok {
+		apply = append(apply, change)
+	}
+	delete(message, keyChangeOption)
+	records := vendRecords(message, requestID, helpers.VendOperator(claims), helpers.VendTenant(options))
+	if err := helpers.RecordTokens(records, apply...); err != nil {
+		// A retry of the same request raced this one, answer with what it issued
+		if err == helpers.ErrDuplicateRequest {
+			if replay := replayVendRequest(requestID, options); replay != nil {
+				return replay
+			}
+		}
+		if _, reused := err.(*helpers.TokenIDReusedError); reused {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		return map[string]interface{}{
+			"success": false,
+			"message": "Token was not issued, recording it failed: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": helpers.VendReceipt(records, false),
+	}
+}
+
+// VendPayment converts a payment into units with the tariff of the meter's tariff index and issues a
+// credit token for them, the response carries the "receipt". Options: "meter_number", "payment",
+// "request_id", "issued_time" and the "subclass" of STS credit tokens.
+func VendPayment(claims map[string]interface{}, options map[string]interface{}) map[string]interface{} {
+	meter, err := helpers.LookupMeter(options)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	// A retried payment must not recover the debt twice
+	if requestID, _ := options["request_id"].(string); requestID != "" && len(requestID) <= 64 {
+		if replay := replayVendRequest(requestID, options); replay != nil {
+			return replay
+		}
+	}
+	payment, err := paymentAmount(options["payment"])
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	tariff, err := helpers.GetTariff(meter.Tenant, meter.TariffIndex)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Tariff lookup failed: " + err.Error(),
+		}
+	}
+	if tariff == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("No tariff is set for tariff index %d", meter.TariffIndex),
+		}
+	}
+	issueTime := tokenIssueTime(options)
+	usage, err := helpers.MeterUsage(meter.Number, issueTime)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Meter usage lookup failed: " + err.Error(),
+		}
+	}
+	debt, err := helpers.MeterDebt(meter.Number)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Meter debt lookup failed: " + err.Error(),
+		}
+	}
+	// STS amounts have 0.1 unit steps, the original format 0.01
+	resolution := 0.01
+	if meter.TokenFormat == helpers.TokenFormatSTS {
+		resolution = 0.1
+	}
+	quote, err := tariff.Quote(payment, issueTime, usage, debt, resolution)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	tokenOptions := map[string]interface{}{
+		"meter_number": meter.Number,
+		"amount":       strconv.FormatFloat(quote.Units, 'f', -1, 64),
+	}
+	for _, key := range []string{"request_id", "issued_time", "subclass", helpers.TenantOption} {
+		if value, ok := options[key]; ok {
+			tokenOptions[key] = value
+		}
+	}
+	// The debt is recovered with the ledger entry, a vend never recovers more than is owed
+	var apply []func(helpers.Querier) error
+	if quote.DebtRecovered > 0 {
+		apply = append(apply, func(q helpers.Querier) error {
+			return helpers.RecoverDebt(q, meter.Number, quote.DebtRecovered)
+		})
+	}
+	return vendToken(claims, tokenOptions, map[string]interface{}{"receipt": quote.Receipt(*tariff)}, apply...)
+}
+
+// paymentAmount reads a payment, a number or a number in a string (query parameters)
+func paymentAmount(value interface{}) (float64, error) {
+	number := math.NaN()
+	switch payment := value.(type) {
+	case nil:
+		return 0, fmt.Errorf("payment is required")
+	case float64:
+		number = payment
+	case string:
+		if parsed, err := strconv.ParseFloat(payment, 64); err == nil {
+			number = parsed
+		}
+	}
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("payment must be a valid number")
+	}
+	return number, nil
+}
+
+// replayVendRequest answers a request id already in the ledger with the tokens it issued, nil for a new id.
+// The tokens of another tenant's request are not shown.
+func replayVendRequest(requestID string, options map[string]interface{}) map[string]interface{} {
+	previous, err := helpers.FindVendRequest(requestID)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Vending ledger lookup failed: " + err.Error(),
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	if !helpers.VendVisible(previous[0], helpers.VendTenant(options)) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "request_id was already used",
+		}
+	}
+	if number, _ := options["meter_number"].(string); number != previous[0].MeterNumber {
+		return map[string]interface{}{
+			"success": false,
+			"message": "request_id was already used for another meter",
+		}
+	}
+	receipt := helpers.VendReceipt(previous, false)
+	receipt["duplicate_request"] = true
+	return map[string]interface{}{
+		"success": true,
+		"message": receipt,
+	}
+}
+
+// vendRecords turns the response of issueToken into ledger entries, one per token
+func vendRecords(message map[string]interface{}, requestID, operator, tenant string) []helpers.VendRecord {
+	tokens, _ := message["tokens"].([]interface{})
+	if token, ok := message["token"]; ok {
+		tokens = []interface{}{token}
+	}
+	subclasses, _ := message["subclass"].([]int)
+	issuedAt := time.Now()
+	records := make([]helpers.VendRecord, 0, len(tokens))
+	for i, token := range tokens {
+		record := helpers.VendRecord{
+			RequestID:   requestID,
+			Position:    i,
+			MeterNumber: fmt.Sprint(message["meter_number"]),
+			Token:       fmt.Sprint(token),
+			TokenType:   fmt.Sprint(message["type"]),
+			Operator:    operator,
+			Tenant:      tenant,
+			Details:     message,
+			IssuedAt:    issuedAt,
+		}
+		record.Class, _ = message["class"].(int)
+		record.Subclass, _ = message["subclass"].(int)
+		if i < len(subclasses) {
+			record.Subclass = subclasses[i]
+		}
+		if tid, ok := message["identifier"].(int64); ok {
+			record.TID = sql.NullInt64{Int64: tid, Valid: true}
+		}
+		if record.TokenType == "credit" {
+			record.Amount, _ = message["units"].(float64)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// DecriptToken decrypts a token and reports whether we issued it ("issued" and its "ledger" entry).
+// "redeem": true marks the token as used, a used or unknown token is then rejected. Callers with a tenant
+// only see the tokens vended by their tenant.
+func DecriptToken(options map[string]interface{}) map[string]interface{} {
+	result := decodeToken(options)
+	if success, ok := result["success"].(bool); !ok || !success {
+		return result
+	}
+	message := result["message"].(map[string]interface{})
+	redeem := options["redeem"] == true || options["redeem"] == "true"
+	status, err := helpers.VendTokenStatus(fmt.Sprint(message["meter_number"]), options["token"].(string), helpers.VendTenant(options), redeem)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	for key, value := range status {
+		message[key] = value
+	}
+	return result
+}
@@ -0,0 +1,424 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// apiKeyTable holds the API keys, hidden from the generic CRUD routes
+const apiKeyTable = "auth_api_keys"
+
+// apiKeyPrefix starts every API key: vk_<id>_<secret>
+const apiKeyPrefix = "vk_"
+
+// apiKeyRolePrefix names the role carrying the scopes of one key
+const apiKeyRolePrefix = "apikey:"
+
+// lastUsedInterval limits how often last_used_at is written for a busy key
+const lastUsedInterval = time.Minute
+
+// APIKey is one stored key, the secret itself is only kept as a sha256 hash
+type APIKey struct {
+	ID         string
+	Name       string
+	Roles      []string    // policy roles of the key, or
+	Scopes     *RolePolicy // its own routes and tables
+	Tenant     interface{}
+	RateLimit  float64 // requests per second, 0 for no limit
+	Burst      int
+	ExpiresAt  time.Time // zero for keys that never expire
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+	Revoked    bool
+	hash       string
+}
+
+var (
+	apiKeyMu       sync.Mutex
+	apiKeyScopes   = map[string]RolePolicy{}    // scopes by key id, read by the policy checks
+	apiKeyLimiters = map[string]*rate.Limiter{} // limiter by key id
+	apiKeyLastUsed = map[string]time.Time{}     // last time last_used_at was written
+)
+
+// InitAPIKeys creates the API key table, keys are unavailable without a database
+func InitAPIKeys() map[string]interface{} {
+	if DB == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "API keys need a database connection",
+		}
+	}
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id VARCHAR(32) NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL,
+		key_hash VARCHAR(64) NOT NULL, roles TEXT NOT NULL, scopes TEXT NOT NULL, tenant TEXT NOT NULL,
+		rate_limit DOUBLE PRECISION NOT NULL DEFAULT 0, burst INTEGER NOT NULL DEFAULT 0, expires_at BIGINT NOT NULL DEFAULT 0,
+		last_used_at BIGINT NOT NULL DEFAULT 0, created_at BIGINT NOT NULL, revoked INTEGER NOT NULL DEFAULT 0)`, EscapeId(apiKeyTable))
+	if _, err := DB.Exec(query); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to create API key table: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "API keys enabled",
+	}
+}
+
+// CreateAPIKey stores a new key and returns it, the plaintext key is only shown here.
+// The roles and scopes must be held by the caller of claims, a key never has more permissions than its creator.
+//
+//	{"name": "billing-cron", "roles": ["reader"], "scopes": {"routes": ["create"], "tables": {"orders": ["create"]}},
+//	 "expires_in": 86400, "rate_limit": 5, "burst": 10}
+func CreateAPIKey(claims map[string]interface{}, options map[string]interface{}) map[string]interface{} {
+	name, _ := options["name"].(string)
+	if strings.TrimSpace(name) == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "API key name is required",
+		}
+	}
+	key := APIKey{Name: name, Roles: normalizeRoles(options["roles"]), CreatedAt: time.Now()}
+	if scopes, ok := options["scopes"]; ok && scopes != nil {
+		content, _ := json.Marshal(scopes)
+		var policy RolePolicy
+		if err := json.Unmarshal(content, &policy); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Invalid scopes: " + err.Error(),
+			}
+		}
+		if err := validateRolePolicy(policy); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Invalid scopes: " + err.Error(),
+			}
+		}
+		key.Scopes = &policy
+	}
+	if (len(key.Roles) == 0) == (key.Scopes == nil) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "An API key needs either roles or scopes",
+		}
+	}
+	callerRoles := RolesFromClaims(claims)
+	for _, role := range key.Roles {
+		policy, ok := definedRole(role)
+		if !ok {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Unknown role '%s'", role),
+			}
+		}
+		if err := CheckGrant(callerRoles, policy); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Role '%s' can't be granted: %v", role, err),
+			}
+		}
+	}
+	if key.Scopes != nil {
+		if err := CheckGrant(callerRoles, *key.Scopes); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Scopes can't be granted: " + err.Error(),
+			}
+		}
+	}
+	// Keys created by a tenant scoped caller belong to that tenant
+	if tenant, ok := options[TenantOption].(Tenant); ok {
+		key.Tenant = tenant.Value
+	} else {
+		key.Tenant = options["tenant"]
+	}
+	if seconds, ok := options["expires_in"].(float64); ok && seconds > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(time.Duration(seconds) * time.Second)
+	}
+	if value, ok := options["rate_limit"].(float64); ok && value > 0 {
+		key.RateLimit = value
+	}
+	if value, ok := options["burst"].(float64); ok && value > 0 {
+		key.Burst = int(value)
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to create API key: " + err.Error(),
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to create API key: " + err.Error(),
+		}
+	}
+	key.ID = id
+	plaintext := apiKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.hash = hashAPIKeySecret(plaintext)
+
+	roles, _ := json.Marshal(key.Roles)
+	scopes, _ := json.Marshal(key.Scopes)
+	tenant, _ := json.Marshal(key.Tenant)
+	query := fmt.Sprintf("INSERT INTO %s (id, name, key_hash, roles, scopes, tenant, rate_limit, burst, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", EscapeId(apiKeyTable))
+	if _, err := DB.Exec(Rebind(query), key.ID, key.Name, key.hash, string(roles), string(scopes), string(tenant),
+		key.RateLimit, key.Burst, unixOrZero(key.ExpiresAt), key.CreatedAt.Unix()); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to create API key: " + err.Error(),
+		}
+	}
+	result := key.info()
+	result["key"] = plaintext
+	return map[string]interface{}{
+		"success": true,
+		"message": result,
+	}
+}
+
+// ListAPIKeys returns every key without its secret, tenant callers only see their tenant's keys
+func ListAPIKeys(options map[string]interface{}) map[string]interface{} {
+	keys, err := loadAPIKeys("")
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to list API keys: " + err.Error(),
+		}
+	}
+	list := []map[string]interface{}{}
+	for _, key := range keys {
+		if !apiKeyVisible(options, key) {
+			continue
+		}
+		list = append(list, key.info())
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": list,
+	}
+}
+
+// RevokeAPIKey disables a key immediately: {"id": "..."}
+func RevokeAPIKey(options map[string]interface{}) map[string]interface{} {
+	id, _ := options["id"].(string)
+	if id == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "API key id is required",
+		}
+	}
+	keys, err := loadAPIKeys(id)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to revoke API key: " + err.Error(),
+		}
+	}
+	if len(keys) == 0 || !apiKeyVisible(options, keys[0]) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "API key not found",
+		}
+	}
+	query := fmt.Sprintf("UPDATE %s SET revoked = 1 WHERE id = ?", EscapeId(apiKeyTable))
+	if _, err := DB.Exec(Rebind(query), id); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to revoke API key: " + err.Error(),
+		}
+	}
+	apiKeyMu.Lock()
+	delete(apiKeyScopes, id)
+	delete(apiKeyLimiters, id)
+	delete(apiKeyLastUsed, id)
+	apiKeyMu.Unlock()
+	return map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("API key %s revoked", id),
+	}
+}
+
+// AuthenticateAPIKey verifies an X-API-Key value and returns the claims of the key.
+// status is the HTTP status to answer with when err is set (401, or 429 over the rate limit).
+func AuthenticateAPIKey(value string) (map[string]interface{}, int, error) {
+	invalid := fmt.Errorf("Access denied: invalid or expired API key")
+	parts := strings.SplitN(strings.TrimPrefix(value, apiKeyPrefix), "_", 2)
+	if DB == nil || !strings.HasPrefix(value, apiKeyPrefix) || len(parts) != 2 {
+		return nil, http.StatusUnauthorized, invalid
+	}
+	keys, err := loadAPIKeys(parts[0])
+	if err != nil {
+		LogJSON(false, "API key lookup failed: "+err.Error())
+		return nil, http.StatusUnauthorized, invalid
+	}
+	if len(keys) == 0 {
+		hashAPIKeySecret(value) // same work as a known key
+		return nil, http.StatusUnauthorized, invalid
+	}
+	key := keys[0]
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(value)), []byte(key.hash)) != 1 ||
+		key.Revoked || (!key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt)) {
+		return nil, http.StatusUnauthorized, invalid
+	}
+
+	now := time.Now()
+	apiKeyMu.Lock()
+	if key.RateLimit > 0 {
+		burst := key.Burst
+		if burst <= 0 {
+			burst = int(key.RateLimit) + 1
+		}
+		limiter, ok := apiKeyLimiters[key.ID]
+		if !ok || limiter.Limit() != rate.Limit(key.RateLimit) || limiter.Burst() != burst {
+			limiter = rate.NewLimiter(rate.Limit(key.RateLimit), burst)
+			apiKeyLimiters[key.ID] = limiter
+		}
+		if !limiter.Allow() {
+			apiKeyMu.Unlock()
+			return nil, http.StatusTooManyRequests, fmt.Errorf("Rate limit exceeded for API key %s", key.ID)
+		}
+	}
+	if key.Scopes != nil {
+		apiKeyScopes[key.ID] = *key.Scopes
+	}
+	touch := now.Sub(apiKeyLastUsed[key.ID]) >= lastUsedInterval
+	if touch {
+		apiKeyLastUsed[key.ID] = now
+	}
+	apiKeyMu.Unlock()
+
+	if touch {
+		query := fmt.Sprintf("UPDATE %s SET last_used_at = ? WHERE id = ?", EscapeId(apiKeyTable))
+		if _, err := DB.Exec(Rebind(query), now.Unix(), key.ID); err != nil {
+			LogJSON(false, "Failed to record API key use: "+err.Error())
+		}
+	}
+
+	roles := key.Roles
+	if key.Scopes != nil {
+		roles = []string{apiKeyRolePrefix + key.ID}
+	}
+	claims := map[string]interface{}{
+		"api_key":   key.ID,
+		"user_name": key.Name,
+		"roles":     roles,
+	}
+	if key.Tenant != nil {
+		claims[tenantClaim()] = key.Tenant
+	}
+	return claims, http.StatusOK, nil
+}
+
+// apiKeyPolicy returns the scopes of an "apikey:<id>" role
+func apiKeyPolicy(role string) (RolePolicy, bool) {
+	if !strings.HasPrefix(role, apiKeyRolePrefix) {
+		return RolePolicy{}, false
+	}
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+	policy, ok := apiKeyScopes[strings.TrimPrefix(role, apiKeyRolePrefix)]
+	return policy, ok
+}
+
+// apiKeyVisible hides keys of other tenants from tenant scoped callers
+func apiKeyVisible(options map[string]interface{}, key APIKey) bool {
+	tenant, ok := options[TenantOption].(Tenant)
+	return !ok || fmt.Sprint(tenant.Value) == fmt.Sprint(key.Tenant)
+}
+
+// hashAPIKeySecret is the stored form of a key
+func hashAPIKeySecret(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadAPIKeys reads one key by id, or every key when id is ""
+func loadAPIKeys(id string) ([]APIKey, error) {
+	query := fmt.Sprintf("SELECT id, name, key_hash, roles, scopes, tenant, rate_limit, burst, expires_at, last_used_at, created_at, revoked FROM %s", EscapeId(apiKeyTable))
+	var params []interface{}
+	if id != "" {
+		query += " WHERE id = ?"
+		params = append(params, id)
+	}
+	rows, err := DB.Query(Rebind(query+" ORDER BY created_at"), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		var roles, scopes, tenant string
+		var expires, lastUsed, created int64
+		var revoked int
+		if err := rows.Scan(&key.ID, &key.Name, &key.hash, &roles, &scopes, &tenant, &key.RateLimit, &key.Burst,
+			&expires, &lastUsed, &created, &revoked); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(roles), &key.Roles)
+		json.Unmarshal([]byte(scopes), &key.Scopes)
+		decoder := json.NewDecoder(strings.NewReader(tenant))
+		decoder.UseNumber()
+		decoder.Decode(&key.Tenant)
+		key.ExpiresAt = timeOrZero(expires)
+		key.LastUsedAt = timeOrZero(lastUsed)
+		key.CreatedAt = time.Unix(created, 0)
+		key.Revoked = revoked != 0
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// info is the listed form of a key
+func (key APIKey) info() map[string]interface{} {
+	format := func(t time.Time) interface{} {
+		if t.IsZero() {
+			return nil
+		}
+		return t.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"id":           key.ID,
+		"name":         key.Name,
+		"roles":        key.Roles,
+		"scopes":       key.Scopes,
+		"tenant":       key.Tenant,
+		"rate_limit":   key.RateLimit,
+		"burst":        key.Burst,
+		"expires_at":   format(key.ExpiresAt),
+		"last_used_at": format(key.LastUsedAt),
+		"created_at":   format(key.CreatedAt),
+		"revoked":      key.Revoked,
+	}
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
@@ -0,0 +1,62 @@
+package helpers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCreateAPIKeyGrants(t *testing.T) {
+	openTestDB(t)
+	if res := InitAPIKeys(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	user := map[string]interface{}{"id": 1.0, "user_name": "joe", "roles": []interface{}{"user"}}
+	admin := map[string]interface{}{"id": 2.0, "user_name": "boss", "roles": []interface{}{"admin"}}
+	tests := []struct {
+		claims  map[string]interface{}
+		options string
+		ok      bool
+	}{
+		{user, `{"name": "k", "roles": ["user"]}`, true},
+		{user, `{"name": "k", "roles": ["admin"]}`, false},
+		{user, `{"name": "k", "roles": ["nobody"]}`, false},
+		{user, `{"name": "k", "scopes": {"routes": ["read", "list"], "tables": {"orders": ["read"]}}}`, true},
+		{user, `{"name": "k", "scopes": {"routes": ["*"]}}`, false},
+		{user, `{"name": "k", "scopes": {"routes": ["search*"]}}`, false},
+		{user, `{"name": "k", "scopes": {"routes": ["vend"]}}`, false},
+		{user, `{"name": "k", "scopes": {"routes": ["read"], "tables": {"*": ["read"]}}}`, true},
+		{user, `{"name": "k", "scopes": {"routes": ["read"], "tables": {"*": ["*"]}}}`, false},
+		{admin, `{"name": "k", "roles": ["admin"]}`, true},
+		{admin, `{"name": "k", "scopes": {"routes": ["*"], "tables": {"*": ["*"]}}}`, true},
+		{nil, `{"name": "k", "roles": ["admin"]}`, false},
+	}
+	for _, tt := range tests {
+		var options map[string]interface{}
+		json.Unmarshal([]byte(tt.options), &options)
+		if res := CreateAPIKey(tt.claims, options); res["success"].(bool) != tt.ok {
+			t.Errorf("CreateAPIKey(%v, %s) = %v, want success %t", tt.claims["roles"], tt.options, res["message"], tt.ok)
+		}
+	}
+}
+
+func TestCheckGrantAPIKeyCaller(t *testing.T) {
+	openTestDB(t)
+	InitAPIKeys()
+	var options map[string]interface{}
+	json.Unmarshal([]byte(`{"name": "k", "scopes": {"routes": ["read"], "tables": {"orders": ["read"]}}}`), &options)
+	created := CreateAPIKey(map[string]interface{}{"roles": []interface{}{"admin"}}, options)
+	if !created["success"].(bool) {
+		t.Fatal(created["message"])
+	}
+	claims, _, err := AuthenticateAPIKey(created["message"].(map[string]interface{})["key"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := RolesFromClaims(claims)
+	if err := CheckGrant(roles, RolePolicy{Routes: []string{"read"}, Tables: map[string][]string{"orders": {"read"}}}); err != nil {
+		t.Errorf("a key can't pass on its own scopes: %v", err)
+	}
+	if err := CheckGrant(roles, RolePolicy{Tables: map[string][]string{"orders": {"delete"}}}); err == nil {
+		t.Errorf("a key passed on a table action it does not have")
+	}
+}
@@ -0,0 +1,127 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxCursorPageSize caps page_size in cursor pagination mode
+const MaxCursorPageSize = 100
+
+// Cursor directions
+const (
+	CursorNext = "next"
+	CursorPrev = "prev"
+)
+
+// Cursor is the decoded form of the opaque next_cursor/prev_cursor strings
+type Cursor struct {
+	Direction string        `json:"d"`
+	Keys      []string      `json:"k"` // sort columns the values belong to
+	Values    []interface{} `json:"v"`
+}
+
+// EncodeCursor builds an opaque cursor pointing at row of table for the given sort order
+func EncodeCursor(direction, table string, order []OrderColumn, row map[string]interface{}) (string, error) {
+	cursor := Cursor{Direction: direction}
+	schema := GetTableSchema(table)
+	for _, o := range order {
+		value, ok := row[o.Column]
+		if !ok {
+			return "", fmt.Errorf("Sort column '%s' is missing from the row", o.Column)
+		}
+		// Rows carry RFC3339 datetimes, compare them in the layout the engines accept
+		if text, ok := value.(string); ok && schema != nil && columnKind(schema.byName[o.Column].DataType) == columnDateTime {
+			if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+				value = t.Format(mysqlDateTime)
+			}
+		}
+		cursor.Keys = append(cursor.Keys, o.Column)
+		cursor.Values = append(cursor.Values, value)
+	}
+	content, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(content), nil
+}
+
+// DecodeCursor parses a cursor string and checks it was issued for the same sort order
+func DecodeCursor(value string, order []OrderColumn) (*Cursor, error) {
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber() // keeps large integer keys exact
+	var cursor Cursor
+	if err := decoder.Decode(&cursor); err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	if cursor.Direction != CursorNext && cursor.Direction != CursorPrev {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	if len(cursor.Keys) != len(order) || len(cursor.Values) != len(order) {
+		return nil, fmt.Errorf("Cursor does not match the requested order_by")
+	}
+	for i, o := range order {
+		if cursor.Keys[i] != o.Column {
+			return nil, fmt.Errorf("Cursor does not match the requested order_by")
+		}
+		if number, ok := cursor.Values[i].(json.Number); ok {
+			cursor.Values[i] = number.String()
+		}
+	}
+	return &cursor, nil
+}
+
+// CheckCursorOrder refuses sort columns that may hold NULL: comparisons with NULL are never true, so
+// KeysetWhere would skip those rows. Primary keys count as NOT NULL, SQLite reports its rowid alias as nullable.
+func CheckCursorOrder(table string, order []OrderColumn) error {
+	schema := GetTableSchema(table)
+	if schema == nil {
+		return nil
+	}
+	for _, o := range order {
+		column, ok := schema.byName[strings.TrimPrefix(o.Column, table+".")]
+		if ok && column.Nullable && !column.PrimaryKey {
+			return fmt.Errorf("Cursor pagination can't sort on the nullable column '%s', use offset pagination or a NOT NULL column", o.Column)
+		}
+	}
+	return nil
+}
+
+// KeysetWhere returns the condition selecting rows after (or before, when backward) the cursor values:
+// (a > ?) OR (a = ? AND b > ?) OR ... with the comparison flipped for descending columns.
+func KeysetWhere(order []OrderColumn, values []interface{}, backward bool) (string, []interface{}) {
+	var groups []string
+	var params []interface{}
+	for i, o := range order {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, EscapeId(order[j].Column)+" = ?")
+			params = append(params, values[j])
+		}
+		operator := ">"
+		if o.Desc != backward {
+			operator = "<"
+		}
+		parts = append(parts, fmt.Sprintf("%s %s ?", EscapeId(o.Column), operator))
+		params = append(params, values[i])
+		groups = append(groups, "( "+strings.Join(parts, " AND ")+" )")
+	}
+	return strings.Join(groups, " OR "), params
+}
+
+// ReverseOrder flips every direction, used to walk backwards from a prev cursor
+func ReverseOrder(order []OrderColumn) []OrderColumn {
+	reversed := make([]OrderColumn, len(order))
+	for i, o := range order {
+		reversed[i] = OrderColumn{Column: o.Column, Desc: !o.Desc}
+	}
+	return reversed
+}
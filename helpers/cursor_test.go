@@ -0,0 +1,148 @@
+package helpers
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	order := []OrderColumn{{Column: "score", Desc: true}, {Column: "id"}}
+	value, err := EncodeCursor(CursorNext, "", order, map[string]interface{}{"id": 9007199254740993, "score": "b", "name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := DecodeCursor(value, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Direction != CursorNext || !reflect.DeepEqual(cursor.Values, []interface{}{"b", "9007199254740993"}) {
+		t.Errorf("DecodeCursor = %+v", cursor)
+	}
+	if _, err := DecodeCursor(value, []OrderColumn{{Column: "id"}}); err == nil {
+		t.Errorf("DecodeCursor accepted a cursor of another order_by")
+	}
+	if _, err := DecodeCursor(value, []OrderColumn{{Column: "name", Desc: true}, {Column: "id"}}); err == nil {
+		t.Errorf("DecodeCursor accepted a cursor of other columns")
+	}
+	for _, bad := range []string{"", "!!", "e30"} {
+		if _, err := DecodeCursor(bad, order); err == nil {
+			t.Errorf("DecodeCursor(%q) succeeded", bad)
+		}
+	}
+	if _, err := EncodeCursor(CursorNext, "", order, map[string]interface{}{"id": 1}); err == nil {
+		t.Errorf("EncodeCursor without the score column succeeded")
+	}
+}
+
+func TestKeysetWhere(t *testing.T) {
+	useDialect(t, sqliteDialect{})
+	order := []OrderColumn{{Column: "score", Desc: true}, {Column: "id"}}
+	clause, params := KeysetWhere(order, []interface{}{5, 2}, false)
+	if want := `( "score" < ? ) OR ( "score" = ? AND "id" > ? )`; clause != want {
+		t.Errorf("KeysetWhere = %s, want %s", clause, want)
+	}
+	if !reflect.DeepEqual(params, []interface{}{5, 5, 2}) {
+		t.Errorf("KeysetWhere params = %v", params)
+	}
+	clause, _ = KeysetWhere(order, []interface{}{5, 2}, true)
+	if want := `( "score" > ? ) OR ( "score" = ? AND "id" < ? )`; clause != want {
+		t.Errorf("backward KeysetWhere = %s, want %s", clause, want)
+	}
+	if got := ReverseOrder(order); !reflect.DeepEqual(got, []OrderColumn{{Column: "score"}, {Column: "id", Desc: true}}) {
+		t.Errorf("ReverseOrder = %v", got)
+	}
+}
+
+// TestKeysetPages walks a table with duplicate sort values forwards and back again
+func TestKeysetPages(t *testing.T) {
+	openTestDB(t)
+	if _, err := DB.Exec(`CREATE TABLE scores (id INTEGER PRIMARY KEY, score INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for id := 1; id <= 10; id++ {
+		values = append(values, fmt.Sprintf("(%d, %d)", id, id%3))
+	}
+	if _, err := DB.Exec("INSERT INTO scores (id, score) VALUES " + strings.Join(values, ", ")); err != nil {
+		t.Fatal(err)
+	}
+	order := []OrderColumn{{Column: "score", Desc: true}, {Column: "id"}}
+	page := func(cursor string) []map[string]interface{} {
+		query := "SELECT id, score FROM scores"
+		var params []interface{}
+		sortOrder := order
+		if cursor != "" {
+			decoded, err := DecodeCursor(cursor, order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backward := decoded.Direction == CursorPrev
+			var clause string
+			clause, params = KeysetWhere(order, decoded.Values, backward)
+			query += " WHERE " + clause
+			if backward {
+				sortOrder = ReverseOrder(order)
+			}
+		}
+		var sorts []string
+		for _, o := range sortOrder {
+			direction := "ASC"
+			if o.Desc {
+				direction = "DESC"
+			}
+			sorts = append(sorts, EscapeId(o.Column)+" "+direction)
+		}
+		rows, err := DB.Query(Rebind(query+" ORDER BY "+strings.Join(sorts, ", ")+" LIMIT 4"), params...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var result []map[string]interface{}
+		for rows.Next() {
+			var id, score int64
+			rows.Scan(&id, &score)
+			result = append(result, map[string]interface{}{"id": id, "score": score})
+		}
+		if sortOrder[0].Desc != order[0].Desc {
+			for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+				result[i], result[j] = result[j], result[i]
+			}
+		}
+		return result
+	}
+	ids := func(rows []map[string]interface{}) []int64 {
+		var list []int64
+		for _, row := range rows {
+			list = append(list, row["id"].(int64))
+		}
+		return list
+	}
+
+	var seen []int64
+	var pages [][]map[string]interface{}
+	cursor := ""
+	for {
+		rows := page(cursor)
+		if len(rows) == 0 {
+			break
+		}
+		pages = append(pages, rows)
+		seen = append(seen, ids(rows)...)
+		var err error
+		if cursor, err = EncodeCursor(CursorNext, "scores", order, rows[len(rows)-1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []int64{2, 5, 8, 1, 4, 7, 10, 3, 6, 9}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("forward pages = %v, want %v", seen, want)
+	}
+	prev, err := EncodeCursor(CursorPrev, "scores", order, pages[2][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(page(prev)); !reflect.DeepEqual(got, ids(pages[1])) {
+		t.Errorf("prev page = %v, want %v", got, ids(pages[1]))
+	}
+}
@@ -10,40 +10,40 @@ import (
 // This assumes a global DB variable
 var DB *sql.DB // exported so other packages can use it
 // ---------- SQL HELPERS ----------
-// InitDBConnection establishes and checks the MySQL connection with retries
+// InitDBConnection opens the connection for DATABASE_DRIVER (mysql, postgres or sqlite) and checks it
 
 func InitDBConnection() map[string]interface{} {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		DatabaseUser,
-		DatabasePassword,
-		DatabaseHost,
-		DatabasePort,
-		DatabaseName,
-	)
-
-	var err error
-	DB, err = sql.Open("mysql", dsn)
+	dialect, err := DialectFor(DatabaseDriver)
 	if err != nil {
-		//logger.Errorf("Failed to open MySQL connection: %v", err)
 		return map[string]interface{}{
 			"success": false,
-			"message": fmt.Sprintf("Failed to open MySQL connection: %v", err),
+			"message": err.Error(),
+		}
+	}
+	DBDialect = dialect
+
+	DB, err = sql.Open(DBDialect.DriverName(), DBDialect.DSN())
+	if err != nil {
+		//logger.Errorf("Failed to open connection: %v", err)
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Failed to open %s connection: %v", DBDialect.Name(), err),
 		}
 	}
 
 	if err = DB.Ping(); err != nil {
-		//logger.Errorf("Failed to ping MySQL: %v", err)
+		//logger.Errorf("Failed to ping: %v", err)
 		return map[string]interface{}{
 			"success": false,
-			"message": fmt.Sprintf("Failed to ping MySQL: %v", err),
+			"message": fmt.Sprintf("Failed to ping %s: %v", DBDialect.Name(), err),
 		}
 	}
 
 	// ✅ Connection successful
-	//logger.Info("MySQL connection established successfully")
+	//logger.Info("connection established successfully")
 	return map[string]interface{}{
 		"success": true,
-		"message": "MySQL connection established successfully",
+		"message": fmt.Sprintf("%s connection established successfully", DBDialect.Name()),
 	}
 }
 
@@ -52,7 +52,7 @@ func GenerateWhere(cond map[string]interface{}) (string, []interface{}) {
 	var parts []string
 	var params []interface{}
 	for k, v := range cond {
-		parts = append(parts, fmt.Sprintf("BINARY %s = ?", EscapeId(k)))
+		parts = append(parts, fmt.Sprintf("%s = ?", DBDialect.CaseSensitive(EscapeId(k))))
 		params = append(params, v)
 	}
 	return strings.Join(parts, " AND "), params
@@ -63,7 +63,7 @@ func GenerateWhereOr(cond map[string]interface{}) (string, []interface{}) {
 	var parts []string
 	var params []interface{}
 	for k, v := range cond {
-		parts = append(parts, fmt.Sprintf("BINARY %s = ?", EscapeId(k)))
+		parts = append(parts, fmt.Sprintf("%s = ?", DBDialect.CaseSensitive(EscapeId(k))))
 		params = append(params, v)
 	}
 	return strings.Join(parts, " OR "), params
@@ -74,7 +74,7 @@ func GenerateLike(like map[string]interface{}) (string, []interface{}) {
 	var conditions []string
 	var params []interface{}
 	for key, val := range like {
-		conditions = append(conditions, fmt.Sprintf("BINARY %s LIKE ?", EscapeId(key)))
+		conditions = append(conditions, fmt.Sprintf("%s LIKE ?", DBDialect.CaseSensitive(EscapeId(key))))
 		params = append(params, fmt.Sprintf("%%%v%%", val))
 	}
 	return strings.Join(conditions, " AND "), params
@@ -91,6 +91,33 @@ func GenerateSet(set map[string]interface{}) (string, []interface{}) {
 	return strings.Join(parts, ", "), params
 }
 
+// GenerateInsert builds the `(field1, field2) VALUES (?, ?)` part of an INSERT
+func GenerateInsert(data map[string]interface{}) (string, []interface{}) {
+	var columns []string
+	var placeholders []string
+	var params []interface{}
+	for key, val := range data {
+		columns = append(columns, EscapeId(key))
+		placeholders = append(placeholders, "?")
+		params = append(params, val)
+	}
+	return fmt.Sprintf("(%s) VALUES (%s)", strings.Join(columns, ", "), strings.Join(placeholders, ", ")), params
+}
+
+// GenerateInsertRows builds "(cols) VALUES (?, ..), (?, ..)" for records sharing the same columns
+func GenerateInsertRows(columns []string, records []map[string]interface{}) (string, []interface{}) {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	rows := make([]string, len(records))
+	params := make([]interface{}, 0, len(columns)*len(records))
+	for i, record := range records {
+		rows[i] = row
+		for _, column := range columns {
+			params = append(params, record[column])
+		}
+	}
+	return fmt.Sprintf("(%s) VALUES %s", strings.Join(EscapeIds(columns), ", "), strings.Join(rows, ", ")), params
+}
+
 // Select generate
 func GenerateSelect(fields interface{}) string {
 	var strFields []string
@@ -113,12 +140,21 @@ func GenerateSelect(fields interface{}) string {
 	return strings.Join(EscapeIds(strFields), ", ")
 }
 
-// EscapeId safely escapes table/column names using backticks
+// EscapeId safely escapes table/column names using the dialect quotes, table.column is kept qualified
 func EscapeId(identifier string) string {
+	if identifier == "*" {
+		return "*"
+	}
 	// Strip dangerous characters except underscore and alphanumerics
 	re := regexp.MustCompile(`[^a-zA-Z0-9_]+`)
-	safe := re.ReplaceAllString(identifier, "")
-	return "`" + safe + "`"
+	parts := strings.Split(identifier, ".")
+	for i, part := range parts {
+		if part == "*" && i == len(parts)-1 && i > 0 {
+			continue
+		}
+		parts[i] = DBDialect.QuoteIdent(re.ReplaceAllString(part, ""))
+	}
+	return strings.Join(parts, ".")
 }
 
 // EscapeIdentifiers for multiple fields
@@ -130,38 +166,145 @@ func EscapeIds(identifiers []string) []string {
 	return escaped
 }
 
-// Scan SQL rows into []map[string]interface{}
-func ScanRowss(rows *sql.Rows) ([]map[string]interface{}, error) {
-	columns, err := rows.Columns()
-	if err != nil {
-		return nil, err
+// JoinType maps the join "type" option to an allowed SQL join, INNER JOIN by default
+func JoinType(value interface{}) (string, error) {
+	joinType, _ := value.(string)
+	switch strings.ToUpper(strings.TrimSpace(joinType)) {
+	case "", "INNER", "INNER JOIN", "JOIN":
+		return "INNER JOIN", nil
+	case "LEFT", "LEFT JOIN", "LEFT OUTER JOIN":
+		return "LEFT JOIN", nil
+	case "RIGHT", "RIGHT JOIN", "RIGHT OUTER JOIN":
+		return "RIGHT JOIN", nil
+	default:
+		return "", fmt.Errorf("Invalid join type '%s'", joinType)
+	}
+}
+
+// JoinOn parses a join "on" option into column pairs.
+// Accepts "table1.col = table2.col" or {"table1.col": "table2.col", ...}.
+func JoinOn(value interface{}) ([][2]string, error) {
+	var pairs [][2]string
+	switch v := value.(type) {
+	case string:
+		re := regexp.MustCompile(`^\s*(\w+\.\w+)\s*=\s*(\w+\.\w+)\s*$`)
+		for _, part := range regexp.MustCompile(`(?i)\s+AND\s+`).Split(v, -1) {
+			match := re.FindStringSubmatch(part)
+			if match == nil {
+				return nil, fmt.Errorf("Invalid join condition '%s', expected table.column = table.column", part)
+			}
+			pairs = append(pairs, [2]string{match[1], match[2]})
+		}
+	case map[string]interface{}:
+		for left, rightRaw := range v {
+			right, ok := rightRaw.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid join condition for '%s'", left)
+			}
+			pairs = append(pairs, [2]string{left, right})
+		}
 	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("Join condition 'on' is required")
+	}
+	return pairs, nil
+}
+
+// OrderColumn is one parsed entry of the order_by option
+type OrderColumn struct {
+	Column string
+	Desc   bool
+}
 
-	var results []map[string]interface{}
-	for rows.Next() {
-		values := make([]interface{}, len(columns))
-		valuePtrs := make([]interface{}, len(columns))
-		for i := range values {
-			valuePtrs[i] = &values[i]
+// ParseOrderBy parses the order_by option and validates its columns against tables, redacted columns are rejected.
+// Accepts "name", "-name", {"column": "name", "direction": "desc"} or a list of them.
+func ParseOrderBy(value interface{}, tables []string) ([]OrderColumn, error) {
+	var items []interface{}
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		items = v
+	case []string:
+		for _, item := range v {
+			items = append(items, item)
 		}
+	default:
+		items = []interface{}{v}
+	}
 
-		if err := rows.Scan(valuePtrs...); err != nil {
+	order := make([]OrderColumn, 0, len(items))
+	for _, item := range items {
+		var column, direction string
+		switch v := item.(type) {
+		case string:
+			column = strings.TrimSpace(v)
+			if strings.HasPrefix(column, "-") {
+				column, direction = column[1:], "desc"
+			}
+		case map[string]interface{}:
+			column, _ = v["column"].(string)
+			direction, _ = v["direction"].(string)
+		default:
+			return nil, fmt.Errorf("Invalid order_by entry")
+		}
+		if column == "" {
+			return nil, fmt.Errorf("order_by entry requires a column")
+		}
+		var desc bool
+		switch strings.ToLower(direction) {
+		case "", "asc":
+		case "desc":
+			desc = true
+		default:
+			return nil, fmt.Errorf("Invalid order_by direction '%s'", direction)
+		}
+		if err := ValidateColumns(tables, []string{column}); err != nil {
 			return nil, err
 		}
+		if err := ValidateLookup(tables, []string{column}); err != nil {
+			return nil, err
+		}
+		order = append(order, OrderColumn{Column: column, Desc: desc})
+	}
+	return order, nil
+}
 
-		rowMap := map[string]interface{}{}
-		for i, col := range columns {
-			val := values[i]
-			if b, ok := val.([]byte); ok {
-				rowMap[col] = string(b)
-			} else {
-				rowMap[col] = val
+// StableOrder appends the primary key of table to order so equal sort values keep a fixed order
+func StableOrder(order []OrderColumn, table string) []OrderColumn {
+	schema := GetTableSchema(table)
+	if schema == nil {
+		return order
+	}
+	for _, key := range schema.PrimaryKey() {
+		present := false
+		for _, o := range order {
+			if o.Column == key || o.Column == table+"."+key {
+				present = true
+				break
 			}
 		}
-		results = append(results, rowMap)
+		if !present {
+			order = append(order, OrderColumn{Column: key})
+		}
 	}
+	return order
+}
 
-	return results, nil
+// GenerateOrderBy returns " ORDER BY ..." for the parsed order, empty when there is none
+func GenerateOrderBy(order []OrderColumn) string {
+	if len(order) == 0 {
+		return ""
+	}
+	parts := make([]string, len(order))
+	for i, o := range order {
+		direction := "ASC"
+		if o.Desc {
+			direction = "DESC"
+		}
+		parts[i] = EscapeId(o.Column) + " " + direction
+	}
+	return " ORDER BY " + strings.Join(parts, ", ")
 }
 
 // buildWhere generates the WHERE clause and parameter slice from conditions
@@ -176,62 +319,34 @@ func BuildWhere(condition, orCondition map[string]interface{}) (string, []interf
 
 	if len(condition) > 0 {
 		w, p := GenerateWhere(condition)
-		whereParts = append(whereParts, w)
+		whereParts = append(whereParts, "( "+w+" )")
 		params = append(params, p...)
 	}
 
 	if len(orCondition) > 0 {
 		w, p := GenerateWhereOr(orCondition)
-		whereParts = append(whereParts, w)
+		whereParts = append(whereParts, "( "+w+" )")
 		params = append(params, p...)
 	}
 
-	// Join conditions with AND
+	// Join conditions with AND, parentheses keep the OR group together
 	return strings.Join(whereParts, " AND "), params, nil
 }
 
-// scanRows converts sql.Rows into []map[string]interface{} with byte -> string conversion
-func ScanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
-	columns, err := rows.Columns()
-	if err != nil {
-		return nil, err
-	}
-
-	var results []map[string]interface{}
-	for rows.Next() {
-		columnValues := make([]interface{}, len(columns))
-		columnPointers := make([]interface{}, len(columns))
-		for i := range columnValues {
-			columnPointers[i] = &columnValues[i]
-		}
-
-		if err := rows.Scan(columnPointers...); err != nil {
-			return nil, err
-		}
-
-		rowMap := make(map[string]interface{})
-		for i, col := range columns {
-			val := columnPointers[i].(*interface{})
-			if b, ok := (*val).([]byte); ok {
-				rowMap[col] = string(b)
-			} else {
-				rowMap[col] = *val
-			}
-		}
-		results = append(results, rowMap)
-	}
-	return results, nil
-}
-
 // executeSelect runs SELECT query with params and returns results
 func ExecuteSelect(query string, params ...interface{}) map[string]interface{} {
-	rows, err := DB.Query(query, params...)
+	return ExecuteSelectWith(ScanOptions{}, query, params...)
+}
+
+// ExecuteSelectWith is ExecuteSelect with explicit scan options
+func ExecuteSelectWith(options ScanOptions, query string, params ...interface{}) map[string]interface{} {
+	rows, err := DB.Query(Rebind(query), params...)
 	if err != nil {
 		return map[string]interface{}{"success": false, "message": err.Error()}
 	}
 	defer rows.Close()
 
-	results, err := ScanRows(rows)
+	results, err := ScanRowsWith(rows, options)
 	if err != nil {
 		return map[string]interface{}{"success": false, "message": err.Error()}
 	}
@@ -240,3 +355,66 @@ func ExecuteSelect(query string, params ...interface{}) map[string]interface{} {
 	}
 	return map[string]interface{}{"success": true, "message": results}
 }
+
+// InsertRows executes a multi-row INSERT and returns the affected rows and the generated id range.
+// exactRange must be false when rows may be skipped or updated, the range is then left nil.
+func InsertRows(q Querier, query string, params []interface{}, rows int, exactRange bool) (int64, interface{}, interface{}, error) {
+	if DBDialect.Returning() {
+		result, err := q.Query(Rebind(query+" RETURNING *"), params...)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		defer result.Close()
+		inserted, err := ScanRowsWith(result, ScanOptions{Unredacted: true})
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		var first, last interface{}
+		if len(inserted) > 0 {
+			first, last = inserted[0]["id"], inserted[len(inserted)-1]["id"]
+		}
+		return int64(len(inserted)), first, last, nil
+	}
+
+	result, err := q.Exec(Rebind(query), params...)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	affected, _ := result.RowsAffected()
+	if !exactRange || affected != int64(rows) {
+		return affected, nil, nil, nil
+	}
+	if id, err := result.LastInsertId(); err == nil && id > 0 {
+		first, last := DBDialect.InsertedIDRange(id, affected)
+		return affected, first, last, nil
+	}
+	return affected, nil, nil, nil
+}
+
+// InsertReturningID runs an INSERT and returns the generated id, nil when the table has none
+func InsertReturningID(q Querier, query string, params ...interface{}) (interface{}, error) {
+	if DBDialect.Returning() {
+		rows, err := q.Query(Rebind(query+" RETURNING *"), params...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		results, err := ScanRowsWith(rows, ScanOptions{Unredacted: true})
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			return results[0]["id"], nil
+		}
+		return nil, nil
+	}
+
+	result, err := q.Exec(Rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	if id, err := result.LastInsertId(); err == nil && id > 0 {
+		return id, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,152 @@
+package helpers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB connects the package to a SQLite file of the test, the previous connection is restored afterwards
+func openTestDB(t *testing.T) {
+	t.Helper()
+	driver, name, db, dialect := DatabaseDriver, DatabaseName, DB, DBDialect
+	DatabaseDriver = "sqlite"
+	DatabaseName = filepath.Join(t.TempDir(), "test.db")
+	if res := InitDBConnection(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	t.Cleanup(func() {
+		DB.Close()
+		DatabaseDriver, DatabaseName, DB, DBDialect = driver, name, db, dialect
+	})
+}
+
+// useDialect switches DBDialect for the SQL generated by a test
+func useDialect(t *testing.T, dialect Dialect) {
+	t.Helper()
+	previous := DBDialect
+	DBDialect = dialect
+	t.Cleanup(func() { DBDialect = previous })
+}
+
+func TestDialectFor(t *testing.T) {
+	tests := map[string]string{"": "MySQL", "mariadb": "MySQL", " Postgres ": "PostgreSQL", "pgsql": "PostgreSQL", "sqlite3": "SQLite"}
+	for driver, name := range tests {
+		dialect, err := DialectFor(driver)
+		if err != nil || dialect.Name() != name {
+			t.Errorf("DialectFor(%q) = %v, %v, want %s", driver, dialect, err, name)
+		}
+	}
+	if _, err := DialectFor("oracle"); err == nil {
+		t.Errorf("DialectFor(oracle) succeeded")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT * FROM `t` WHERE a = ? AND b = '?' AND c IN (?, ?)"
+	useDialect(t, sqliteDialect{})
+	if got := Rebind(query); got != query {
+		t.Errorf("SQLite Rebind = %s", got)
+	}
+	useDialect(t, postgresDialect{})
+	if got, want := Rebind(query), "SELECT * FROM `t` WHERE a = $1 AND b = '?' AND c IN ($2, $3)"; got != want {
+		t.Errorf("PostgreSQL Rebind = %s, want %s", got, want)
+	}
+}
+
+func TestDialectSQL(t *testing.T) {
+	tests := []struct {
+		dialect      Dialect
+		escaped      string
+		ignore       [2]string
+		update       [2]string
+		changeColumn string
+	}{
+		{
+			mysqlDialect{}, "`users`.`name`",
+			[2]string{"INSERT IGNORE INTO", ""},
+			[2]string{"INSERT INTO", " ON DUPLICATE KEY UPDATE `name` = VALUES(`name`), `age` = VALUES(`age`)"},
+			"ALTER TABLE `users` CHANGE `name` full_name VARCHAR(64)",
+		},
+		{
+			postgresDialect{}, `"users"."name"`,
+			[2]string{"INSERT INTO", " ON CONFLICT DO NOTHING"},
+			[2]string{"INSERT INTO", ` ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "age" = EXCLUDED."age"`},
+			`ALTER TABLE "users" RENAME COLUMN "name" TO "full_name"`,
+		},
+		{
+			sqliteDialect{}, `"users"."name"`,
+			[2]string{"INSERT OR IGNORE INTO", ""},
+			[2]string{"INSERT INTO", ` ON CONFLICT ("id") DO UPDATE SET "name" = excluded."name", "age" = excluded."age"`},
+			`ALTER TABLE "users" RENAME COLUMN "name" TO "full_name"`,
+		},
+	}
+	for _, tt := range tests {
+		useDialect(t, tt.dialect)
+		if got := EscapeId("users.na`me"); got != tt.escaped {
+			t.Errorf("%s EscapeId = %s, want %s", tt.dialect.Name(), got, tt.escaped)
+		}
+		if verb, suffix := tt.dialect.OnConflict(true, nil, nil); verb != tt.ignore[0] || suffix != tt.ignore[1] {
+			t.Errorf("%s OnConflict ignore = %q %q, want %q %q", tt.dialect.Name(), verb, suffix, tt.ignore[0], tt.ignore[1])
+		}
+		if verb, suffix := tt.dialect.OnConflict(false, []string{"id"}, []string{"name", "age"}); verb != tt.update[0] || suffix != tt.update[1] {
+			t.Errorf("%s OnConflict update = %q %q, want %q %q", tt.dialect.Name(), verb, suffix, tt.update[0], tt.update[1])
+		}
+		definition := "full_name"
+		if _, ok := tt.dialect.(mysqlDialect); ok {
+			definition = "full_name VARCHAR(64)"
+		}
+		if got, err := tt.dialect.ChangeColumn("users", "name", definition); err != nil || got != tt.changeColumn {
+			t.Errorf("%s ChangeColumn = %s, %v, want %s", tt.dialect.Name(), got, err, tt.changeColumn)
+		}
+	}
+	useDialect(t, sqliteDialect{})
+	if _, err := (sqliteDialect{}).ChangeColumn("users", "name", "full_name VARCHAR(64)"); err == nil {
+		t.Errorf("SQLite ChangeColumn accepted a column definition")
+	}
+	if first, last := (mysqlDialect{}).InsertedIDRange(10, 3); first != 10 || last != 12 {
+		t.Errorf("MySQL InsertedIDRange(10, 3) = %d, %d", first, last)
+	}
+	if first, last := (sqliteDialect{}).InsertedIDRange(12, 3); first != 10 || last != 12 {
+		t.Errorf("SQLite InsertedIDRange(12, 3) = %d, %d", first, last)
+	}
+}
+
+func TestSQLiteOnConflict(t *testing.T) {
+	openTestDB(t)
+	if _, err := DB.Exec(`CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT, age INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec(`INSERT INTO people (id, name, age) VALUES (1, 'ann', 30)`); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := DB.Exec(`INSERT INTO people (id, name, age) VALUES (1, 'bob', 40)`)
+	if kind, _, ok := ClassifyDBError(err); !ok || kind != DBErrorDuplicate {
+		t.Errorf("ClassifyDBError(%v) = %q, %t, want %q", err, kind, ok, DBErrorDuplicate)
+	}
+
+	columns := []string{"age", "id", "name"}
+	rows := []map[string]interface{}{{"id": 1, "name": "bob", "age": 40}, {"id": 2, "name": "cid", "age": 50}}
+	values, params := GenerateInsertRows(columns, rows)
+
+	verb, suffix := DBDialect.OnConflict(true, nil, nil)
+	affected, _, _, err := InsertRows(DB, verb+" "+EscapeId("people")+" "+values+suffix, params, len(rows), false)
+	if err != nil || affected != 1 {
+		t.Fatalf("ignore insert affected %d rows, %v", affected, err)
+	}
+	var name string
+	DB.QueryRow(`SELECT name FROM people WHERE id = 1`).Scan(&name)
+	if name != "ann" {
+		t.Errorf("ignore insert changed row 1 to %s", name)
+	}
+
+	verb, suffix = DBDialect.OnConflict(false, []string{"id"}, []string{"name"})
+	if _, _, _, err := InsertRows(DB, verb+" "+EscapeId("people")+" "+values+suffix, params, len(rows), false); err != nil {
+		t.Fatal(err)
+	}
+	var age int
+	DB.QueryRow(`SELECT name, age FROM people WHERE id = 1`).Scan(&name, &age)
+	if name != "bob" || age != 30 {
+		t.Errorf("upsert left row 1 as %s, %d, want bob, 30", name, age)
+	}
+}
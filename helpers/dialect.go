@@ -0,0 +1,384 @@
+package helpers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dialect hides the SQL differences between the supported database engines
+type Dialect interface {
+	// Name is the human readable engine name used in messages
+	Name() string
+	// DriverName is the database/sql driver registered for the engine
+	DriverName() string
+	// DSN builds the connection string from the DATABASE_* environment values
+	DSN() string
+	// QuoteIdent wraps an already sanitised identifier in the engine quotes
+	QuoteIdent(identifier string) string
+	// Placeholder returns the bind parameter for the n-th (1 based) argument
+	Placeholder(n int) string
+	// CaseSensitive wraps a column expression so that comparisons are case sensitive
+	CaseSensitive(expr string) string
+	// Returning reports whether INSERT ... RETURNING must be used to read generated keys
+	Returning() bool
+	// SupportsDatabases reports whether CREATE/DROP DATABASE are available
+	SupportsDatabases() bool
+	// ListTablesQuery returns the query listing every table of the current database
+	ListTablesQuery() (string, []interface{})
+	// ListColumns returns the columns of a table in definition order
+	ListColumns(q Querier, table string) ([]ColumnInfo, error)
+	// CreateTableStatement returns the DDL that recreates the table
+	CreateTableStatement(q Querier, table string) (string, error)
+	// ChangeColumn returns the statement that renames/redefines a column
+	ChangeColumn(table, column, definition string) (string, error)
+	// OnConflict returns the INSERT verb and trailing clause that ignore conflicting rows,
+	// or update the listed columns of the row conflicting on target
+	OnConflict(ignore bool, target, update []string) (verb string, suffix string)
+	// InsertedIDRange turns LastInsertId of a multi-row INSERT into the first and last generated ids
+	InsertedIDRange(lastInsertID, rows int64) (first, last int64)
+}
+
+// Querier is satisfied by both *sql.DB and *sql.Tx
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// DBDialect is the dialect of the active connection, MySQL until InitDBConnection runs
+var DBDialect Dialect = mysqlDialect{}
+
+// Kinds of constraint violations recognised by ClassifyDBError
+const (
+	DBErrorDuplicate  = "duplicate"
+	DBErrorForeignKey = "foreign_key"
+)
+
+// DialectFor returns the dialect for a DATABASE_DRIVER value (empty means mysql)
+func DialectFor(driver string) (Dialect, error) {
+	switch strings.ToLower(strings.TrimSpace(driver)) {
+	case "", "mysql", "mariadb":
+		return mysqlDialect{}, nil
+	case "postgres", "postgresql", "pgsql":
+		return postgresDialect{}, nil
+	case "sqlite", "sqlite3":
+		return sqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DATABASE_DRIVER %q (use mysql, postgres or sqlite)", driver)
+	}
+}
+
+// Rebind rewrites the `?` placeholders of a query into the active dialect placeholders
+func Rebind(query string) string {
+	if DBDialect.Placeholder(1) == "?" {
+		return query
+	}
+	var builder strings.Builder
+	var quote rune
+	n := 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '?':
+			n++
+			builder.WriteString(DBDialect.Placeholder(n))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// ClassifyDBError maps driver specific constraint errors to a common kind.
+// ok is false when err does not come from a known driver.
+func ClassifyDBError(err error) (kind string, message string, ok bool) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1062:
+			return DBErrorDuplicate, mysqlErr.Message, true
+		case 1451, 1452:
+			return DBErrorForeignKey, mysqlErr.Message, true
+		}
+		return "", mysqlErr.Message, true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505":
+			return DBErrorDuplicate, pqErr.Message, true
+		case "23503":
+			return DBErrorForeignKey, pqErr.Message, true
+		}
+		return "", pqErr.Message, true
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return DBErrorDuplicate, sqliteErr.Error(), true
+		case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+			return DBErrorForeignKey, sqliteErr.Error(), true
+		}
+		return "", sqliteErr.Error(), true
+	}
+	return "", "", false
+}
+
+// ---------- MySQL ----------
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string       { return "MySQL" }
+func (mysqlDialect) DriverName() string { return "mysql" }
+func (mysqlDialect) DSN() string {
+	port := DatabasePort
+	if port == "" {
+		port = "3306"
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+		DatabaseUser,
+		DatabasePassword,
+		DatabaseHost,
+		port,
+		DatabaseName,
+	)
+}
+func (mysqlDialect) QuoteIdent(identifier string) string { return "`" + identifier + "`" }
+func (mysqlDialect) Placeholder(n int) string            { return "?" }
+func (mysqlDialect) CaseSensitive(expr string) string    { return "BINARY " + expr }
+func (mysqlDialect) Returning() bool                     { return false }
+func (mysqlDialect) SupportsDatabases() bool             { return true }
+func (mysqlDialect) ListTablesQuery() (string, []interface{}) {
+	return "SELECT table_name FROM information_schema.tables WHERE table_schema = ?", []interface{}{DatabaseName}
+}
+func (mysqlDialect) ListColumns(q Querier, table string) ([]ColumnInfo, error) {
+	return scanColumns(q.Query(`SELECT column_name, data_type, is_nullable = 'YES', column_key = 'PRI'
+		FROM information_schema.columns
+		WHERE table_schema = ? AND table_name = ?
+		ORDER BY ordinal_position`, DatabaseName, table))
+}
+func (d mysqlDialect) CreateTableStatement(q Querier, table string) (string, error) {
+	var tName, createStmt string
+	err := q.QueryRow(fmt.Sprintf("SHOW CREATE TABLE %s", EscapeId(table))).Scan(&tName, &createStmt)
+	return createStmt, err
+}
+func (mysqlDialect) OnConflict(ignore bool, target, update []string) (string, string) {
+	if ignore {
+		return "INSERT IGNORE INTO", ""
+	}
+	if len(update) == 0 {
+		return "INSERT INTO", ""
+	}
+	// MySQL resolves the conflicting key itself, target is not needed
+	sets := make([]string, len(update))
+	for i, column := range update {
+		sets[i] = fmt.Sprintf("%s = VALUES(%s)", EscapeId(column), EscapeId(column))
+	}
+	return "INSERT INTO", " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+// MySQL reports the id of the first row of a multi-row INSERT
+func (mysqlDialect) InsertedIDRange(lastInsertID, rows int64) (int64, int64) {
+	return lastInsertID, lastInsertID + rows - 1
+}
+
+func (mysqlDialect) ChangeColumn(table, column, definition string) (string, error) {
+	return fmt.Sprintf("ALTER TABLE %s CHANGE %s %s", EscapeId(table), EscapeId(column), definition), nil
+}
+
+// ---------- PostgreSQL ----------
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string       { return "PostgreSQL" }
+func (postgresDialect) DriverName() string { return "postgres" }
+func (postgresDialect) DSN() string {
+	port := DatabasePort
+	if port == "" {
+		port = "5432"
+	}
+	sslMode := DatabaseSSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(DatabaseUser, DatabasePassword),
+		Host:     fmt.Sprintf("%s:%s", DatabaseHost, port),
+		Path:     "/" + DatabaseName,
+		RawQuery: url.Values{"sslmode": []string{sslMode}}.Encode(),
+	}
+	return dsn.String()
+}
+func (postgresDialect) QuoteIdent(identifier string) string { return `"` + identifier + `"` }
+func (postgresDialect) Placeholder(n int) string            { return fmt.Sprintf("$%d", n) }
+func (postgresDialect) CaseSensitive(expr string) string    { return expr }
+func (postgresDialect) Returning() bool                     { return true }
+func (postgresDialect) SupportsDatabases() bool             { return true }
+func (postgresDialect) ListTablesQuery() (string, []interface{}) {
+	return "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE'", nil
+}
+func (postgresDialect) ListColumns(q Querier, table string) ([]ColumnInfo, error) {
+	return scanColumns(q.Query(`SELECT c.column_name, c.data_type, c.is_nullable = 'YES',
+		EXISTS (
+			SELECT 1 FROM information_schema.table_constraints tc
+			JOIN information_schema.key_column_usage k
+				ON k.constraint_name = tc.constraint_name AND k.table_schema = tc.table_schema
+			WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = c.table_schema
+				AND tc.table_name = c.table_name AND k.column_name = c.column_name
+		)
+		FROM information_schema.columns c
+		WHERE c.table_schema = current_schema() AND c.table_name = $1
+		ORDER BY c.ordinal_position`, table))
+}
+func (d postgresDialect) CreateTableStatement(q Querier, table string) (string, error) {
+	// PostgreSQL has no SHOW CREATE TABLE, rebuild a plain definition from information_schema
+	rows, err := q.Query(`SELECT column_name, data_type, is_nullable, COALESCE(column_default, '')
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1
+		ORDER BY ordinal_position`, table)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var colDefs []string
+	for rows.Next() {
+		var name, dataType, nullable, def string
+		if err := rows.Scan(&name, &dataType, &nullable, &def); err != nil {
+			return "", err
+		}
+		colDef := fmt.Sprintf("%s %s", EscapeId(name), dataType)
+		if def != "" {
+			colDef += " DEFAULT " + def
+		}
+		if nullable == "NO" {
+			colDef += " NOT NULL"
+		}
+		colDefs = append(colDefs, colDef)
+	}
+	if len(colDefs) == 0 {
+		return "", fmt.Errorf("table %s not found", table)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", EscapeId(table), strings.Join(colDefs, ", ")), rows.Err()
+}
+func (postgresDialect) OnConflict(ignore bool, target, update []string) (string, string) {
+	return "INSERT INTO", excludedConflict(ignore, target, update, "EXCLUDED")
+}
+
+// PostgreSQL ids are read with RETURNING, LastInsertId is not supported
+func (postgresDialect) InsertedIDRange(lastInsertID, rows int64) (int64, int64) {
+	return 0, 0
+}
+
+func (postgresDialect) ChangeColumn(table, column, definition string) (string, error) {
+	return renameColumn(table, column, definition)
+}
+
+// ---------- SQLite ----------
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string       { return "SQLite" }
+func (sqliteDialect) DriverName() string { return "sqlite" }
+func (sqliteDialect) DSN() string {
+	// DATABASE_NAME is the database file path, ":memory:" is accepted as well
+	return fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", DatabaseName)
+}
+func (sqliteDialect) QuoteIdent(identifier string) string { return `"` + identifier + `"` }
+func (sqliteDialect) Placeholder(n int) string            { return "?" }
+func (sqliteDialect) CaseSensitive(expr string) string    { return expr }
+func (sqliteDialect) Returning() bool                     { return false }
+func (sqliteDialect) SupportsDatabases() bool             { return false }
+func (sqliteDialect) ListTablesQuery() (string, []interface{}) {
+	return "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'", nil
+}
+func (sqliteDialect) ListColumns(q Querier, table string) ([]ColumnInfo, error) {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s)", EscapeId(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []ColumnInfo
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, dataType string
+		var def sql.NullString
+		if err := rows.Scan(&cid, &name, &dataType, &notNull, &def, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, ColumnInfo{Name: name, DataType: strings.ToLower(dataType), Nullable: notNull == 0, PrimaryKey: pk > 0})
+	}
+	return columns, rows.Err()
+}
+func (sqliteDialect) CreateTableStatement(q Querier, table string) (string, error) {
+	var createStmt string
+	err := q.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&createStmt)
+	return createStmt, err
+}
+func (sqliteDialect) OnConflict(ignore bool, target, update []string) (string, string) {
+	if ignore {
+		return "INSERT OR IGNORE INTO", ""
+	}
+	return "INSERT INTO", excludedConflict(ignore, target, update, "excluded")
+}
+
+// SQLite reports the id of the last row of a multi-row INSERT
+func (sqliteDialect) InsertedIDRange(lastInsertID, rows int64) (int64, int64) {
+	return lastInsertID - rows + 1, lastInsertID
+}
+
+func (sqliteDialect) ChangeColumn(table, column, definition string) (string, error) {
+	return renameColumn(table, column, definition)
+}
+
+// scanColumns reads (name, type, nullable, primary key) rows
+func scanColumns(rows *sql.Rows, err error) ([]ColumnInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []ColumnInfo
+	for rows.Next() {
+		var column ColumnInfo
+		if err := rows.Scan(&column.Name, &column.DataType, &column.Nullable, &column.PrimaryKey); err != nil {
+			return nil, err
+		}
+		column.DataType = strings.ToLower(column.DataType)
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// excludedConflict builds the ON CONFLICT clause shared by PostgreSQL and SQLite
+func excludedConflict(ignore bool, target, update []string, excluded string) string {
+	if ignore {
+		return " ON CONFLICT DO NOTHING"
+	}
+	if len(update) == 0 {
+		return ""
+	}
+	sets := make([]string, len(update))
+	for i, column := range update {
+		sets[i] = fmt.Sprintf("%s = %s.%s", EscapeId(column), excluded, EscapeId(column))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(EscapeIds(target), ", "), strings.Join(sets, ", "))
+}
+
+// renameColumn is used by engines without CHANGE COLUMN, only a new name is accepted
+func renameColumn(table, column, newName string) (string, error) {
+	if strings.ContainsAny(strings.TrimSpace(newName), " \t\n(") {
+		return "", fmt.Errorf("%s only supports renaming a column, newColumn must be a column name", DBDialect.Name())
+	}
+	return fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", EscapeId(table), EscapeId(column), EscapeId(newName)), nil
+}
@@ -0,0 +1,191 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// envelopeVersion prefixes AES-GCM payloads: "v2:<kid>:<base64(nonce | ciphertext | tag)>".
+// Payloads without the prefix are the original AES-CBC format with the static IV.
+const envelopeVersion = "v2"
+
+// defaultEncryptionKeyID names EncryptionKey in the keyring
+const defaultEncryptionKeyID = "default"
+
+// encryptionKeyring returns the payload keys by id and the id new payloads are sealed with.
+// EncryptionKeys lists "kid=key" pairs separated by commas, EncryptionKey is kept as "default"
+// so payloads of clients not rotated yet still open.
+func encryptionKeyring() (map[string][]byte, string, error) {
+	keys := map[string][]byte{}
+	active := EncryptionKeyId
+	for _, entry := range strings.Split(EncryptionKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, key, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || strings.Contains(kid, ":") || strings.HasPrefix(kid, sessionKeyPrefix) {
+			return nil, "", fmt.Errorf("invalid EncryptionKeys entry %q, expected kid=key", entry)
+		}
+		keys[kid] = []byte(key)
+		if active == "" {
+			active = kid
+		}
+	}
+	if _, ok := keys[defaultEncryptionKeyID]; !ok && EncryptionKey != "" {
+		keys[defaultEncryptionKeyID] = []byte(EncryptionKey)
+	}
+	if active == "" {
+		active = defaultEncryptionKeyID
+	}
+	for kid, key := range keys {
+		if !(len(key) == 16 || len(key) == 24 || len(key) == 32) {
+			return nil, "", fmt.Errorf("invalid length (%d) of encryption key %s, AES requires 16, 24 or 32 bytes", len(key), kid)
+		}
+	}
+	if _, ok := keys[active]; !ok {
+		return nil, "", fmt.Errorf("encryption key %q is not configured", active)
+	}
+	return keys, active, nil
+}
+
+// errLegacyPayload is the only error an AES-CBC payload gets once it is decrypted, telling bad padding
+// from bad JSON apart would make the format a padding oracle
+var errLegacyPayload = fmt.Errorf("payload could not be decrypted")
+
+// sealEnvelope encrypts a payload with the active key and a random nonce, always as a v2 envelope
+func sealEnvelope(plaintext []byte) (string, error) {
+	keys, active, err := encryptionKeyring()
+	if err != nil {
+		return "", err
+	}
+	return sealWith(active, keys[active], plaintext)
+}
+
+// sealWith builds a v2 envelope of the key named kid
+func sealWith(kid string, key, plaintext []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	header := envelopeVersion + ":" + kid
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(header))
+	return header + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openEnvelope decrypts and authenticates a v2 payload, or decodes a CBC payload while
+// EncryptionRejectLegacy is off. CBC payloads must hold JSON.
+func openEnvelope(encrypted string) ([]byte, error) {
+	keys, _, err := encryptionKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(encrypted, envelopeVersion+":") {
+		if EncryptionRejectLegacy {
+			return nil, fmt.Errorf("unsupported payload format, %s envelopes are required", envelopeVersion)
+		}
+		plaintext, err := openCBC(keys[defaultEncryptionKeyID], encrypted)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(plaintext) {
+			return nil, errLegacyPayload
+		}
+		return plaintext, nil
+	}
+	parts := strings.SplitN(encrypted, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed %s envelope", envelopeVersion)
+	}
+	key, ok := keys[parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", parts[1])
+	}
+	return openWith(key, encrypted)
+}
+
+// openWith opens a v2 envelope with the key of its kid, looked up by the caller
+func openWith(key []byte, encrypted string) ([]byte, error) {
+	parts := strings.SplitN(encrypted, ":", 3)
+	if len(parts) != 3 || parts[0] != envelopeVersion {
+		return nil, fmt.Errorf("malformed %s envelope", envelopeVersion)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Base64 decode error: %v", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%s envelope is too short", envelopeVersion)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(parts[0]+":"+parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("payload authentication failed")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AES error: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// cbcIV is the static IV of the AES-CBC format
+func cbcIV() ([]byte, error) {
+	iv := []byte(EncryptionInitializatin)
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid initialization vector (IV) configuration")
+	}
+	return iv, nil
+}
+
+// openCBC decodes the original AES-CBC format (PKCS7 padded, static IV, no MAC), it is only read, never
+// written. Every PKCS7 padding byte is checked.
+func openCBC(key []byte, encrypted string) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("invalid encryption key configuration")
+	}
+	iv, err := cbcIV()
+	if err != nil {
+		return nil, err
+	}
+	cipherBytes, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("Base64 decode error: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AES error: %v", err)
+	}
+	if len(cipherBytes) == 0 || len(cipherBytes)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
+	}
+	plaintext := make([]byte, len(cipherBytes))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, cipherBytes)
+
+	length := len(plaintext)
+	padLen := int(plaintext[length-1])
+	if padLen <= 0 || padLen > block.BlockSize() ||
+		subtle.ConstantTimeCompare(plaintext[length-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) != 1 {
+		return nil, errLegacyPayload
+	}
+	return plaintext[:length-padLen], nil
+}
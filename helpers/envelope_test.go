@@ -0,0 +1,106 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// legacyPayload encrypts plaintext the way clients of the AES-CBC format do
+func legacyPayload(t *testing.T, key string, plaintext []byte) string {
+	t.Helper()
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, []byte(EncryptionInitializatin)).CryptBlocks(padded, padded)
+	return base64.StdEncoding.EncodeToString(padded)
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	useEncryption(t, false)
+	message := map[string]interface{}{"message": map[string]interface{}{"table": "users"}}
+
+	// Equal payloads never produce equal ciphertexts
+	first, _ := Encript(message)["encrypted"].(string)
+	second, _ := Encript(message)["encrypted"].(string)
+	if !strings.HasPrefix(first, envelopeVersion+":"+defaultEncryptionKeyID+":") || first == second {
+		t.Fatalf("Encript = %q and %q, want distinct v2 envelopes", first, second)
+	}
+	opened := Decript(map[string]interface{}{"encrypted": first})
+	if !opened["success"].(bool) || opened["message"].(map[string]interface{})["table"] != "users" {
+		t.Fatalf("Decript = %v", opened)
+	}
+
+	// Any change to the ciphertext or its header is detected
+	sealed, _ := base64.StdEncoding.DecodeString(strings.SplitN(first, ":", 3)[2])
+	sealed[len(sealed)-1] ^= 1
+	for _, tampered := range []string{
+		envelopeVersion + ":" + defaultEncryptionKeyID + ":" + base64.StdEncoding.EncodeToString(sealed),
+		strings.Replace(first, defaultEncryptionKeyID, "other", 1),
+		envelopeVersion + ":" + defaultEncryptionKeyID + ":AAAA",
+	} {
+		if res := Decript(map[string]interface{}{"encrypted": tampered}); res["success"].(bool) {
+			t.Errorf("Decript accepted the tampered payload %q", tampered)
+		}
+	}
+}
+
+func TestEnvelopeKeyRotation(t *testing.T) {
+	useEncryption(t, false)
+	EncryptionKeys = "k1=aaaaaaaaaaaaaaaa"
+	old, _ := Encript(map[string]interface{}{"message": []interface{}{1}})["encrypted"].(string)
+	if !strings.HasPrefix(old, envelopeVersion+":k1:") {
+		t.Fatalf("Encript = %q, want it sealed with k1", old)
+	}
+
+	// The new key seals, the old key still opens until it is removed
+	EncryptionKeys, EncryptionKeyId = "k1=aaaaaaaaaaaaaaaa,k2=bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "k2"
+	if current, _ := Encript(map[string]interface{}{"message": []interface{}{1}})["encrypted"].(string); !strings.HasPrefix(current, envelopeVersion+":k2:") {
+		t.Errorf("Encript after the rotation = %q, want it sealed with k2", current)
+	}
+	if res := Decript(map[string]interface{}{"encrypted": old}); !res["success"].(bool) {
+		t.Errorf("Decript of a k1 payload during the rotation = %v", res)
+	}
+	EncryptionKeys = "k2=bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	if res := Decript(map[string]interface{}{"encrypted": old}); res["success"].(bool) {
+		t.Errorf("Decript opened a payload of a removed key")
+	}
+
+	for _, keys := range []string{"k1", "k1=short", "sess:x=aaaaaaaaaaaaaaaa"} {
+		EncryptionKeys, EncryptionKeyId = keys, ""
+		if _, _, err := encryptionKeyring(); err == nil {
+			t.Errorf("encryptionKeyring accepted EncryptionKeys %q", keys)
+		}
+	}
+}
+
+func TestLegacyPayload(t *testing.T) {
+	useEncryption(t, false)
+	iv, reject := EncryptionInitializatin, EncryptionRejectLegacy
+	EncryptionInitializatin = "fedcba9876543210"
+	t.Cleanup(func() { EncryptionInitializatin, EncryptionRejectLegacy = iv, reject })
+
+	legacy := legacyPayload(t, EncryptionKey, []byte(`{"user_name":"joe"}`))
+	if res := Decript(map[string]interface{}{"encrypted": legacy}); !res["success"].(bool) || res["message"].(map[string]interface{})["user_name"] != "joe" {
+		t.Fatalf("Decript of a CBC payload = %v", res)
+	}
+	// Bad padding and bad JSON give the same error
+	for _, payload := range []string{
+		legacyPayload(t, EncryptionKey, []byte(`not json`)),
+		legacyPayload(t, "aaaaaaaaaaaaaaaa", []byte(`{"user_name":"joe"}`)),
+	} {
+		if _, err := openEnvelope(payload); err != errLegacyPayload {
+			t.Errorf("openEnvelope of a bad CBC payload = %v, want %v", err, errLegacyPayload)
+		}
+	}
+	EncryptionRejectLegacy = true
+	if res := Decript(map[string]interface{}{"encrypted": legacy}); res["success"].(bool) {
+		t.Errorf("EncryptionRejectLegacy accepted a CBC payload")
+	}
+}
@@ -0,0 +1,260 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxFilterDepth limits how deeply and/or groups may be nested
+const maxFilterDepth = 16
+
+// GenerateFilter compiles the JSON filter grammar into a parameterized WHERE expression.
+//
+//	{"and": [
+//	    {"column": "age", "op": "gte", "value": 18},
+//	    {"or": [
+//	        {"column": "name", "op": "starts_with", "value": "jo", "case_insensitive": true},
+//	        {"column": "deleted_at", "op": "is_null"}
+//	    ]}
+//	]}
+//
+// Supported ops: eq, ne, gt, gte, lt, lte, in, not_in, like, starts_with, is_null, between.
+// A top level array is treated as an "and" group. Columns are checked against tables when given.
+func GenerateFilter(filter interface{}, tables []string) (string, []interface{}, error) {
+	return compileFilter(filter, tableColumns(tables), 0)
+}
+
+// GenerateHaving compiles the filter grammar for a HAVING clause.
+// columns maps every name the filter may use (aggregate aliases, group columns) to its SQL expression.
+func GenerateHaving(filter interface{}, columns map[string]string) (string, []interface{}, error) {
+	return compileFilter(filter, func(column string) (string, error) {
+		expr, ok := columns[column]
+		if !ok {
+			return "", fmt.Errorf("Unknown having column '%s'", column)
+		}
+		return expr, nil
+	}, 0)
+}
+
+// filterColumn turns a filter column name into its SQL expression
+type filterColumn func(column string) (string, error)
+
+// tableColumns resolves filter columns as table columns, validated when tables is not nil.
+// Redacted columns are always rejected.
+func tableColumns(tables []string) filterColumn {
+	return func(column string) (string, error) {
+		if tables != nil {
+			if err := ValidateColumns(tables, []string{column}); err != nil {
+				return "", err
+			}
+		}
+		if err := ValidateLookup(tables, []string{column}); err != nil {
+			return "", err
+		}
+		return EscapeId(column), nil
+	}
+}
+
+// AppendFilter ANDs the compiled filter to an existing WHERE clause, a nil filter changes nothing
+func AppendFilter(whereClause string, params []interface{}, filter interface{}, tables []string) (string, []interface{}, error) {
+	if filter == nil {
+		return whereClause, params, nil
+	}
+	filterClause, filterParams, err := GenerateFilter(filter, tables)
+	if err != nil {
+		return "", nil, err
+	}
+	if whereClause == "" || whereClause == "1=1" {
+		return filterClause, filterParams, nil
+	}
+	return fmt.Sprintf("( %s ) AND ( %s )", whereClause, filterClause), append(params, filterParams...), nil
+}
+
+// BuildFilteredWhere combines condition, or_condition and filter, at least one of them is required
+func BuildFilteredWhere(condition, orCondition map[string]interface{}, filter interface{}, tables []string) (string, []interface{}, error) {
+	if len(condition) == 0 && len(orCondition) == 0 {
+		if filter == nil {
+			return "", nil, fmt.Errorf("Missing condition(s)")
+		}
+		return GenerateFilter(filter, tables)
+	}
+	whereClause, params, err := BuildWhere(condition, orCondition)
+	if err != nil {
+		return "", nil, err
+	}
+	return AppendFilter(whereClause, params, filter, tables)
+}
+
+func compileFilter(filter interface{}, resolve filterColumn, depth int) (string, []interface{}, error) {
+	if depth > maxFilterDepth {
+		return "", nil, fmt.Errorf("filter is nested too deeply (max %d levels)", maxFilterDepth)
+	}
+	switch node := filter.(type) {
+	case []interface{}:
+		return compileFilterGroup(node, " AND ", resolve, depth)
+	case map[string]interface{}:
+		if group, ok := node["and"]; ok {
+			items, ok := group.([]interface{})
+			if !ok {
+				return "", nil, fmt.Errorf("filter 'and' must be an array")
+			}
+			return compileFilterGroup(items, " AND ", resolve, depth)
+		}
+		if group, ok := node["or"]; ok {
+			items, ok := group.([]interface{})
+			if !ok {
+				return "", nil, fmt.Errorf("filter 'or' must be an array")
+			}
+			return compileFilterGroup(items, " OR ", resolve, depth)
+		}
+		return compileFilterCondition(node, resolve)
+	default:
+		return "", nil, fmt.Errorf("filter must be an object or an array")
+	}
+}
+
+func compileFilterGroup(items []interface{}, separator string, resolve filterColumn, depth int) (string, []interface{}, error) {
+	if len(items) == 0 {
+		return "", nil, fmt.Errorf("filter group can't be empty")
+	}
+	var parts []string
+	var params []interface{}
+	for _, item := range items {
+		clause, p, err := compileFilter(item, resolve, depth+1)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, "( "+clause+" )")
+		params = append(params, p...)
+	}
+	return strings.Join(parts, separator), params, nil
+}
+
+func compileFilterCondition(node map[string]interface{}, resolve filterColumn) (string, []interface{}, error) {
+	column, ok := node["column"].(string)
+	if !ok || column == "" {
+		return "", nil, fmt.Errorf("filter condition requires a 'column'")
+	}
+	col, err := resolve(column)
+	if err != nil {
+		return "", nil, err
+	}
+	op, _ := node["op"].(string)
+	if op == "" {
+		op = "eq"
+	}
+	value, hasValue := node["value"]
+	caseInsensitive, _ := node["case_insensitive"].(bool)
+
+	// left wraps the column and right the placeholder for string comparisons
+	left := func(v interface{}) string {
+		if _, isString := v.(string); !isString {
+			return col
+		}
+		if caseInsensitive {
+			return "LOWER(" + col + ")"
+		}
+		return DBDialect.CaseSensitive(col)
+	}
+	right := func(v interface{}) string {
+		if _, isString := v.(string); isString && caseInsensitive {
+			return "LOWER(?)"
+		}
+		return "?"
+	}
+
+	switch op {
+	case "eq", "ne":
+		if !hasValue {
+			return "", nil, fmt.Errorf("filter op '%s' on '%s' requires a value", op, column)
+		}
+		if value == nil {
+			if op == "eq" {
+				return col + " IS NULL", nil, nil
+			}
+			return col + " IS NOT NULL", nil, nil
+		}
+		operator := "="
+		if op == "ne" {
+			operator = "<>"
+		}
+		return fmt.Sprintf("%s %s %s", left(value), operator, right(value)), []interface{}{value}, nil
+
+	case "gt", "gte", "lt", "lte":
+		if !hasValue || value == nil {
+			return "", nil, fmt.Errorf("filter op '%s' on '%s' requires a value", op, column)
+		}
+		operator := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}[op]
+		if caseInsensitive {
+			return fmt.Sprintf("%s %s %s", left(value), operator, right(value)), []interface{}{value}, nil
+		}
+		return fmt.Sprintf("%s %s ?", col, operator), []interface{}{value}, nil
+
+	case "in", "not_in":
+		values, ok := value.([]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("filter op '%s' on '%s' requires an array value", op, column)
+		}
+		if len(values) == 0 {
+			// Nothing is IN an empty list, everything is NOT IN it
+			if op == "in" {
+				return "1=0", nil, nil
+			}
+			return "1=1", nil, nil
+		}
+		allStrings := true
+		for _, v := range values {
+			if _, isString := v.(string); !isString {
+				allStrings = false
+			}
+		}
+		lhs := col
+		placeholders := make([]string, len(values))
+		for i := range values {
+			placeholders[i] = "?"
+		}
+		if allStrings {
+			lhs = left(values[0])
+			for i := range values {
+				placeholders[i] = right(values[0])
+			}
+		}
+		operator := "IN"
+		if op == "not_in" {
+			operator = "NOT IN"
+		}
+		return fmt.Sprintf("%s %s (%s)", lhs, operator, strings.Join(placeholders, ", ")), values, nil
+
+	case "like", "starts_with":
+		pattern, ok := value.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("filter op '%s' on '%s' requires a string value", op, column)
+		}
+		if op == "like" {
+			return fmt.Sprintf("%s LIKE %s", left(pattern), right(pattern)), []interface{}{pattern}, nil
+		}
+		// '!' is used as escape character because backslash handling differs between engines
+		escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(pattern) + "%"
+		return fmt.Sprintf("%s LIKE %s ESCAPE '!'", left(pattern), right(pattern)), []interface{}{escaped}, nil
+
+	case "is_null":
+		isNull := true
+		if b, ok := value.(bool); ok {
+			isNull = b
+		}
+		if isNull {
+			return col + " IS NULL", nil, nil
+		}
+		return col + " IS NOT NULL", nil, nil
+
+	case "between":
+		bounds, ok := value.([]interface{})
+		if !ok || len(bounds) != 2 || bounds[0] == nil || bounds[1] == nil {
+			return "", nil, fmt.Errorf("filter op 'between' on '%s' requires a [from, to] value", column)
+		}
+		return fmt.Sprintf("%s BETWEEN ? AND ?", col), bounds, nil
+
+	default:
+		return "", nil, fmt.Errorf("unsupported filter op '%s'", op)
+	}
+}
@@ -0,0 +1,124 @@
+package helpers
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// filterJSON decodes a filter the way request bodies are decoded
+func filterJSON(t *testing.T, content string) interface{} {
+	t.Helper()
+	var filter interface{}
+	if err := json.Unmarshal([]byte(content), &filter); err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestGenerateFilter(t *testing.T) {
+	useDialect(t, sqliteDialect{})
+	tests := []struct {
+		filter string
+		clause string
+		params []interface{}
+	}{
+		{`{"column": "age", "op": "gte", "value": 18}`, `"age" >= ?`, []interface{}{18.0}},
+		{`{"column": "name", "value": "jo"}`, `"name" = ?`, []interface{}{"jo"}},
+		{`{"column": "name", "op": "ne", "value": null}`, `"name" IS NOT NULL`, nil},
+		{`{"column": "name", "op": "eq", "value": "Jo", "case_insensitive": true}`, `LOWER("name") = LOWER(?)`, []interface{}{"Jo"}},
+		{`{"column": "age", "op": "in", "value": [1, 2]}`, `"age" IN (?, ?)`, []interface{}{1.0, 2.0}},
+		{`{"column": "age", "op": "in", "value": []}`, `1=0`, nil},
+		{`{"column": "age", "op": "not_in", "value": []}`, `1=1`, nil},
+		{`{"column": "name", "op": "starts_with", "value": "5%_!"}`, `"name" LIKE ? ESCAPE '!'`, []interface{}{"5!%!_!!%"}},
+		{`{"column": "deleted_at", "op": "is_null", "value": false}`, `"deleted_at" IS NOT NULL`, nil},
+		{`{"column": "age", "op": "between", "value": [1, 9]}`, `"age" BETWEEN ? AND ?`, []interface{}{1.0, 9.0}},
+		{
+			`{"and": [{"column": "age", "op": "gt", "value": 1}, {"or": [{"column": "name", "value": "a"}, {"column": "name", "value": "b"}]}]}`,
+			`( "age" > ? ) AND ( ( "name" = ? ) OR ( "name" = ? ) )`, []interface{}{1.0, "a", "b"},
+		},
+		{`[{"column": "age", "op": "lt", "value": 5}, {"column": "age", "op": "gt", "value": 1}]`, `( "age" < ? ) AND ( "age" > ? )`, []interface{}{5.0, 1.0}},
+	}
+	for _, tt := range tests {
+		clause, params, err := GenerateFilter(filterJSON(t, tt.filter), nil)
+		if err != nil {
+			t.Errorf("GenerateFilter(%s): %v", tt.filter, err)
+			continue
+		}
+		if clause != tt.clause || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("GenerateFilter(%s) = %s %v, want %s %v", tt.filter, clause, params, tt.clause, tt.params)
+		}
+	}
+}
+
+func TestGenerateFilterErrors(t *testing.T) {
+	useDialect(t, sqliteDialect{})
+	tests := []string{
+		`"age"`,
+		`{"and": {}}`,
+		`{"or": []}`,
+		`{"op": "eq", "value": 1}`,
+		`{"column": "age", "op": "gt"}`,
+		`{"column": "age", "op": "in", "value": 1}`,
+		`{"column": "age", "op": "between", "value": [1]}`,
+		`{"column": "age", "op": "regexp", "value": "."}`,
+		`{"column": "password", "value": "secret"}`,
+		`{"column": "age", "op": "like", "value": 1}`,
+		`{"and": [` + strings.Repeat(`{"and": [`, maxFilterDepth) + `{"column": "age", "value": 1}` + strings.Repeat(`]}`, maxFilterDepth) + `]}`,
+	}
+	for _, filter := range tests {
+		if clause, _, err := GenerateFilter(filterJSON(t, filter), nil); err == nil {
+			t.Errorf("GenerateFilter(%s) = %s, want an error", filter, clause)
+		}
+	}
+}
+
+func TestFilterOnSQLite(t *testing.T) {
+	openTestDB(t)
+	for _, statement := range []string{
+		`CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT, age INTEGER, deleted_at TEXT)`,
+		`INSERT INTO people (id, name, age, deleted_at) VALUES (1, 'John', 17, NULL), (2, 'joan', 30, NULL), (3, 'Mary', 45, '2024-01-01'), (4, 'jo_x', 60, NULL)`,
+	} {
+		if _, err := DB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res := LoadSchema(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	tests := []struct {
+		filter string
+		ids    []int
+	}{
+		{`{"column": "name", "op": "starts_with", "value": "jo", "case_insensitive": true}`, []int{1, 2, 4}},
+		{`{"column": "name", "op": "starts_with", "value": "jo_"}`, []int{4}},
+		{`{"column": "name", "op": "eq", "value": "john"}`, nil},
+		{`{"and": [{"column": "age", "op": "gte", "value": 18}, {"column": "deleted_at", "op": "is_null"}]}`, []int{2, 4}},
+		{`{"or": [{"column": "age", "op": "between", "value": [40, 50]}, {"column": "id", "op": "in", "value": [1]}]}`, []int{1, 3}},
+		{`{"column": "id", "op": "not_in", "value": [1, 2]}`, []int{3, 4}},
+	}
+	for _, tt := range tests {
+		clause, params, err := GenerateFilter(filterJSON(t, tt.filter), []string{"people"})
+		if err != nil {
+			t.Fatalf("GenerateFilter(%s): %v", tt.filter, err)
+		}
+		rows, err := DB.Query(Rebind("SELECT id FROM people WHERE "+clause+" ORDER BY id"), params...)
+		if err != nil {
+			t.Fatalf("%s: %v", clause, err)
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			rows.Scan(&id)
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("filter %s selected %v, want %v", tt.filter, ids, tt.ids)
+		}
+	}
+	if _, _, err := GenerateFilter(filterJSON(t, `{"column": "email", "value": "x"}`), []string{"people"}); err == nil {
+		t.Errorf("GenerateFilter accepted an unknown column")
+	}
+}
@@ -3,9 +3,6 @@ package helpers
 import (
 	"bytes"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -28,33 +25,60 @@ import (
 )
 
 var (
-	ServerSecurity          string
-	ServerDomain            string
-	ServerPort              int
-	ServerEnvironment       string
-	SslCertificate          string
-	SslKey                  string
-	DatabaseHost            string
-	DatabaseUser            string
-	DatabasePassword        string
-	DatabaseName            string
-	DatabasePort            string
-	Mailsender              string
-	Mailhost                string
-	Mailusername            string
-	Mailpassword            string
-	Mailport                int
-	SmsUserName             string
-	SmsApiKey               string
-	SmsSenderId             string
-	JwtKey                  string
-	EnableEncripted         bool
-	EncryptionKey           string
-	EncryptionAlgorithm     string
-	EncryptionInitializatin string
-	// encryptionKey and initializationVector are the binary forms used by crypto
-	EncryptionKey_Byte        []byte
-	initializationVector_Byte []byte
+	ServerSecurity           string
+	ServerDomain             string
+	ServerPort               int
+	ServerEnvironment        string
+	SslCertificate           string
+	SslKey                   string
+	DatabaseDriver           string
+	DatabaseHost             string
+	DatabaseUser             string
+	DatabasePassword         string
+	DatabaseName             string
+	DatabasePort             string
+	DatabaseSSLMode          string
+	SchemaConfigPath         string
+	BulkBatchSize            int
+	PasswordHash             string
+	AuthTable                string
+	AuthUsernameColumn       string
+	AuthPasswordColumn       string
+	AuthRoleColumn           string
+	PolicyConfigPath         string
+	TenantClaim              string
+	Mailsender               string
+	Mailhost                 string
+	Mailusername             string
+	Mailpassword             string
+	Mailport                 int
+	SmsUserName              string
+	SmsApiKey                string
+	SmsSenderId              string
+	JwtKey                   string
+	JwtAlgorithm             string
+	JwtKeysDir               string
+	JwtRotationHours         int
+	AccessTokenTTL           int
+	RefreshTokenTTL          int
+	TokenStoreName           string
+	TwoFactorIssuer          string
+	TwoFactorTTL             int
+	OTPStoreName             string
+	OTPTTL                   int
+	OTPMaxAttempts           int
+	OTPResendCooldown        int
+	EnableEncripted          bool
+	EncryptionKey            string
+	EncryptionAlgorithm      string
+	EncryptionInitializatin  string
+	EncryptionKeys           string
+	EncryptionKeyId          string
+	EncryptionRejectLegacy   bool
+	EncryptionRequireSession bool
+	VendingKey               string
+	STSVendingKey            string
+	STSBaseYear              int
 )
 
 func UpdateEnvVars() {
@@ -64,11 +88,22 @@ func UpdateEnvVars() {
 	ServerPort = getEnvValue("PORT", 2010).(int)
 	SslCertificate = getEnvValue("SSL_CERTIFICATE", "").(string)
 	SslKey = getEnvValue("SSL_KEY", "").(string)
+	DatabaseDriver = getEnvValue("DATABASE_DRIVER", "mysql").(string)
 	DatabaseHost = getEnvValue("DATABASE_HOST", "localhost").(string)
 	DatabaseUser = getEnvValue("DATABASE_USER", "root").(string)
 	DatabasePassword = getEnvValue("DATABASE_PASSWORD", "").(string)
 	DatabaseName = getEnvValue("DATABASE_NAME", "trick").(string)
 	DatabasePort = getEnvValue("DATABASE_PORT", "3306").(string)
+	DatabaseSSLMode = getEnvValue("DATABASE_SSLMODE", "disable").(string)
+	SchemaConfigPath = getEnvValue("SCHEMA_CONFIG", "configurations/schema.json").(string)
+	BulkBatchSize = getEnvValue("BULK_BATCH_SIZE", 500).(int)
+	PasswordHash = getEnvValue("PASSWORD_HASH", "argon2id").(string)
+	AuthTable = getEnvValue("AUTH_TABLE", "users").(string)
+	AuthUsernameColumn = getEnvValue("AUTH_USERNAME_COLUMN", "user_name").(string)
+	AuthPasswordColumn = getEnvValue("AUTH_PASSWORD_COLUMN", "password").(string)
+	AuthRoleColumn = getEnvValue("AUTH_ROLE_COLUMN", "role").(string)
+	PolicyConfigPath = getEnvValue("POLICY_CONFIG", "configurations/policy.json").(string)
+	TenantClaim = getEnvValue("TENANT_CLAIM", "org_id").(string)
 	Mailsender = getEnvValue("MAIL_SENDER", "noreply@example.com").(string)
 	Mailhost = getEnvValue("MAIL_HOST", "smtp.example.com").(string)
 	Mailusername = getEnvValue("MAIL_ADDRESS", "noreply@example.com").(string)
@@ -78,10 +113,29 @@ func UpdateEnvVars() {
 	SmsApiKey = getEnvValue("SMS_API_KEY", "").(string)
 	SmsSenderId = getEnvValue("SMS_SENDER_ID", "").(string)
 	JwtKey = getEnvValue("JWT_KEY", "").(string)
+	JwtAlgorithm = getEnvValue("JWT_ALGORITHM", "HS256").(string)
+	JwtKeysDir = getEnvValue("JWT_KEYS_DIR", "configurations/jwt").(string)
+	JwtRotationHours = getEnvValue("JWT_ROTATION_HOURS", 0).(int)
+	AccessTokenTTL = getEnvValue("ACCESS_TOKEN_TTL", 15).(int)
+	RefreshTokenTTL = getEnvValue("REFRESH_TOKEN_TTL", 720).(int)
+	TokenStoreName = getEnvValue("TOKEN_STORE", "database").(string)
+	TwoFactorIssuer = getEnvValue("TWO_FACTOR_ISSUER", "go_backend_api").(string)
+	TwoFactorTTL = getEnvValue("TWO_FACTOR_TTL", 5).(int)
+	OTPStoreName = getEnvValue("OTP_STORE", "database").(string)
+	OTPTTL = getEnvValue("OTP_TTL", 10).(int)
+	OTPMaxAttempts = getEnvValue("OTP_MAX_ATTEMPTS", 5).(int)
+	OTPResendCooldown = getEnvValue("OTP_RESEND_COOLDOWN", 60).(int)
 	EnableEncripted = getEnvValue("EnableEncripted", false).(bool)
 	EncryptionKey = (getEnvValue("EncryptionKey", "1234567890123456").(string))
-	EncryptionAlgorithm = (getEnvValue("EncryptionAlgorithm", "aes-128-cbc").(string))
+	EncryptionAlgorithm = (getEnvValue("EncryptionAlgorithm", "aes-gcm").(string))
 	EncryptionInitializatin = (getEnvValue("EncryptionInitializatin", "2d52550dc714656b").(string))
+	EncryptionKeys = getEnvValue("EncryptionKeys", "").(string)
+	EncryptionKeyId = getEnvValue("EncryptionKeyId", "").(string)
+	EncryptionRejectLegacy = getEnvValue("EncryptionRejectLegacy", false).(bool)
+	EncryptionRequireSession = getEnvValue("EncryptionRequireSession", false).(bool)
+	VendingKey = getEnvValue("VENDING_KEY", "").(string)
+	STSVendingKey = getEnvValue("STS_VENDING_KEY", "").(string)
+	STSBaseYear = getEnvValue("STS_BASE_YEAR", 2014).(int)
 }
 
 func getEnvValue(key string, fallback interface{}) interface{} {
@@ -223,6 +277,7 @@ func StartServer(router *gin.Engine) map[string]interface{} {
 
 // --- AES helpers ---
 // Encript encrypts either a single JSON object or a JSON array in data["message"]
+// into a v2 AES-GCM envelope (see sealEnvelope)
 func Encript(data map[string]interface{}) map[string]interface{} {
 	message, ok := data["message"]
 	if !ok {
@@ -256,57 +311,20 @@ func Encript(data map[string]interface{}) map[string]interface{} {
 		return data
 	}
 
-	// Prepare key and IV
-	if EncryptionKey != "" {
-		EncryptionKey_Byte = []byte(EncryptionKey)
-		if !(len(EncryptionKey_Byte) == 16 || len(EncryptionKey_Byte) == 24 || len(EncryptionKey_Byte) == 32) {
-			LogJSON(false, fmt.Sprintf("Invalid EncryptionKey length (%d). AES requires 16, 24 or 32 bytes.", len(EncryptionKey_Byte)))
-		}
-	} else {
-		EncryptionKey_Byte = nil
-	}
-
-	if EncryptionKey_Byte == nil || !(len(EncryptionKey_Byte) == 16 || len(EncryptionKey_Byte) == 24 || len(EncryptionKey_Byte) == 32) {
-		return map[string]interface{}{
-			"success": false,
-			"message": "invalid encryption key configuration",
-		}
-	}
-
-	initializationVector_Byte = []byte(EncryptionInitializatin)
-	if initializationVector_Byte == nil || len(initializationVector_Byte) != aes.BlockSize {
-		return map[string]interface{}{
-			"success": false,
-			"message": "invalid initialization vector (IV) configuration",
-		}
-	}
-
-	block, err := aes.NewCipher(EncryptionKey_Byte)
+	encoded, err := sealEnvelope(jsonBytes)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
-			"message": "AES error: " + err.Error(),
+			"message": "Encryption error: " + err.Error(),
 		}
 	}
-
-	// PKCS7 padding
-	blockSize := block.BlockSize()
-	padding := blockSize - (len(jsonBytes) % blockSize)
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	padded := append(jsonBytes, padtext...)
-
-	ciphertext := make([]byte, len(padded))
-	mode := cipher.NewCBCEncrypter(block, initializationVector_Byte)
-	mode.CryptBlocks(ciphertext, padded)
-
-	encoded := base64.StdEncoding.EncodeToString(ciphertext)
-
 	return map[string]interface{}{
 		"encrypted": encoded,
 	}
 }
 
-// Decript decrypts either a single JSON object or a JSON array from data["encrypted"]
+// Decript decrypts either a single JSON object or a JSON array from data["encrypted"],
+// v2 AES-GCM envelopes and, unless EncryptionRejectLegacy is set, the older AES-CBC payloads
 func Decript(data map[string]interface{}) map[string]interface{} {
 	encrypted, ok := data["encrypted"].(string)
 	if !ok {
@@ -320,75 +338,14 @@ func Decript(data map[string]interface{}) map[string]interface{} {
 		return data
 	}
 
-	// Prepare key and IV
-	if EncryptionKey != "" {
-		EncryptionKey_Byte = []byte(EncryptionKey)
-		if !(len(EncryptionKey_Byte) == 16 || len(EncryptionKey_Byte) == 24 || len(EncryptionKey_Byte) == 32) {
-			LogJSON(false, fmt.Sprintf("Invalid EncryptionKey length (%d). AES requires 16, 24 or 32 bytes.", len(EncryptionKey_Byte)))
-		}
-	} else {
-		EncryptionKey_Byte = nil
-	}
-
-	if EncryptionKey_Byte == nil || !(len(EncryptionKey_Byte) == 16 || len(EncryptionKey_Byte) == 24 || len(EncryptionKey_Byte) == 32) {
-		return map[string]interface{}{
-			"success": false,
-			"message": "invalid encryption key configuration",
-		}
-	}
-
-	initializationVector_Byte = []byte(EncryptionInitializatin)
-	if initializationVector_Byte == nil || len(initializationVector_Byte) != aes.BlockSize {
-		return map[string]interface{}{
-			"success": false,
-			"message": "invalid initialization vector (IV) configuration",
-		}
-	}
-
-	cipherBytes, err := base64.StdEncoding.DecodeString(encrypted)
-	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"message": "Base64 decode error: " + err.Error(),
-		}
-	}
-
-	block, err := aes.NewCipher(EncryptionKey_Byte)
+	unpadded, err := openEnvelope(encrypted)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
-			"message": "AES error: " + err.Error(),
+			"message": "Decryption error: " + err.Error(),
 		}
 	}
 
-	if len(cipherBytes)%block.BlockSize() != 0 {
-		return map[string]interface{}{
-			"success": false,
-			"message": "ciphertext is not a multiple of the block size",
-		}
-	}
-
-	plaintext := make([]byte, len(cipherBytes))
-	mode := cipher.NewCBCDecrypter(block, initializationVector_Byte)
-	mode.CryptBlocks(plaintext, cipherBytes)
-
-	// PKCS7 unpadding
-	length := len(plaintext)
-	if length == 0 {
-		return map[string]interface{}{
-			"success": false,
-			"message": "decrypted plaintext is empty",
-		}
-	}
-	padLen := int(plaintext[length-1])
-	if padLen <= 0 || padLen > block.BlockSize() {
-		return map[string]interface{}{
-			"success": false,
-			"message": "invalid padding size",
-		}
-	}
-	unpadded := plaintext[:length-padLen]
-
 	var original interface{}
 	if err := json.Unmarshal(unpadded, &original); err != nil {
 		return map[string]interface{}{
@@ -403,10 +360,10 @@ func Decript(data map[string]interface{}) map[string]interface{} {
 	}
 }
 
-// authenticate
+// authenticate starts a session: a short lived access token in "message"
+// plus a rotating "refresh_token" (see RefreshSession). Optional "roles" and "tenant" are carried in the claims,
+// an optional "session" of a pre-login handshake (see PayloadSession) becomes the session with its key.
 func Authenticate(data map[string]interface{}) map[string]interface{} {
-	//key
-	var jwtKey = []byte(JwtKey)
 	// Ensure required fields exist
 	user_name, uOk := data["user_name"].(string)
 	id, idOk := data["id"]
@@ -416,37 +373,37 @@ func Authenticate(data map[string]interface{}) map[string]interface{} {
 			"message": "Authentication failed: user_name and id are required",
 		}
 	}
-
-	// Create JWT claims 1h expiration
-	expireTime := time.Now().Add(12 * time.Hour)
-	options := jwt.MapClaims{
-		"exp":          expireTime.Unix(),
-		"expired_time": expireTime.Format(time.RFC3339),
-		"user_name":    user_name,
-		"id":           id,
-		"issued_at":    time.Now().Unix(),
-		"issuer":       "go_backend_api",
-	}
-
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, options)
-	// Sign the token
-	tokenString, err := token.SignedString(jwtKey)
+	family, err := randomToken(16)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
 			"message": "Authentication failed: " + err.Error(),
 		}
 	}
-	return map[string]interface{}{
-		"success": true,
-		"message": tokenString,
+	if session, _ := data["session"].(string); strings.HasPrefix(session, pendingSessionPrefix) {
+		if err := bindSessionKey(session); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Authentication failed: " + err.Error(),
+			}
+		}
+		family = session
 	}
+	subject := map[string]interface{}{
+		"user_name": user_name,
+		"id":        id,
+	}
+	if roles := normalizeRoles(data["roles"]); len(roles) > 0 {
+		subject["roles"] = roles
+	}
+	if tenant, ok := data["tenant"]; ok && tenant != nil {
+		subject[tenantClaim()] = tenant
+	}
+	return issueSession(subject, family)
 }
 
 // AuthMiddleware validates access_token
 func Authorization(options map[string]interface{}) map[string]interface{} {
-	var jwtKey = []byte(JwtKey)
 	authTokenRaw, ok := options["authorization"].(string)
 	if !ok || authTokenRaw == "" {
 		return map[string]interface{}{
@@ -461,13 +418,7 @@ func Authorization(options map[string]interface{}) map[string]interface{} {
 		authTokenRaw = authTokenRaw[len(bearerPrefix):]
 	}
 	// Parse and verify the token
-	token, err := jwt.Parse(authTokenRaw, func(token *jwt.Token) (interface{}, error) {
-		// Ensure HMAC is used
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return jwtKey, nil
-	})
+	token, err := jwt.Parse(authTokenRaw, verificationKey)
 	if err != nil || !token.Valid {
 		return map[string]interface{}{
 			"success": false,
@@ -475,6 +426,22 @@ func Authorization(options map[string]interface{}) map[string]interface{} {
 		}
 	}
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		// Tokens without a jti can't be revoked and are not accepted, nor are login challenges
+		if jti, _ := claims["jti"].(string); jti == "" || claims["token_use"] != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Unauthorized: Token expired or invalid",
+			}
+		}
+		if revoked, err := tokenRevoked(claims); revoked {
+			if err != nil {
+				LogJSON(false, "Token revocation check failed: "+err.Error())
+			}
+			return map[string]interface{}{
+				"success": false,
+				"message": "Unauthorized: Token has been revoked",
+			}
+		}
 		return map[string]interface{}{
 			"success": true,
 			"message": map[string]interface{}{
@@ -490,9 +457,37 @@ func Authorization(options map[string]interface{}) map[string]interface{} {
 	}
 }
 
-// Middleware to enforce token authentication
-func AuthMiddleware() gin.HandlerFunc {
+// Middleware to enforce token authentication and the route permission of the caller's roles.
+// The route is named after the last static path segment, or route when given ("file-delete").
+func AuthMiddleware(route ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		name := routeName(c.FullPath())
+		if len(route) > 0 {
+			name = route[0]
+		}
+		// Machine clients authenticate with an API key instead of a token
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			claims, status, err := AuthenticateAPIKey(apiKey)
+			if err != nil {
+				c.AbortWithStatusJSON(status, map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				})
+				return
+			}
+			// Keys are limited to their routes everywhere, including routes without table checks
+			if err := CheckRoute(RolesFromClaims(claims), name); err != nil {
+				c.AbortWithStatusJSON(http.StatusForbidden, map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				})
+				return
+			}
+			c.Set("claims", claims)
+			c.Next()
+			return
+		}
+
 		access_token := c.Query("access_token")
 
 		if access_token == "" {
@@ -512,8 +507,21 @@ func AuthMiddleware() gin.HandlerFunc {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, result)
 			return
 		}
-		// Token is valid, proceed
-
+		// Token is valid, keep its claims for the handlers (logout, ...)
+		claims := map[string]interface{}{}
+		if message, ok := result["message"].(map[string]interface{}); ok {
+			if data, ok := message["data"].(jwt.MapClaims); ok {
+				claims = map[string]interface{}(data)
+			}
+		}
+		if err := CheckRoute(RolesFromClaims(claims), name); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.Set("claims", claims)
 		c.Next()
 	}
 }
@@ -0,0 +1,316 @@
+package helpers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one private key of JWT_KEYS_DIR, kid is the file name without ".pem"
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	created time.Time
+	path    string
+}
+
+var (
+	keysMu      sync.RWMutex
+	signingKeys []*signingKey // oldest first, the last one signs
+)
+
+// jwtAlgorithm returns JWT_ALGORITHM, HS256 (the JWT_KEY secret) by default
+func jwtAlgorithm() string {
+	if JwtAlgorithm == "" {
+		return "HS256"
+	}
+	return strings.ToUpper(JwtAlgorithm)
+}
+
+// asymmetricJWT reports whether tokens are signed with the keys of JWT_KEYS_DIR
+func asymmetricJWT() bool {
+	return jwtAlgorithm() != "HS256"
+}
+
+func jwtKeysDir() string {
+	if JwtKeysDir == "" {
+		return "configurations/jwt"
+	}
+	return JwtKeysDir
+}
+
+// InitSigningKeys loads the JWT signing keys, creating the first one when the directory is empty
+func InitSigningKeys() map[string]interface{} {
+	if !asymmetricJWT() {
+		return map[string]interface{}{
+			"success": true,
+			"message": "JWT signing: HS256 with JWT_KEY",
+		}
+	}
+	if err := RotateSigningKeys(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to load JWT signing keys: " + err.Error(),
+		}
+	}
+	keysMu.RLock()
+	count := len(signingKeys)
+	keysMu.RUnlock()
+	return map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("JWT signing: %s with %d key(s) from %s", jwtAlgorithm(), count, jwtKeysDir()),
+	}
+}
+
+// RotateSigningKeys reloads JWT_KEYS_DIR, adds a key when the newest one is older than
+// JWT_ROTATION_HOURS and retires keys whose tokens have all expired
+func RotateSigningKeys() error {
+	keys, err := loadSigningKeys(jwtKeysDir())
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	interval := time.Duration(JwtRotationHours) * time.Hour
+	if len(keys) == 0 || (interval > 0 && now.Sub(keys[len(keys)-1].created) >= interval) {
+		key, err := generateSigningKey(jwtKeysDir(), jwtAlgorithm())
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	// A key stops signing when the next one is created and is kept until its last token expires
+	var active []*signingKey
+	for i, key := range keys {
+		if i < len(keys)-1 && now.Sub(keys[i+1].created) > accessTokenTTL() {
+			if interval > 0 {
+				if err := os.Remove(key.path); err != nil {
+					LogJSON(false, fmt.Sprintf("Failed to remove retired JWT key %s: %v", key.kid, err))
+				}
+			}
+			continue
+		}
+		active = append(active, key)
+	}
+
+	keysMu.Lock()
+	signingKeys = active
+	keysMu.Unlock()
+	return nil
+}
+
+// StartKeyRotation reloads and rotates the signing keys every interval, only for asymmetric signing
+func StartKeyRotation(interval time.Duration) {
+	if !asymmetricJWT() {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := RotateSigningKeys(); err != nil {
+				LogJSON(false, "JWT key rotation failed: "+err.Error())
+			}
+		}
+	}()
+}
+
+// signToken signs claims with JWT_KEY (HS256) or the newest signing key, setting its kid
+func signToken(claims jwt.MapClaims) (string, error) {
+	if !asymmetricJWT() {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(JwtKey))
+	}
+	keysMu.RLock()
+	var key *signingKey
+	if len(signingKeys) > 0 {
+		key = signingKeys[len(signingKeys)-1]
+	}
+	keysMu.RUnlock()
+	if key == nil {
+		return "", fmt.Errorf("no JWT signing key loaded")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// verificationKey is the jwt.Keyfunc of Authorization: JWT_KEY for HS256, else the key named by kid
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if !asymmetricJWT() {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(JwtKey), nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	for _, key := range signingKeys {
+		if key.kid == kid {
+			if token.Method.Alg() != key.method.Alg() {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return key.private.Public(), nil
+		}
+	}
+	return nil, jwt.ErrTokenUnverifiable
+}
+
+// JWKS returns the public signing keys as a JSON Web Key Set
+func JWKS() map[string]interface{} {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	keys := []map[string]interface{}{}
+	if !asymmetricJWT() {
+		return map[string]interface{}{"keys": keys}
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	for _, key := range signingKeys {
+		jwk := map[string]interface{}{"kid": key.kid, "alg": key.method.Alg(), "use": "sig"}
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = encode(public.N.Bytes())
+			jwk["e"] = encode(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk["kty"] = "EC"
+			jwk["crv"] = public.Curve.Params().Name
+			jwk["x"] = encode(public.X.FillBytes(make([]byte, size)))
+			jwk["y"] = encode(public.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = encode(public)
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// loadSigningKeys reads every *.pem private key of dir, oldest first
+func loadSigningKeys(dir string) ([]*signingKey, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*signingKey, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		private, method, err := parsePrivateKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, &signingKey{
+			kid:     strings.TrimSuffix(filepath.Base(path), ".pem"),
+			method:  method,
+			private: private,
+			created: info.ModTime(),
+			path:    path,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].created.Before(keys[j].created) })
+	return keys, nil
+}
+
+// parsePrivateKey decodes a PKCS#8, PKCS#1 or SEC 1 PEM key and picks its signing method
+func parsePrivateKey(content []byte) (crypto.Signer, jwt.SigningMethod, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no PEM block found")
+	}
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return key, jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return key, jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return key, jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return key, jwt.SigningMethodES512, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported EC curve %s", key.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return key, jwt.SigningMethodEdDSA, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported private key type %T", parsed)
+}
+
+// generateSigningKey creates a key for the algorithm and stores it as PKCS#8 PEM in dir
+func generateSigningKey(dir, algorithm string) (*signingKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EDDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %q, expected HS256, RS256, ES256 or EdDSA", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	path := filepath.Join(dir, kid+".pem")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return nil, err
+	}
+	_, method, err := parsePrivateKey(content)
+	if err != nil {
+		return nil, err
+	}
+	LogJSON(true, fmt.Sprintf("Created JWT signing key %s (%s)", kid, method.Alg()))
+	return &signingKey{kid: kid, method: method, private: private, created: time.Now(), path: path}, nil
+}
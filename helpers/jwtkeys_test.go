@@ -0,0 +1,145 @@
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useSigningKeys signs tokens with the algorithm and keys of a directory of the test
+func useSigningKeys(t *testing.T, algorithm string) {
+	t.Helper()
+	useTokenStore(t, "memory")
+	dir, rotation, ttl := JwtKeysDir, JwtRotationHours, AccessTokenTTL
+	JwtAlgorithm, JwtKeysDir, JwtRotationHours, AccessTokenTTL = algorithm, t.TempDir(), 0, 15
+	t.Cleanup(func() {
+		keysMu.Lock()
+		signingKeys = nil
+		keysMu.Unlock()
+		JwtKeysDir, JwtRotationHours, AccessTokenTTL = dir, rotation, ttl
+	})
+	if res := InitSigningKeys(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+}
+
+// loginToken is the access token of a login of joe
+func loginToken(t *testing.T) string {
+	t.Helper()
+	login := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1})
+	if !login["success"].(bool) {
+		t.Fatal(login["message"])
+	}
+	return login["message"].(string)
+}
+
+// jwkPublicKey decodes a public key of the JWKS the way another service would
+func jwkPublicKey(t *testing.T, jwk map[string]interface{}) interface{} {
+	t.Helper()
+	decode := func(name string) []byte {
+		value, err := base64.RawURLEncoding.DecodeString(jwk[name].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode("n")), E: int(new(big.Int).SetBytes(decode("e")).Int64())}
+	case "EC":
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(decode("x")), Y: new(big.Int).SetBytes(decode("y"))}
+	case "OKP":
+		return ed25519.PublicKey(decode("x"))
+	}
+	t.Fatalf("unexpected JWK %v", jwk)
+	return nil
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "ES256", "EdDSA"} {
+		t.Run(algorithm, func(t *testing.T) {
+			openTestDB(t)
+			useSigningKeys(t, algorithm)
+			token := loginToken(t)
+			if !authorized(token) {
+				t.Fatalf("Authorization refused a %s token", algorithm)
+			}
+
+			// Other services verify the token with the published key of its kid
+			keys := JWKS()["keys"].([]map[string]interface{})
+			if len(keys) != 1 || keys[0]["alg"] != algorithm {
+				t.Fatalf("JWKS = %v", keys)
+			}
+			parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+				if token.Header["kid"] != keys[0]["kid"] {
+					t.Errorf("token kid %v, JWKS kid %v", token.Header["kid"], keys[0]["kid"])
+				}
+				return jwkPublicKey(t, keys[0]), nil
+			}, jwt.WithValidMethods([]string{algorithm}))
+			if err != nil || !parsed.Valid {
+				t.Errorf("verifying with the JWKS = %v", err)
+			}
+
+			// An HS256 token signed with JWT_KEY is refused
+			forged := jwt.NewWithClaims(jwt.SigningMethodHS256, parsed.Claims)
+			forged.Header["kid"] = keys[0]["kid"]
+			if signed, _ := forged.SignedString([]byte(JwtKey)); authorized(signed) {
+				t.Errorf("Authorization accepted an HS256 token while signing with %s", algorithm)
+			}
+		})
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	openTestDB(t)
+	useSigningKeys(t, "EdDSA")
+	JwtRotationHours, AccessTokenTTL = 1, 5
+	backdate := func(kid string, by time.Duration) {
+		t.Helper()
+		at := time.Now().Add(-by)
+		if err := os.Chtimes(filepath.Join(JwtKeysDir, kid+".pem"), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := loginToken(t)
+	oldKid := JWKS()["keys"].([]map[string]interface{})[0]["kid"].(string)
+
+	// A key older than JWT_ROTATION_HOURS is replaced, its tokens still verify
+	backdate(oldKid, 2*time.Hour)
+	if err := RotateSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	keys := JWKS()["keys"].([]map[string]interface{})
+	if len(keys) != 2 || keys[0]["kid"] != oldKid {
+		t.Fatalf("JWKS after the rotation = %v", keys)
+	}
+	current := loginToken(t)
+	header, _, _ := jwt.NewParser().ParseUnverified(current, jwt.MapClaims{})
+	if header.Header["kid"] != keys[1]["kid"] || !authorized(old) {
+		t.Fatalf("after the rotation new tokens use %v and the old token is accepted %t", header.Header["kid"], authorized(old))
+	}
+
+	// Once every token of the old key has expired the key is removed
+	backdate(keys[1]["kid"].(string), 10*time.Minute)
+	if err := RotateSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := JWKS()["keys"].([]map[string]interface{}); len(keys) != 1 || keys[0]["kid"] == oldKid {
+		t.Errorf("JWKS after the retirement = %v", keys)
+	}
+	if _, err := os.Stat(filepath.Join(JwtKeysDir, oldKid+".pem")); !os.IsNotExist(err) {
+		t.Errorf("the retired key file is kept: %v", err)
+	}
+	if authorized(old) || !authorized(current) {
+		t.Errorf("after the retirement the old token is accepted %t, the current token %t", authorized(old), authorized(current))
+	}
+}
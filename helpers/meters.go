@@ -0,0 +1,396 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// meterTable is the meter registry, one row per meter we vend tokens for
+const meterTable = "sts_meters"
+
+// Meter is a registered meter and the key parameters its decoder key is derived from
+type Meter struct {
+	Number          string // decoder reference number, up to 20 digits
+	SupplyGroupCode int
+	TariffIndex     int
+	KeyRevision     int
+	KeyType         int
+	TokenFormat     string // TokenFormatLegacy or TokenFormatSTS
+	Tenant          string // tenant of the caller that registered it, "" for callers without one
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (m Meter) info() map[string]interface{} {
+	return map[string]interface{}{
+		"meter_number":      m.Number,
+		"supply_group_code": m.SupplyGroupCode,
+		"tariff_index":      m.TariffIndex,
+		"key_revision":      m.KeyRevision,
+		"key_type":          m.KeyType,
+		"token_format":      m.TokenFormat,
+		"tenant":            m.Tenant,
+		"created_at":        m.CreatedAt.Format(time.RFC3339),
+		"updated_at":        m.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// InitMeters creates the meter registry table
+func InitMeters() map[string]interface{} {
+	if DB == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Meter registry needs a database connection",
+		}
+	}
+	_, err := DB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (meter_number VARCHAR(20) NOT NULL PRIMARY KEY, supply_group_code INTEGER NOT NULL, tariff_index INTEGER NOT NULL, key_revision INTEGER NOT NULL, key_type INTEGER NOT NULL, token_format VARCHAR(16) NOT NULL, tenant VARCHAR(255) NOT NULL DEFAULT '', created_at BIGINT NOT NULL, updated_at BIGINT NOT NULL)", EscapeId(meterTable)))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to create meter registry table: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "Meter registry ready",
+	}
+}
+
+// RegisterMeter adds a meter with its key parameters:
+//
+//	{"meter_number": "01234567897", "supply_group_code": 123456, "tariff_index": 1, "key_revision": 1, "key_type": 2,
+//	 "token_format": "sts"}
+//
+// STS meters may name their "key_generation_algorithm" and "encryption_algorithm", see ValidSTSAlgorithms.
+// Registering a meter again with the same parameters returns it, other parameters are refused: they change
+// the decoder key, so they only change with a key change token the meter accepts (see ChangeMeterKey).
+// A meter belongs to the tenant of the caller registering it, see MeterVisible.
+func RegisterMeter(options map[string]interface{}) map[string]interface{} {
+	number, err := meterNumber(options["meter_number"])
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	existing, err := GetMeter(number)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to register meter: " + err.Error(),
+		}
+	}
+	tenant := VendTenant(options)
+	if existing != nil && !MeterVisible(*existing, tenant) {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Meter %s is already registered", number),
+		}
+	}
+	// Registering again may omit the parameters it doesn't change
+	meter := Meter{Number: number, KeyRevision: 1, TokenFormat: TokenFormatLegacy, Tenant: tenant, CreatedAt: time.Now()}
+	if existing != nil {
+		meter = *existing
+	}
+	meter.UpdatedAt = time.Now()
+	if err := applyKeyParameters(&meter, options, "", existing == nil); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	if value, ok := options["token_format"]; ok {
+		format, _ := value.(string)
+		if format != TokenFormatLegacy && format != TokenFormatSTS {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("token_format must be %q or %q", TokenFormatLegacy, TokenFormatSTS),
+			}
+		}
+		meter.TokenFormat = format
+	}
+	if meter.TokenFormat == TokenFormatSTS {
+		if err := ValidSTSAlgorithms(options); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		if err := ValidSTSMeterNumber(meter.Number); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+	}
+
+	if existing != nil {
+		if meter.keyParameters() != existing.keyParameters() {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Meter %s is already registered, its key parameters only change with a key change token", number),
+			}
+		}
+		return map[string]interface{}{
+			"success": true,
+			"message": existing.info(),
+		}
+	}
+
+	if err := SaveMeter(meter); err != nil {
+		if kind, _, ok := ClassifyDBError(err); ok && kind == DBErrorDuplicate {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Meter %s is already registered", number),
+			}
+		}
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to register meter: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": meter.info(),
+	}
+}
+
+// keyParameters are the fields a meter's decoder key is derived from
+func (m Meter) keyParameters() [5]interface{} {
+	return [5]interface{}{m.SupplyGroupCode, m.TariffIndex, m.KeyRevision, m.KeyType, m.TokenFormat}
+}
+
+// SaveMeter inserts a new meter, registered meters only change their key with ChangeMeterKey
+func SaveMeter(meter Meter) error {
+	query := fmt.Sprintf("INSERT INTO %s (meter_number, supply_group_code, tariff_index, key_revision, key_type, token_format, tenant, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", EscapeId(meterTable))
+	_, err := DB.Exec(Rebind(query), meter.Number, meter.SupplyGroupCode, meter.TariffIndex, meter.KeyRevision, meter.KeyType, meter.TokenFormat, meter.Tenant, meter.CreatedAt.Unix(), meter.UpdatedAt.Unix())
+	return err
+}
+
+// ChangeMeterKey moves a meter from the key parameters of current to those of next, failing when the
+// registry no longer holds current (another key change or registration got there first)
+func ChangeMeterKey(q Querier, current, next Meter) error {
+	query := fmt.Sprintf(`UPDATE %s SET supply_group_code = ?, tariff_index = ?, key_revision = ?, key_type = ?, updated_at = ?
+		WHERE meter_number = ? AND supply_group_code = ? AND tariff_index = ? AND key_revision = ? AND key_type = ?`, EscapeId(meterTable))
+	result, err := q.Exec(Rebind(query), next.SupplyGroupCode, next.TariffIndex, next.KeyRevision, next.KeyType, next.UpdatedAt.Unix(),
+		current.Number, current.SupplyGroupCode, current.TariffIndex, current.KeyRevision, current.KeyType)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("the key parameters of meter %s changed while the key change was built, issue it again", current.Number)
+	}
+	return nil
+}
+
+// ChangeKeyParameters returns the meter with the key parameters named "new_supply_group_code",
+// "new_tariff_index", "new_key_revision" and "new_key_type" in options, as a key change token sets them
+func ChangeKeyParameters(meter Meter, options map[string]interface{}) (Meter, error) {
+	err := applyKeyParameters(&meter, options, "new_", false)
+	return meter, err
+}
+
+// applyKeyParameters validates and sets the key parameters found in options, numbers may be JSON
+// numbers or digit strings (query parameters)
+func applyKeyParameters(meter *Meter, options map[string]interface{}, prefix string, required bool) error {
+	fields := []struct {
+		name       string
+		target     *int
+		min, max   int
+		isRequired bool
+	}{
+		{"supply_group_code", &meter.SupplyGroupCode, 0, 999999, true},
+		{"tariff_index", &meter.TariffIndex, 0, 99, true},
+		{"key_revision", &meter.KeyRevision, 1, 9, false},
+		{"key_type", &meter.KeyType, 0, 3, false},
+	}
+	for _, field := range fields {
+		name := prefix + field.name
+		raw, present := options[name]
+		if !present || raw == "" {
+			if required && field.isRequired {
+				return fmt.Errorf("%s must be a number", name)
+			}
+			continue
+		}
+		value, ok := raw.(float64)
+		if text, isText := raw.(string); isText {
+			number, err := strconv.Atoi(text)
+			value, ok = float64(number), err == nil
+		}
+		if !ok {
+			return fmt.Errorf("%s must be a number", name)
+		}
+		if value != float64(int(value)) || int(value) < field.min || int(value) > field.max {
+			return fmt.Errorf("%s must be a whole number between %d and %d", name, field.min, field.max)
+		}
+		*field.target = int(value)
+	}
+	return nil
+}
+
+// ListMeters returns the registered meters, {"meter_number": "..."} returns one meter.
+// Callers with a tenant only see the meters of their tenant.
+func ListMeters(options map[string]interface{}) map[string]interface{} {
+	var where []string
+	var args []interface{}
+	if number, ok := options["meter_number"]; ok {
+		value, err := meterNumber(number)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		where = append(where, "meter_number = ?")
+		args = append(args, value)
+	}
+	if tenant := VendTenant(options); tenant != "" {
+		where = append(where, "tenant = ?")
+		args = append(args, tenant)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", meterColumns, EscapeId(meterTable))
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := DB.Query(Rebind(query+" ORDER BY meter_number"), args...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to list meters: " + err.Error(),
+		}
+	}
+	defer rows.Close()
+	list := []map[string]interface{}{}
+	for rows.Next() {
+		meter, err := scanMeter(rows)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Unable to list meters: " + err.Error(),
+			}
+		}
+		list = append(list, meter.info())
+	}
+	if err := rows.Err(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to list meters: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": list,
+	}
+}
+
+// meterColumns are the columns scanMeter reads
+const meterColumns = "meter_number, supply_group_code, tariff_index, key_revision, key_type, token_format, tenant, created_at, updated_at"
+
+// GetMeter returns a registered meter of any tenant, nil when the number is unknown.
+// Requests resolve their meter with LookupMeter.
+func GetMeter(number string) (*Meter, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("meter registry needs a database connection")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE meter_number = ?", meterColumns, EscapeId(meterTable))
+	meter, err := scanMeter(DB.QueryRow(Rebind(query), number))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meter, nil
+}
+
+// LookupMeter resolves the "meter_number" option of a request to its registered meter.
+// Meters of another tenant count as not registered.
+func LookupMeter(options map[string]interface{}) (*Meter, error) {
+	number, err := meterNumber(options["meter_number"])
+	if err != nil {
+		return nil, err
+	}
+	meter, err := GetMeter(number)
+	if err != nil {
+		return nil, fmt.Errorf("Meter lookup failed: %v", err)
+	}
+	if meter == nil || !MeterVisible(*meter, VendTenant(options)) {
+		return nil, fmt.Errorf("Meter %s is not registered", number)
+	}
+	return meter, nil
+}
+
+// MeterVisible reports whether a caller of tenant may use a meter, callers without a tenant use all
+func MeterVisible(meter Meter, tenant string) bool {
+	return tenant == "" || meter.Tenant == tenant
+}
+
+func scanMeter(row interface{ Scan(...interface{}) error }) (*Meter, error) {
+	meter := &Meter{}
+	var created, updated int64
+	if err := row.Scan(&meter.Number, &meter.SupplyGroupCode, &meter.TariffIndex, &meter.KeyRevision, &meter.KeyType, &meter.TokenFormat, &meter.Tenant, &created, &updated); err != nil {
+		return nil, err
+	}
+	meter.CreatedAt = time.Unix(created, 0)
+	meter.UpdatedAt = time.Unix(updated, 0)
+	return meter, nil
+}
+
+// meterNumber validates a decoder reference number, it has to fit the 64 bit field of the key data block
+func meterNumber(value interface{}) (string, error) {
+	number, _ := value.(string)
+	number = strings.TrimSpace(number)
+	if number == "" {
+		return "", fmt.Errorf("meter_number is required")
+	}
+	if len(number) > 20 || !IsAllDigits(number) {
+		return "", fmt.Errorf("meter_number must be a string of up to 20 digits")
+	}
+	if _, err := strconv.ParseUint(number, 10, 64); err != nil {
+		return "", fmt.Errorf("meter_number is too large")
+	}
+	return number, nil
+}
+
+// vendingKey returns the server side key decoder keys are derived from, VENDING_KEY in hex
+func vendingKey() ([]byte, error) {
+	if VendingKey == "" {
+		return nil, fmt.Errorf("VENDING_KEY is not configured")
+	}
+	key, err := hex.DecodeString(VendingKey)
+	if err != nil {
+		return nil, fmt.Errorf("VENDING_KEY must be hex encoded")
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("VENDING_KEY must be at least 16 bytes")
+	}
+	return key, nil
+}
+
+// meterKeyData is the key data block of a meter: key type (8 bits), supply group code (24),
+// tariff index (8), key revision (8) and decoder reference number (64)
+func meterKeyData(meter Meter) string {
+	reference, _ := new(big.Int).SetString(meter.Number, 10)
+	return DecToBin(meter.KeyType, 8) + DecToBin(meter.SupplyGroupCode, 24) + DecToBin(meter.TariffIndex, 8) +
+		DecToBin(meter.KeyRevision, 8) + DecToBinBigInt(reference, 64)
+}
+
+// deriveDecoderKey is HMAC-SHA256 of the meter's key data block under the vending key,
+// truncated to a 192 bit 3DES key
+func deriveDecoderKey(meter Meter) ([]byte, error) {
+	key, err := vendingKey()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(BinStrToBytes(meterKeyData(meter)))
+	return mac.Sum(nil)[:24], nil
+}
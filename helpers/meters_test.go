@@ -0,0 +1,205 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// useMeters creates the meter registry of the test with a vending key
+func useMeters(t *testing.T) {
+	t.Helper()
+	openTestDB(t)
+	if res := InitMeters(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	vending, sts := VendingKey, STSVendingKey
+	VendingKey, STSVendingKey = "000102030405060708090a0b0c0d0e0f", "0123456789abcdef"
+	t.Cleanup(func() { VendingKey, STSVendingKey = vending, sts })
+}
+
+// meterJSON decodes a registration body the way the routes do
+func meterJSON(t *testing.T, content string) map[string]interface{} {
+	t.Helper()
+	var options map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &options); err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+func TestRegisterMeter(t *testing.T) {
+	useMeters(t)
+	tests := []struct {
+		options string
+		ok      bool
+	}{
+		{`{"meter_number": "01234567897", "supply_group_code": 123456, "tariff_index": 1, "key_type": 2}`, true},
+		{`{"meter_number": "12345", "supply_group_code": "654321", "tariff_index": "7"}`, true},
+		{`{"meter_number": "1", "tariff_index": 1}`, false},
+		{`{"meter_number": "1", "supply_group_code": 1000000, "tariff_index": 1}`, false},
+		{`{"meter_number": "1", "supply_group_code": 1, "tariff_index": 1, "key_revision": 0}`, false},
+		{`{"meter_number": "1", "supply_group_code": 1, "tariff_index": 1.5}`, false},
+		{`{"meter_number": "1", "supply_group_code": 1, "tariff_index": 1, "token_format": "xml"}`, false},
+		{`{"meter_number": "12a", "supply_group_code": 1, "tariff_index": 1}`, false},
+		{`{"meter_number": "99999999999999999999", "supply_group_code": 1, "tariff_index": 1}`, false},
+		{`{"meter_number": "01234567890", "supply_group_code": 1, "tariff_index": 1, "token_format": "sts"}`, false},
+		{`{"meter_number": "1234567890128", "supply_group_code": 1, "tariff_index": 1, "token_format": "sts"}`, true},
+	}
+	for _, tt := range tests {
+		if res := RegisterMeter(meterJSON(t, tt.options)); res["success"].(bool) != tt.ok {
+			t.Errorf("RegisterMeter(%s) = %v, want success %t", tt.options, res["message"], tt.ok)
+		}
+	}
+	meter, err := LookupMeter(map[string]interface{}{"meter_number": "01234567897"})
+	if err != nil || meter.SupplyGroupCode != 123456 || meter.KeyRevision != 1 || meter.KeyType != 2 || meter.TokenFormat != TokenFormatLegacy {
+		t.Fatalf("LookupMeter = %+v, %v", meter, err)
+	}
+	if _, err := LookupMeter(map[string]interface{}{"meter_number": "555"}); err == nil || err.Error() != "Meter 555 is not registered" {
+		t.Errorf("LookupMeter of an unknown meter = %v", err)
+	}
+	if list := ListMeters(map[string]interface{}{})["message"].([]map[string]interface{}); len(list) != 3 {
+		t.Errorf("ListMeters = %v", list)
+	}
+}
+
+func TestRegisterMeterKeepsKey(t *testing.T) {
+	useMeters(t)
+	options := `{"meter_number": "01234567897", "supply_group_code": 123456, "tariff_index": 1}`
+	if res := RegisterMeter(meterJSON(t, options)); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	registered, _ := GetMeter("01234567897")
+	key, err := deriveDecoderKey(*registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering again with the same or without parameters is accepted and changes nothing
+	for _, again := range []string{options, `{"meter_number": "01234567897"}`} {
+		if res := RegisterMeter(meterJSON(t, again)); !res["success"].(bool) {
+			t.Errorf("RegisterMeter(%s) again = %v", again, res["message"])
+		}
+	}
+	// Parameters that change the decoder key need a key change token
+	for _, changed := range []string{
+		`{"meter_number": "01234567897", "supply_group_code": 111111}`,
+		`{"meter_number": "01234567897", "tariff_index": 2}`,
+		`{"meter_number": "01234567897", "key_revision": 2}`,
+		`{"meter_number": "01234567897", "key_type": 1}`,
+		`{"meter_number": "01234567897", "token_format": "sts"}`,
+	} {
+		if res := RegisterMeter(meterJSON(t, changed)); res["success"].(bool) {
+			t.Errorf("RegisterMeter(%s) changed a registered meter", changed)
+		}
+	}
+	meter, _ := GetMeter("01234567897")
+	if after, _ := deriveDecoderKey(*meter); !bytes.Equal(after, key) {
+		t.Errorf("the decoder key of the registered meter changed")
+	}
+}
+
+func TestChangeMeterKey(t *testing.T) {
+	useMeters(t)
+	RegisterMeter(meterJSON(t, `{"meter_number": "01234567897", "supply_group_code": 123456, "tariff_index": 1}`))
+	current, _ := GetMeter("01234567897")
+	next, err := ChangeKeyParameters(*current, meterJSON(t, `{"new_key_revision": 2, "new_tariff_index": "3"}`))
+	if err != nil || next.KeyRevision != 2 || next.TariffIndex != 3 || next.SupplyGroupCode != 123456 {
+		t.Fatalf("ChangeKeyParameters = %+v, %v", next, err)
+	}
+	if _, err := ChangeKeyParameters(*current, meterJSON(t, `{"new_key_type": 4}`)); err == nil {
+		t.Errorf("ChangeKeyParameters accepted key type 4")
+	}
+	if err := ChangeMeterKey(DB, *current, next); err != nil {
+		t.Fatal(err)
+	}
+	// A second change built from the old parameters lost the race
+	if err := ChangeMeterKey(DB, *current, next); err == nil {
+		t.Errorf("ChangeMeterKey applied a change built from outdated parameters")
+	}
+	if meter, _ := GetMeter("01234567897"); meter.KeyRevision != 2 || meter.TariffIndex != 3 {
+		t.Errorf("registry after the key change = %+v", meter)
+	}
+}
+
+func TestDeriveDecoderKey(t *testing.T) {
+	useMeters(t)
+	meter := Meter{Number: "01234567897", SupplyGroupCode: 123456, TariffIndex: 1, KeyRevision: 1, KeyType: 2}
+	key, err := deriveDecoderKey(meter)
+	if err != nil || len(key) != 24 {
+		t.Fatalf("deriveDecoderKey = %x, %v", key, err)
+	}
+	for _, other := range []Meter{
+		{Number: "01234567898", SupplyGroupCode: 123456, TariffIndex: 1, KeyRevision: 1, KeyType: 2},
+		{Number: "01234567897", SupplyGroupCode: 123456, TariffIndex: 1, KeyRevision: 2, KeyType: 2},
+	} {
+		if otherKey, _ := deriveDecoderKey(other); bytes.Equal(otherKey, key) {
+			t.Errorf("meters %+v and %+v share a decoder key", meter, other)
+		}
+	}
+	for _, vending := range []string{"", "xyz", "00010203"} {
+		VendingKey = vending
+		if _, err := deriveDecoderKey(meter); err == nil {
+			t.Errorf("deriveDecoderKey with VENDING_KEY %q succeeded", vending)
+		}
+	}
+}
+
+func TestMeterTenants(t *testing.T) {
+	useMeters(t)
+	if res := InitTariffs(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	acme := func(options string) map[string]interface{} {
+		body := meterJSON(t, options)
+		body[TenantOption] = Tenant{Value: 7}
+		return body
+	}
+	globex := func(options string) map[string]interface{} {
+		body := meterJSON(t, options)
+		body[TenantOption] = Tenant{Value: "globex"}
+		return body
+	}
+	if res := RegisterMeter(acme(`{"meter_number": "01234567897", "supply_group_code": 123456, "tariff_index": 1}`)); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	RegisterMeter(globex(`{"meter_number": "12345", "supply_group_code": 1, "tariff_index": 1}`))
+
+	// Another tenant can't take over, list, look up or charge the meter
+	if res := RegisterMeter(globex(`{"meter_number": "01234567897", "supply_group_code": 123456, "tariff_index": 1}`)); res["success"].(bool) {
+		t.Errorf("a meter was registered again by another tenant: %v", res["message"])
+	}
+	if _, err := LookupMeter(globex(`{"meter_number": "01234567897"}`)); err == nil || err.Error() != "Meter 01234567897 is not registered" {
+		t.Errorf("LookupMeter of another tenant's meter = %v", err)
+	}
+	if res := SetMeterDebt(globex(`{"meter_number": "01234567897", "balance": 100}`)); res["success"].(bool) {
+		t.Errorf("SetMeterDebt changed the debt of another tenant's meter")
+	}
+	list := ListMeters(globex(`{}`))["message"].([]map[string]interface{})
+	if len(list) != 1 || list[0]["meter_number"] != "12345" {
+		t.Errorf("ListMeters of globex = %v", list)
+	}
+	if meter, err := LookupMeter(acme(`{"meter_number": "01234567897"}`)); err != nil || meter.Tenant != "7" {
+		t.Errorf("LookupMeter of the owner = %+v, %v", meter, err)
+	}
+	// Callers without a tenant see every meter
+	if list := ListMeters(meterJSON(t, `{}`))["message"].([]map[string]interface{}); len(list) != 2 {
+		t.Errorf("ListMeters without a tenant = %v", list)
+	}
+
+	// Tenants price their own meters, the shared tariff applies where they have none
+	SetTariff(meterJSON(t, `{"tariff_index": 1, "name": "Shared", "type": "flat", "rate": 100}`))
+	SetTariff(globex(`{"tariff_index": 1, "name": "Globex", "type": "flat", "rate": 250}`))
+	if tariff, _ := GetTariff("7", 1); tariff == nil || tariff.Name != "Shared" {
+		t.Errorf("GetTariff of a tenant without tariffs = %+v", tariff)
+	}
+	if tariff, _ := GetTariff("globex", 1); tariff == nil || tariff.Name != "Globex" || tariff.Tenant != "globex" {
+		t.Errorf("GetTariff of globex = %+v", tariff)
+	}
+	if tariff, _ := GetTariff("", 1); tariff == nil || tariff.Name != "Shared" {
+		t.Errorf("the tariff of globex replaced the shared tariff: %+v", tariff)
+	}
+	if list := ListTariffs(acme(`{}`))["message"].([]map[string]interface{}); len(list) != 1 || list[0]["name"] != "Shared" {
+		t.Errorf("ListTariffs of acme = %v", list)
+	}
+}
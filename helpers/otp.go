@@ -0,0 +1,454 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otpTable holds the pending codes of the database OTP store, otpFailuresTable the wrong guesses per recipient
+const (
+	otpTable         = "auth_otp_codes"
+	otpFailuresTable = "auth_otp_failures"
+)
+
+// Defaults used when OTP_TTL (minutes), OTP_MAX_ATTEMPTS and OTP_RESEND_COOLDOWN (seconds) are unset
+const (
+	defaultOTPTTL         = 10 * time.Minute
+	defaultOTPMaxAttempts = 5
+	defaultOTPCooldown    = 60 * time.Second
+)
+
+// A recipient that used up the attempts of a code waits before the next one, twice as long for every
+// further OTP_MAX_ATTEMPTS wrong guesses up to otpMaxLockout. Wrong guesses are forgotten after a
+// successful verification or otpFailureMemory after the last one.
+const (
+	otpMaxLockout    = 24 * time.Hour
+	otpFailureMemory = 7 * 24 * time.Hour
+)
+
+// OTPCode is a pending one-time code, only the hash of the code is stored
+type OTPCode struct {
+	ID       string // sha256 of purpose and recipient
+	Hash     string // sha256 of the code
+	Expires  time.Time
+	SentAt   time.Time
+	Attempts int
+}
+
+// OTPStore keeps one pending code per purpose and recipient
+type OTPStore interface {
+	// SaveOTP stores a code, replacing the previous code of the same id
+	SaveOTP(code OTPCode) error
+	// GetOTP returns nil when there is no code
+	GetOTP(id string) (*OTPCode, error)
+	// AddOTPAttempt counts a verification attempt and returns the attempts made so far
+	AddOTPAttempt(id string) (int, error)
+	// DeleteOTP removes a code, false when it was already gone
+	DeleteOTP(id string) (bool, error)
+	// AddOTPFailure counts a wrong guess, kept across resends, and returns the wrong guesses so far
+	AddOTPFailure(id string, at time.Time) (int, error)
+	// GetOTPFailures returns the wrong guesses and the time of the last one
+	GetOTPFailures(id string) (int, time.Time, error)
+	// ClearOTPFailures forgets the wrong guesses after a successful verification
+	ClearOTPFailures(id string) error
+	// PurgeExpired removes expired codes and wrong guesses older than otpFailureMemory
+	PurgeExpired(now time.Time) error
+}
+
+// OTPCooldownError is returned when a new code is requested too soon after the last one
+type OTPCooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OTPCooldownError) Error() string {
+	return fmt.Sprintf("Please wait %d seconds before requesting a new code", int(e.RetryAfter.Seconds()+0.5))
+}
+
+var (
+	otpStoreMu sync.RWMutex
+	otpStore   OTPStore
+)
+
+// InitOTPStore selects the OTP store from OTP_STORE ("database" by default or "memory")
+func InitOTPStore() map[string]interface{} {
+	if strings.EqualFold(OTPStoreName, "memory") || DB == nil {
+		SetOTPStore(newMemoryOTPStore())
+		return map[string]interface{}{
+			"success": true,
+			"message": "OTP store: memory",
+		}
+	}
+	store := dbOTPStore{}
+	if err := store.createTable(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to create OTP store table: " + err.Error(),
+		}
+	}
+	SetOTPStore(store)
+	return map[string]interface{}{
+		"success": true,
+		"message": "OTP store: database",
+	}
+}
+
+// SetOTPStore replaces the OTP store, for custom stores (Redis, ...)
+func SetOTPStore(store OTPStore) {
+	otpStoreMu.Lock()
+	otpStore = store
+	otpStoreMu.Unlock()
+}
+
+// currentOTPStore returns the configured store, an in-memory one until InitOTPStore runs
+func currentOTPStore() OTPStore {
+	otpStoreMu.RLock()
+	store := otpStore
+	otpStoreMu.RUnlock()
+	if store != nil {
+		return store
+	}
+	otpStoreMu.Lock()
+	defer otpStoreMu.Unlock()
+	if otpStore == nil {
+		otpStore = newMemoryOTPStore()
+	}
+	return otpStore
+}
+
+// OTPExpiry is how long an issued code stays valid, OTP_TTL minutes
+func OTPExpiry() time.Duration {
+	if OTPTTL <= 0 {
+		return defaultOTPTTL
+	}
+	return time.Duration(OTPTTL) * time.Minute
+}
+
+func otpMaxAttempts() int {
+	if OTPMaxAttempts <= 0 {
+		return defaultOTPMaxAttempts
+	}
+	return OTPMaxAttempts
+}
+
+func otpCooldown() time.Duration {
+	if OTPResendCooldown < 0 {
+		return 0
+	}
+	if OTPResendCooldown == 0 {
+		return defaultOTPCooldown
+	}
+	return time.Duration(OTPResendCooldown) * time.Second
+}
+
+// otpLockout is how long a recipient waits for a new code after its last wrong guess
+func otpLockout(failures int) time.Duration {
+	exhausted := failures / otpMaxAttempts()
+	if exhausted == 0 {
+		return 0
+	}
+	base := otpCooldown()
+	if base < time.Minute {
+		base = time.Minute
+	}
+	if exhausted > 16 {
+		return otpMaxLockout
+	}
+	return min(base<<exhausted, otpMaxLockout)
+}
+
+// otpID keys a code by purpose and recipient, emails are compared case insensitively
+func otpID(purpose, recipient string) string {
+	recipient = strings.ToLower(strings.TrimSpace(recipient))
+	sum := sha256.Sum256([]byte(purpose + "\x00" + recipient))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashOTP(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueOTP stores a code for the purpose ("verification", "login", ...) and recipient before it is sent.
+// It returns an *OTPCooldownError when the last code was sent less than OTP_RESEND_COOLDOWN ago, or
+// while the recipient is locked out after too many wrong guesses (see otpLockout).
+func IssueOTP(purpose, recipient, code string) error {
+	store := currentOTPStore()
+	id := otpID(purpose, recipient)
+	now := time.Now()
+	previous, err := store.GetOTP(id)
+	if err != nil {
+		return err
+	}
+	var wait time.Duration
+	if previous != nil && now.Before(previous.Expires) {
+		wait = previous.SentAt.Add(otpCooldown()).Sub(now)
+	}
+	failures, failedAt, err := store.GetOTPFailures(id)
+	if err != nil {
+		return err
+	}
+	if locked := failedAt.Add(otpLockout(failures)).Sub(now); locked > wait {
+		wait = locked
+	}
+	if wait > 0 {
+		return &OTPCooldownError{RetryAfter: wait}
+	}
+	return store.SaveOTP(OTPCode{ID: id, Hash: hashOTP(code), Expires: now.Add(OTPExpiry()), SentAt: now})
+}
+
+// WithdrawOTP removes the code of a purpose and recipient that could not be delivered, so it can't be
+// guessed and a new one may be sent right away
+func WithdrawOTP(purpose, recipient string) error {
+	_, err := currentOTPStore().DeleteOTP(otpID(purpose, recipient))
+	return err
+}
+
+// VerifyOTP checks a code in constant time. A code is removed once it is used and refused after it
+// expired or after OTP_MAX_ATTEMPTS guesses. Wrong guesses also count against the recipient, see otpLockout.
+func VerifyOTP(purpose, recipient, code string) error {
+	store := currentOTPStore()
+	id := otpID(purpose, recipient)
+	stored, err := store.GetOTP(id)
+	if err != nil {
+		return err
+	}
+	if stored == nil || time.Now().After(stored.Expires) {
+		return fmt.Errorf("Code expired or not found, please request a new one")
+	}
+	attempts, err := store.AddOTPAttempt(id)
+	if err != nil {
+		return err
+	}
+	if attempts > otpMaxAttempts() {
+		return fmt.Errorf("Too many attempts, please request a new code")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashOTP(code)), []byte(stored.Hash)) != 1 {
+		if _, err := store.AddOTPFailure(id, time.Now()); err != nil {
+			return err
+		}
+		return fmt.Errorf("Invalid code")
+	}
+	// Deleting decides between concurrent verifications of the same code
+	deleted, err := store.DeleteOTP(id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("Code expired or not found, please request a new one")
+	}
+	return store.ClearOTPFailures(id)
+}
+
+// memoryOTPStore keeps codes in process, they are lost on restart
+type memoryOTPStore struct {
+	mu       sync.Mutex
+	codes    map[string]*OTPCode
+	failures map[string]*otpFailures
+}
+
+// otpFailures are the wrong guesses of a recipient
+type otpFailures struct {
+	count int
+	last  time.Time
+}
+
+func newMemoryOTPStore() *memoryOTPStore {
+	return &memoryOTPStore{codes: map[string]*OTPCode{}, failures: map[string]*otpFailures{}}
+}
+
+func (s *memoryOTPStore) SaveOTP(code OTPCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code.ID] = &code
+	return nil
+}
+
+func (s *memoryOTPStore) GetOTP(id string) (*OTPCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.codes[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *code
+	return &copied, nil
+}
+
+func (s *memoryOTPStore) AddOTPAttempt(id string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.codes[id]
+	if !ok {
+		return otpMaxAttempts() + 1, nil
+	}
+	code.Attempts++
+	return code.Attempts, nil
+}
+
+func (s *memoryOTPStore) DeleteOTP(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.codes[id]
+	delete(s.codes, id)
+	return ok, nil
+}
+
+func (s *memoryOTPStore) AddOTPFailure(id string, at time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures, ok := s.failures[id]
+	if !ok {
+		failures = &otpFailures{}
+		s.failures[id] = failures
+	}
+	failures.count++
+	failures.last = at
+	return failures.count, nil
+}
+
+func (s *memoryOTPStore) GetOTPFailures(id string) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failures, ok := s.failures[id]; ok {
+		return failures.count, failures.last, nil
+	}
+	return 0, time.Time{}, nil
+}
+
+func (s *memoryOTPStore) ClearOTPFailures(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, id)
+	return nil
+}
+
+func (s *memoryOTPStore) PurgeExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, code := range s.codes {
+		if now.After(code.Expires) {
+			delete(s.codes, id)
+		}
+	}
+	for id, failures := range s.failures {
+		if now.After(failures.last.Add(otpFailureMemory)) {
+			delete(s.failures, id)
+		}
+	}
+	return nil
+}
+
+// dbOTPStore keeps codes in the connected database, times are unix seconds
+type dbOTPStore struct{}
+
+func (dbOTPStore) createTable() error {
+	if _, err := DB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) NOT NULL PRIMARY KEY, code_hash VARCHAR(64) NOT NULL, expires_at BIGINT NOT NULL, sent_at BIGINT NOT NULL, attempts INTEGER NOT NULL DEFAULT 0)", EscapeId(otpTable))); err != nil {
+		return err
+	}
+	_, err := DB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) NOT NULL PRIMARY KEY, failures INTEGER NOT NULL DEFAULT 0, failed_at BIGINT NOT NULL)", EscapeId(otpFailuresTable)))
+	return err
+}
+
+func (dbOTPStore) SaveOTP(code OTPCode) error {
+	verb, suffix := DBDialect.OnConflict(false, []string{"id"}, []string{"code_hash", "expires_at", "sent_at", "attempts"})
+	query := fmt.Sprintf("%s %s (id, code_hash, expires_at, sent_at, attempts) VALUES (?, ?, ?, ?, ?)%s", verb, EscapeId(otpTable), suffix)
+	_, err := DB.Exec(Rebind(query), code.ID, code.Hash, code.Expires.Unix(), code.SentAt.Unix(), code.Attempts)
+	return err
+}
+
+func (dbOTPStore) GetOTP(id string) (*OTPCode, error) {
+	query := fmt.Sprintf("SELECT code_hash, expires_at, sent_at, attempts FROM %s WHERE id = ?", EscapeId(otpTable))
+	code := &OTPCode{ID: id}
+	var expires, sent int64
+	err := DB.QueryRow(Rebind(query), id).Scan(&code.Hash, &expires, &sent, &code.Attempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	code.Expires = time.Unix(expires, 0)
+	code.SentAt = time.Unix(sent, 0)
+	return code, nil
+}
+
+func (dbOTPStore) AddOTPAttempt(id string) (int, error) {
+	query := fmt.Sprintf("UPDATE %s SET attempts = attempts + 1 WHERE id = ?", EscapeId(otpTable))
+	if _, err := DB.Exec(Rebind(query), id); err != nil {
+		return 0, err
+	}
+	var attempts int
+	query = fmt.Sprintf("SELECT attempts FROM %s WHERE id = ?", EscapeId(otpTable))
+	err := DB.QueryRow(Rebind(query), id).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return otpMaxAttempts() + 1, nil
+	}
+	return attempts, err
+}
+
+func (dbOTPStore) DeleteOTP(id string) (bool, error) {
+	result, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", EscapeId(otpTable))), id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func (dbOTPStore) AddOTPFailure(id string, at time.Time) (int, error) {
+	query := fmt.Sprintf("UPDATE %s SET failures = failures + 1, failed_at = ? WHERE id = ?", EscapeId(otpFailuresTable))
+	result, err := DB.Exec(Rebind(query), at.Unix(), id)
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if affected == 0 {
+		// The first wrong guess of the recipient, a concurrent one may have inserted it meanwhile
+		verb, suffix := DBDialect.OnConflict(true, []string{"id"}, nil)
+		insert := fmt.Sprintf("%s %s (id, failures, failed_at) VALUES (?, 1, ?)%s", verb, EscapeId(otpFailuresTable), suffix)
+		if result, err = DB.Exec(Rebind(insert), id, at.Unix()); err != nil {
+			return 0, err
+		}
+		if inserted, _ := result.RowsAffected(); inserted == 0 {
+			if _, err := DB.Exec(Rebind(query), at.Unix(), id); err != nil {
+				return 0, err
+			}
+		}
+	}
+	failures, _, err := dbOTPStore{}.GetOTPFailures(id)
+	return failures, err
+}
+
+func (dbOTPStore) GetOTPFailures(id string) (int, time.Time, error) {
+	query := fmt.Sprintf("SELECT failures, failed_at FROM %s WHERE id = ?", EscapeId(otpFailuresTable))
+	var failures int
+	var failedAt int64
+	err := DB.QueryRow(Rebind(query), id).Scan(&failures, &failedAt)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return failures, time.Unix(failedAt, 0), nil
+}
+
+func (dbOTPStore) ClearOTPFailures(id string) error {
+	_, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", EscapeId(otpFailuresTable))), id)
+	return err
+}
+
+func (dbOTPStore) PurgeExpired(now time.Time) error {
+	if _, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE expires_at < ?", EscapeId(otpTable))), now.Unix()); err != nil {
+		return err
+	}
+	_, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE failed_at < ?", EscapeId(otpFailuresTable))), now.Add(-otpFailureMemory).Unix())
+	return err
+}
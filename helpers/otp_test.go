@@ -0,0 +1,134 @@
+package helpers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// useOTPStore starts the OTP store of OTP_STORE name with the default limits and no resend cooldown
+func useOTPStore(t *testing.T, name string) {
+	t.Helper()
+	openTestDB(t)
+	storeName, ttl, attempts, cooldown := OTPStoreName, OTPTTL, OTPMaxAttempts, OTPResendCooldown
+	OTPStoreName, OTPTTL, OTPMaxAttempts, OTPResendCooldown = name, 0, 0, -1
+	if res := InitOTPStore(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	t.Cleanup(func() {
+		SetOTPStore(nil)
+		OTPStoreName, OTPTTL, OTPMaxAttempts, OTPResendCooldown = storeName, ttl, attempts, cooldown
+	})
+}
+
+// backdateOTPFailures moves the last wrong guess of a recipient into the past
+func backdateOTPFailures(t *testing.T, purpose, recipient string, by time.Duration) {
+	t.Helper()
+	id := otpID(purpose, recipient)
+	switch store := currentOTPStore().(type) {
+	case *memoryOTPStore:
+		if failures, ok := store.failures[id]; ok {
+			failures.last = failures.last.Add(-by)
+		}
+	case dbOTPStore:
+		query := fmt.Sprintf("UPDATE %s SET failed_at = failed_at - ? WHERE id = ?", EscapeId(otpFailuresTable))
+		if _, err := DB.Exec(Rebind(query), int64(by.Seconds()), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOTPLockoutAcrossResends(t *testing.T) {
+	for _, name := range []string{"memory", "database"} {
+		t.Run(name, func(t *testing.T) {
+			useOTPStore(t, name)
+			recipient := "Joe@example.com"
+
+			// Four wrong guesses, a new code, and the fifth wrong guess still counts
+			if err := IssueOTP("verification", recipient, "1111"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 4; i++ {
+				if err := VerifyOTP("verification", recipient, "0000"); err == nil {
+					t.Fatal("VerifyOTP accepted a wrong code")
+				}
+			}
+			if err := IssueOTP("verification", "joe@example.com", "2222"); err != nil {
+				t.Fatalf("IssueOTP after 4 wrong guesses = %v", err)
+			}
+			if err := VerifyOTP("verification", recipient, "1111"); err == nil {
+				t.Fatal("the replaced code is still accepted")
+			}
+			cooldown, ok := IssueOTP("verification", recipient, "3333").(*OTPCooldownError)
+			if !ok || cooldown.RetryAfter <= time.Minute || cooldown.RetryAfter > 2*time.Minute {
+				t.Fatalf("IssueOTP after 5 wrong guesses = %v, want a 2 minute lockout", cooldown)
+			}
+			// The current code keeps its own attempts during the lockout
+			if err := VerifyOTP("verification", recipient, "2222"); err != nil {
+				t.Fatalf("VerifyOTP of the current code = %v", err)
+			}
+			if failures, _, _ := currentOTPStore().GetOTPFailures(otpID("verification", recipient)); failures != 0 {
+				t.Errorf("%d wrong guesses kept after a successful verification", failures)
+			}
+
+			// Every exhausted code doubles the lockout
+			for i := 0; i < 2*otpMaxAttempts(); i++ {
+				if i%otpMaxAttempts() == 0 {
+					backdateOTPFailures(t, "login", recipient, otpMaxLockout)
+					if err := IssueOTP("login", recipient, "4444"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				VerifyOTP("login", recipient, "0000")
+			}
+			if err := VerifyOTP("login", recipient, "4444"); err == nil {
+				t.Errorf("VerifyOTP accepted a code after OTP_MAX_ATTEMPTS guesses")
+			}
+			cooldown, ok = IssueOTP("login", recipient, "5555").(*OTPCooldownError)
+			if !ok || cooldown.RetryAfter <= 3*time.Minute || cooldown.RetryAfter > 4*time.Minute {
+				t.Fatalf("IssueOTP after 10 wrong guesses = %v, want a 4 minute lockout", cooldown)
+			}
+			backdateOTPFailures(t, "login", recipient, 4*time.Minute)
+			if err := IssueOTP("login", recipient, "5555"); err != nil {
+				t.Errorf("IssueOTP after the lockout = %v", err)
+			}
+
+			// Wrong guesses are forgotten long after the last one
+			currentOTPStore().PurgeExpired(time.Now().Add(otpFailureMemory + time.Minute))
+			if failures, _, _ := currentOTPStore().GetOTPFailures(otpID("login", recipient)); failures != 0 {
+				t.Errorf("PurgeExpired kept %d wrong guesses", failures)
+			}
+		})
+	}
+}
+
+func TestWithdrawOTP(t *testing.T) {
+	useOTPStore(t, "database")
+	OTPResendCooldown = 60
+	if err := IssueOTP("verification", "+255700000000", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := IssueOTP("verification", "+255700000000", "5678").(*OTPCooldownError); !ok {
+		t.Fatal("IssueOTP ignored OTP_RESEND_COOLDOWN")
+	}
+	if err := WithdrawOTP("verification", "+255700000000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyOTP("verification", "+255700000000", "1234"); err == nil {
+		t.Errorf("a withdrawn code is accepted")
+	}
+	if err := IssueOTP("verification", "+255700000000", "5678"); err != nil {
+		t.Errorf("IssueOTP after an undelivered code = %v", err)
+	}
+}
+
+func TestOTPLockout(t *testing.T) {
+	defer func(attempts, cooldown int) { OTPMaxAttempts, OTPResendCooldown = attempts, cooldown }(OTPMaxAttempts, OTPResendCooldown)
+	OTPMaxAttempts, OTPResendCooldown = 5, 60
+	tests := map[int]time.Duration{0: 0, 4: 0, 5: 2 * time.Minute, 9: 2 * time.Minute, 10: 4 * time.Minute, 50: 1024 * time.Minute, 100: otpMaxLockout, 1000: otpMaxLockout}
+	for failures, want := range tests {
+		if got := otpLockout(failures); got != want {
+			t.Errorf("otpLockout(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported PASSWORD_HASH algorithms
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// argon2id parameters for new hashes, older hashes with other parameters are rehashed on login
+const (
+	argonMemory  = 64 * 1024
+	argonTime    = 3
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// passwordHashAlgorithm returns the configured algorithm, argon2id by default
+func passwordHashAlgorithm() string {
+	if strings.EqualFold(PasswordHash, HashBcrypt) {
+		return HashBcrypt
+	}
+	return HashArgon2id
+}
+
+// HashPassword hashes a plaintext password with the configured algorithm
+func HashPassword(password string) (string, error) {
+	if passwordHashAlgorithm() == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword compares a password with a stored hash in constant time.
+// needsRehash is true when the hash uses another algorithm or older parameters,
+// including legacy plaintext values which are compared directly.
+func VerifyPassword(stored, password string) (ok bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		var version, memory, time, threads int
+		parts := strings.Split(stored, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false
+		}
+		computed := argon2.IDKey([]byte(password), salt, uint32(time), uint32(memory), uint8(threads), uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false
+		}
+		current := version == argon2.Version && memory == argonMemory && time == argonTime && threads == argonThreads
+		return true, passwordHashAlgorithm() != HashArgon2id || !current
+
+	case strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$"):
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return false, false
+		}
+		cost, _ := bcrypt.Cost([]byte(stored))
+		return true, passwordHashAlgorithm() != HashBcrypt || cost < bcrypt.DefaultCost
+
+	default:
+		// Rows written before hashing was introduced hold the plaintext
+		if stored == "" || subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+			return false, false
+		}
+		return true, true
+	}
+}
+
+// VerifyDummyPassword spends the time of a real verification when the user does not exist,
+// hashing costs the same as verifying with the configured algorithm
+func VerifyDummyPassword(password string) {
+	HashPassword(password)
+}
+
+// PasswordColumns returns the columns of table that are stored hashed:
+// the table's "password_columns" from the schema config plus the login password column
+func PasswordColumns(table string) []string {
+	schemaMu.RLock()
+	columns := append([]string{}, schemaConfig.Tables[table].PasswordColumns...)
+	schemaMu.RUnlock()
+	if table == authTable() {
+		columns = append(columns, authPasswordColumn())
+	}
+	return columns
+}
+
+// HashPasswordColumns replaces plaintext values of password columns in data with their hash
+func HashPasswordColumns(table string, data map[string]interface{}) error {
+	for _, column := range PasswordColumns(table) {
+		value, ok := data[column]
+		if !ok || value == nil {
+			continue
+		}
+		password, ok := value.(string)
+		if !ok || password == "" {
+			return fmt.Errorf("Password column '%s' requires a non empty string", column)
+		}
+		hash, err := HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("Unable to hash password: %v", err)
+		}
+		data[column] = hash
+	}
+	return nil
+}
+
+// authTable, authUsernameColumn and authPasswordColumn apply the AUTH_* defaults
+func authTable() string {
+	if AuthTable == "" {
+		return "users"
+	}
+	return AuthTable
+}
+
+func authUsernameColumn() string {
+	if AuthUsernameColumn == "" {
+		return "user_name"
+	}
+	return AuthUsernameColumn
+}
+
+func authPasswordColumn() string {
+	if AuthPasswordColumn == "" {
+		return "password"
+	}
+	return AuthPasswordColumn
+}
+
+// AuthColumns returns the login table with its username and password columns
+func AuthColumns() (table, username, password string) {
+	return authTable(), authUsernameColumn(), authPasswordColumn()
+}
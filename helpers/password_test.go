@@ -0,0 +1,81 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPassword(t *testing.T) {
+	defer func(previous string) { PasswordHash = previous }(PasswordHash)
+	for _, algorithm := range []string{HashArgon2id, HashBcrypt} {
+		PasswordHash = algorithm
+		hash, err := HashPassword("s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, _ := HashPassword("s3cret")
+		if hash == other {
+			t.Errorf("%s hashes of the same password are equal, the salt is missing", algorithm)
+		}
+		if ok, rehash := VerifyPassword(hash, "s3cret"); !ok || rehash {
+			t.Errorf("%s VerifyPassword = %t, %t, want true, false", algorithm, ok, rehash)
+		}
+		if ok, _ := VerifyPassword(hash, "S3cret"); ok {
+			t.Errorf("%s VerifyPassword accepted a wrong password", algorithm)
+		}
+	}
+}
+
+func TestVerifyPasswordRehash(t *testing.T) {
+	defer func(previous string) { PasswordHash = previous }(PasswordHash)
+	PasswordHash = HashBcrypt
+	bcryptHash, _ := HashPassword("pw")
+	cheap, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	PasswordHash = HashArgon2id
+	argonHash, _ := HashPassword("pw")
+	// Same key parameters as argonHash except the memory cost
+	older := strings.Replace(argonHash, "m=65536,", "m=32768,", 1)
+
+	tests := []struct {
+		algorithm string
+		stored    string
+		ok        bool
+		rehash    bool
+	}{
+		{HashArgon2id, argonHash, true, false},
+		{HashArgon2id, bcryptHash, true, true},
+		{HashBcrypt, argonHash, true, true},
+		{HashBcrypt, string(cheap), true, true},
+		{HashArgon2id, "pw", true, true}, // plaintext row written before hashing
+		{HashArgon2id, "", false, false},
+		{HashArgon2id, older, false, false},
+		{HashArgon2id, "$argon2id$v=19$broken", false, false},
+	}
+	for _, tt := range tests {
+		PasswordHash = tt.algorithm
+		if ok, rehash := VerifyPassword(tt.stored, "pw"); ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("%s VerifyPassword(%.20s) = %t, %t, want %t, %t", tt.algorithm, tt.stored, ok, rehash, tt.ok, tt.rehash)
+		}
+	}
+}
+
+func TestHashPasswordColumns(t *testing.T) {
+	defer func(table, column string) { AuthTable, AuthPasswordColumn = table, column }(AuthTable, AuthPasswordColumn)
+	AuthTable, AuthPasswordColumn = "accounts", "pass"
+	data := map[string]interface{}{"user_name": "joe", "pass": "pw"}
+	if err := HashPasswordColumns("accounts", data); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := VerifyPassword(data["pass"].(string), "pw"); !ok || data["pass"] == "pw" {
+		t.Errorf("HashPasswordColumns stored %v", data["pass"])
+	}
+	plain := map[string]interface{}{"pass": "pw"}
+	if HashPasswordColumns("users", plain); plain["pass"] != "pw" {
+		t.Errorf("HashPasswordColumns hashed a column of another table")
+	}
+	if err := HashPasswordColumns("accounts", map[string]interface{}{"pass": ""}); err == nil {
+		t.Errorf("HashPasswordColumns accepted an empty password")
+	}
+}
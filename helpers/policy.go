@@ -0,0 +1,362 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Table actions checked by the policy
+const (
+	ActionRead   = "read"
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// RolePolicy lists what one role may do, names accept glob patterns ("*", "report_*")
+type RolePolicy struct {
+	Routes []string            `json:"routes"` // route names, e.g. "read", "database-handle"
+	Tables map[string][]string `json:"tables"` // table -> actions (read, create, update, delete or *)
+}
+
+// PolicyConfig is the content of the policy file (POLICY_CONFIG)
+type PolicyConfig struct {
+	DefaultRole string                `json:"default_role"` // role of users without one
+	Roles       map[string]RolePolicy `json:"roles"`
+}
+
+// PermissionError names the permission a request is missing, routes answer it with 403
+type PermissionError struct {
+	Permission string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Forbidden: missing permission '%s'", e.Permission)
+}
+
+// defaultPolicy applies without a policy file: admins may do everything, other users may read
+// every table and use their own session routes. Writes need a policy file, otherwise any user
+// could update the auth table and change their own role or another user's password
+var defaultPolicy = PolicyConfig{
+	DefaultRole: "user",
+	Roles: map[string]RolePolicy{
+		"admin": {Routes: []string{"*"}, Tables: map[string][]string{"*": {"*"}}},
+		"user": {
+			Routes: []string{"read", "joint-read", "list", "list-all", "search", "search-between", "count", "aggregate",
+				"read-bulk", "count-bulk", "bulk-count", "logout", "handshake", "2fa-enroll", "2fa-confirm", "2fa-disable"},
+			Tables: map[string][]string{"*": {ActionRead}},
+		},
+	},
+}
+
+var (
+	policyMu     sync.RWMutex
+	policyConfig = defaultPolicy
+)
+
+// routeActions is the table action of each CRUD route, routes missing here are only checked by name
+var routeActions = map[string]string{
+	"read":           ActionRead,
+	"joint-read":     ActionRead,
+	"list":           ActionRead,
+	"list-all":       ActionRead,
+	"search":         ActionRead,
+	"search-between": ActionRead,
+	"count":          ActionRead,
+	"aggregate":      ActionRead,
+	"read-bulk":      ActionRead,
+	"count-bulk":     ActionRead,
+	"bulk-count":     ActionRead,
+	"create":         ActionCreate,
+	"create-bulk":    ActionCreate,
+	"update":         ActionUpdate,
+	"update-bulk":    ActionUpdate,
+	"delete":         ActionDelete,
+	"delete-bulk":    ActionDelete,
+}
+
+// defaultPolicyConfigPath may be missing, a POLICY_CONFIG naming another file must exist
+const defaultPolicyConfigPath = "configurations/policy.json"
+
+// LoadPolicyConfig reads the role policy file, a missing default file keeps the default policy
+func LoadPolicyConfig() map[string]interface{} {
+	path := PolicyConfigPath
+	if path == "" {
+		path = defaultPolicyConfigPath
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && path == defaultPolicyConfigPath {
+			policyMu.Lock()
+			policyConfig = defaultPolicy
+			policyMu.Unlock()
+			return map[string]interface{}{
+				"success": true,
+				"message": fmt.Sprintf("No policy config at %s, using the default policy", path),
+			}
+		}
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Failed to read policy config %s: %v", path, err),
+		}
+	}
+	var config PolicyConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Invalid policy config %s: %v", path, err),
+		}
+	}
+	for name, role := range config.Roles {
+		if err := validateRolePolicy(role); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Invalid role %s: %v", name, err),
+			}
+		}
+	}
+
+	policyMu.Lock()
+	policyConfig = config
+	policyMu.Unlock()
+	return map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Policy config loaded from %s", path),
+	}
+}
+
+// validateRolePolicy rejects unknown table actions and malformed glob patterns
+func validateRolePolicy(role RolePolicy) error {
+	patterns := append([]string{}, role.Routes...)
+	for table, actions := range role.Tables {
+		patterns = append(patterns, table)
+		for _, action := range actions {
+			if !validAction(action) {
+				return fmt.Errorf("invalid action %q for table %s", action, table)
+			}
+		}
+	}
+	if pattern, ok := invalidPattern(patterns); !ok {
+		return fmt.Errorf("invalid pattern %q", pattern)
+	}
+	return nil
+}
+
+// rolePolicy returns the policy of a role, API key scopes included, policyMu must be held
+func rolePolicy(role string) RolePolicy {
+	if policy, ok := apiKeyPolicy(role); ok {
+		return policy
+	}
+	return policyConfig.Roles[role]
+}
+
+// routeName is the last static segment of a route path: "/files/download/:filename" -> "download"
+func routeName(fullPath string) string {
+	segments := strings.Split(strings.Trim(fullPath, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i] != "" && !strings.HasPrefix(segments[i], ":") && !strings.HasPrefix(segments[i], "*") {
+			return segments[i]
+		}
+	}
+	return ""
+}
+
+// UserRoles reads the roles of a user row from AUTH_ROLE_COLUMN (default "role"),
+// a comma separated string or a JSON list
+func UserRoles(user map[string]interface{}) []string {
+	column := AuthRoleColumn
+	if column == "" {
+		column = "role"
+	}
+	return normalizeRoles(user[column])
+}
+
+// RolesFromClaims returns the roles of validated token claims, the default role when none are set
+func RolesFromClaims(claims map[string]interface{}) []string {
+	roles := normalizeRoles(claims["roles"])
+	if len(roles) == 0 {
+		policyMu.RLock()
+		if policyConfig.DefaultRole != "" {
+			roles = []string{policyConfig.DefaultRole}
+		}
+		policyMu.RUnlock()
+	}
+	return roles
+}
+
+func normalizeRoles(value interface{}) []string {
+	var roles []string
+	switch v := value.(type) {
+	case string:
+		for _, role := range strings.Split(v, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+	case []string:
+		roles = append(roles, v...)
+	case []interface{}:
+		for _, role := range v {
+			if s, ok := role.(string); ok && s != "" {
+				roles = append(roles, s)
+			}
+		}
+	}
+	return roles
+}
+
+// CheckRoute verifies that one of the roles may call the route
+func CheckRoute(roles []string, route string) error {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	for _, role := range roles {
+		if matchAny(rolePolicy(role).Routes, route) {
+			return nil
+		}
+	}
+	return &PermissionError{Permission: "route:" + route}
+}
+
+// CheckTable verifies that one of the roles may perform the action on the table
+func CheckTable(roles []string, table, action string) error {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	for _, role := range roles {
+		for pattern, actions := range rolePolicy(role).Tables {
+			if matchAny([]string{pattern}, table) && matchAny(actions, action) {
+				return nil
+			}
+		}
+	}
+	return &PermissionError{Permission: table + ":" + action}
+}
+
+// CheckGrant verifies that the roles hold every route and table permission of policy,
+// so a role or API key scope can only be handed out by a caller who has it
+func CheckGrant(roles []string, policy RolePolicy) error {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	for _, route := range policy.Routes {
+		held := false
+		for _, role := range roles {
+			if patternCovered(rolePolicy(role).Routes, route) {
+				held = true
+				break
+			}
+		}
+		if !held {
+			return &PermissionError{Permission: "route:" + route}
+		}
+	}
+	for table, actions := range policy.Tables {
+		for _, action := range actions {
+			held := false
+			for _, role := range roles {
+				for pattern, heldActions := range rolePolicy(role).Tables {
+					if patternCovered([]string{pattern}, table) && patternCovered(heldActions, action) {
+						held = true
+					}
+				}
+			}
+			if !held {
+				return &PermissionError{Permission: table + ":" + action}
+			}
+		}
+	}
+	return nil
+}
+
+// definedRole returns the policy of a role of the policy config
+func definedRole(role string) (RolePolicy, bool) {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	policy, ok := policyConfig.Roles[role]
+	return policy, ok
+}
+
+// CheckRequest applies the route and table permissions to a single item request body
+func CheckRequest(roles []string, route string, body map[string]interface{}) error {
+	if err := CheckRoute(roles, route); err != nil {
+		return err
+	}
+	action, ok := routeActions[route]
+	if !ok {
+		return nil
+	}
+	return checkBodyTables(roles, action, body)
+}
+
+// CheckBulkRequest applies the route and table permissions to every item of a bulk request,
+// transaction steps are checked with their own "action"
+func CheckBulkRequest(roles []string, route string, items []map[string]interface{}) error {
+	if err := CheckRoute(roles, route); err != nil {
+		return err
+	}
+	for _, item := range items {
+		action, ok := routeActions[route]
+		if !ok {
+			action, _ = item["action"].(string)
+			if !validAction(action) || action == "*" {
+				continue // rejected by the controller
+			}
+		}
+		if err := checkBodyTables(roles, action, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBodyTables checks the "table" of a request and the tables it joins
+func checkBodyTables(roles []string, action string, body map[string]interface{}) error {
+	if table, ok := body["table"].(string); ok && table != "" {
+		if err := CheckTable(roles, table, action); err != nil {
+			return err
+		}
+	}
+	if joins, ok := body["joins"].([]interface{}); ok {
+		for _, join := range joins {
+			if joinMap, ok := join.(map[string]interface{}); ok {
+				if name, ok := joinMap["table"].(string); ok {
+					if err := CheckTable(roles, name, ActionRead); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchAny matches a name against names and glob patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// patternCovered reports whether patterns grant everything pattern does: a glob pattern is only
+// covered by itself or "*", a plain name by any pattern matching it
+func patternCovered(patterns []string, pattern string) bool {
+	for _, held := range patterns {
+		if held == pattern || held == "*" {
+			return true
+		}
+	}
+	return !strings.ContainsAny(pattern, `*?[\`) && matchAny(patterns, pattern)
+}
+
+func validAction(action string) bool {
+	switch action {
+	case ActionRead, ActionCreate, ActionUpdate, ActionDelete, "*":
+		return true
+	}
+	return false
+}
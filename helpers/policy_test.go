@@ -0,0 +1,147 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// usePolicy loads a policy file of the test, or the default policy without content.
+// The previous policy is restored afterwards.
+func usePolicy(t *testing.T, content string) map[string]interface{} {
+	t.Helper()
+	path, previous := PolicyConfigPath, policyConfig
+	t.Cleanup(func() {
+		policyMu.Lock()
+		PolicyConfigPath, policyConfig = path, previous
+		policyMu.Unlock()
+	})
+	if content == "" {
+		policyMu.Lock()
+		policyConfig = defaultPolicy
+		policyMu.Unlock()
+		return map[string]interface{}{"success": true}
+	}
+	PolicyConfigPath = filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(PolicyConfigPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadPolicyConfig()
+}
+
+func TestDefaultPolicyUserCannotWrite(t *testing.T) {
+	openTestDB(t)
+	useTokenStore(t, "memory")
+	usePolicy(t, "")
+
+	// A user without a role logs in and tries to make itself admin
+	login := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1})
+	claims := Authorization(map[string]interface{}{"authorization": login["message"].(string)})["message"].(map[string]interface{})["data"]
+	roles := RolesFromClaims(claims.(jwt.MapClaims))
+	if len(roles) != 1 || roles[0] != "user" {
+		t.Fatalf("RolesFromClaims = %v, want the default role", roles)
+	}
+	update := map[string]interface{}{
+		"table":      "users",
+		"data":       map[string]interface{}{"role": "admin"},
+		"conditions": map[string]interface{}{"id": 1},
+	}
+	if err := CheckRequest(roles, "update", update); err == nil {
+		t.Errorf("a user token may update its own role")
+	}
+	step := map[string]interface{}{"action": "update", "table": "users", "data": map[string]interface{}{"password": "x"}}
+	if err := CheckBulkRequest(roles, "transaction", []map[string]interface{}{step}); err == nil {
+		t.Errorf("a user token may change a password in a transaction")
+	}
+	for _, route := range []string{"create", "update-bulk", "delete"} {
+		if err := CheckRequest(roles, route, map[string]interface{}{"table": "orders"}); err == nil {
+			t.Errorf("the default user role may call %s", route)
+		}
+	}
+	if err := CheckRequest(roles, "read", map[string]interface{}{"table": "orders"}); err != nil {
+		t.Errorf("the default user role can't read: %v", err)
+	}
+	if err := CheckRequest([]string{"admin"}, "update", update); err != nil {
+		t.Errorf("admin can't update users: %v", err)
+	}
+}
+
+func TestPolicyConfig(t *testing.T) {
+	res := usePolicy(t, `{"default_role": "reader", "roles": {
+		"reader": {"routes": ["read", "list*"], "tables": {"report_*": ["read"]}},
+		"clerk":  {"routes": ["create"], "tables": {"orders": ["create", "read"]}}
+	}}`)
+	if !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	tests := []struct {
+		roles []string
+		route string
+		body  map[string]interface{}
+		ok    bool
+	}{
+		{[]string{"reader"}, "list-all", map[string]interface{}{"table": "report_sales"}, true},
+		{[]string{"reader"}, "read", map[string]interface{}{"table": "orders"}, false},
+		{[]string{"reader"}, "create", map[string]interface{}{"table": "report_sales"}, false},
+		{[]string{"reader", "clerk"}, "create", map[string]interface{}{"table": "orders"}, true},
+		{[]string{"clerk"}, "create", map[string]interface{}{"table": "customers"}, false},
+		{[]string{"reader"}, "read", map[string]interface{}{"table": "report_sales",
+			"joins": []interface{}{map[string]interface{}{"table": "orders"}}}, false},
+		{[]string{"unknown"}, "read", map[string]interface{}{"table": "report_sales"}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckRequest(tt.roles, tt.route, tt.body); (err == nil) != tt.ok {
+			t.Errorf("CheckRequest(%v, %s, %v) = %v, want ok %t", tt.roles, tt.route, tt.body, err, tt.ok)
+		}
+	}
+	if roles := RolesFromClaims(map[string]interface{}{}); len(roles) != 1 || roles[0] != "reader" {
+		t.Errorf("RolesFromClaims without roles = %v, want [reader]", roles)
+	}
+	err := CheckRequest([]string{"reader"}, "delete", map[string]interface{}{"table": "report_sales"})
+	if err == nil || err.Error() != "Forbidden: missing permission 'route:delete'" {
+		t.Errorf("CheckRequest delete = %v", err)
+	}
+}
+
+func TestLoadPolicyConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		`{"roles": `,
+		`{"roles": {"x": {"tables": {"orders": ["drop"]}}}}`,
+		`{"roles": {"x": {"routes": ["[read"]}}}`,
+	} {
+		if res := usePolicy(t, content); res["success"].(bool) {
+			t.Errorf("LoadPolicyConfig(%s) succeeded", content)
+		}
+	}
+
+	// Only the default path may be missing, a configured file that isn't there must not fall back
+	PolicyConfigPath = filepath.Join(t.TempDir(), "missing.json")
+	if res := LoadPolicyConfig(); res["success"].(bool) {
+		t.Errorf("LoadPolicyConfig of a missing POLICY_CONFIG succeeded: %v", res["message"])
+	}
+	PolicyConfigPath = ""
+	if res := LoadPolicyConfig(); !res["success"].(bool) {
+		t.Errorf("LoadPolicyConfig without a policy file = %v", res["message"])
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  int
+	}{
+		{"admin, clerk", 2},
+		{[]interface{}{"admin", "", 3}, 1},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		if roles := UserRoles(map[string]interface{}{"role": tt.value}); len(roles) != tt.want {
+			t.Errorf("UserRoles(%v) = %v", tt.value, roles)
+		}
+	}
+	if name := routeName("/api/v1/files/download/:filename"); name != "download" {
+		t.Errorf("routeName = %s", name)
+	}
+}
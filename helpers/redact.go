@@ -0,0 +1,84 @@
+package helpers
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultRedactPatterns apply when the schema config has no "redact" entry
+var defaultRedactPatterns = []string{"*password*", "*_secret"}
+
+// IsRedacted reports whether a result column must be removed before rows leave the server.
+// Global patterns always apply, table rules and password columns apply for the given tables
+// or for every table when nil.
+func IsRedacted(tables []string, column string) bool {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+	patterns := schemaConfig.Redact
+	if patterns == nil {
+		patterns = defaultRedactPatterns
+	}
+	if matchRedact(patterns, column) {
+		return true
+	}
+	if tables == nil {
+		for _, table := range schemaConfig.Tables {
+			if matchRedact(table.Redact, column) || matchRedact(table.PasswordColumns, column) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range tables {
+		if matchRedact(schemaConfig.Tables[name].Redact, column) || matchRedact(schemaConfig.Tables[name].PasswordColumns, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateLookup rejects redacted columns among the columns rows are matched, joined or sorted by,
+// such lookups would reveal a redacted value one guess at a time
+func ValidateLookup(tables []string, columnLists ...[]string) error {
+	for _, columns := range columnLists {
+		for _, column := range columns {
+			if IsRedacted(tables, column) {
+				return fmt.Errorf("Column '%s' is redacted and can't be used to match or sort rows", column)
+			}
+		}
+	}
+	return nil
+}
+
+// RedactRows removes redacted columns from rows in place
+func RedactRows(rows []map[string]interface{}, tables []string) []map[string]interface{} {
+	redacted := map[string]bool{}
+	for _, row := range rows {
+		for column := range row {
+			hidden, seen := redacted[column]
+			if !seen {
+				hidden = IsRedacted(tables, column)
+				redacted[column] = hidden
+			}
+			if hidden {
+				delete(row, column)
+			}
+		}
+	}
+	return rows
+}
+
+// matchRedact matches a column against column names and glob patterns, case insensitive
+func matchRedact(patterns []string, column string) bool {
+	column = strings.ToLower(column)
+	if i := strings.LastIndex(column, "."); i >= 0 {
+		column = column[i+1:]
+	}
+	for _, pattern := range patterns {
+		if ok, err := path.Match(strings.ToLower(pattern), column); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
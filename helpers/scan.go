@@ -0,0 +1,211 @@
+package helpers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ScanOptions tunes how ScanRowsWith converts column values
+type ScanOptions struct {
+	// DecimalAsNumber returns DECIMAL/NUMERIC as float64 instead of the exact string
+	DecimalAsNumber bool
+	// Tables whose redaction rules apply, nil applies the rules of every table
+	Tables []string
+	// Unredacted keeps redacted columns, only for internal lookups that never reach a client
+	Unredacted bool
+}
+
+// Column kinds derived from the driver column type names
+const (
+	columnText = iota
+	columnInteger
+	columnFloat
+	columnDecimal
+	columnBool
+	columnJSON
+	columnDateTime
+	columnBinary
+)
+
+// mysqlDateTime is the layout MySQL returns DATETIME/TIMESTAMP in when parseTime is off
+const mysqlDateTime = "2006-01-02 15:04:05.999999999"
+
+// ScanOptionsFrom reads the scan options of a request ("decimal_as_number": true)
+// and the tables it reads from ("table" and the "joins" tables)
+func ScanOptionsFrom(options map[string]interface{}) ScanOptions {
+	decimalAsNumber, _ := options["decimal_as_number"].(bool)
+	scan := ScanOptions{DecimalAsNumber: decimalAsNumber}
+	if table, ok := options["table"].(string); ok && table != "" {
+		scan.Tables = []string{table}
+		if joins, ok := options["joins"].([]interface{}); ok {
+			for _, join := range joins {
+				if joinMap, ok := join.(map[string]interface{}); ok {
+					if name, ok := joinMap["table"].(string); ok {
+						scan.Tables = append(scan.Tables, name)
+					}
+				}
+			}
+		}
+	}
+	return scan
+}
+
+// ScanRows converts sql.Rows into []map[string]interface{} keeping column types, see ScanRowsWith
+func ScanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	return ScanRowsWith(rows, ScanOptions{})
+}
+
+// ScanRowsWith converts sql.Rows into []map[string]interface{} using rows.ColumnTypes():
+// integers and floats become numbers, DECIMAL an exact string (or a number by option),
+// JSON columns parsed values, DATETIME/TIMESTAMP RFC3339 strings and binary columns
+// {"type": "base64", "data": "..."}. Columns matching the redaction policy are left out.
+func ScanRowsWith(rows *sql.Rows, options ScanOptions) ([]map[string]interface{}, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	kinds := make([]int, len(columnTypes))
+	redacted := make([]bool, len(columnTypes))
+	for i, columnType := range columnTypes {
+		kinds[i] = columnKind(columnType.DatabaseTypeName())
+		redacted[i] = !options.Unredacted && IsRedacted(options.Tables, columnType.Name())
+	}
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		columnValues := make([]interface{}, len(columnTypes))
+		columnPointers := make([]interface{}, len(columnTypes))
+		for i := range columnValues {
+			columnPointers[i] = &columnValues[i]
+		}
+		if err := rows.Scan(columnPointers...); err != nil {
+			return nil, err
+		}
+
+		rowMap := make(map[string]interface{}, len(columnTypes))
+		for i, columnType := range columnTypes {
+			if redacted[i] {
+				continue
+			}
+			rowMap[columnType.Name()] = convertColumn(columnValues[i], kinds[i], options)
+		}
+		results = append(results, rowMap)
+	}
+	return results, rows.Err()
+}
+
+// columnKind maps a DatabaseTypeName of the MySQL, PostgreSQL or SQLite driver to a column kind
+func columnKind(typeName string) int {
+	name := strings.ToUpper(typeName)
+	name = strings.TrimPrefix(name, "UNSIGNED ")
+	if i := strings.IndexAny(name, "( "); i >= 0 {
+		name = name[:i]
+	}
+	switch name {
+	case "INT", "INTEGER", "TINYINT", "SMALLINT", "MEDIUMINT", "BIGINT", "INT2", "INT4", "INT8", "YEAR", "SERIAL", "BIGSERIAL":
+		return columnInteger
+	case "FLOAT", "DOUBLE", "REAL", "FLOAT4", "FLOAT8":
+		return columnFloat
+	case "DECIMAL", "NUMERIC":
+		return columnDecimal
+	case "BOOL", "BOOLEAN":
+		return columnBool
+	case "JSON", "JSONB":
+		return columnJSON
+	case "DATETIME", "TIMESTAMP", "TIMESTAMPTZ":
+		return columnDateTime
+	case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BINARY", "VARBINARY", "BYTEA", "BIT", "GEOMETRY":
+		return columnBinary
+	default:
+		return columnText
+	}
+}
+
+// convertColumn turns one scanned driver value into its JSON friendly form
+func convertColumn(value interface{}, kind int, options ScanOptions) interface{} {
+	if value == nil {
+		return nil
+	}
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	b, isBytes := value.([]byte)
+	text, isText := value.(string)
+	if isBytes && kind != columnBinary {
+		text, isText = string(b), true
+	}
+
+	switch kind {
+	case columnInteger:
+		if isText {
+			if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+				return i
+			}
+			if u, err := strconv.ParseUint(text, 10, 64); err == nil {
+				return u
+			}
+		}
+	case columnFloat:
+		if isText {
+			if f, err := strconv.ParseFloat(text, 64); err == nil {
+				return f
+			}
+		}
+	case columnDecimal:
+		if options.DecimalAsNumber {
+			if isText {
+				if f, err := strconv.ParseFloat(text, 64); err == nil {
+					return f
+				}
+			}
+			break
+		}
+		// Exact representation, float64 would lose precision
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case int64:
+			return strconv.FormatInt(v, 10)
+		}
+	case columnBool:
+		if isText {
+			if v, err := strconv.ParseBool(text); err == nil {
+				return v
+			}
+		}
+		if i, ok := value.(int64); ok {
+			return i != 0
+		}
+	case columnJSON:
+		if isText {
+			var parsed interface{}
+			if err := json.Unmarshal([]byte(text), &parsed); err == nil {
+				return parsed
+			}
+		}
+	case columnDateTime:
+		if isText {
+			if t, err := time.Parse(mysqlDateTime, text); err == nil {
+				return t.Format(time.RFC3339Nano)
+			}
+		}
+	case columnBinary:
+		if isBytes {
+			return map[string]interface{}{"type": "base64", "data": base64.StdEncoding.EncodeToString(b)}
+		}
+	default:
+		// Untyped columns (expressions, unknown types): text stays text, raw bytes are marked
+		if isBytes && !utf8.Valid(b) {
+			return map[string]interface{}{"type": "base64", "data": base64.StdEncoding.EncodeToString(b)}
+		}
+	}
+	if isText {
+		return text
+	}
+	return value
+}
@@ -0,0 +1,354 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Table exposure levels declared in the schema config file
+const (
+	ExposureHidden   = "hidden"
+	ExposureReadOnly = "read-only"
+	ExposureFull     = "full"
+)
+
+// ColumnInfo describes one introspected column
+type ColumnInfo struct {
+	Name       string `json:"name"`
+	DataType   string `json:"data_type"`
+	Nullable   bool   `json:"nullable"`
+	PrimaryKey bool   `json:"primary_key"`
+}
+
+// TableSchema describes one introspected table and how it is exposed
+type TableSchema struct {
+	Name     string                `json:"name"`
+	Exposure string                `json:"exposure"`
+	Columns  []ColumnInfo          `json:"columns"`
+	byName   map[string]ColumnInfo // lookup by column name
+}
+
+// TableConfig is the per-table entry of the schema config file
+type TableConfig struct {
+	Exposure        string   `json:"exposure"`
+	Redact          []string `json:"redact"`           // columns or glob patterns removed from results
+	PasswordColumns []string `json:"password_columns"` // columns hashed on create/update
+	TenantColumn    string   `json:"tenant_column"`    // column restricted to the caller's tenant
+}
+
+// SchemaConfig is the content of the schema config file (SCHEMA_CONFIG)
+type SchemaConfig struct {
+	Default string                 `json:"default"`
+	Redact  []string               `json:"redact"` // patterns for every table, nil uses the defaults
+	Tables  map[string]TableConfig `json:"tables"`
+}
+
+var (
+	schemaMu     sync.RWMutex
+	schemaTables map[string]*TableSchema
+	schemaConfig = SchemaConfig{Default: ExposureFull}
+)
+
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// defaultSchemaConfigPath may be missing, a SCHEMA_CONFIG naming another file must exist
+const defaultSchemaConfigPath = "configurations/schema.json"
+
+// LoadSchemaConfig reads the exposure config file, a missing default file exposes every table fully
+func LoadSchemaConfig() map[string]interface{} {
+	path := SchemaConfigPath
+	if path == "" {
+		path = defaultSchemaConfigPath
+	}
+	config := SchemaConfig{Default: ExposureFull}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) || path != defaultSchemaConfigPath {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Failed to read schema config %s: %v", path, err),
+			}
+		}
+	} else if err := json.Unmarshal(content, &config); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Invalid schema config %s: %v", path, err),
+		}
+	}
+	if config.Default == "" {
+		config.Default = ExposureFull
+	}
+	for name, table := range config.Tables {
+		if !validExposure(table.Exposure) {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Invalid exposure %q for table %s", table.Exposure, name),
+			}
+		}
+		if pattern, ok := invalidPattern(table.Redact); !ok {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Invalid redact pattern %q for table %s", pattern, name),
+			}
+		}
+	}
+	if pattern, ok := invalidPattern(config.Redact); !ok {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Invalid redact pattern %q", pattern),
+		}
+	}
+	if !validExposure(config.Default) {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("Invalid default exposure %q", config.Default),
+		}
+	}
+
+	schemaMu.Lock()
+	schemaConfig = config
+	schemaMu.Unlock()
+	return map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Schema config loaded from %s", path),
+	}
+}
+
+// LoadSchema introspects every table and column of the connected database
+func LoadSchema() map[string]interface{} {
+	if DB == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Database connection is not initialised",
+		}
+	}
+	query, params := DBDialect.ListTablesQuery()
+	rows, err := DB.Query(Rebind(query), params...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to list tables: " + err.Error(),
+		}
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return map[string]interface{}{
+				"success": false,
+				"message": "Failed to list tables: " + err.Error(),
+			}
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	tables := make(map[string]*TableSchema, len(names))
+	for _, name := range names {
+		columns, err := DBDialect.ListColumns(DB, name)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Failed to list columns of %s: %v", name, err),
+			}
+		}
+		table := &TableSchema{Name: name, Columns: columns, byName: make(map[string]ColumnInfo, len(columns))}
+		for _, column := range columns {
+			table.byName[column.Name] = column
+		}
+		tables[name] = table
+	}
+
+	schemaMu.Lock()
+	schemaTables = tables
+	schemaMu.Unlock()
+	return map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Schema loaded: %d table(s)", len(tables)),
+	}
+}
+
+// RefreshSchema reloads the registry after DDL and logs failures
+func RefreshSchema() {
+	if result := LoadSchema(); !result["success"].(bool) {
+		LogJSON(false, fmt.Sprintf("Schema refresh failed: %v", result["message"]))
+	}
+}
+
+// GetTableSchema returns the exposed schema of a table, nil if unknown or hidden
+func GetTableSchema(table string) *TableSchema {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+	t, ok := schemaTables[table]
+	if !ok {
+		return nil
+	}
+	exposure := tableExposure(table)
+	if exposure == ExposureHidden {
+		return nil
+	}
+	copied := *t
+	copied.Exposure = exposure
+	return &copied
+}
+
+// HasColumn reports whether the table has the column
+func (t *TableSchema) HasColumn(column string) bool {
+	_, ok := t.byName[column]
+	return ok
+}
+
+// PrimaryKey returns the primary key columns in table order
+func (t *TableSchema) PrimaryKey() []string {
+	var keys []string
+	for _, column := range t.Columns {
+		if column.PrimaryKey {
+			keys = append(keys, column.Name)
+		}
+	}
+	return keys
+}
+
+// ValidateTable rejects unknown or hidden tables, and writes to read-only tables
+func ValidateTable(table string, write bool) error {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+	if schemaTables == nil {
+		return fmt.Errorf("Schema registry is not loaded")
+	}
+	if _, ok := schemaTables[table]; !ok || tableExposure(table) == ExposureHidden {
+		return fmt.Errorf("Unknown table '%s'", table)
+	}
+	if write && tableExposure(table) == ExposureReadOnly {
+		return fmt.Errorf("Table '%s' is read-only", table)
+	}
+	return nil
+}
+
+// ValidateColumns rejects columns that do not exist in any of the given tables.
+// Columns may be qualified as table.column, "*" and table.* are accepted.
+func ValidateColumns(tables []string, columns []string) error {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+	for _, column := range columns {
+		if column == "*" {
+			continue
+		}
+		tableName, columnName := "", column
+		if i := strings.Index(column, "."); i >= 0 {
+			tableName, columnName = column[:i], column[i+1:]
+		}
+		if !identifierPattern.MatchString(columnName) && columnName != "*" {
+			return fmt.Errorf("Invalid column name '%s'", column)
+		}
+		found := false
+		for _, name := range tables {
+			if tableName != "" && tableName != name {
+				continue
+			}
+			if columnName == "*" {
+				found = true
+				break
+			}
+			if t, ok := schemaTables[name]; ok {
+				if _, ok := t.byName[columnName]; ok {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown column '%s'", column)
+		}
+	}
+	return nil
+}
+
+// ValidateAccess checks the table exposure and every referenced column before SQL is built
+func ValidateAccess(table string, write bool, columnLists ...[]string) error {
+	if err := ValidateTable(table, write); err != nil {
+		return err
+	}
+	for _, columns := range columnLists {
+		if err := ValidateColumns([]string{table}, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MapKeys returns the keys of a condition/data map
+func MapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// SelectColumns returns the column names of a select option (same input as GenerateSelect)
+func SelectColumns(fields interface{}) []string {
+	switch v := fields.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		columns := make([]string, 0, len(v))
+		for _, f := range v {
+			if s, ok := f.(string); ok {
+				columns = append(columns, s)
+			}
+		}
+		return columns
+	default:
+		return nil
+	}
+}
+
+// internalTables are managed by the auth code and never exposed to the generic routes
+var internalTables = map[string]bool{
+	refreshTokenTable: true,
+	revokedTokenTable: true,
+	apiKeyTable:       true,
+	twoFactorTable:    true,
+	otpTable:          true,
+	sessionKeyTable:   true,
+	meterTable:        true,
+	vendTable:         true,
+	tariffTable:       true,
+	debtTable:         true,
+}
+
+// tableExposure must be called with schemaMu held
+func tableExposure(table string) string {
+	if internalTables[table] {
+		return ExposureHidden
+	}
+	if t, ok := schemaConfig.Tables[table]; ok && t.Exposure != "" {
+		return t.Exposure
+	}
+	return schemaConfig.Default
+}
+
+// invalidPattern returns the first malformed glob pattern, ok is false when one is found
+func invalidPattern(patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return pattern, false
+		}
+	}
+	return "", true
+}
+
+func validExposure(exposure string) bool {
+	switch exposure {
+	case "", ExposureHidden, ExposureReadOnly, ExposureFull:
+		return true
+	}
+	return false
+}
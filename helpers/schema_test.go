@@ -0,0 +1,54 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useSchemaConfig loads a schema config file of the test, the previous config is restored afterwards
+func useSchemaConfig(t *testing.T, content string) map[string]interface{} {
+	t.Helper()
+	path, previous := SchemaConfigPath, schemaConfig
+	t.Cleanup(func() {
+		schemaMu.Lock()
+		SchemaConfigPath, schemaConfig = path, previous
+		schemaMu.Unlock()
+	})
+	SchemaConfigPath = filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(SchemaConfigPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadSchemaConfig()
+}
+
+func TestLoadSchemaConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		`{"tables": `,
+		`{"default": "public"}`,
+		`{"tables": {"orders": {"exposure": "write-only"}}}`,
+		`{"tables": {"orders": {"redact": ["[x"]}}}`,
+		`{"redact": ["[x"]}`,
+	} {
+		if res := useSchemaConfig(t, content); res["success"].(bool) {
+			t.Errorf("LoadSchemaConfig(%s) succeeded", content)
+		}
+	}
+	// A failed load keeps the previous config
+	if res := useSchemaConfig(t, `{"tables": {"orders": {"tenant_column": "org_id"}}}`); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	useSchemaConfig(t, `{"tables": `)
+	if column := TenantColumn("orders"); column != "org_id" {
+		t.Errorf("TenantColumn after a failed load = %q, want org_id", column)
+	}
+
+	// Only the default path may be missing, a configured file that isn't there must not fall back
+	SchemaConfigPath = filepath.Join(t.TempDir(), "missing.json")
+	if res := LoadSchemaConfig(); res["success"].(bool) {
+		t.Errorf("LoadSchemaConfig of a missing SCHEMA_CONFIG succeeded: %v", res["message"])
+	}
+	if column := TenantColumn("orders"); column != "org_id" {
+		t.Errorf("a missing SCHEMA_CONFIG dropped the tenant columns")
+	}
+}
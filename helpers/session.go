@@ -0,0 +1,566 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults used when ACCESS_TOKEN_TTL (minutes) and REFRESH_TOKEN_TTL (hours) are unset
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Tables of the database token store, hidden from the generic CRUD routes
+const (
+	refreshTokenTable = "auth_refresh_tokens"
+	revokedTokenTable = "auth_revoked_tokens"
+)
+
+// Refresh token states
+const (
+	RefreshActive  = 0
+	RefreshUsed    = 1 // rotated, presenting it again means it was stolen
+	RefreshRevoked = 2 // logged out or revoked after reuse
+)
+
+// RefreshToken is the server side record of a refresh token, the token itself is only stored hashed
+type RefreshToken struct {
+	ID      string                 // sha256 of the token
+	Family  string                 // shared by every token rotated from the same login
+	Subject map[string]interface{} // claims copied into every access token of the family
+	Expires time.Time
+	State   int
+}
+
+// TokenStore keeps refresh tokens and the denylist of revoked access tokens (jti) and families
+type TokenStore interface {
+	SaveRefresh(token RefreshToken) error
+	// GetRefresh returns nil when the token is unknown
+	GetRefresh(id string) (*RefreshToken, error)
+	// UseRefresh moves an active token to used, false when it was not active anymore
+	UseRefresh(id string) (bool, error)
+	RevokeFamily(family string, until time.Time) error
+	Revoke(id string, until time.Time) error
+	IsRevoked(id string) (bool, error)
+	PurgeExpired(now time.Time) error
+}
+
+var (
+	tokenStoreMu sync.RWMutex
+	tokenStore   TokenStore
+)
+
+// InitTokenStore selects the token store from TOKEN_STORE ("database" by default or "memory")
+// and creates the database tables when needed
+func InitTokenStore() map[string]interface{} {
+	if strings.EqualFold(TokenStoreName, "memory") || DB == nil {
+		SetTokenStore(newMemoryTokenStore())
+		initSessionKeyStore(false)
+		return map[string]interface{}{
+			"success": true,
+			"message": "Token store: memory",
+		}
+	}
+	store := dbTokenStore{}
+	err := store.createTables()
+	if err == nil {
+		err = initSessionKeyStore(true)
+	}
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to create token store tables: " + err.Error(),
+		}
+	}
+	SetTokenStore(store)
+	return map[string]interface{}{
+		"success": true,
+		"message": "Token store: database",
+	}
+}
+
+// SetTokenStore replaces the token store, for custom stores (Redis, ...)
+func SetTokenStore(store TokenStore) {
+	tokenStoreMu.Lock()
+	tokenStore = store
+	tokenStoreMu.Unlock()
+}
+
+// currentTokenStore returns the configured store, an in-memory one until InitTokenStore runs
+func currentTokenStore() TokenStore {
+	tokenStoreMu.RLock()
+	store := tokenStore
+	tokenStoreMu.RUnlock()
+	if store != nil {
+		return store
+	}
+	tokenStoreMu.Lock()
+	defer tokenStoreMu.Unlock()
+	if tokenStore == nil {
+		tokenStore = newMemoryTokenStore()
+	}
+	return tokenStore
+}
+
+// StartTokenCleanup periodically removes expired refresh tokens, denylist entries, OTP codes and session keys
+func StartTokenCleanup(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := currentTokenStore().PurgeExpired(time.Now()); err != nil {
+				LogJSON(false, "Token cleanup failed: "+err.Error())
+			}
+			if err := currentOTPStore().PurgeExpired(time.Now()); err != nil {
+				LogJSON(false, "OTP cleanup failed: "+err.Error())
+			}
+			if err := currentSessionKeyStore().PurgeExpired(time.Now()); err != nil {
+				LogJSON(false, "Session key cleanup failed: "+err.Error())
+			}
+		}
+	}()
+}
+
+func accessTokenTTL() time.Duration {
+	if AccessTokenTTL <= 0 {
+		return defaultAccessTokenTTL
+	}
+	return time.Duration(AccessTokenTTL) * time.Minute
+}
+
+func refreshTokenTTL() time.Duration {
+	if RefreshTokenTTL <= 0 {
+		return defaultRefreshTokenTTL
+	}
+	return time.Duration(RefreshTokenTTL) * time.Hour
+}
+
+// randomToken returns n random bytes, hex encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashRefreshToken is the store id of a refresh token
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// signAccessToken signs a short lived access token for the subject, jti and sid make it revocable
+func signAccessToken(subject map[string]interface{}, family string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	expireTime := now.Add(accessTokenTTL())
+	claims := jwt.MapClaims{}
+	for key, value := range subject {
+		claims[key] = value
+	}
+	claims["exp"] = expireTime.Unix()
+	claims["expired_time"] = expireTime.Format(time.RFC3339)
+	claims["issued_at"] = now.Unix()
+	claims["issuer"] = "go_backend_api"
+	claims["jti"] = jti
+	claims["sid"] = family
+	return signToken(claims)
+}
+
+// issueRefreshToken stores a new refresh token of the family and returns the opaque token
+func issueRefreshToken(subject map[string]interface{}, family string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	err := currentTokenStore().SaveRefresh(RefreshToken{
+		ID:      hashRefreshToken(token),
+		Family:  family,
+		Subject: subject,
+		Expires: time.Now().Add(refreshTokenTTL()),
+		State:   RefreshActive,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// issueSession signs an access token and a refresh token of the family
+func issueSession(subject map[string]interface{}, family string) map[string]interface{} {
+	refreshToken, err := issueRefreshToken(subject, family)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Authentication failed: " + err.Error(),
+		}
+	}
+	accessToken, err := signAccessToken(subject, family)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Authentication failed: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success":       true,
+		"message":       accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    int64(accessTokenTTL().Seconds()),
+	}
+}
+
+// RefreshSession rotates a refresh token: the presented token is spent and a new access and
+// refresh token of the same family are returned. Presenting a spent token revokes the family.
+func RefreshSession(refreshToken string) map[string]interface{} {
+	if refreshToken == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "refresh_token is required",
+		}
+	}
+	store := currentTokenStore()
+	id := hashRefreshToken(refreshToken)
+	record, err := store.GetRefresh(id)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to refresh session: " + err.Error(),
+		}
+	}
+	if record == nil || time.Now().After(record.Expires) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Invalid or expired refresh token",
+		}
+	}
+	if record.State == RefreshRevoked {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Session has been revoked",
+		}
+	}
+	active, err := store.UseRefresh(id)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to refresh session: " + err.Error(),
+		}
+	}
+	if !active {
+		// A rotated token came back: someone holds a copy, end the whole session
+		if err := store.RevokeFamily(record.Family, time.Now().Add(accessTokenTTL())); err != nil {
+			LogJSON(false, "Failed to revoke token family: "+err.Error())
+		}
+		forgetSessionKey(record.Family)
+		LogJSON(false, fmt.Sprintf("Refresh token reuse detected, session %s revoked", record.Family))
+		return map[string]interface{}{
+			"success": false,
+			"message": "Refresh token reuse detected, session revoked",
+		}
+	}
+
+	// Roles and tenant may have changed since login, a removed account ends the session
+	subject, err := currentSubject(record.Subject)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to refresh session: " + err.Error(),
+		}
+	}
+	if subject == nil {
+		if err := store.RevokeFamily(record.Family, time.Now().Add(accessTokenTTL())); err != nil {
+			LogJSON(false, "Failed to revoke token family: "+err.Error())
+		}
+		forgetSessionKey(record.Family)
+		return map[string]interface{}{
+			"success": false,
+			"message": "Account no longer exists, session revoked",
+		}
+	}
+
+	result := issueSession(subject, record.Family)
+	if success, _ := result["success"].(bool); !success {
+		return result
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"token":         result["message"],
+			"refresh_token": result["refresh_token"],
+			"expires_in":    result["expires_in"],
+		},
+	}
+}
+
+// currentSubject reloads the user of a session subject from the auth table and returns the subject
+// with its current name, roles and tenant, nil when the user was deleted
+func currentSubject(subject map[string]interface{}) (map[string]interface{}, error) {
+	table, usernameColumn, _ := AuthColumns()
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s = ?", EscapeId(table), EscapeId("id"))
+	rows, err := DB.Query(Rebind(query), subject["id"])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users, err := ScanRowsWith(rows, ScanOptions{Unredacted: true})
+	if err != nil || len(users) != 1 {
+		return nil, err
+	}
+	user := users[0]
+
+	current := map[string]interface{}{}
+	for key, value := range subject {
+		current[key] = value
+	}
+	current["user_name"] = user[usernameColumn]
+	delete(current, "roles")
+	if roles := UserRoles(user); len(roles) > 0 {
+		current["roles"] = roles
+	}
+	delete(current, tenantClaim())
+	if tenant := UserTenant(user); tenant != nil {
+		current[tenantClaim()] = tenant
+	}
+	return current, nil
+}
+
+// RevokeSession ends the session of validated access token claims:
+// the token's jti is denylisted until it expires and its refresh token family is revoked
+func RevokeSession(claims map[string]interface{}) map[string]interface{} {
+	store := currentTokenStore()
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Token can't be revoked",
+		}
+	}
+	until := time.Now().Add(accessTokenTTL())
+	if exp, err := jwt.MapClaims(claims).GetExpirationTime(); err == nil && exp != nil {
+		until = exp.Time
+	}
+	if err := store.Revoke(jti, until); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to revoke token: " + err.Error(),
+		}
+	}
+	if family, _ := claims["sid"].(string); family != "" {
+		if err := store.RevokeFamily(family, time.Now().Add(accessTokenTTL())); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Failed to revoke session: " + err.Error(),
+			}
+		}
+		forgetSessionKey(family)
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "Logged out successfully",
+	}
+}
+
+// tokenRevoked reports whether the access token or its session is on the denylist
+func tokenRevoked(claims jwt.MapClaims) (bool, error) {
+	store := currentTokenStore()
+	for _, key := range []string{"jti", "sid"} {
+		id, _ := claims[key].(string)
+		if id == "" {
+			continue
+		}
+		revoked, err := store.IsRevoked(id)
+		if err != nil || revoked {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// memoryTokenStore keeps tokens in process, they are lost on restart
+type memoryTokenStore struct {
+	mu      sync.Mutex
+	refresh map[string]*RefreshToken
+	revoked map[string]time.Time
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{refresh: map[string]*RefreshToken{}, revoked: map[string]time.Time{}}
+}
+
+func (s *memoryTokenStore) SaveRefresh(token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh[token.ID] = &token
+	return nil
+}
+
+func (s *memoryTokenStore) GetRefresh(id string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refresh[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *memoryTokenStore) UseRefresh(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refresh[id]
+	if !ok || token.State != RefreshActive {
+		return false, nil
+	}
+	token.State = RefreshUsed
+	return true, nil
+}
+
+func (s *memoryTokenStore) RevokeFamily(family string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.refresh {
+		if token.Family == family {
+			token.State = RefreshRevoked
+		}
+	}
+	s.revoked[family] = until
+	return nil
+}
+
+func (s *memoryTokenStore) Revoke(id string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = until
+	return nil
+}
+
+func (s *memoryTokenStore) IsRevoked(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.revoked[id]
+	return ok && time.Now().Before(until), nil
+}
+
+func (s *memoryTokenStore) PurgeExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, token := range s.refresh {
+		if now.After(token.Expires) {
+			delete(s.refresh, id)
+		}
+	}
+	for id, until := range s.revoked {
+		if now.After(until) {
+			delete(s.revoked, id)
+		}
+	}
+	return nil
+}
+
+// dbTokenStore keeps tokens in the connected database, expiry times are unix seconds
+type dbTokenStore struct{}
+
+func (dbTokenStore) createTables() error {
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) NOT NULL PRIMARY KEY, family VARCHAR(64) NOT NULL, subject TEXT NOT NULL, expires_at BIGINT NOT NULL, state INTEGER NOT NULL DEFAULT 0)", EscapeId(refreshTokenTable)),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) NOT NULL PRIMARY KEY, expires_at BIGINT NOT NULL)", EscapeId(revokedTokenTable)),
+	}
+	for _, statement := range statements {
+		if _, err := DB.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dbTokenStore) SaveRefresh(token RefreshToken) error {
+	subject, err := json.Marshal(token.Subject)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (id, family, subject, expires_at, state) VALUES (?, ?, ?, ?, ?)", EscapeId(refreshTokenTable))
+	_, err = DB.Exec(Rebind(query), token.ID, token.Family, string(subject), token.Expires.Unix(), token.State)
+	return err
+}
+
+func (dbTokenStore) GetRefresh(id string) (*RefreshToken, error) {
+	query := fmt.Sprintf("SELECT family, subject, expires_at, state FROM %s WHERE id = ?", EscapeId(refreshTokenTable))
+	var family, subject string
+	var expires int64
+	var state int
+	err := DB.QueryRow(Rebind(query), id).Scan(&family, &subject, &expires, &state)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	token := &RefreshToken{ID: id, Family: family, Expires: time.Unix(expires, 0), State: state}
+	decoder := json.NewDecoder(strings.NewReader(subject))
+	decoder.UseNumber()
+	if err := decoder.Decode(&token.Subject); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (dbTokenStore) UseRefresh(id string) (bool, error) {
+	query := fmt.Sprintf("UPDATE %s SET state = ? WHERE id = ? AND state = ?", EscapeId(refreshTokenTable))
+	result, err := DB.Exec(Rebind(query), RefreshUsed, id, RefreshActive)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func (s dbTokenStore) RevokeFamily(family string, until time.Time) error {
+	query := fmt.Sprintf("UPDATE %s SET state = ? WHERE family = ?", EscapeId(refreshTokenTable))
+	if _, err := DB.Exec(Rebind(query), RefreshRevoked, family); err != nil {
+		return err
+	}
+	return s.Revoke(family, until)
+}
+
+func (dbTokenStore) Revoke(id string, until time.Time) error {
+	verb, suffix := DBDialect.OnConflict(true, []string{"id"}, nil)
+	query := fmt.Sprintf("%s %s (id, expires_at) VALUES (?, ?)%s", verb, EscapeId(revokedTokenTable), suffix)
+	_, err := DB.Exec(Rebind(query), id, until.Unix())
+	return err
+}
+
+func (dbTokenStore) IsRevoked(id string) (bool, error) {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ? AND expires_at > ?", EscapeId(revokedTokenTable))
+	var count int
+	if err := DB.QueryRow(Rebind(query), id, time.Now().Unix()).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (dbTokenStore) PurgeExpired(now time.Time) error {
+	for _, table := range []string{refreshTokenTable, revokedTokenTable} {
+		query := fmt.Sprintf("DELETE FROM %s WHERE expires_at < ?", EscapeId(table))
+		if _, err := DB.Exec(Rebind(query), now.Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useTokenStore starts the token store of TOKEN_STORE name, HS256 tokens are signed with a test key
+func useTokenStore(t *testing.T, name string) {
+	t.Helper()
+	storeName, jwtKey, algorithm := TokenStoreName, JwtKey, JwtAlgorithm
+	TokenStoreName, JwtKey, JwtAlgorithm = name, "test-key", ""
+	if res := InitTokenStore(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	t.Cleanup(func() {
+		SetTokenStore(nil)
+		SetSessionKeyStore(nil)
+		TokenStoreName, JwtKey, JwtAlgorithm = storeName, jwtKey, algorithm
+	})
+}
+
+// createUsers adds the auth table with the user joe (id 1) of the session tests
+func createUsers(t *testing.T) {
+	t.Helper()
+	for _, statement := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY, user_name TEXT, password TEXT, role TEXT, org_id INTEGER)`,
+		`INSERT INTO users (id, user_name, password, role, org_id) VALUES (1, 'joe', '', 'admin', 7)`,
+	} {
+		if _, err := DB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// authorized reports whether an access token is accepted
+func authorized(token interface{}) bool {
+	res := Authorization(map[string]interface{}{"authorization": "Bearer " + token.(string)})
+	return res["success"].(bool)
+}
+
+func TestRefreshRotation(t *testing.T) {
+	for _, store := range []string{"memory", "database"} {
+		t.Run(store, func(t *testing.T) {
+			openTestDB(t)
+			createUsers(t)
+			useTokenStore(t, store)
+
+			login := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1})
+			if !login["success"].(bool) || !authorized(login["message"]) {
+				t.Fatalf("Authenticate = %v", login)
+			}
+			first := login["refresh_token"].(string)
+
+			rotated := RefreshSession(first)
+			if !rotated["success"].(bool) {
+				t.Fatalf("RefreshSession = %v", rotated)
+			}
+			session := rotated["message"].(map[string]interface{})
+			second := session["refresh_token"].(string)
+			if second == first || !authorized(session["token"]) {
+				t.Fatalf("RefreshSession did not rotate: %v", session)
+			}
+
+			// The spent token comes back: the whole family is revoked
+			if reuse := RefreshSession(first); reuse["success"].(bool) || reuse["message"] != "Refresh token reuse detected, session revoked" {
+				t.Errorf("reusing a rotated token = %v", reuse)
+			}
+			if res := RefreshSession(second); res["success"].(bool) || res["message"] != "Session has been revoked" {
+				t.Errorf("refreshing after reuse = %v", res)
+			}
+			if authorized(session["token"]) || authorized(login["message"]) {
+				t.Errorf("access tokens of a revoked session are still accepted")
+			}
+			if res := RefreshSession("unknown"); res["success"].(bool) {
+				t.Errorf("RefreshSession accepted an unknown token")
+			}
+		})
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	openTestDB(t)
+	createUsers(t)
+	useTokenStore(t, "database")
+	login := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1})
+	claims := Authorization(map[string]interface{}{"authorization": login["message"].(string)})["message"].(map[string]interface{})["data"]
+	if res := RevokeSession(claims.(jwt.MapClaims)); !res["success"].(bool) {
+		t.Fatalf("RevokeSession = %v", res)
+	}
+	if authorized(login["message"]) {
+		t.Errorf("access token is accepted after logout")
+	}
+	if res := RefreshSession(login["refresh_token"].(string)); res["success"].(bool) {
+		t.Errorf("refresh token is accepted after logout")
+	}
+}
+
+func TestRefreshReloadsUser(t *testing.T) {
+	openTestDB(t)
+	createUsers(t)
+	useTokenStore(t, "database")
+	login := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1, "roles": "admin", "tenant": 7})
+
+	// Demoted and moved to another tenant after login
+	if _, err := DB.Exec(`UPDATE users SET role = 'user', org_id = 8 WHERE id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	rotated := RefreshSession(login["refresh_token"].(string))
+	if !rotated["success"].(bool) {
+		t.Fatalf("RefreshSession = %v", rotated)
+	}
+	session := rotated["message"].(map[string]interface{})
+	claims := Authorization(map[string]interface{}{"authorization": session["token"].(string)})["message"].(map[string]interface{})["data"].(jwt.MapClaims)
+	if roles := RolesFromClaims(claims); len(roles) != 1 || roles[0] != "user" {
+		t.Errorf("refreshed roles = %v, want [user]", roles)
+	}
+	if tenant, _ := claims["org_id"].(float64); tenant != 8 {
+		t.Errorf("refreshed tenant = %v, want 8", claims["org_id"])
+	}
+
+	// A deleted account can't refresh and its session ends
+	if _, err := DB.Exec(`DELETE FROM users WHERE id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if res := RefreshSession(session["refresh_token"].(string)); res["success"].(bool) || res["message"] != "Account no longer exists, session revoked" {
+		t.Errorf("refresh of a deleted account = %v", res)
+	}
+	if authorized(session["token"]) {
+		t.Errorf("access token of a deleted account is still accepted")
+	}
+}
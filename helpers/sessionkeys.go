@@ -0,0 +1,446 @@
+package helpers
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionKeyTable holds the payload keys of the database session key store
+const sessionKeyTable = "auth_session_keys"
+
+// sessionKeyPrefix starts the envelope kid of session keys, static keys can't use it
+const sessionKeyPrefix = "s-"
+
+// pendingSessionPrefix starts the session id of a handshake done before login, the login that
+// uses its key keeps the id for the new session
+const pendingSessionPrefix = "h-"
+
+// pendingSessionKeyTTL is the time a client has to log in after a handshake
+const pendingSessionKeyTTL = 10 * time.Minute
+
+// SessionKey is the payload key agreed by one login session (refresh token family) in the handshake
+type SessionKey struct {
+	Family  string
+	ID      string // envelope kid, "s-..."
+	Key     []byte
+	Expires time.Time
+}
+
+// SessionKeyStore keeps one payload key per session, a new handshake replaces it
+type SessionKeyStore interface {
+	SaveSessionKey(key SessionKey) error
+	// GetSessionKey returns nil when the session has no key
+	GetSessionKey(family string) (*SessionKey, error)
+	// GetSessionKeyByID returns the key of an envelope kid, nil when it is unknown
+	GetSessionKeyByID(id string) (*SessionKey, error)
+	DeleteSessionKey(family string) error
+	PurgeExpired(now time.Time) error
+}
+
+var (
+	sessionKeyStoreMu sync.RWMutex
+	sessionKeyStore   SessionKeyStore
+)
+
+// initSessionKeyStore follows TOKEN_STORE, session keys live as long as the refresh tokens
+func initSessionKeyStore(database bool) error {
+	if !database {
+		SetSessionKeyStore(newMemorySessionKeyStore())
+		return nil
+	}
+	store := dbSessionKeyStore{}
+	if err := store.createTable(); err != nil {
+		return err
+	}
+	SetSessionKeyStore(store)
+	return nil
+}
+
+// SetSessionKeyStore replaces the session key store, for custom stores (Redis, ...)
+func SetSessionKeyStore(store SessionKeyStore) {
+	sessionKeyStoreMu.Lock()
+	sessionKeyStore = store
+	sessionKeyStoreMu.Unlock()
+}
+
+// currentSessionKeyStore returns the configured store, an in-memory one until InitTokenStore runs
+func currentSessionKeyStore() SessionKeyStore {
+	sessionKeyStoreMu.RLock()
+	store := sessionKeyStore
+	sessionKeyStoreMu.RUnlock()
+	if store != nil {
+		return store
+	}
+	sessionKeyStoreMu.Lock()
+	defer sessionKeyStoreMu.Unlock()
+	if sessionKeyStore == nil {
+		sessionKeyStore = newMemorySessionKeyStore()
+	}
+	return sessionKeyStore
+}
+
+// SessionHandshake agrees a payload key with the client of a login session, or without claims with
+// a client about to log in: {"public_key": "<base64 X25519 public key>"}. The key is HKDF-SHA256 of
+// the X25519 shared secret, salted with a random value and bound to the session id and both public keys.
+func SessionHandshake(claims map[string]interface{}, options map[string]interface{}) map[string]interface{} {
+	family, _ := claims["sid"].(string)
+	ttl := refreshTokenTTL()
+	if claims == nil {
+		pending, err := randomToken(16)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Key exchange failed: " + err.Error(),
+			}
+		}
+		family, ttl = pendingSessionPrefix+pending, pendingSessionKeyTTL
+	}
+	if family == "" {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key exchange needs a login session",
+		}
+	}
+	encoded, _ := options["public_key"].(string)
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "public_key must be a base64 X25519 public key",
+		}
+	}
+	clientKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "public_key must be a base64 X25519 public key",
+		}
+	}
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key exchange failed: " + err.Error(),
+		}
+	}
+	shared, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		// all-zero output of a low order client key
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key exchange failed: invalid public key",
+		}
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key exchange failed: " + err.Error(),
+		}
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+	info := sessionKeyInfo(family, raw, serverPublic)
+	key, err := hkdf.Key(sha256.New, shared, salt, info, 32)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key exchange failed: " + err.Error(),
+		}
+	}
+	id, err := randomToken(8)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key exchange failed: " + err.Error(),
+		}
+	}
+	session := SessionKey{Family: family, ID: sessionKeyPrefix + id, Key: key, Expires: time.Now().Add(ttl)}
+	if err := currentSessionKeyStore().SaveSessionKey(session); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Key exchange failed: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"public_key": base64.StdEncoding.EncodeToString(serverPublic),
+			"salt":       base64.StdEncoding.EncodeToString(salt),
+			"info":       info,
+			"kid":        session.ID,
+			"algorithm":  "X25519-HKDF-SHA256-AES-256-GCM",
+			"expires_in": int(ttl.Seconds()),
+		},
+	}
+}
+
+// sessionKeyInfo is the HKDF info of a handshake, clients derive the key with the same string
+func sessionKeyInfo(family string, clientPublic, serverPublic []byte) string {
+	encode := base64.StdEncoding.EncodeToString
+	return strings.Join([]string{"vartrick-session-key", family, encode(clientPublic), encode(serverPublic)}, "|")
+}
+
+// sessionKeyFor returns the payload key of the claims' session, nil without a handshake
+func sessionKeyFor(claims map[string]interface{}) *SessionKey {
+	family, _ := claims["sid"].(string)
+	if family == "" {
+		return nil
+	}
+	key, err := currentSessionKeyStore().GetSessionKey(family)
+	if err != nil {
+		LogJSON(false, "Session key lookup failed: "+err.Error())
+		return nil
+	}
+	if key == nil || time.Now().After(key.Expires) {
+		return nil
+	}
+	return key
+}
+
+// PayloadSession returns the session id of the session key a request payload is sealed with,
+// "" for payloads of the static keys. Callers without claims (login, refresh) use it to answer
+// under the key of their handshake.
+func PayloadSession(data map[string]interface{}) string {
+	encrypted, _ := data["encrypted"].(string)
+	parts := strings.SplitN(encrypted, ":", 3)
+	if len(parts) != 3 || parts[0] != envelopeVersion || !strings.HasPrefix(parts[1], sessionKeyPrefix) {
+		return ""
+	}
+	key, err := currentSessionKeyStore().GetSessionKeyByID(parts[1])
+	if err != nil {
+		LogJSON(false, "Session key lookup failed: "+err.Error())
+		return ""
+	}
+	if key == nil || time.Now().After(key.Expires) {
+		return ""
+	}
+	return key.Family
+}
+
+// bindSessionKey keeps the key of a pre-login handshake for the session started with it
+func bindSessionKey(family string) error {
+	store := currentSessionKeyStore()
+	key, err := store.GetSessionKey(family)
+	if err != nil {
+		return err
+	}
+	if key == nil || time.Now().After(key.Expires) {
+		return fmt.Errorf("key exchange expired, repeat the handshake")
+	}
+	key.Expires = time.Now().Add(refreshTokenTTL())
+	return store.SaveSessionKey(*key)
+}
+
+// forgetSessionKey removes the payload key of an ended session
+func forgetSessionKey(family string) {
+	if err := currentSessionKeyStore().DeleteSessionKey(family); err != nil {
+		LogJSON(false, "Failed to delete session key: "+err.Error())
+	}
+}
+
+// EncriptFor seals the "message" of a response with the session key of the caller once the handshake
+// is done, otherwise with the static key. Any JSON object or array is sealed (rows, typed slices),
+// plain status messages such as errors are sent as they are.
+func EncriptFor(data map[string]interface{}, claims map[string]interface{}) map[string]interface{} {
+	message, ok := data["message"]
+	if !ok || !EnableEncripted {
+		return Encript(data)
+	}
+	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "JSON marshal error: " + err.Error(),
+		}
+	}
+	if len(jsonBytes) == 0 || (jsonBytes[0] != '{' && jsonBytes[0] != '[') {
+		return data
+	}
+	var encoded string
+	if session := sessionKeyFor(claims); session != nil {
+		encoded, err = sealWith(session.ID, session.Key, jsonBytes)
+	} else {
+		encoded, err = sealEnvelope(jsonBytes)
+	}
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Encryption error: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"encrypted": encoded,
+	}
+}
+
+// DecriptFor is Decript accepting the session key of the caller. Once a session did the
+// handshake, or when EncryptionRequireSession is set, its requests must use the session key.
+// Without claims EncryptionRequireSession also refuses static key payloads.
+func DecriptFor(data map[string]interface{}, claims map[string]interface{}) map[string]interface{} {
+	encrypted, _ := data["encrypted"].(string)
+	if !EnableEncripted {
+		return Decript(data)
+	}
+	session := sessionKeyFor(claims)
+	if session == nil {
+		if EncryptionRequireSession {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Decryption error: a session key handshake is required",
+			}
+		}
+		return Decript(data)
+	}
+	if !strings.HasPrefix(encrypted, envelopeVersion+":"+session.ID+":") {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Decryption error: payload must be sealed with the session key " + session.ID,
+		}
+	}
+	plaintext, err := openWith(session.Key, encrypted)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Decryption error: " + err.Error(),
+		}
+	}
+	var original interface{}
+	if err := json.Unmarshal(plaintext, &original); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "JSON unmarshal error: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": original,
+	}
+}
+
+// memorySessionKeyStore keeps session keys in process, they are lost on restart
+type memorySessionKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]SessionKey
+}
+
+func newMemorySessionKeyStore() *memorySessionKeyStore {
+	return &memorySessionKeyStore{keys: map[string]SessionKey{}}
+}
+
+func (s *memorySessionKeyStore) SaveSessionKey(key SessionKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.Family] = key
+	return nil
+}
+
+func (s *memorySessionKeyStore) GetSessionKey(family string) (*SessionKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[family]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+func (s *memorySessionKeyStore) GetSessionKeyByID(id string) (*SessionKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.keys {
+		if key.ID == id {
+			return &key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memorySessionKeyStore) DeleteSessionKey(family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, family)
+	return nil
+}
+
+func (s *memorySessionKeyStore) PurgeExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for family, key := range s.keys {
+		if now.After(key.Expires) {
+			delete(s.keys, family)
+		}
+	}
+	return nil
+}
+
+// dbSessionKeyStore keeps session keys in the connected database, expiry times are unix seconds
+type dbSessionKeyStore struct{}
+
+func (dbSessionKeyStore) createTable() error {
+	_, err := DB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (family VARCHAR(64) NOT NULL PRIMARY KEY, kid VARCHAR(64) NOT NULL, session_key VARCHAR(64) NOT NULL, expires_at BIGINT NOT NULL)", EscapeId(sessionKeyTable)))
+	return err
+}
+
+func (dbSessionKeyStore) SaveSessionKey(key SessionKey) error {
+	verb, suffix := DBDialect.OnConflict(false, []string{"family"}, []string{"kid", "session_key", "expires_at"})
+	query := fmt.Sprintf("%s %s (family, kid, session_key, expires_at) VALUES (?, ?, ?, ?)%s", verb, EscapeId(sessionKeyTable), suffix)
+	_, err := DB.Exec(Rebind(query), key.Family, key.ID, base64.StdEncoding.EncodeToString(key.Key), key.Expires.Unix())
+	return err
+}
+
+func (dbSessionKeyStore) GetSessionKey(family string) (*SessionKey, error) {
+	query := fmt.Sprintf("SELECT kid, session_key, expires_at FROM %s WHERE family = ?", EscapeId(sessionKeyTable))
+	key := &SessionKey{Family: family}
+	var encoded string
+	var expires int64
+	err := DB.QueryRow(Rebind(query), family).Scan(&key.ID, &encoded, &expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return nil, err
+	}
+	key.Expires = time.Unix(expires, 0)
+	return key, nil
+}
+
+func (dbSessionKeyStore) GetSessionKeyByID(id string) (*SessionKey, error) {
+	query := fmt.Sprintf("SELECT family, session_key, expires_at FROM %s WHERE kid = ?", EscapeId(sessionKeyTable))
+	key := &SessionKey{ID: id}
+	var encoded string
+	var expires int64
+	err := DB.QueryRow(Rebind(query), id).Scan(&key.Family, &encoded, &expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return nil, err
+	}
+	key.Expires = time.Unix(expires, 0)
+	return key, nil
+}
+
+func (dbSessionKeyStore) DeleteSessionKey(family string) error {
+	_, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE family = ?", EscapeId(sessionKeyTable))), family)
+	return err
+}
+
+func (dbSessionKeyStore) PurgeExpired(now time.Time) error {
+	_, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE expires_at < ?", EscapeId(sessionKeyTable))), now.Unix())
+	return err
+}
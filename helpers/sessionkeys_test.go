@@ -0,0 +1,155 @@
+package helpers
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useEncryption turns the encrypted payload protocol on with a static test key
+func useEncryption(t *testing.T, requireSession bool) {
+	t.Helper()
+	enabled, key, keys, keyID, require := EnableEncripted, EncryptionKey, EncryptionKeys, EncryptionKeyId, EncryptionRequireSession
+	EnableEncripted, EncryptionKey, EncryptionKeys, EncryptionKeyId, EncryptionRequireSession = true, "0123456789abcdef", "", "", requireSession
+	t.Cleanup(func() {
+		EnableEncripted, EncryptionKey, EncryptionKeys, EncryptionKeyId, EncryptionRequireSession = enabled, key, keys, keyID, require
+	})
+}
+
+// clientHandshake runs the client side of SessionHandshake and returns the agreed kid and key
+func clientHandshake(t *testing.T, claims map[string]interface{}) (string, []byte, string) {
+	t.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := SessionHandshake(claims, map[string]interface{}{"public_key": base64.StdEncoding.EncodeToString(private.PublicKey().Bytes())})
+	if !res["success"].(bool) {
+		t.Fatalf("SessionHandshake = %v", res)
+	}
+	message := res["message"].(map[string]interface{})
+	raw, _ := base64.StdEncoding.DecodeString(message["public_key"].(string))
+	server, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := private.ECDH(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(message["salt"].(string))
+	key, err := hkdf.Key(sha256.New, shared, salt, message["info"].(string), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message["kid"].(string), key, strings.Split(message["info"].(string), "|")[1]
+}
+
+// sealedBody is a request body sealed by the client with key
+func sealedBody(t *testing.T, kid string, key []byte, message interface{}) map[string]interface{} {
+	t.Helper()
+	plaintext, _ := json.Marshal(message)
+	encoded, err := sealWith(kid, key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{"encrypted": encoded}
+}
+
+func TestPreLoginHandshake(t *testing.T) {
+	openTestDB(t)
+	useTokenStore(t, "database")
+	useEncryption(t, true)
+
+	kid, key, session := clientHandshake(t, nil)
+	if !strings.HasPrefix(session, pendingSessionPrefix) {
+		t.Fatalf("pre-login handshake session %s", session)
+	}
+	body := sealedBody(t, kid, key, map[string]interface{}{"user_name": "joe", "password": "pw"})
+	if got := PayloadSession(body); got != session {
+		t.Fatalf("PayloadSession = %q, want %q", got, session)
+	}
+	opened := DecriptFor(body, map[string]interface{}{"sid": session})
+	if !opened["success"].(bool) || opened["message"].(map[string]interface{})["password"] != "pw" {
+		t.Fatalf("DecriptFor = %v", opened)
+	}
+
+	// The login keeps the handshake's session, responses are sealed with its key
+	login := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1, "session": session})
+	claims := Authorization(map[string]interface{}{"authorization": login["message"].(string)})["message"].(map[string]interface{})["data"].(jwt.MapClaims)
+	if claims["sid"] != session {
+		t.Fatalf("login session %v, want %s", claims["sid"], session)
+	}
+	sealed := EncriptFor(map[string]interface{}{"success": true, "message": []map[string]interface{}{{"token": "t"}}}, claims)
+	encrypted, _ := sealed["encrypted"].(string)
+	if !strings.HasPrefix(encrypted, envelopeVersion+":"+kid+":") {
+		t.Fatalf("login response %v is not sealed with %s", sealed, kid)
+	}
+	if plaintext, err := openWith(key, encrypted); err != nil || string(plaintext) != `[{"token":"t"}]` {
+		t.Errorf("client opens %s, %v", plaintext, err)
+	}
+	if key := sessionKeyFor(claims); key == nil || key.Expires.Before(time.Now().Add(pendingSessionKeyTTL)) {
+		t.Errorf("session key of the login = %v, want it kept as long as the refresh token", key)
+	}
+
+	// Logging out forgets the key, its payloads no longer name a session
+	RevokeSession(claims)
+	if got := PayloadSession(body); got != "" {
+		t.Errorf("PayloadSession after logout = %q", got)
+	}
+	if res := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1, "session": session}); res["success"].(bool) {
+		t.Errorf("a login reused the key of an ended session")
+	}
+}
+
+func TestDecriptForRequireSession(t *testing.T) {
+	openTestDB(t)
+	useTokenStore(t, "memory")
+	useEncryption(t, false)
+	static := Encript(map[string]interface{}{"message": map[string]interface{}{"user_name": "joe"}})
+
+	// Without EncryptionRequireSession callers without a session may use the static key
+	if res := DecriptFor(static, nil); !res["success"].(bool) {
+		t.Fatalf("DecriptFor static payload = %v", res)
+	}
+	EncryptionRequireSession = true
+	if res := DecriptFor(static, nil); res["success"].(bool) {
+		t.Errorf("EncryptionRequireSession accepted a static key login payload")
+	}
+
+	// A session with a key refuses the static key and the keys of other sessions
+	login := Authenticate(map[string]interface{}{"user_name": "joe", "id": 1})
+	claims := Authorization(map[string]interface{}{"authorization": login["message"].(string)})["message"].(map[string]interface{})["data"].(jwt.MapClaims)
+	kid, key, session := clientHandshake(t, claims)
+	if session != claims["sid"] {
+		t.Fatalf("handshake of a logged in session bound to %s, want %v", session, claims["sid"])
+	}
+	EncryptionRequireSession = false
+	if res := DecriptFor(static, claims); res["success"].(bool) {
+		t.Errorf("a session with a key accepted a static key payload")
+	}
+	otherKid, otherKey, _ := clientHandshake(t, nil)
+	if res := DecriptFor(sealedBody(t, otherKid, otherKey, map[string]interface{}{}), claims); res["success"].(bool) {
+		t.Errorf("a session accepted the key of another handshake")
+	}
+	if res := DecriptFor(sealedBody(t, kid, key, map[string]interface{}{"table": "users"}), claims); !res["success"].(bool) {
+		t.Errorf("DecriptFor with the session key = %v", res)
+	}
+
+	// API key callers have no session to bind a key to
+	if res := SessionHandshake(map[string]interface{}{"api_key": "k"}, map[string]interface{}{"public_key": ""}); res["success"].(bool) {
+		t.Errorf("SessionHandshake without a session succeeded")
+	}
+	// Status messages are not sealed
+	if res := EncriptFor(map[string]interface{}{"success": false, "message": "Forbidden"}, claims); res["message"] != "Forbidden" {
+		t.Errorf("EncriptFor of a status message = %v", res)
+	}
+}
@@ -0,0 +1,404 @@
+package helpers
+
+import (
+	"crypto/des"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token formats of a registered meter: the original STS-inspired format with HMAC derived 3DES keys,
+// or IEC 62055-41 STS tokens (DKGA-02 decoder keys, EA09 DEA encryption)
+const (
+	TokenFormatLegacy = "legacy"
+	TokenFormatSTS    = "sts"
+)
+
+// Decoder key generation and encryption algorithms of STS meters. Only DKGA-02 and EA09 (DEA) are
+// implemented, meters using DKGA-04, EA07 (STA) or EA11 (MISTY1) are refused at registration. EA11
+// needs the 128-bit keys of DKGA-04, neither is added until it can be checked against the IEC
+// 62055-41 conformance vectors.
+const (
+	STSKeyAlgorithm        = "02"
+	STSEncryptionAlgorithm = "09"
+)
+
+// stsUnsupportedAlgorithms names the IEC 62055-41 algorithms this vending system can't serve
+var stsUnsupportedAlgorithms = map[string]string{
+	"key_generation_algorithm:04": "DKGA-04",
+	"encryption_algorithm:07":     "EA07 (STA)",
+	"encryption_algorithm:11":     "EA11 (MISTY1)",
+}
+
+// ValidSTSAlgorithms checks the "key_generation_algorithm" and "encryption_algorithm" of an STS meter
+// registration, 2 digit codes as strings or numbers. Missing options are DKGA-02 and EA09.
+func ValidSTSAlgorithms(options map[string]interface{}) error {
+	for _, field := range []struct{ name, supported string }{
+		{"key_generation_algorithm", STSKeyAlgorithm},
+		{"encryption_algorithm", STSEncryptionAlgorithm},
+	} {
+		var code string
+		switch value := options[field.name].(type) {
+		case nil:
+			continue
+		case float64:
+			if value == float64(int(value)) {
+				code = fmt.Sprintf("%02d", int(value))
+			}
+		case string:
+			code = fmt.Sprintf("%02s", strings.TrimSpace(value))
+		}
+		if code == field.supported {
+			continue
+		}
+		if name, ok := stsUnsupportedAlgorithms[field.name+":"+code]; ok {
+			return fmt.Errorf("%s is not supported, STS meters must use DKGA-02 decoder keys and EA09 (DEA) encryption", name)
+		}
+		return fmt.Errorf("unknown %s %v", field.name, options[field.name])
+	}
+	return nil
+}
+
+// STS token classes, the 2 bits transposed into every token
+const (
+	STSClassTransfer   = 0
+	STSClassInitiate   = 1
+	STSClassManagement = 2
+	STSClassReserved   = 3
+)
+
+// Subclasses of class 2 management tokens
+const (
+	STSSubclassSetMaxPower     = 0
+	STSSubclassClearCredit     = 1
+	STSSubclassSetTariffRate   = 2
+	STSSubclassKeyChangeFirst  = 3
+	STSSubclassKeyChangeSecond = 4
+	STSSubclassClearTamper     = 5
+)
+
+// IIN of the STS Association, the issuer of 11 digit decoder reference numbers. 13 digit
+// numbers use the IIN 0000.
+const (
+	stsIIN11 = "600727"
+	stsIIN13 = "0000"
+)
+
+// Largest transfer amount, in 0.1 units, the 16 bit exponent/mantissa field holds
+const stsMaxUnits = 18201624
+
+// ValidSTSMeterNumber checks an STS decoder reference number: 11 or 13 digits ending in a Luhn check digit
+func ValidSTSMeterNumber(number string) error {
+	if (len(number) != 11 && len(number) != 13) || !IsAllDigits(number) {
+		return fmt.Errorf("STS meter numbers have 11 or 13 digits")
+	}
+	if LuhnCheckDigit(number[:len(number)-1]) != int(number[len(number)-1]-'0') {
+		return fmt.Errorf("meter number %s fails its Luhn check digit", number)
+	}
+	return nil
+}
+
+// stsVendingKey returns the vending unique DES key of DKGA-02, STS_VENDING_KEY in hex
+func stsVendingKey() ([]byte, error) {
+	if STSVendingKey == "" {
+		return nil, fmt.Errorf("STS_VENDING_KEY is not configured")
+	}
+	key, err := hex.DecodeString(STSVendingKey)
+	if err != nil || len(key) != des.BlockSize {
+		return nil, fmt.Errorf("STS_VENDING_KEY must be 8 bytes in hex")
+	}
+	return key, nil
+}
+
+// STSBaseDate is the date token identifiers count minutes from, STS_BASE_YEAR 1993, 2014 (default) or 2035.
+// The 24 bit identifier rolls over about 31.9 years after the base date.
+func STSBaseDate() time.Time {
+	switch STSBaseYear {
+	case 1993, 2035:
+		return time.Date(STSBaseYear, 1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// stsPANBlock is the 16 least significant digits of the IAIN, the IIN followed by the meter number
+func stsPANBlock(number string) ([]byte, error) {
+	if err := ValidSTSMeterNumber(number); err != nil {
+		return nil, err
+	}
+	iain := stsIIN11 + number
+	if len(number) == 13 {
+		iain = stsIIN13 + number
+	}
+	return hex.DecodeString(iain[len(iain)-16:])
+}
+
+// stsControlBlock is KT (1 digit), SGC (6), TI (2), KRN (1) padded with FFFFFF
+func stsControlBlock(meter Meter) ([]byte, error) {
+	return hex.DecodeString(fmt.Sprintf("%01X%06d%02d%01XFFFFFF", meter.KeyType, meter.SupplyGroupCode, meter.TariffIndex, meter.KeyRevision))
+}
+
+// STSDecoderKey derives the 64-bit decoder key of an STS meter with DKGA-02:
+// DK = DEA(VUDK, PANBlock XOR CONTROLBlock) XOR PANBlock
+func STSDecoderKey(meter Meter) map[string]interface{} {
+	vudk, err := stsVendingKey()
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	pan, err := stsPANBlock(meter.Number)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	control, err := stsControlBlock(meter)
+	if err != nil || len(control) != 8 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "invalid key parameters for meter " + meter.Number,
+		}
+	}
+	block, err := des.NewCipher(vudk)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	data := make([]byte, 8)
+	for i := range data {
+		data[i] = pan[i] ^ control[i]
+	}
+	key := make([]byte, 8)
+	block.Encrypt(key, data)
+	for i := range key {
+		key[i] ^= pan[i]
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": BytesToBinStr(key),
+	}
+}
+
+// EncodeSTSUnits encodes an amount with 0.1 resolution in the 16-bit STS transfer amount:
+// 2 exponent bits and a 14 bit mantissa, value = 10^e * m + sum(2^14 * 10^(i-1), i = 1..e).
+// Amounts between representable values are rounded down.
+func EncodeSTSUnits(amount float64) map[string]interface{} {
+	if amount < 0 || math.IsNaN(amount) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "units value containing Negative values is not supported.",
+		}
+	}
+	units := int64(math.Floor(amount*10 + 1e-6))
+	if units > stsMaxUnits {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("units value too large to be represented, the maximum is %.1f", float64(stsMaxUnits)/10),
+		}
+	}
+	for exponent := 0; exponent <= 3; exponent++ {
+		mantissa := (units - stsUnitsOffset(exponent)) / int64(math.Pow10(exponent))
+		if mantissa <= 16383 {
+			return map[string]interface{}{
+				"success": true,
+				"message": DecToBin(exponent, 2) + DecToBin(int(mantissa), 14),
+			}
+		}
+	}
+	return map[string]interface{}{
+		"success": false,
+		"message": "units value too large to be represented.",
+	}
+}
+
+// DecodeSTSUnits decodes a 16-bit STS transfer amount
+func DecodeSTSUnits(packedBin string) map[string]interface{} {
+	if len(packedBin) != 16 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "binary string must be 16 bits",
+		}
+	}
+	exponent := int(BinStrToDecimal(packedBin[:2]))
+	mantissa := BinStrToDecimal(packedBin[2:])
+	units := mantissa*int64(math.Pow10(exponent)) + stsUnitsOffset(exponent)
+	return map[string]interface{}{
+		"success": true,
+		"message": float64(units) / 10,
+	}
+}
+
+func stsUnitsOffset(exponent int) int64 {
+	var offset int64
+	for i := 1; i <= exponent; i++ {
+		offset += 16384 * int64(math.Pow10(i-1))
+	}
+	return offset
+}
+
+// STSTokenID is the 24-bit token identifier, minutes since STSBaseDate
+func STSTokenID(issued time.Time) map[string]interface{} {
+	minutes := int64(issued.Sub(STSBaseDate()) / time.Minute)
+	if issued.Before(STSBaseDate()) || minutes >= 1<<24 {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("issue time %s is outside the range of base date %s", issued.Format(time.RFC3339), STSBaseDate().Format("2006-01-02")),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": minutes,
+	}
+}
+
+// CalculateSTSCRC16 is the CRC-16 of STS tokens: polynomial x^16 + x^15 + x^2 + 1 (reflected 0xA001),
+// initial value 0xFFFF
+func CalculateSTSCRC16(data []byte) map[string]interface{} {
+	crc := 0xFFFF
+	for _, b := range data {
+		crc ^= int(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("%016b", crc),
+	}
+}
+
+// stsCRC covers the class (as a byte), subclass and the 44 data bits
+func stsCRC(class int, subclassAndData string) string {
+	return CalculateSTSCRC16(BinStrToBytes(DecToBin(class, 8) + subclassAndData))["message"].(string)
+}
+
+// SealSTSToken builds a 20 digit STS token for a meter: subclass (4 bits) and data (44 bits) with
+// the CRC appended are encrypted with EA09 under the meter's decoder key and the class bits transposed in
+func SealSTSToken(meter Meter, class, subclass int, data string) map[string]interface{} {
+	if subclass < 0 || subclass > 15 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "subclass must be between 0 and 15",
+		}
+	}
+	if len(data) != 44 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "STS token data must be 44 bits",
+		}
+	}
+	classRes := GenerateClassBits(class)
+	if !classRes["success"].(bool) {
+		return classRes
+	}
+	keyRes := STSDecoderKey(meter)
+	if !keyRes["success"].(bool) {
+		return keyRes
+	}
+	block, err := des.NewCipher(BinStrToBytes(keyRes["message"].(string)))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	plain := DecToBin(subclass, 4) + data
+	plain += stsCRC(class, plain)
+	encrypted := make([]byte, 8)
+	block.Encrypt(encrypted, BinStrToBytes(plain))
+
+	transposed := TranspositionAndAddClassBits(BytesToBinStr(encrypted), classRes["message"].(string))
+	if !transposed["success"].(bool) {
+		return transposed
+	}
+	return FormatTokenDisplay(transposed["message"].(string))
+}
+
+// OpenSTSToken decrypts a 20 digit STS token of a meter and checks its CRC. The message holds
+// the class, the subclass and the 44 data bits.
+func OpenSTSToken(meter Meter, token string) map[string]interface{} {
+	digits := strings.ReplaceAll(token, "-", "")
+	number, ok := new(big.Int).SetString(digits, 10)
+	if len(digits) != 20 || !IsAllDigits(digits) || !ok || number.BitLen() > 66 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Invalid token format. Must be 20 digits (dashes allowed).",
+		}
+	}
+	keyRes := STSDecoderKey(meter)
+	if !keyRes["success"].(bool) {
+		return keyRes
+	}
+	block, err := des.NewCipher(BinStrToBytes(keyRes["message"].(string)))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	removed := TranspositionAndRemoveClassBits(DecToBinBigInt(number, 66))
+	parts := removed["message"].(map[string]interface{})
+	class, _ := strconv.ParseInt(parts["class"].(string), 2, 8)
+	plain := make([]byte, 8)
+	block.Decrypt(plain, BinStrToBytes(parts["data"].(string)))
+	bits := BytesToBinStr(plain)
+	if stsCRC(int(class), bits[:48]) != bits[48:] {
+		return map[string]interface{}{
+			"success": false,
+			"message": "CRC mismatch - invalid token data",
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"class":    int(class),
+			"subclass": int(BinStrToDecimal(bits[:4])),
+			"data":     bits[4:48],
+			"crc":      bits[48:],
+		},
+	}
+}
+
+// STSKeyChangeData builds the 44 data bits of the two key change tokens (class 2, subclasses 3 and 4)
+// moving a meter to the decoder key of newMeter. The first carries the high nibble of the key expiry
+// number, the new key revision, the rollover flag, the new key type and the high 32 key bits; the second
+// the low nibble of the key expiry number, the new tariff index and the low 32 key bits.
+func STSKeyChangeData(newMeter Meter, keyExpiry int, rollover bool) map[string]interface{} {
+	if keyExpiry < 0 || keyExpiry > 255 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "key_expiry_number must be between 0 and 255",
+		}
+	}
+	keyRes := STSDecoderKey(newMeter)
+	if !keyRes["success"].(bool) {
+		return keyRes
+	}
+	newKey := keyRes["message"].(string)
+	rolloverBit := "0"
+	if rollover {
+		rolloverBit = "1"
+	}
+	first := DecToBin(keyExpiry>>4, 4) + DecToBin(newMeter.KeyRevision, 4) + rolloverBit + "0" + DecToBin(newMeter.KeyType, 2) + newKey[:32]
+	second := DecToBin(keyExpiry&0xF, 4) + DecToBin(newMeter.TariffIndex, 8) + newKey[32:]
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"first":  first,
+			"second": second,
+		},
+	}
+}
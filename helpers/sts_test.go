@@ -0,0 +1,239 @@
+package helpers
+
+import (
+	"crypto/des"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// These are published vectors of the primitives STS builds on (DES, CRC-16/MODBUS) and values
+// computed independently of this package (OpenSSL's DES) from the block layouts of IEC 62055-41.
+// They are not the IEC 62055-41 conformance test vectors, which aren't public and aren't in this tree.
+
+func TestDEAKnownAnswer(t *testing.T) {
+	// FIPS 81 / NBS example: key 0123456789ABCDEF, "Now is t"
+	key, _ := hex.DecodeString("0123456789ABCDEF")
+	plain, _ := hex.DecodeString("4E6F772069732074")
+	block, err := des.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, 8)
+	block.Encrypt(out, plain)
+	if got := strings.ToUpper(hex.EncodeToString(out)); got != "3FA40E8A984D4815" {
+		t.Fatalf("DEA(0123456789ABCDEF, 4E6F772069732074) = %s, want 3FA40E8A984D4815", got)
+	}
+}
+
+func TestSTSDecoderKeyDKGA02(t *testing.T) {
+	defer func(previous string) { STSVendingKey = previous }(STSVendingKey)
+	STSVendingKey = "0123456789ABCDEF"
+
+	// The blocks follow the field layout of IEC 62055-41, the keys were computed with OpenSSL's DES
+	// from those blocks: DEA(VUDK, PAN XOR CONTROL) XOR PAN
+	tests := []struct {
+		meter   Meter
+		pan     string // 16 least significant digits of IIN + meter number
+		control string // KT, SGC, TI, KRN, FFFFFF
+		key     string
+	}{
+		{Meter{Number: "01234567897", SupplyGroupCode: 123456, TariffIndex: 1, KeyRevision: 1, KeyType: 2}, "0072701234567897", "2123456011FFFFFF", "AF205CC99317FAEB"},
+		{Meter{Number: "01234567897", SupplyGroupCode: 999999, TariffIndex: 99, KeyRevision: 9, KeyType: 3}, "0072701234567897", "3999999999FFFFFF", "12837F4C32FC6BC0"},
+		{Meter{Number: "1234567890128", SupplyGroupCode: 7, TariffIndex: 0, KeyRevision: 1, KeyType: 0}, "0001234567890128", "0000007001FFFFFF", "C17C75AF0F62E048"},
+	}
+	for _, tt := range tests {
+		if pan, _ := stsPANBlock(tt.meter.Number); strings.ToUpper(hex.EncodeToString(pan)) != tt.pan {
+			t.Errorf("stsPANBlock(%s) = %X, want %s", tt.meter.Number, pan, tt.pan)
+		}
+		if control, _ := stsControlBlock(tt.meter); strings.ToUpper(hex.EncodeToString(control)) != tt.control {
+			t.Errorf("stsControlBlock(%+v) = %X, want %s", tt.meter, control, tt.control)
+		}
+		res := STSDecoderKey(tt.meter)
+		if !res["success"].(bool) {
+			t.Fatalf("STSDecoderKey(%s): %v", tt.meter.Number, res["message"])
+		}
+		if got := strings.ToUpper(hex.EncodeToString(BinStrToBytes(res["message"].(string)))); got != tt.key {
+			t.Errorf("STSDecoderKey(%+v) = %s, want %s", tt.meter, got, tt.key)
+		}
+	}
+}
+
+func TestSealSTSTokenKnownAnswer(t *testing.T) {
+	defer func(previous string) { STSVendingKey = previous }(STSVendingKey)
+	STSVendingKey = "0123456789ABCDEF"
+	meter := Meter{Number: "01234567897", SupplyGroupCode: 123456, TariffIndex: 1, KeyRevision: 1, KeyType: 2}
+	data := "10100101101001011010010110100101101001011010"
+
+	// Computed outside this package: CRC-16 over the class byte, subclass and data, DEA under the
+	// decoder key AF205CC99317FAEB, class bits swapped with bits 28 and 27, 66 bits as 20 digits
+	tests := []struct {
+		class, subclass int
+		token           string
+	}{
+		{0, 0, "4799-3891-0822-5050-5536"},
+		{2, 3, "0602-0487-7581-0900-7302"},
+	}
+	for _, tt := range tests {
+		if sealed := SealSTSToken(meter, tt.class, tt.subclass, data); sealed["message"] != tt.token {
+			t.Errorf("SealSTSToken(%d, %d) = %v, want %s", tt.class, tt.subclass, sealed["message"], tt.token)
+		}
+	}
+}
+
+func TestValidSTSMeterNumber(t *testing.T) {
+	if digit := LuhnCheckDigit("7992739871"); digit != 3 {
+		t.Errorf("LuhnCheckDigit(7992739871) = %d, want 3", digit)
+	}
+	tests := []struct {
+		number string
+		ok     bool
+	}{
+		{"01234567897", true},
+		{"1234567890128", true},
+		{"01234567893", false},
+		{"1234567890", false},
+		{"0123456789a", false},
+	}
+	for _, tt := range tests {
+		if err := ValidSTSMeterNumber(tt.number); (err == nil) != tt.ok {
+			t.Errorf("ValidSTSMeterNumber(%s) = %v, want ok %t", tt.number, err, tt.ok)
+		}
+	}
+}
+
+func TestSTSDecoderKeyNeedsVendingKey(t *testing.T) {
+	defer func(previous string) { STSVendingKey = previous }(STSVendingKey)
+	for _, key := range []string{"", "0123", "zz23456789ABCDEF"} {
+		STSVendingKey = key
+		if res := STSDecoderKey(Meter{Number: "01234567897"}); res["success"].(bool) {
+			t.Errorf("STSDecoderKey with STS_VENDING_KEY %q succeeded", key)
+		}
+	}
+}
+
+func TestEncodeSTSUnits(t *testing.T) {
+	tests := []struct {
+		amount float64
+		bits   string
+		value  float64 // decoded amount
+	}{
+		{0, "00" + "00000000000000", 0},
+		{0.1, "00" + "00000000000001", 0.1},
+		{1638.3, "00" + "11111111111111", 1638.3},
+		{1638.4, "01" + "00000000000000", 1638.4},
+		{1638.45, "01" + "00000000000000", 1638.4},
+		{1638.5, "01" + "00000000000000", 1638.4},
+		{1639.4, "01" + "00000000000001", 1639.4},
+		{18021.4, "01" + "11111111111111", 18021.4},
+		{18022.3, "01" + "11111111111111", 18021.4},
+		{18022.4, "10" + "00000000000000", 18022.4},
+		{181852.4, "10" + "11111111111111", 181852.4},
+		{181862.3, "10" + "11111111111111", 181852.4},
+		{181862.4, "11" + "00000000000000", 181862.4},
+		{1820162.4, "11" + "11111111111111", 1820162.4},
+	}
+	for _, tt := range tests {
+		res := EncodeSTSUnits(tt.amount)
+		if !res["success"].(bool) {
+			t.Fatalf("EncodeSTSUnits(%v): %v", tt.amount, res["message"])
+		}
+		if res["message"] != tt.bits {
+			t.Errorf("EncodeSTSUnits(%v) = %v, want %s", tt.amount, res["message"], tt.bits)
+		}
+		decoded := DecodeSTSUnits(tt.bits)
+		if decoded["message"] != tt.value {
+			t.Errorf("DecodeSTSUnits(%s) = %v, want %v", tt.bits, decoded["message"], tt.value)
+		}
+	}
+	for _, amount := range []float64{-0.1, 1820162.5, 1e9} {
+		if res := EncodeSTSUnits(amount); res["success"].(bool) {
+			t.Errorf("EncodeSTSUnits(%v) = %v, want an error", amount, res["message"])
+		}
+	}
+	if res := DecodeSTSUnits("0101"); res["success"].(bool) {
+		t.Errorf("DecodeSTSUnits of 4 bits succeeded")
+	}
+}
+
+func TestCalculateSTSCRC16(t *testing.T) {
+	tests := []struct {
+		data []byte
+		crc  uint16
+	}{
+		{[]byte("123456789"), 0x4B37}, // CRC-16/MODBUS check value
+		{[]byte{}, 0xFFFF},
+		{[]byte{0x00}, 0x40BF},
+	}
+	for _, tt := range tests {
+		res := CalculateSTSCRC16(tt.data)
+		if got := uint16(BinStrToDecimal(res["message"].(string))); got != tt.crc {
+			t.Errorf("CalculateSTSCRC16(%x) = %04X, want %04X", tt.data, got, tt.crc)
+		}
+	}
+}
+
+func TestSealOpenSTSToken(t *testing.T) {
+	defer func(previous string) { STSVendingKey = previous }(STSVendingKey)
+	STSVendingKey = "0123456789ABCDEF"
+	meter := Meter{Number: "01234567897", SupplyGroupCode: 123456, TariffIndex: 1, KeyRevision: 1, KeyType: 2}
+	data := "10100101101001011010010110100101101001011010"
+
+	for _, tt := range []struct{ class, subclass int }{{0, 0}, {0, 1}, {1, 7}, {2, 3}, {3, 15}} {
+		sealed := SealSTSToken(meter, tt.class, tt.subclass, data)
+		if !sealed["success"].(bool) {
+			t.Fatalf("SealSTSToken(%d, %d): %v", tt.class, tt.subclass, sealed["message"])
+		}
+		token := sealed["message"].(string)
+		if digits := strings.ReplaceAll(token, "-", ""); len(digits) != 20 || !IsAllDigits(digits) {
+			t.Fatalf("SealSTSToken(%d, %d) = %q, want 20 digits", tt.class, tt.subclass, token)
+		}
+		opened := OpenSTSToken(meter, token)
+		if !opened["success"].(bool) {
+			t.Fatalf("OpenSTSToken(%s): %v", token, opened["message"])
+		}
+		parts := opened["message"].(map[string]interface{})
+		if parts["class"] != tt.class || parts["subclass"] != tt.subclass || parts["data"] != data {
+			t.Errorf("OpenSTSToken(%s) = %v, want class %d subclass %d data %s", token, parts, tt.class, tt.subclass, data)
+		}
+	}
+
+	token := SealSTSToken(meter, 0, 0, data)["message"].(string)
+	other := meter
+	other.KeyRevision = 2
+	if opened := OpenSTSToken(other, token); opened["success"].(bool) {
+		t.Errorf("OpenSTSToken with another decoder key succeeded")
+	}
+	for _, bad := range []string{"1234", strings.Repeat("9", 20), "abcd-efgh-ijkl-mnop-qrst"} {
+		if opened := OpenSTSToken(meter, bad); opened["success"].(bool) {
+			t.Errorf("OpenSTSToken(%q) succeeded", bad)
+		}
+	}
+	if sealed := SealSTSToken(meter, 0, 16, data); sealed["success"].(bool) {
+		t.Errorf("SealSTSToken with subclass 16 succeeded")
+	}
+	if sealed := SealSTSToken(meter, 0, 0, data[:40]); sealed["success"].(bool) {
+		t.Errorf("SealSTSToken with 40 data bits succeeded")
+	}
+}
+
+func TestValidSTSAlgorithms(t *testing.T) {
+	tests := []struct {
+		options map[string]interface{}
+		ok      bool
+	}{
+		{map[string]interface{}{}, true},
+		{map[string]interface{}{"key_generation_algorithm": "02", "encryption_algorithm": "09"}, true},
+		{map[string]interface{}{"key_generation_algorithm": 2.0, "encryption_algorithm": "9"}, true},
+		{map[string]interface{}{"key_generation_algorithm": "04"}, false},
+		{map[string]interface{}{"encryption_algorithm": "07"}, false},
+		{map[string]interface{}{"encryption_algorithm": 11.0}, false},
+		{map[string]interface{}{"encryption_algorithm": "EA11"}, false},
+		{map[string]interface{}{"key_generation_algorithm": 2.5}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidSTSAlgorithms(tt.options); (err == nil) != tt.ok {
+			t.Errorf("ValidSTSAlgorithms(%v) = %v, want ok %t", tt.options, err, tt.ok)
+		}
+	}
+}
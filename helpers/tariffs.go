@@ -0,0 +1,544 @@
+package helpers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// tariffTable holds the tariff of each tariff index, debtTable the outstanding debt of meters
+const (
+	tariffTable = "sts_tariffs"
+	debtTable   = "meter_debts"
+)
+
+// Tariff types
+const (
+	TariffTypeFlat  = "flat"  // one rate per unit
+	TariffTypeBlock = "block" // rates rising with the units bought in the calendar month
+	TariffTypeTOU   = "tou"   // rate of the period the payment is made in
+)
+
+// Tariff prices the units of the meters on one tariff index. Rates are currency per unit, VAT is
+// included in payments and charged on the energy and fixed charges.
+type Tariff struct {
+	Index               int            `json:"tariff_index"`
+	Name                string         `json:"name"`
+	Currency            string         `json:"currency"`
+	Type                string         `json:"type"`
+	Rate                float64        `json:"rate,omitempty"`
+	Blocks              []TariffBlock  `json:"blocks,omitempty"`
+	Periods             []TariffPeriod `json:"periods,omitempty"`
+	VATPercent          float64        `json:"vat_percent"`
+	FixedCharges        []FixedCharge  `json:"fixed_charges,omitempty"`
+	DebtRecoveryPercent float64        `json:"debt_recovery_percent"`
+	Tenant              string         `json:"-"` // tenant of the caller that set it, "" for a shared tariff
+	UpdatedAt           time.Time      `json:"-"`
+}
+
+// TariffBlock prices the units of the month up to UpTo, 0 for the open ended last block
+type TariffBlock struct {
+	UpTo float64 `json:"up_to"`
+	Rate float64 `json:"rate"`
+}
+
+// TariffPeriod prices payments made from From to To ("HH:MM", To may be past midnight) on Days
+// ("mon" ... "sun", every day when empty)
+type TariffPeriod struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Days []string `json:"days,omitempty"`
+	Rate float64  `json:"rate"`
+}
+
+// FixedCharge is deducted before VAT, Per is "vend" for every payment or "month" for the first
+// credit token of the calendar month
+type FixedCharge struct {
+	Name   string  `json:"name"`
+	Amount float64 `json:"amount"`
+	Per    string  `json:"per"`
+}
+
+func (t Tariff) info() map[string]interface{} {
+	var info map[string]interface{}
+	content, _ := json.Marshal(t)
+	json.Unmarshal(content, &info)
+	info["tenant"] = t.Tenant
+	info["updated_at"] = t.UpdatedAt.Format(time.RFC3339)
+	return info
+}
+
+// TariffUsage is what a meter bought this month, blocks and monthly charges depend on it
+type TariffUsage struct {
+	MonthUnits float64
+	MonthVends int
+}
+
+// TariffQuote splits a payment into debt recovery, fixed charges, VAT and the units it buys
+type TariffQuote struct {
+	Payment       float64
+	DebtRecovered float64
+	DebtBalance   float64 // outstanding debt after this payment
+	FixedCharges  []FixedCharge
+	FixedTotal    float64
+	VAT           float64
+	EnergyCharge  float64
+	Units         float64
+	Lines         []map[string]interface{} // units and amount per rate
+	Change        float64                  // money too small to buy one unit step
+}
+
+// Receipt is the breakdown returned to the customer
+func (q TariffQuote) Receipt(t Tariff) map[string]interface{} {
+	fixed := []map[string]interface{}{}
+	for _, charge := range q.FixedCharges {
+		fixed = append(fixed, map[string]interface{}{"name": charge.Name, "amount": charge.Amount})
+	}
+	return map[string]interface{}{
+		"tariff_index":   t.Index,
+		"tariff_name":    t.Name,
+		"tariff_type":    t.Type,
+		"currency":       t.Currency,
+		"payment":        q.Payment,
+		"debt_recovered": q.DebtRecovered,
+		"debt_balance":   q.DebtBalance,
+		"fixed_charges":  fixed,
+		"fixed_total":    q.FixedTotal,
+		"vat_percent":    t.VATPercent,
+		"vat":            q.VAT,
+		"energy_charge":  q.EnergyCharge,
+		"units":          q.Units,
+		"lines":          q.Lines,
+		"change":         q.Change,
+	}
+}
+
+// InitTariffs creates the tariff and meter debt tables
+func InitTariffs() map[string]interface{} {
+	if DB == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Tariffs need a database connection",
+		}
+	}
+	for _, query := range []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (tenant VARCHAR(255) NOT NULL DEFAULT '', tariff_index INTEGER NOT NULL, definition TEXT NOT NULL, updated_at BIGINT NOT NULL, PRIMARY KEY (tenant, tariff_index))", EscapeId(tariffTable)),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (meter_number VARCHAR(20) NOT NULL PRIMARY KEY, balance DOUBLE PRECISION NOT NULL, updated_at BIGINT NOT NULL)", EscapeId(debtTable)),
+	} {
+		if _, err := DB.Exec(query); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Failed to create tariff tables: " + err.Error(),
+			}
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "Tariffs ready",
+	}
+}
+
+// SetTariff stores the tariff of a tariff index, replacing the previous one:
+//
+//	{"tariff_index": 1, "name": "Domestic", "currency": "TZS", "type": "block",
+//	 "blocks": [{"up_to": 75, "rate": 100}, {"up_to": 0, "rate": 350}],
+//	 "vat_percent": 18, "fixed_charges": [{"name": "Service charge", "amount": 5000, "per": "month"}],
+//	 "debt_recovery_percent": 25}
+//
+// "flat" tariffs take a "rate", "tou" tariffs "periods": [{"from": "06:00", "to": "22:00", "rate": 300}, ...].
+// Callers with a tenant set the tariffs of their tenant's meters, callers without one the shared tariffs
+// used where a tenant has none, see GetTariff.
+func SetTariff(options map[string]interface{}) map[string]interface{} {
+	content, _ := json.Marshal(options)
+	var tariff Tariff
+	if err := json.Unmarshal(content, &tariff); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Invalid tariff: " + err.Error(),
+		}
+	}
+	if err := tariff.validate(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Invalid tariff: " + err.Error(),
+		}
+	}
+	tariff.Tenant = VendTenant(options)
+	tariff.UpdatedAt = time.Now()
+	definition, _ := json.Marshal(tariff)
+	verb, suffix := DBDialect.OnConflict(false, []string{"tenant", "tariff_index"}, []string{"definition", "updated_at"})
+	query := fmt.Sprintf("%s %s (tenant, tariff_index, definition, updated_at) VALUES (?, ?, ?, ?)%s", verb, EscapeId(tariffTable), suffix)
+	if _, err := DB.Exec(Rebind(query), tariff.Tenant, tariff.Index, string(definition), tariff.UpdatedAt.Unix()); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to save tariff: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": tariff.info(),
+	}
+}
+
+// ListTariffs returns the stored tariffs, {"tariff_index": 1} those of one index.
+// Callers with a tenant see their tenant's tariffs and the shared ones.
+func ListTariffs(options map[string]interface{}) map[string]interface{} {
+	var where []string
+	var args []interface{}
+	if index, ok := options["tariff_index"].(float64); ok {
+		where = append(where, "tariff_index = ?")
+		args = append(args, int(index))
+	}
+	if tenant := VendTenant(options); tenant != "" {
+		where = append(where, "tenant IN (?, '')")
+		args = append(args, tenant)
+	}
+	query := fmt.Sprintf("SELECT tenant, definition, updated_at FROM %s", EscapeId(tariffTable))
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := DB.Query(Rebind(query+" ORDER BY tariff_index, tenant"), args...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to list tariffs: " + err.Error(),
+		}
+	}
+	defer rows.Close()
+	list := []map[string]interface{}{}
+	for rows.Next() {
+		tariff, err := scanTariff(rows)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Unable to list tariffs: " + err.Error(),
+			}
+		}
+		list = append(list, tariff.info())
+	}
+	if err := rows.Err(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to list tariffs: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": list,
+	}
+}
+
+// GetTariff returns the tariff of a tariff index for the meters of tenant, the shared tariff when the
+// tenant has none of its own and nil when neither is set
+func GetTariff(tenant string, index int) (*Tariff, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("tariffs need a database connection")
+	}
+	// The tenant's own tariff sorts before the shared one ("")
+	query := fmt.Sprintf("SELECT tenant, definition, updated_at FROM %s WHERE tariff_index = ? AND tenant IN (?, '') ORDER BY tenant DESC", EscapeId(tariffTable))
+	tariff, err := scanTariff(DB.QueryRow(Rebind(query), index, tenant))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return tariff, err
+}
+
+func scanTariff(row interface{ Scan(...interface{}) error }) (*Tariff, error) {
+	var tenant, definition string
+	var updated int64
+	if err := row.Scan(&tenant, &definition, &updated); err != nil {
+		return nil, err
+	}
+	tariff := &Tariff{}
+	if err := json.Unmarshal([]byte(definition), tariff); err != nil {
+		return nil, err
+	}
+	tariff.Tenant = tenant
+	tariff.UpdatedAt = time.Unix(updated, 0)
+	return tariff, nil
+}
+
+func (t Tariff) validate() error {
+	if t.Index < 0 || t.Index > 99 {
+		return fmt.Errorf("tariff_index must be a whole number between 0 and 99")
+	}
+	if t.VATPercent < 0 || t.VATPercent > 100 {
+		return fmt.Errorf("vat_percent must be between 0 and 100")
+	}
+	if t.DebtRecoveryPercent < 0 || t.DebtRecoveryPercent > 100 {
+		return fmt.Errorf("debt_recovery_percent must be between 0 and 100")
+	}
+	for _, charge := range t.FixedCharges {
+		if charge.Name == "" || charge.Amount < 0 {
+			return fmt.Errorf("fixed charges need a name and an amount of at least 0")
+		}
+		if charge.Per != "vend" && charge.Per != "month" {
+			return fmt.Errorf("fixed charge %q must be per \"vend\" or \"month\"", charge.Name)
+		}
+	}
+	switch t.Type {
+	case TariffTypeFlat:
+		if t.Rate <= 0 {
+			return fmt.Errorf("flat tariffs need a rate above 0")
+		}
+	case TariffTypeBlock:
+		if len(t.Blocks) == 0 {
+			return fmt.Errorf("block tariffs need blocks")
+		}
+		previous := 0.0
+		for i, block := range t.Blocks {
+			if block.Rate <= 0 {
+				return fmt.Errorf("block %d needs a rate above 0", i+1)
+			}
+			last := i == len(t.Blocks)-1
+			if (block.UpTo == 0) != last {
+				return fmt.Errorf("only the last block is open ended (up_to 0)")
+			}
+			if !last && block.UpTo <= previous {
+				return fmt.Errorf("block limits must increase")
+			}
+			previous = block.UpTo
+		}
+	case TariffTypeTOU:
+		if len(t.Periods) == 0 {
+			return fmt.Errorf("time of use tariffs need periods")
+		}
+		for i, period := range t.Periods {
+			if period.Rate <= 0 {
+				return fmt.Errorf("period %d needs a rate above 0", i+1)
+			}
+			from, errFrom := clockMinutes(period.From)
+			to, errTo := clockMinutes(period.To)
+			if errFrom != nil || errTo != nil || from == to {
+				return fmt.Errorf("period %d needs different from and to times as HH:MM", i+1)
+			}
+			for _, day := range period.Days {
+				if _, ok := weekdays[strings.ToLower(day)]; !ok {
+					return fmt.Errorf("period %d has an unknown day %q", i+1, day)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("type must be %q, %q or %q", TariffTypeFlat, TariffTypeBlock, TariffTypeTOU)
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// clockMinutes reads "HH:MM" as minutes after midnight
+func clockMinutes(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// periodRate is the rate of the time of use period at covers
+func (t Tariff) periodRate(at time.Time) (float64, error) {
+	minute := at.Hour()*60 + at.Minute()
+	for _, period := range t.Periods {
+		from, _ := clockMinutes(period.From)
+		to, _ := clockMinutes(period.To)
+		day := at.Weekday()
+		inPeriod := minute >= from && minute < to
+		if from > to {
+			// Past midnight the period started the day before
+			inPeriod = minute >= from || minute < to
+			if minute < to {
+				day = at.AddDate(0, 0, -1).Weekday()
+			}
+		}
+		if inPeriod && periodDay(period, day) {
+			return period.Rate, nil
+		}
+	}
+	return 0, fmt.Errorf("No tariff period covers %s", at.Format("Mon 15:04"))
+}
+
+func periodDay(period TariffPeriod, day time.Weekday) bool {
+	if len(period.Days) == 0 {
+		return true
+	}
+	for _, name := range period.Days {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Quote splits a payment made at a time: debt recovery comes off the payment first, then VAT and the
+// fixed charges, the rest buys units in steps of resolution (0.1 for STS meters).
+func (t Tariff) Quote(payment float64, at time.Time, usage TariffUsage, debt float64, resolution float64) (TariffQuote, error) {
+	quote := TariffQuote{Payment: roundMoney(payment), DebtBalance: roundMoney(debt), Lines: []map[string]interface{}{}}
+	if payment <= 0 {
+		return quote, fmt.Errorf("payment must be a number above 0")
+	}
+	if debt > 0 && t.DebtRecoveryPercent > 0 {
+		quote.DebtRecovered = math.Min(roundMoney(payment*t.DebtRecoveryPercent/100), quote.DebtBalance)
+		quote.DebtBalance = roundMoney(quote.DebtBalance - quote.DebtRecovered)
+	}
+	for _, charge := range t.FixedCharges {
+		if charge.Per == "vend" || usage.MonthVends == 0 {
+			quote.FixedCharges = append(quote.FixedCharges, charge)
+			quote.FixedTotal = roundMoney(quote.FixedTotal + charge.Amount)
+		}
+	}
+	// The rest of the payment includes the VAT on the fixed charges and the energy
+	net := roundDown((payment-quote.DebtRecovered)/(1+t.VATPercent/100), 0.01)
+	budget := roundDown(net-quote.FixedTotal, 0.01)
+	if budget <= 0 {
+		return quote, fmt.Errorf("Payment does not cover the debt recovery, fixed charges and VAT of %.2f", quote.DebtRecovered+quote.FixedTotal*(1+t.VATPercent/100))
+	}
+
+	var rates []TariffBlock
+	switch t.Type {
+	case TariffTypeFlat:
+		rates = []TariffBlock{{Rate: t.Rate}}
+	case TariffTypeTOU:
+		rate, err := t.periodRate(at)
+		if err != nil {
+			return quote, err
+		}
+		rates = []TariffBlock{{Rate: rate}}
+	case TariffTypeBlock:
+		// Blocks already filled this month are skipped, the current one is only partly available
+		for _, block := range t.Blocks {
+			if block.UpTo == 0 || block.UpTo > usage.MonthUnits {
+				available := 0.0
+				if block.UpTo > 0 {
+					available = block.UpTo - math.Max(usage.MonthUnits, 0)
+				}
+				rates = append(rates, TariffBlock{UpTo: available, Rate: block.Rate})
+				usage.MonthUnits = block.UpTo
+			}
+		}
+	}
+	for _, rate := range rates {
+		units := roundDown(budget/rate.Rate, resolution)
+		filled := rate.UpTo > 0 && units > rate.UpTo
+		if filled {
+			// Only whole steps of a block are sold, the rest of it goes at the next block's rate
+			units = roundDown(rate.UpTo, resolution)
+			if units <= 0 {
+				continue
+			}
+		}
+		if units <= 0 {
+			break
+		}
+		amount := roundMoney(units * rate.Rate)
+		if amount > budget {
+			amount = budget
+		}
+		budget = roundMoney(budget - amount)
+		quote.Units = math.Round((quote.Units+units)*1000) / 1000
+		quote.EnergyCharge = roundMoney(quote.EnergyCharge + amount)
+		quote.Lines = append(quote.Lines, map[string]interface{}{"rate": rate.Rate, "units": units, "amount": amount})
+		if !filled {
+			break
+		}
+	}
+	if quote.Units <= 0 {
+		return quote, fmt.Errorf("Payment is too small to buy %g units", resolution)
+	}
+	quote.VAT = roundMoney((quote.FixedTotal + quote.EnergyCharge) * t.VATPercent / 100)
+	quote.Change = roundMoney(quote.Payment - quote.DebtRecovered - quote.FixedTotal - quote.EnergyCharge - quote.VAT)
+	if quote.Change < 0 {
+		// VAT rounded up by a cent
+		quote.VAT = roundMoney(quote.VAT + quote.Change)
+		quote.Change = 0
+	}
+	return quote, nil
+}
+
+func roundMoney(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// roundDown rounds value down to a multiple of step, tolerating float error just below a step
+func roundDown(value, step float64) float64 {
+	steps := math.Floor(value/step + 1e-9)
+	return math.Round(steps*step*1000) / 1000
+}
+
+// MeterUsage returns the credit units vended to a meter since the start of the month of at,
+// and the number of credit tokens
+func MeterUsage(meterNumber string, at time.Time) (TariffUsage, error) {
+	var usage TariffUsage
+	monthStart := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, at.Location())
+	query := fmt.Sprintf("SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM %s WHERE meter_number = ? AND token_type = ? AND issued_at >= ?", EscapeId(vendTable))
+	err := DB.QueryRow(Rebind(query), meterNumber, "credit", monthStart.Unix()).Scan(&usage.MonthUnits, &usage.MonthVends)
+	return usage, err
+}
+
+// MeterDebt returns the outstanding debt of a meter, 0 when it has none
+func MeterDebt(meterNumber string) (float64, error) {
+	if DB == nil {
+		return 0, fmt.Errorf("tariffs need a database connection")
+	}
+	var balance float64
+	query := fmt.Sprintf("SELECT balance FROM %s WHERE meter_number = ?", EscapeId(debtTable))
+	err := DB.QueryRow(Rebind(query), meterNumber).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
+
+// RecoverDebt takes a recovered amount off a meter's debt, failing when the debt is no longer that large
+// (it was changed or recovered by another vend since the payment was quoted)
+func RecoverDebt(q Querier, meterNumber string, amount float64) error {
+	query := fmt.Sprintf("UPDATE %s SET balance = balance - ?, updated_at = ? WHERE meter_number = ? AND balance >= ?", EscapeId(debtTable))
+	result, err := q.Exec(Rebind(query), amount, time.Now().Unix(), meterNumber, amount)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("the debt of meter %s changed during the vend, try again", meterNumber)
+	}
+	return nil
+}
+
+// SetMeterDebt sets the outstanding debt of a registered meter, recovered from its payments by the tariff's
+// debt_recovery_percent: {"meter_number": "01234567890", "balance": 12000}
+func SetMeterDebt(options map[string]interface{}) map[string]interface{} {
+	meter, err := LookupMeter(options)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	number := meter.Number
+	balance, ok := options["balance"].(float64)
+	if !ok || balance < 0 {
+		return map[string]interface{}{
+			"success": false,
+			"message": "balance must be a number of at least 0",
+		}
+	}
+	verb, suffix := DBDialect.OnConflict(false, []string{"meter_number"}, []string{"balance", "updated_at"})
+	query := fmt.Sprintf("%s %s (meter_number, balance, updated_at) VALUES (?, ?, ?)%s", verb, EscapeId(debtTable), suffix)
+	if _, err := DB.Exec(Rebind(query), number, roundMoney(balance), time.Now().Unix()); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to set meter debt: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"meter_number": number,
+			"balance":      roundMoney(balance),
+		},
+	}
+}
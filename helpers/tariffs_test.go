@@ -0,0 +1,148 @@
+package helpers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// tariffJSON decodes a tariff the way SetTariff reads it
+func tariffJSON(t *testing.T, content string) Tariff {
+	t.Helper()
+	var tariff Tariff
+	if err := json.Unmarshal([]byte(content), &tariff); err != nil {
+		t.Fatal(err)
+	}
+	if err := tariff.validate(); err != nil {
+		t.Fatalf("%s: %v", content, err)
+	}
+	return tariff
+}
+
+func TestTariffQuote(t *testing.T) {
+	flat := `{"type": "flat", "rate": 100, "vat_percent": 18}`
+	blocks := `{"type": "block", "blocks": [{"up_to": 75, "rate": 100}, {"up_to": 0, "rate": 350}]}`
+	tou := `{"type": "tou", "periods": [{"from": "06:00", "to": "22:00", "rate": 300}, {"from": "22:00", "to": "06:00", "rate": 100}]}`
+	monthly := `{"type": "flat", "rate": 100, "fixed_charges": [{"name": "Service", "amount": 500, "per": "month"}]}`
+	debt := `{"type": "flat", "rate": 100, "debt_recovery_percent": 25}`
+	noon := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		tariff    string
+		payment   float64
+		at        time.Time
+		usage     TariffUsage
+		debt      float64
+		units     float64
+		energy    float64
+		vat       float64
+		change    float64
+		recovered float64
+	}{
+		{"flat with VAT", flat, 1180, noon, TariffUsage{}, 0, 10, 1000, 180, 0, 0},
+		{"flat rounded down to 0.1", flat, 1000, noon, TariffUsage{}, 0, 8.4, 840, 151.2, 8.8, 0},
+		{"block crossing", blocks, 10000, noon, TariffUsage{MonthUnits: 70}, 0, 32.1, 9985, 0, 15, 0},
+		{"block partial step", blocks, 10000, noon, TariffUsage{MonthUnits: 70.05}, 0, 32, 9975, 0, 25, 0},
+		{"block filled", blocks, 10000, noon, TariffUsage{MonthUnits: 80}, 0, 28.5, 9975, 0, 25, 0},
+		{"tou day", tou, 3000, noon, TariffUsage{}, 0, 10, 3000, 0, 0, 0},
+		{"tou past midnight", tou, 3000, time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), TariffUsage{}, 0, 30, 3000, 0, 0, 0},
+		{"monthly charge", monthly, 1000, noon, TariffUsage{}, 0, 5, 500, 0, 0, 0},
+		{"monthly charge paid", monthly, 1000, noon, TariffUsage{MonthVends: 1}, 0, 10, 1000, 0, 0, 0},
+		{"debt cleared", debt, 1000, noon, TariffUsage{}, 100, 9, 900, 0, 0, 100},
+		{"debt recovered", debt, 1000, noon, TariffUsage{}, 1000, 7.5, 750, 0, 0, 250},
+	}
+	for _, tt := range tests {
+		quote, err := tariffJSON(t, tt.tariff).Quote(tt.payment, tt.at, tt.usage, tt.debt, 0.1)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if quote.Units != tt.units || quote.EnergyCharge != tt.energy || quote.VAT != tt.vat || quote.Change != tt.change || quote.DebtRecovered != tt.recovered {
+			t.Errorf("%s: units %v energy %v vat %v change %v recovered %v, want %v %v %v %v %v", tt.name,
+				quote.Units, quote.EnergyCharge, quote.VAT, quote.Change, quote.DebtRecovered, tt.units, tt.energy, tt.vat, tt.change, tt.recovered)
+		}
+		total := quote.DebtRecovered + quote.FixedTotal + quote.EnergyCharge + quote.VAT + quote.Change
+		if roundMoney(total) != tt.payment {
+			t.Errorf("%s: receipt adds up to %v, not the payment %v", tt.name, total, tt.payment)
+		}
+	}
+
+	for _, payment := range []float64{0, 5} {
+		if _, err := tariffJSON(t, flat).Quote(payment, noon, TariffUsage{}, 0, 0.1); err == nil {
+			t.Errorf("Quote of %v succeeded", payment)
+		}
+	}
+	if _, err := tariffJSON(t, monthly).Quote(400, noon, TariffUsage{}, 0, 0.1); err == nil {
+		t.Errorf("Quote of a payment below the fixed charges succeeded")
+	}
+}
+
+func TestTariffValidate(t *testing.T) {
+	tests := []string{
+		`{"type": "flat"}`,
+		`{"type": "flat", "rate": 1, "tariff_index": 100}`,
+		`{"type": "flat", "rate": 1, "vat_percent": 101}`,
+		`{"type": "flat", "rate": 1, "fixed_charges": [{"name": "x", "amount": 1, "per": "year"}]}`,
+		`{"type": "block", "blocks": [{"up_to": 0, "rate": 1}, {"up_to": 50, "rate": 2}]}`,
+		`{"type": "block", "blocks": [{"up_to": 50, "rate": 1}, {"up_to": 20, "rate": 2}, {"up_to": 0, "rate": 3}]}`,
+		`{"type": "tou", "periods": [{"from": "06:00", "to": "06:00", "rate": 1}]}`,
+		`{"type": "tou", "periods": [{"from": "06:00", "to": "22:00", "days": ["xyz"], "rate": 1}]}`,
+		`{"type": "stepped", "rate": 1}`,
+	}
+	for _, content := range tests {
+		var tariff Tariff
+		json.Unmarshal([]byte(content), &tariff)
+		if err := tariff.validate(); err == nil {
+			t.Errorf("validate(%s) succeeded", content)
+		}
+	}
+}
+
+func TestTariffStore(t *testing.T) {
+	useMeters(t)
+	if res := InitTariffs(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	var options map[string]interface{}
+	json.Unmarshal([]byte(`{"tariff_index": 1, "name": "Domestic", "type": "flat", "rate": 100}`), &options)
+	if res := SetTariff(options); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	options["rate"] = 120.0
+	if res := SetTariff(options); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	tariff, err := GetTariff("", 1)
+	if err != nil || tariff == nil || tariff.Rate != 120 || tariff.Name != "Domestic" {
+		t.Errorf("GetTariff(1) = %+v, %v", tariff, err)
+	}
+	if tariff, err := GetTariff("", 2); tariff != nil || err != nil {
+		t.Errorf("GetTariff(2) = %+v, %v, want nil", tariff, err)
+	}
+	if list := ListTariffs(map[string]interface{}{})["message"].([]map[string]interface{}); len(list) != 1 {
+		t.Errorf("ListTariffs = %v", list)
+	}
+
+	const meter = "01234567897"
+	if res := SetMeterDebt(map[string]interface{}{"meter_number": "555", "balance": 100.0}); res["success"].(bool) {
+		t.Errorf("SetMeterDebt of an unregistered meter succeeded")
+	}
+	RegisterMeter(map[string]interface{}{"meter_number": meter, "supply_group_code": 123456.0, "tariff_index": 1.0})
+	if res := SetMeterDebt(map[string]interface{}{"meter_number": meter, "balance": 100.0}); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	if err := RecoverDebt(DB, meter, 60); err != nil {
+		t.Fatal(err)
+	}
+	// A second recovery quoted against the old balance must not drive the debt below zero
+	if err := RecoverDebt(DB, meter, 60); err == nil {
+		t.Errorf("RecoverDebt took more than the outstanding debt")
+	}
+	if balance, err := MeterDebt(meter); err != nil || balance != 40 {
+		t.Errorf("MeterDebt = %v, %v, want 40", balance, err)
+	}
+	if balance, err := MeterDebt("1"); err != nil || balance != 0 {
+		t.Errorf("MeterDebt of a meter without debt = %v, %v", balance, err)
+	}
+}
@@ -0,0 +1,92 @@
+package helpers
+
+import (
+	"fmt"
+)
+
+// TenantOption is the request option holding the caller's Tenant, set by the route layer only
+const TenantOption = "$tenant"
+
+// Tenant is the tenant of an authorized caller. JSON bodies can't produce this type,
+// so a client sending "$tenant" itself never passes for a scoped caller.
+type Tenant struct {
+	Value interface{}
+}
+
+// tenantClaim is the claim (and user column) holding the tenant, TENANT_CLAIM or "org_id"
+func tenantClaim() string {
+	if TenantClaim == "" {
+		return "org_id"
+	}
+	return TenantClaim
+}
+
+// UserTenant reads the tenant of a user row at login, nil when the user has none
+func UserTenant(user map[string]interface{}) interface{} {
+	return user[tenantClaim()]
+}
+
+// WithTenant sets the tenant of validated token claims on a request body,
+// any "$tenant" sent by the client is removed
+func WithTenant(body map[string]interface{}, claims map[string]interface{}) {
+	delete(body, TenantOption)
+	if value, ok := claims[tenantClaim()]; ok && value != nil {
+		body[TenantOption] = Tenant{Value: value}
+	}
+}
+
+// TenantColumn returns the "tenant_column" of a table from the schema config, "" when not scoped
+func TenantColumn(table string) string {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+	return schemaConfig.Tables[table].TenantColumn
+}
+
+// HasTenantTables reports whether any table is tenant scoped
+func HasTenantTables() bool {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+	for _, table := range schemaConfig.Tables {
+		if table.TenantColumn != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantScope returns the tenant column and value a request must be restricted to on table.
+// column is "" for tables that are not scoped, requests without a tenant can't use scoped tables.
+func TenantScope(options map[string]interface{}, table string) (string, interface{}, error) {
+	column := TenantColumn(table)
+	if column == "" {
+		return "", nil, nil
+	}
+	tenant, ok := options[TenantOption].(Tenant)
+	if !ok || tenant.Value == nil {
+		return "", nil, fmt.Errorf("Table '%s' is tenant scoped and requires a tenant", table)
+	}
+	return column, tenant.Value, nil
+}
+
+// ScopeWhere ANDs the tenant condition of table into a WHERE clause
+func ScopeWhere(options map[string]interface{}, table, where string, params []interface{}) (string, []interface{}, error) {
+	column, value, err := TenantScope(options, table)
+	if err != nil || column == "" {
+		return where, params, err
+	}
+	scope := fmt.Sprintf("%s = ?", EscapeId(table+"."+column))
+	if where == "" {
+		return scope, append(params, value), nil
+	}
+	return fmt.Sprintf("( %s ) AND %s", where, scope), append(params, value), nil
+}
+
+// ScopeData forces the tenant column of table into a create/update data map
+func ScopeData(options map[string]interface{}, table string, data map[string]interface{}) error {
+	column, value, err := TenantScope(options, table)
+	if err != nil || column == "" {
+		return err
+	}
+	data[column] = value
+	return nil
+}
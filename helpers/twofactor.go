@@ -0,0 +1,644 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// twoFactorTable holds the TOTP secret and recovery codes of each enrolled user
+const twoFactorTable = "auth_two_factor"
+
+// RFC 6238 parameters, the defaults of authenticator apps
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1 // periods accepted before and after the current one
+)
+
+const (
+	recoveryCodeCount   = 10
+	challengeMaxAttempt = 5
+	challengeTokenUse   = "2fa"
+)
+
+// A user whose second factor fails twoFactorMaxFailures times in a row, across any number of login
+// challenges, is locked out of the second step for twoFactorLockout
+const (
+	twoFactorMaxFailures = 10
+	twoFactorLockout     = 15 * time.Minute
+)
+
+// errTwoFactorLocked is returned while a user is locked out of the second login step
+var errTwoFactorLocked = fmt.Errorf("Too many failed two-factor attempts, try again later")
+
+// Second factor methods of the login challenge
+const (
+	MethodTOTP     = "totp"
+	MethodRecovery = "recovery"
+	MethodEmail    = "email"
+	MethodSMS      = "sms"
+)
+
+// challengeState is the server side part of a login challenge: attempts and the sent OTP
+type challengeState struct {
+	expires      time.Time
+	attempts     int
+	email        string
+	phone        string
+	otpRecipient string // address the last login code was sent to
+}
+
+var (
+	challengeMu sync.Mutex
+	challenges  = map[string]*challengeState{} // by challenge jti
+)
+
+func twoFactorTTL() time.Duration {
+	if TwoFactorTTL <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(TwoFactorTTL) * time.Minute
+}
+
+// InitTwoFactor creates the two-factor table
+func InitTwoFactor() map[string]interface{} {
+	if DB == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication needs a database connection",
+		}
+	}
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (user_id VARCHAR(255) NOT NULL PRIMARY KEY, secret VARCHAR(64) NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 0, recovery_codes TEXT NOT NULL, last_counter BIGINT NOT NULL DEFAULT 0,
+		failed_attempts INTEGER NOT NULL DEFAULT 0, locked_until BIGINT NOT NULL DEFAULT 0, created_at BIGINT NOT NULL)`,
+		EscapeId(twoFactorTable))
+	if _, err := DB.Exec(query); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to create two-factor table: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "Two-factor authentication enabled",
+	}
+}
+
+// EnrollTwoFactor creates a TOTP secret and recovery codes for the caller, 2FA stays off
+// until ConfirmTwoFactor receives a valid code from the authenticator app
+func EnrollTwoFactor(claims map[string]interface{}) map[string]interface{} {
+	userID, userName, ok := twoFactorUser(claims)
+	if !ok {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication needs a user session",
+		}
+	}
+	record, err := loadTwoFactor(userID)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to enroll two-factor authentication: " + err.Error(),
+		}
+	}
+	if record != nil && record.enabled {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication is already enabled",
+		}
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to enroll two-factor authentication: " + err.Error(),
+		}
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := randomToken(5)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": "Unable to enroll two-factor authentication: " + err.Error(),
+			}
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	content, _ := json.Marshal(hashes)
+
+	if _, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE user_id = ?", EscapeId(twoFactorTable))), userID); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to enroll two-factor authentication: " + err.Error(),
+		}
+	}
+	query := fmt.Sprintf("INSERT INTO %s (user_id, secret, enabled, recovery_codes, created_at) VALUES (?, ?, 0, ?, ?)", EscapeId(twoFactorTable))
+	if _, err := DB.Exec(Rebind(query), userID, secret, string(content), time.Now().Unix()); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to enroll two-factor authentication: " + err.Error(),
+		}
+	}
+
+	issuer := TwoFactorIssuer
+	if issuer == "" {
+		issuer = "go_backend_api"
+	}
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", strconv.Itoa(totpDigits))
+	values.Set("period", strconv.Itoa(totpPeriod))
+	uri := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + userName, RawQuery: values.Encode()}
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"status":         "Scan the URI with an authenticator app and confirm with a code",
+			"secret":         secret,
+			"otpauth_uri":    uri.String(),
+			"recovery_codes": codes,
+		},
+	}
+}
+
+// ConfirmTwoFactor turns 2FA on once the caller proves the authenticator app works: {"code": "123456"}
+func ConfirmTwoFactor(claims map[string]interface{}, options map[string]interface{}) map[string]interface{} {
+	userID, _, ok := twoFactorUser(claims)
+	if !ok {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication needs a user session",
+		}
+	}
+	record, err := loadTwoFactor(userID)
+	if err != nil || record == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication is not enrolled",
+		}
+	}
+	if record.enabled {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication is already enabled",
+		}
+	}
+	code, _ := options["code"].(string)
+	if !record.useTOTP(code) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Invalid two-factor code",
+		}
+	}
+	query := fmt.Sprintf("UPDATE %s SET enabled = 1 WHERE user_id = ?", EscapeId(twoFactorTable))
+	if _, err := DB.Exec(Rebind(query), userID); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to enable two-factor authentication: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "Two-factor authentication enabled",
+	}
+}
+
+// DisableTwoFactor removes the caller's 2FA with a current TOTP or a recovery code: {"code": "..."}
+func DisableTwoFactor(claims map[string]interface{}, options map[string]interface{}) map[string]interface{} {
+	userID, _, ok := twoFactorUser(claims)
+	if !ok {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication needs a user session",
+		}
+	}
+	record, err := loadTwoFactor(userID)
+	if err != nil || record == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Two-factor authentication is not enrolled",
+		}
+	}
+	code, _ := options["code"].(string)
+	if record.enabled && !record.useTOTP(code) && !record.useRecoveryCode(code) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Invalid two-factor code",
+		}
+	}
+	if _, err := DB.Exec(Rebind(fmt.Sprintf("DELETE FROM %s WHERE user_id = ?", EscapeId(twoFactorTable))), userID); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to disable two-factor authentication: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "Two-factor authentication disabled",
+	}
+}
+
+// TwoFactorChallenge starts the second login step for users with 2FA enabled. It returns nil
+// when the user has no 2FA and the login can issue tokens right away.
+func TwoFactorChallenge(user map[string]interface{}) map[string]interface{} {
+	userID := userKey(user["id"])
+	if DB == nil || userID == "" {
+		return nil
+	}
+	record, err := loadTwoFactor(userID)
+	if err != nil {
+		LogJSON(false, "Two-factor lookup failed: "+err.Error())
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to complete login",
+		}
+	}
+	if record == nil || !record.enabled {
+		return nil
+	}
+	if record.locked() {
+		return map[string]interface{}{
+			"success": false,
+			"message": errTwoFactorLocked.Error(),
+		}
+	}
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to complete login",
+		}
+	}
+	now := time.Now()
+	expires := now.Add(twoFactorTTL())
+	claims := jwt.MapClaims{
+		"id":        user["id"],
+		"user_name": user[authUsernameColumn()],
+		"token_use": challengeTokenUse,
+		"exp":       expires.Unix(),
+		"issued_at": now.Unix(),
+		"issuer":    "go_backend_api",
+		"jti":       jti,
+	}
+	if roles := UserRoles(user); len(roles) > 0 {
+		claims["roles"] = roles
+	}
+	if tenant := UserTenant(user); tenant != nil {
+		claims["tenant"] = tenant
+	}
+	token, err := signToken(claims)
+	if err != nil {
+		LogJSON(false, "Failed to sign login challenge: "+err.Error())
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to complete login",
+		}
+	}
+
+	state := &challengeState{expires: expires}
+	state.email, _ = user["email"].(string)
+	state.phone, _ = user["phone"].(string)
+	methods := []string{MethodTOTP, MethodRecovery}
+	if state.email != "" {
+		methods = append(methods, MethodEmail)
+	}
+	if state.phone != "" {
+		methods = append(methods, MethodSMS)
+	}
+	challengeMu.Lock()
+	for id, other := range challenges {
+		if now.After(other.expires) {
+			delete(challenges, id)
+		}
+	}
+	challenges[jti] = state
+	challengeMu.Unlock()
+
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"two_factor_required": true,
+			"challenge_token":     token,
+			"methods":             methods,
+			"expires_in":          int(twoFactorTTL().Seconds()),
+		},
+	}
+}
+
+// StoreTwoFactorOTP issues an OTP of purpose "login" for a login challenge and returns the address
+// it must be sent to on the channel ("email" or "sms")
+func StoreTwoFactorOTP(challengeToken, channel, code string) (string, error) {
+	claims, err := parseChallenge(challengeToken)
+	if err != nil {
+		return "", err
+	}
+	if record, err := loadTwoFactor(userKey(claims["id"])); err == nil && record != nil && record.locked() {
+		return "", errTwoFactorLocked
+	}
+	jti, _ := claims["jti"].(string)
+	challengeMu.Lock()
+	defer challengeMu.Unlock()
+	state, ok := challenges[jti]
+	if !ok {
+		return "", fmt.Errorf("Login challenge expired, please log in again")
+	}
+	recipient := state.email
+	if channel == MethodSMS {
+		recipient = state.phone
+	} else if channel != MethodEmail {
+		return "", fmt.Errorf("Unknown OTP channel %q, expected email or sms", channel)
+	}
+	if recipient == "" {
+		return "", fmt.Errorf("No %s address on file for this user", channel)
+	}
+	if err := IssueOTP("login", recipient, code); err != nil {
+		return "", err
+	}
+	state.otpRecipient = recipient
+	return recipient, nil
+}
+
+// WithdrawTwoFactorOTP removes a login code StoreTwoFactorOTP stored but that could not be sent
+func WithdrawTwoFactorOTP(recipient string) error {
+	return WithdrawOTP("login", recipient)
+}
+
+// VerifyTwoFactor checks the second factor of a login challenge:
+// {"challenge_token": "...", "method": "totp|recovery|email|sms", "code": "..."}.
+// It returns the user for Authenticate, each challenge allows a few attempts and one success.
+// Failures also count against the user, see twoFactorMaxFailures.
+func VerifyTwoFactor(options map[string]interface{}) (map[string]interface{}, error) {
+	invalid := fmt.Errorf("Invalid two-factor code")
+	token, _ := options["challenge_token"].(string)
+	claims, err := parseChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	jti, _ := claims["jti"].(string)
+	challengeMu.Lock()
+	state, ok := challenges[jti]
+	if ok {
+		state.attempts++
+		if state.attempts > challengeMaxAttempt {
+			delete(challenges, jti)
+			ok = false
+		}
+	}
+	challengeMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Login challenge expired, please log in again")
+	}
+	record, err := loadTwoFactor(userKey(claims["id"]))
+	if err != nil || record == nil || !record.enabled {
+		return nil, invalid
+	}
+	if record.locked() {
+		challengeMu.Lock()
+		delete(challenges, jti)
+		challengeMu.Unlock()
+		return nil, errTwoFactorLocked
+	}
+
+	method, _ := options["method"].(string)
+	if method == "" {
+		method = MethodTOTP
+	}
+	code, _ := options["code"].(string)
+	code = strings.TrimSpace(code)
+	valid := false
+	switch method {
+	case MethodTOTP, MethodRecovery:
+		if method == MethodTOTP {
+			valid = record.useTOTP(code)
+		} else {
+			valid = record.useRecoveryCode(code)
+		}
+	case MethodEmail, MethodSMS:
+		challengeMu.Lock()
+		recipient := state.otpRecipient
+		challengeMu.Unlock()
+		valid = recipient != "" && VerifyOTP("login", recipient, code) == nil
+	default:
+		return nil, fmt.Errorf("Unknown two-factor method %q", method)
+	}
+	if !valid {
+		if record.recordFailure() {
+			challengeMu.Lock()
+			delete(challenges, jti)
+			challengeMu.Unlock()
+			return nil, errTwoFactorLocked
+		}
+		return nil, invalid
+	}
+	record.resetFailures()
+
+	challengeMu.Lock()
+	_, pending := challenges[jti]
+	delete(challenges, jti)
+	challengeMu.Unlock()
+	if !pending {
+		return nil, fmt.Errorf("Login challenge expired, please log in again")
+	}
+	return map[string]interface{}{
+		"id":        claims["id"],
+		"user_name": claims["user_name"],
+		"roles":     claims["roles"],
+		"tenant":    claims["tenant"],
+	}, nil
+}
+
+// parseChallenge verifies a challenge token signed by TwoFactorChallenge
+func parseChallenge(raw string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(raw, verificationKey)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("Login challenge expired, please log in again")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["token_use"] != challengeTokenUse {
+		return nil, fmt.Errorf("Login challenge expired, please log in again")
+	}
+	return claims, nil
+}
+
+// twoFactorRecord is one row of the two-factor table
+type twoFactorRecord struct {
+	userID      string
+	secret      string
+	enabled     bool
+	recovery    []string
+	lastCounter int64
+	failures    int
+	lockedUntil int64
+}
+
+func loadTwoFactor(userID string) (*twoFactorRecord, error) {
+	query := fmt.Sprintf("SELECT secret, enabled, recovery_codes, last_counter, failed_attempts, locked_until FROM %s WHERE user_id = ?", EscapeId(twoFactorTable))
+	rows, err := DB.Query(Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	record := &twoFactorRecord{userID: userID}
+	var enabled int
+	var recovery string
+	if err := rows.Scan(&record.secret, &enabled, &recovery, &record.lastCounter, &record.failures, &record.lockedUntil); err != nil {
+		return nil, err
+	}
+	record.enabled = enabled != 0
+	json.Unmarshal([]byte(recovery), &record.recovery)
+	return record, nil
+}
+
+// locked reports whether the user is locked out of the second login step
+func (record *twoFactorRecord) locked() bool {
+	return record.lockedUntil > time.Now().Unix()
+}
+
+// recordFailure counts a failed second factor and reports whether it locked the user out
+func (record *twoFactorRecord) recordFailure() bool {
+	query := fmt.Sprintf("UPDATE %s SET failed_attempts = failed_attempts + 1 WHERE user_id = ?", EscapeId(twoFactorTable))
+	if _, err := DB.Exec(Rebind(query), record.userID); err != nil {
+		LogJSON(false, "Failed to record two-factor failure: "+err.Error())
+		return false
+	}
+	query = fmt.Sprintf("UPDATE %s SET failed_attempts = 0, locked_until = ? WHERE user_id = ? AND failed_attempts >= ?", EscapeId(twoFactorTable))
+	result, err := DB.Exec(Rebind(query), time.Now().Add(twoFactorLockout).Unix(), record.userID, twoFactorMaxFailures)
+	if err != nil {
+		LogJSON(false, "Failed to lock two-factor login: "+err.Error())
+		return false
+	}
+	affected, _ := result.RowsAffected()
+	return affected == 1
+}
+
+// resetFailures clears the failure count after a successful second factor
+func (record *twoFactorRecord) resetFailures() {
+	if record.failures == 0 {
+		return
+	}
+	query := fmt.Sprintf("UPDATE %s SET failed_attempts = 0 WHERE user_id = ?", EscapeId(twoFactorTable))
+	if _, err := DB.Exec(Rebind(query), record.userID); err != nil {
+		LogJSON(false, "Failed to reset two-factor failures: "+err.Error())
+	}
+}
+
+// useTOTP accepts a code of the current period (± totpSkew) that is newer than the last one used,
+// so a code can't be replayed
+func (record *twoFactorRecord) useTOTP(code string) bool {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(record.secret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if counter <= record.lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter)), []byte(code)) == 1 {
+			// The counter only moves forward, a concurrent use of the same code updates nothing
+			query := fmt.Sprintf("UPDATE %s SET last_counter = ? WHERE user_id = ? AND last_counter < ?", EscapeId(twoFactorTable))
+			result, err := DB.Exec(Rebind(query), counter, record.userID, counter)
+			if err != nil {
+				LogJSON(false, "Failed to record TOTP use: "+err.Error())
+				return false
+			}
+			affected, _ := result.RowsAffected()
+			return affected == 1
+		}
+	}
+	return false
+}
+
+// useRecoveryCode accepts each recovery code once
+func (record *twoFactorRecord) useRecoveryCode(code string) bool {
+	if code == "" {
+		return false
+	}
+	hash := hashRecoveryCode(code)
+	for i, stored := range record.recovery {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) != 1 {
+			continue
+		}
+		remaining := append(append([]string{}, record.recovery[:i]...), record.recovery[i+1:]...)
+		content, _ := json.Marshal(remaining)
+		previous, _ := json.Marshal(record.recovery)
+		query := fmt.Sprintf("UPDATE %s SET recovery_codes = ? WHERE user_id = ? AND recovery_codes = ?", EscapeId(twoFactorTable))
+		result, err := DB.Exec(Rebind(query), string(content), record.userID, string(previous))
+		if err != nil {
+			LogJSON(false, "Failed to record recovery code use: "+err.Error())
+			return false
+		}
+		affected, _ := result.RowsAffected()
+		return affected == 1
+	}
+	return false
+}
+
+// totpCode is the RFC 4226 HOTP value of a counter
+func totpCode(key []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// hashRecoveryCode hashes a code ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// twoFactorUser returns the user id and name of token claims, API keys have no user
+func twoFactorUser(claims map[string]interface{}) (string, string, bool) {
+	if claims == nil || claims["api_key"] != nil {
+		return "", "", false
+	}
+	userID := userKey(claims["id"])
+	userName, _ := claims["user_name"].(string)
+	return userID, userName, userID != ""
+}
+
+// userKey formats a user id from a row or from JSON claims (float64) the same way
+func userKey(id interface{}) string {
+	switch v := id.(type) {
+	case nil:
+		return ""
+	case float64:
+		if v == float64(int64(v)) {
+			return strconv.FormatInt(int64(v), 10)
+		}
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(id)
+}
@@ -0,0 +1,67 @@
+package helpers
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	// RFC 4226 appendix D
+	hotp := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, want := range hotp {
+		if got := totpCode(key, int64(counter)); got != want {
+			t.Errorf("totpCode(%d) = %s, want %s", counter, got, want)
+		}
+	}
+	// RFC 6238 appendix B (SHA1), the last 6 of the 8 digit values
+	tests := map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"}
+	for unix, want := range tests {
+		if got := totpCode(key, unix/totpPeriod); got != want {
+			t.Errorf("TOTP at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	openTestDB(t)
+	if res := InitTwoFactor(); !res["success"].(bool) {
+		t.Fatal(res["message"])
+	}
+	claims := map[string]interface{}{"id": 7.0, "user_name": "joe"}
+	enrolled := EnrollTwoFactor(claims)
+	if !enrolled["success"].(bool) {
+		t.Fatalf("EnrollTwoFactor = %v", enrolled)
+	}
+	message := enrolled["message"].(map[string]interface{})
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(message["secret"].(string))
+	if err != nil || len(key) != 20 {
+		t.Fatalf("secret %v: %v", message["secret"], err)
+	}
+	codes := message["recovery_codes"].([]string)
+
+	if res := ConfirmTwoFactor(claims, map[string]interface{}{"code": "000000"}); res["success"].(bool) {
+		t.Errorf("ConfirmTwoFactor accepted a wrong code")
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	if res := ConfirmTwoFactor(claims, map[string]interface{}{"code": code}); !res["success"].(bool) {
+		t.Fatalf("ConfirmTwoFactor = %v", res)
+	}
+	if res := EnrollTwoFactor(claims); res["success"].(bool) {
+		t.Errorf("EnrollTwoFactor replaced an enabled secret")
+	}
+	// A code is only accepted once
+	if res := DisableTwoFactor(claims, map[string]interface{}{"code": code}); res["success"].(bool) {
+		t.Errorf("DisableTwoFactor accepted a used TOTP code")
+	}
+	if res := DisableTwoFactor(claims, map[string]interface{}{"code": codes[0]}); !res["success"].(bool) {
+		t.Errorf("DisableTwoFactor with a recovery code = %v", res)
+	}
+	if res := ConfirmTwoFactor(claims, map[string]interface{}{"code": code}); res["success"].(bool) {
+		t.Errorf("ConfirmTwoFactor after disabling = %v", res)
+	}
+	if res := EnrollTwoFactor(map[string]interface{}{"api_key": "k", "id": 7.0}); res["success"].(bool) {
+		t.Errorf("API keys can enroll two-factor authentication")
+	}
+}
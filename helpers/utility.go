@@ -76,42 +76,33 @@ func BytesToBinStr(data []byte) string {
 }
 
 // ---------- ENCRYPTION / DECODING HELPERS ----------
-func GenerateDecoderKey() map[string]interface{} {
-	var (
-		key_type          = 0                    // 8 bits
-		keyRevisionNumber = 0                    // 8 bits
-		supplyGroupCode   = 12345                // 16 bits
-		tariffIndex       = 3                    // 8 bits
-		decoderRefNumber  = uint64(123456789012) // 64 bits
-		random            = 12345678             // 88 bits
-	)
-
-	keyTypeBin := DecToBin(key_type, 8)                        // 8 bits
-	supplyGroupBin := DecToBin(supplyGroupCode, 16)            // 16 bits
-	tariffIndexBin := DecToBin(tariffIndex, 8)                 // 8 bits
-	keyRevisionBin := DecToBin(keyRevisionNumber, 8)           // 8 bits
-	decoderRefNumberBin := DecToBin(int(decoderRefNumber), 64) // 64 bits
-	padding := DecToBin(random, 88)                            // 88 bits
-	// Build data block by concatenating all bits
-	dataBlock := keyTypeBin + supplyGroupBin + tariffIndexBin + keyRevisionBin + decoderRefNumberBin + padding
-	//fmt.Println("DataBlock: ", dataBlock)
-	//fmt.Println("dataBlock length:  ", len(dataBlock)) // Should be 16+8+16+8+8+64 = 120 bits
-	if len(dataBlock) != 192 {
+// GenerateDecoderKey derives the 192-bit 3DES decoder key of a registered meter from the vending key
+func GenerateDecoderKey(meter Meter) map[string]interface{} {
+	key, err := deriveDecoderKey(meter)
+	if err != nil {
 		return map[string]interface{}{
 			"success": false,
-			"message": fmt.Sprintf("decoder key must be 192 bits, got %d", len(dataBlock)),
+			"message": err.Error(),
+		}
+	}
+	keyBin := BytesToBinStr(key)
+	if len(keyBin) != 192 {
+		return map[string]interface{}{
+			"success": false,
+			"message": fmt.Sprintf("decoder key must be 192 bits, got %d", len(keyBin)),
 		}
 	}
 	return map[string]interface{}{
 		"success": true,
-		"message": dataBlock,
+		"message": keyBin,
 	}
 }
 
-// LuhnCheckDigit calculates the Luhn check digit for a given number string
+// LuhnCheckDigit calculates the Luhn check digit for a given number string,
+// the rightmost digit is doubled as the check digit goes after it
 func LuhnCheckDigit(number string) int {
 	sum := 0
-	alt := false
+	alt := true
 	// Loop through the number in reverse
 	for i := len(number) - 1; i >= 0; i-- {
 		n, _ := strconv.Atoi(string(number[i]))
@@ -369,13 +360,10 @@ func TranspositionAndRemoveClassBits(tokenBin string) map[string]interface{} {
 	pos28 := len(bits) - 1 - 28
 	pos27 := len(bits) - 1 - 27
 
-	saved65 := bits[pos65]
-	saved64 := bits[pos64]
-
-	bits[pos28] = saved65
-	bits[pos27] = saved64
-
-	tokenClass := bits[0:2]
+	// The class bits sit at positions 28 and 27, the bits they replaced at 65 and 64
+	tokenClass := []string{bits[pos28], bits[pos27]}
+	bits[pos28] = bits[pos65]
+	bits[pos27] = bits[pos64]
 	restored := bits[2:]
 	return map[string]interface{}{
 		"success": true,
@@ -0,0 +1,493 @@
+package helpers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vendTable is the vending ledger, one row per token issued
+const vendTable = "vend_tokens"
+
+// maxVendPage caps the rows /tokens returns at once
+const maxVendPage = 500
+
+// VendRecord is one issued token. Tokens vended together (a key change pair) share a request id
+// and are told apart by their position.
+type VendRecord struct {
+	ID            string
+	RequestID     string
+	Position      int
+	MeterNumber   string
+	Token         string // display form, 5 groups of 4 digits
+	TokenType     string
+	Class         int
+	Subclass      int
+	TID           sql.NullInt64 // token identifier, key change tokens carry none
+	Amount        float64       // units of credit tokens
+	Operator      string
+	Tenant        string                 // tenant of the operator, "" for callers without one
+	Details       map[string]interface{} // the issue response, returned again by reprints
+	IssuedAt      time.Time
+	ReprintCount  int
+	LastReprintAt time.Time
+	UsedAt        time.Time
+}
+
+func (r VendRecord) info() map[string]interface{} {
+	info := map[string]interface{}{
+		"id":              r.ID,
+		"request_id":      r.RequestID,
+		"meter_number":    r.MeterNumber,
+		"token":           r.Token,
+		"type":            r.TokenType,
+		"class":           r.Class,
+		"subclass":        r.Subclass,
+		"identifier":      nil,
+		"amount":          r.Amount,
+		"operator":        r.Operator,
+		"issued_at":       r.IssuedAt.Format(time.RFC3339),
+		"reprint_count":   r.ReprintCount,
+		"last_reprint_at": nil,
+		"used_at":         nil,
+	}
+	if r.TID.Valid {
+		info["identifier"] = r.TID.Int64
+	}
+	if !r.LastReprintAt.IsZero() {
+		info["last_reprint_at"] = r.LastReprintAt.Format(time.RFC3339)
+	}
+	if !r.UsedAt.IsZero() {
+		info["used_at"] = r.UsedAt.Format(time.RFC3339)
+	}
+	return info
+}
+
+// TokenIDReusedError is returned when a meter was already issued a token with the same identifier,
+// the meter would reject the second one
+type TokenIDReusedError struct {
+	Existing VendRecord
+}
+
+func (e *TokenIDReusedError) Error() string {
+	return fmt.Sprintf("Token identifier %d was already issued to meter %s at %s (token %s), reprint it or issue again next minute",
+		e.Existing.TID.Int64, e.Existing.MeterNumber, e.Existing.IssuedAt.Format(time.RFC3339), e.Existing.ID)
+}
+
+// ErrDuplicateRequest is returned when the request id of new tokens is already in the ledger
+var ErrDuplicateRequest = fmt.Errorf("request_id was already used")
+
+// InitVending creates the vending ledger table
+func InitVending() map[string]interface{} {
+	if DB == nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Vending ledger needs a database connection",
+		}
+	}
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id VARCHAR(32) NOT NULL PRIMARY KEY, request_id VARCHAR(64) NOT NULL,
+		position INTEGER NOT NULL, meter_number VARCHAR(20) NOT NULL, token VARCHAR(24) NOT NULL, token_type VARCHAR(32) NOT NULL,
+		token_class INTEGER NOT NULL, subclass INTEGER NOT NULL, tid BIGINT NULL, amount DOUBLE PRECISION NOT NULL DEFAULT 0,
+		issued_by VARCHAR(255) NOT NULL, tenant VARCHAR(255) NOT NULL DEFAULT '', details TEXT NOT NULL, issued_at BIGINT NOT NULL, reprint_count INTEGER NOT NULL DEFAULT 0,
+		last_reprint_at BIGINT NOT NULL DEFAULT 0, used_at BIGINT NOT NULL DEFAULT 0,
+		UNIQUE (request_id, position), UNIQUE (meter_number, tid))`, EscapeId(vendTable))
+	if _, err := DB.Exec(query); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Failed to create vending ledger table: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": "Vending ledger ready",
+	}
+}
+
+// NewVendRequestID returns a request id for callers that did not send one
+func NewVendRequestID() (string, error) {
+	return randomToken(16)
+}
+
+// VendOperator names the caller of validated token claims, the user name or else the user id
+func VendOperator(claims map[string]interface{}) string {
+	if name, ok := claims["user_name"].(string); ok && name != "" {
+		return name
+	}
+	if id, ok := claims["id"]; ok && id != nil {
+		return fmt.Sprint(id)
+	}
+	return ""
+}
+
+// VendTenant returns the tenant a token request is restricted to, "" for callers without one
+func VendTenant(options map[string]interface{}) string {
+	if tenant, ok := options[TenantOption].(Tenant); ok && tenant.Value != nil {
+		return fmt.Sprint(tenant.Value)
+	}
+	return ""
+}
+
+// VendVisible reports whether a caller of tenant may see a ledger entry, callers without a tenant see all
+func VendVisible(record VendRecord, tenant string) bool {
+	return tenant == "" || record.Tenant == tenant
+}
+
+// RecordTokens stores the tokens of one vend request together, nothing is stored when any fails.
+// A token identifier the meter was already issued gives a *TokenIDReusedError, a known request id
+// ErrDuplicateRequest. apply runs in the same transaction after the tokens are stored, the vend is
+// undone when it fails.
+func RecordTokens(records []VendRecord, apply ...func(Querier) error) error {
+	if DB == nil {
+		return fmt.Errorf("vending ledger needs a database connection")
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := Rebind(fmt.Sprintf(`INSERT INTO %s (id, request_id, position, meter_number, token, token_type, token_class, subclass, tid,
+		amount, issued_by, tenant, details, issued_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, EscapeId(vendTable)))
+	for i := range records {
+		record := &records[i]
+		if record.ID, err = randomToken(8); err != nil {
+			return err
+		}
+		details, _ := json.Marshal(record.Details)
+		var tid interface{}
+		if record.TID.Valid {
+			tid = record.TID.Int64
+		}
+		if _, err := tx.Exec(query, record.ID, record.RequestID, record.Position, record.MeterNumber, record.Token, record.TokenType,
+			record.Class, record.Subclass, tid, record.Amount, record.Operator, record.Tenant, string(details), record.IssuedAt.Unix()); err != nil {
+			if kind, _, ok := ClassifyDBError(err); ok && kind == DBErrorDuplicate {
+				// Release the transaction before looking the conflict up
+				tx.Rollback()
+				return duplicateVendError(*record)
+			}
+			return err
+		}
+	}
+	for _, fn := range apply {
+		if err := fn(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// duplicateVendError tells which unique key a rejected record hit
+func duplicateVendError(record VendRecord) error {
+	if previous, err := FindVendRequest(record.RequestID); err == nil && len(previous) > 0 {
+		return ErrDuplicateRequest
+	}
+	if record.TID.Valid {
+		existing, err := findVendRecord("meter_number = ? AND tid = ?", record.MeterNumber, record.TID.Int64)
+		if err == nil && existing != nil {
+			return &TokenIDReusedError{Existing: *existing}
+		}
+	}
+	return fmt.Errorf("token is already recorded")
+}
+
+// FindVendRequest returns the tokens issued for a request id in order, none for an unknown id
+func FindVendRequest(requestID string) ([]VendRecord, error) {
+	return queryVendRecords("WHERE request_id = ? ORDER BY position", requestID)
+}
+
+// findVendToken returns the ledger entry of a token issued to a meter, nil when we never issued it
+func findVendToken(meterNumber, token string) (*VendRecord, error) {
+	display, err := vendTokenDisplay(token)
+	if err != nil {
+		return nil, err
+	}
+	return findVendRecord("meter_number = ? AND token = ?", meterNumber, display)
+}
+
+// VendTokenStatus reports whether we issued a token to a meter and its ledger entry, redeem marks the
+// token as used and fails when it was used before or never issued. Tokens of other tenants count as not issued.
+func VendTokenStatus(meterNumber, token, tenant string, redeem bool) (map[string]interface{}, error) {
+	record, err := findVendToken(meterNumber, token)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil && !VendVisible(*record, tenant) {
+		record = nil
+	}
+	if record == nil {
+		if redeem {
+			return nil, fmt.Errorf("Token was not issued by this vending system")
+		}
+		return map[string]interface{}{"issued": false, "ledger": nil}, nil
+	}
+	if redeem {
+		if err := redeemVendToken(record); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"issued": true, "ledger": record.info()}, nil
+}
+
+// redeemVendToken marks a ledger entry as used, a token can only be used once
+func redeemVendToken(record *VendRecord) error {
+	usedAt := time.Now()
+	query := fmt.Sprintf("UPDATE %s SET used_at = ? WHERE id = ? AND used_at = 0", EscapeId(vendTable))
+	result, err := DB.Exec(Rebind(query), usedAt.Unix(), record.ID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if current, err := findVendRecord("id = ?", record.ID); err == nil && current != nil {
+			*record = *current
+		}
+		return fmt.Errorf("Token was already used at %s", record.UsedAt.Format(time.RFC3339))
+	}
+	record.UsedAt = time.Unix(usedAt.Unix(), 0)
+	return nil
+}
+
+// ReprintToken returns a past vend again, looked up by {"id": "..."}, {"request_id": "..."} or
+// {"meter_number": "...", "token": "..."}. The reprint is counted on every token of the vend.
+// Callers with a tenant only find the tokens vended by their tenant.
+func ReprintToken(options map[string]interface{}) map[string]interface{} {
+	var records []VendRecord
+	var err error
+	id, _ := options["id"].(string)
+	requestID, _ := options["request_id"].(string)
+	token, _ := options["token"].(string)
+	switch {
+	case id != "":
+		var record *VendRecord
+		if record, err = findVendRecord("id = ?", id); record != nil {
+			records, err = FindVendRequest(record.RequestID)
+		}
+	case requestID != "":
+		records, err = FindVendRequest(requestID)
+	case token != "":
+		var number string
+		if number, err = meterNumber(options["meter_number"]); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			}
+		}
+		var record *VendRecord
+		if record, err = findVendToken(number, token); record != nil {
+			records, err = FindVendRequest(record.RequestID)
+		}
+	default:
+		return map[string]interface{}{
+			"success": false,
+			"message": "id, request_id or meter_number and token is required",
+		}
+	}
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to reprint token: " + err.Error(),
+		}
+	}
+	if len(records) == 0 || !VendVisible(records[0], VendTenant(options)) {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Token not found in the vending ledger",
+		}
+	}
+	now := time.Now().Unix()
+	query := fmt.Sprintf("UPDATE %s SET reprint_count = reprint_count + 1, last_reprint_at = ? WHERE request_id = ?", EscapeId(vendTable))
+	if _, err := DB.Exec(Rebind(query), now, records[0].RequestID); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to reprint token: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": VendReceipt(records, true),
+	}
+}
+
+// VendReceipt is the issue response of a vend as stored in the ledger, with its ledger ids
+func VendReceipt(records []VendRecord, reprint bool) map[string]interface{} {
+	receipt := map[string]interface{}{}
+	for key, value := range records[0].Details {
+		receipt[key] = value
+	}
+	ids := make([]interface{}, len(records))
+	for i, record := range records {
+		ids[i] = record.ID
+	}
+	receipt["ledger_id"] = ids[0]
+	if len(ids) > 1 {
+		receipt["ledger_id"] = ids
+	}
+	receipt["request_id"] = records[0].RequestID
+	receipt["operator"] = records[0].Operator
+	receipt["issued_at"] = records[0].IssuedAt.Format(time.RFC3339)
+	if reprint {
+		receipt["reprint"] = true
+		receipt["reprint_count"] = records[0].ReprintCount + 1
+	}
+	return receipt
+}
+
+// ListVendTokens returns the vending history, newest first. Filters: "meter_number", "operator",
+// "request_id", "type", "from" and "to" (RFC 3339 issue times), paged by "limit" (default 50) and "offset".
+// Callers with a tenant only see the tokens vended by their tenant.
+func ListVendTokens(options map[string]interface{}) map[string]interface{} {
+	var where []string
+	var args []interface{}
+	if tenant := VendTenant(options); tenant != "" {
+		where = append(where, "tenant = ?")
+		args = append(args, tenant)
+	}
+	for _, filter := range []struct{ option, column string }{
+		{"meter_number", "meter_number"},
+		{"operator", "issued_by"},
+		{"request_id", "request_id"},
+		{"type", "token_type"},
+	} {
+		if value, ok := options[filter.option].(string); ok && value != "" {
+			where = append(where, filter.column+" = ?")
+			args = append(args, value)
+		}
+	}
+	for _, bound := range []struct{ option, operator string }{{"from", ">="}, {"to", "<="}} {
+		value, ok := options[bound.option].(string)
+		if !ok || value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"message": bound.option + " must be an RFC 3339 time",
+			}
+		}
+		where = append(where, "issued_at "+bound.operator+" ?")
+		args = append(args, t.Unix())
+	}
+	limit, err := vendPageOption(options, "limit", 50)
+	if err == nil && (limit < 1 || limit > maxVendPage) {
+		err = fmt.Errorf("limit must be between 1 and %d", maxVendPage)
+	}
+	offset, offsetErr := vendPageOption(options, "offset", 0)
+	if err == nil {
+		err = offsetErr
+	}
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = "WHERE " + strings.Join(where, " AND ")
+	}
+	var total int64
+	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s %s", EscapeId(vendTable), clause)
+	if err := DB.QueryRow(Rebind(countQuery), args...).Scan(&total); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to list tokens: " + err.Error(),
+		}
+	}
+	records, err := queryVendRecords(fmt.Sprintf("%s ORDER BY issued_at DESC, request_id, position LIMIT %d OFFSET %d", clause, limit, offset), args...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"message": "Unable to list tokens: " + err.Error(),
+		}
+	}
+	list := []map[string]interface{}{}
+	for _, record := range records {
+		list = append(list, record.info())
+	}
+	return map[string]interface{}{
+		"success": true,
+		"message": map[string]interface{}{
+			"tokens":       list,
+			"totalRecords": total,
+			"limit":        limit,
+			"offset":       offset,
+		},
+	}
+}
+
+// vendPageOption reads a paging option, a JSON number or a digit string (query parameters)
+func vendPageOption(options map[string]interface{}, key string, fallback int) (int, error) {
+	switch value := options[key].(type) {
+	case nil:
+		return fallback, nil
+	case float64:
+		if value >= 0 && value == float64(int(value)) {
+			return int(value), nil
+		}
+	case string:
+		if value == "" {
+			return fallback, nil
+		}
+		if number, err := strconv.Atoi(value); err == nil && number >= 0 {
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be a whole number", key)
+}
+
+func findVendRecord(condition string, args ...interface{}) (*VendRecord, error) {
+	records, err := queryVendRecords("WHERE "+condition, args...)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[0], nil
+}
+
+func queryVendRecords(clause string, args ...interface{}) ([]VendRecord, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("vending ledger needs a database connection")
+	}
+	query := fmt.Sprintf(`SELECT id, request_id, position, meter_number, token, token_type, token_class, subclass, tid, amount, issued_by,
+		tenant, details, issued_at, reprint_count, last_reprint_at, used_at FROM %s %s`, EscapeId(vendTable), clause)
+	rows, err := DB.Query(Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []VendRecord
+	for rows.Next() {
+		var record VendRecord
+		var details string
+		var issued, reprinted, used int64
+		if err := rows.Scan(&record.ID, &record.RequestID, &record.Position, &record.MeterNumber, &record.Token, &record.TokenType,
+			&record.Class, &record.Subclass, &record.TID, &record.Amount, &record.Operator, &record.Tenant, &details, &issued, &record.ReprintCount,
+			&reprinted, &used); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(details), &record.Details)
+		record.IssuedAt = time.Unix(issued, 0)
+		if reprinted > 0 {
+			record.LastReprintAt = time.Unix(reprinted, 0)
+		}
+		if used > 0 {
+			record.UsedAt = time.Unix(used, 0)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// vendTokenDisplay returns a 20 digit token, with or without dashes, in its display form
+func vendTokenDisplay(token string) (string, error) {
+	digits := strings.ReplaceAll(token, "-", "")
+	if len(digits) != 20 || !IsAllDigits(digits) {
+		return "", fmt.Errorf("Invalid token format. Must be 20 digits (dashes allowed).")
+	}
+	parts := make([]string, 0, 5)
+	for i := 0; i < len(digits); i += 4 {
+		parts = append(parts, digits[i:i+4])
+	}
+	return strings.Join(parts, "-"), nil
+}
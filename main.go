@@ -3,16 +3,17 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"runtime"
 	"time"
 	"vartrick/controllers"
 	"vartrick/helpers"
+	encrypted "vartrick/public"
 	"vartrick/route"
 
 	"github.com/fatih/color"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
 )
 
@@ -77,7 +78,7 @@ func main() {
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3000"}, // your React URL
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
@@ -89,11 +90,41 @@ func main() {
 	router.Use(ColorLogger())  // pretty colored request logs
 	router.Use(gin.Recovery()) // catch panics
 
+	// JWT signing keys
+	keysResult := helpers.InitSigningKeys()
+	helpers.LogJSON(keysResult["success"].(bool), fmt.Sprint(keysResult["message"]))
+
+	// Role policy and table config used by the API routes, serving without them would drop
+	// the configured permissions, tenant scoping and redaction
+	for _, configResult := range []map[string]interface{}{helpers.LoadPolicyConfig(), helpers.LoadSchemaConfig()} {
+		helpers.LogJSON(configResult["success"].(bool), fmt.Sprint(configResult["message"]))
+		if !configResult["success"].(bool) {
+			os.Exit(1)
+		}
+	}
+
 	// Initialize DB
 	dbResult := helpers.InitDBConnection()
 	if dbResult["success"].(bool) {
 		controllers.SetDB(helpers.DB) // now helpers.db is live
 		helpers.LogJSON(true, "Database connected successfully")
+		tokenStoreResult := helpers.InitTokenStore()
+		helpers.LogJSON(tokenStoreResult["success"].(bool), fmt.Sprint(tokenStoreResult["message"]))
+		otpStoreResult := helpers.InitOTPStore()
+		helpers.LogJSON(otpStoreResult["success"].(bool), fmt.Sprint(otpStoreResult["message"]))
+		apiKeyResult := helpers.InitAPIKeys()
+		helpers.LogJSON(apiKeyResult["success"].(bool), fmt.Sprint(apiKeyResult["message"]))
+		twoFactorResult := helpers.InitTwoFactor()
+		helpers.LogJSON(twoFactorResult["success"].(bool), fmt.Sprint(twoFactorResult["message"]))
+		meterResult := helpers.InitMeters()
+		helpers.LogJSON(meterResult["success"].(bool), fmt.Sprint(meterResult["message"]))
+		vendingResult := helpers.InitVending()
+		helpers.LogJSON(vendingResult["success"].(bool), fmt.Sprint(vendingResult["message"]))
+		tariffResult := helpers.InitTariffs()
+		helpers.LogJSON(tariffResult["success"].(bool), fmt.Sprint(tariffResult["message"]))
+		// Load the table/column allow-list used by the generic CRUD routes
+		schemaResult := helpers.LoadSchema()
+		helpers.LogJSON(schemaResult["success"].(bool), fmt.Sprint(schemaResult["message"]))
 	} else {
 		helpers.LogJSON(false, fmt.Sprintf("Database connection failed: %s", dbResult["message"]))
 	}
@@ -108,6 +139,8 @@ func main() {
 
 	// Start cleanup to prevent memory leaks
 	helpers.StartCleanup(10 * time.Minute)
+	helpers.StartTokenCleanup(time.Hour)
+	helpers.StartKeyRotation(time.Minute)
 
 	// Rate limiter
 	router.Use(helpers.RateLimitMiddleware(2, 10, 10*time.Second, "/api/", "/api/V1/"))
@@ -115,6 +148,7 @@ func main() {
 	// Load app routes
 	route.Router_main(router)
 	route.Router_mysql(router)
+	encrypted.Router_mysql(router) // /api/V1, encrypted payloads
 
 	// Handle 404
 	router.NoRoute(func(c *gin.Context) {
@@ -128,7 +162,7 @@ func main() {
 	// Start server
 	result := helpers.StartServer(router)
 	if result["success"].(bool) {
-		helpers.LogJSON(true, fmt.Sprintf("Server started successfully on port %s", helpers.ServerPort))
+		helpers.LogJSON(true, fmt.Sprintf("Server started successfully on port %d", helpers.ServerPort))
 	} else {
 		helpers.LogJSON(false, fmt.Sprintf("Server failed to start: %s", result["message"]))
 	}
@@ -2,6 +2,7 @@ package route
 
 import (
 	"net/http"
+	"strings"
 	"vartrick/controllers"
 	"vartrick/helpers"
 
@@ -12,34 +13,68 @@ import (
 func decryptAndValidate(c *gin.Context) (map[string]interface{}, bool) {
 	var body map[string]interface{}
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+		c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 			"success": false,
 			"message": "Invalid JSON body",
-		}))
+		}, payloadClaims(c)))
 		return nil, false
 	}
 
-	decrypted := helpers.Decript(body)
+	if callerClaims(c) == nil {
+		c.Set("payload_session", helpers.PayloadSession(body))
+	}
+	decrypted := helpers.DecriptFor(body, payloadClaims(c))
 	if success, ok := decrypted["success"].(bool); !ok || !success {
-		c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+		c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 			"success": false,
 			"message": "Failed to decrypt data. Check encryption keys.",
-		}))
+		}, payloadClaims(c)))
 		return nil, false
 	}
 
 	message, ok := decrypted["message"].(map[string]interface{})
 	if !ok {
-		c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+		c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 			"success": false,
 			"message": "Invalid decrypted payload",
-		}))
+		}, payloadClaims(c)))
 		return nil, false
 	}
 
 	return message, true
 }
 
+// helper: claims of the authorized caller, set by helpers.AuthMiddleware
+func callerClaims(c *gin.Context) map[string]interface{} {
+	claims, _ := c.Get("claims")
+	claimsMap, _ := claims.(map[string]interface{})
+	return claimsMap
+}
+
+// helper: claims of the session key the request payload was sealed with, the caller's claims or
+// before login the session of the caller's handshake
+func payloadClaims(c *gin.Context) map[string]interface{} {
+	if claims := callerClaims(c); claims != nil {
+		return claims
+	}
+	if session := c.GetString("payload_session"); session != "" {
+		return map[string]interface{}{"sid": session}
+	}
+	return nil
+}
+
+// helper: reject requests the caller's roles do not allow, true when the response was sent
+func forbidden(c *gin.Context, check func([]string) error) bool {
+	if err := check(helpers.RolesFromClaims(callerClaims(c))); err != nil {
+		c.JSON(http.StatusForbidden, helpers.EncriptFor(map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+		}, payloadClaims(c)))
+		return true
+	}
+	return false
+}
+
 // helper: determine HTTP status
 func determineStatus(response map[string]interface{}) int {
 	if success, ok := response["success"].(bool); ok && success {
@@ -66,7 +101,7 @@ func Router_mysql(router *gin.Engine) {
 				return
 			}
 
-			response := controllers.Read(message)
+			response := controllers.Login(message)
 
 			status := determineStatus(response)
 
@@ -80,27 +115,142 @@ func Router_mysql(router *gin.Engine) {
 					"browser_name":    c.Request.UserAgent(),
 				}
 
+				// Users with two-factor authentication get a challenge instead of tokens
+				if challenge := helpers.TwoFactorChallenge(user); challenge != nil {
+					c.JSON(determineStatus(challenge), helpers.EncriptFor(challenge, payloadClaims(c)))
+					return
+				}
+
+				_, usernameColumn, _ := helpers.AuthColumns()
 				authResult := helpers.Authenticate(map[string]interface{}{
 					"id":        user["id"],
-					"user_name": user["user_name"],
+					"user_name": user[usernameColumn],
+					"roles":     helpers.UserRoles(user),
+					"tenant":    helpers.UserTenant(user),
+					"session":   c.GetString("payload_session"),
 				})
 
 				if successToken, ok := authResult["success"].(bool); ok && successToken {
 					user["token"] = authResult["message"]
+					user["refresh_token"] = authResult["refresh_token"]
+					user["expires_in"] = authResult["expires_in"]
 				} else {
-					c.JSON(http.StatusInternalServerError, helpers.Encript(map[string]interface{}{
+					c.JSON(http.StatusInternalServerError, helpers.EncriptFor(map[string]interface{}{
 						"success": false,
 						"message": "Failed to generate token",
-					}))
+					}, payloadClaims(c)))
 					return
 				}
 
 				response["message"] = messages
 			}
 
-			c.JSON(status, helpers.Encript(response))
+			c.JSON(status, helpers.EncriptFor(response, payloadClaims(c)))
+		})
+
+		// REFRESH
+		mysql.POST("/refresh", func(c *gin.Context) {
+			message, ok := decryptAndValidate(c)
+			if !ok {
+				return
+			}
+			refreshToken, _ := message["refresh_token"].(string)
+			response := helpers.RefreshSession(refreshToken)
+			status := determineStatus(response)
+			if status != http.StatusOK {
+				status = http.StatusUnauthorized
+			}
+			c.JSON(status, helpers.EncriptFor(response, payloadClaims(c)))
+		})
+
+		// LOGOUT
+		mysql.POST("/logout", helpers.AuthMiddleware(), func(c *gin.Context) {
+			response := helpers.RevokeSession(callerClaims(c))
+			c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
+		})
+
+		// KEY EXCHANGE: X25519 handshake giving the session its own payload key, exchanged in plain JSON.
+		// Before login the key seals the login itself and is kept for the session it starts.
+		handshake := func(c *gin.Context) {
+			var body map[string]interface{}
+			if err := c.ShouldBindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
+				return
+			}
+			response := helpers.SessionHandshake(callerClaims(c), body)
+			if success, ok := response["success"].(bool); !ok || !success {
+				c.JSON(http.StatusBadRequest, response)
+				return
+			}
+			c.JSON(http.StatusOK, response)
+		}
+		mysql.POST("/login/handshake", handshake)
+		mysql.POST("/handshake", helpers.AuthMiddleware(), handshake)
+
+		// LOGIN SECOND STEP: TOTP, recovery code or sent OTP of a login challenge
+		mysql.POST("/login/verify", func(c *gin.Context) {
+			message, ok := decryptAndValidate(c)
+			if !ok {
+				return
+			}
+			subject, err := helpers.VerifyTwoFactor(message)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, helpers.EncriptFor(map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				}, payloadClaims(c)))
+				return
+			}
+			subject["session"] = c.GetString("payload_session")
+			authResult := helpers.Authenticate(subject)
+			if successToken, ok := authResult["success"].(bool); !ok || !successToken {
+				c.JSON(http.StatusInternalServerError, helpers.EncriptFor(map[string]interface{}{
+					"success": false,
+					"message": "Failed to generate token",
+				}, payloadClaims(c)))
+				return
+			}
+			c.JSON(http.StatusOK, helpers.EncriptFor(map[string]interface{}{
+				"success": true,
+				"message": []map[string]interface{}{{
+					"id":            subject["id"],
+					"user_name":     subject["user_name"],
+					"token":         authResult["message"],
+					"refresh_token": authResult["refresh_token"],
+					"expires_in":    authResult["expires_in"],
+				}},
+			}, payloadClaims(c)))
+		})
+
+		mysql.POST("/login/otp", func(c *gin.Context) {
+			message, ok := decryptAndValidate(c)
+			if !ok {
+				return
+			}
+			response := controllers.SendLoginOTP(message)
+			c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
 		})
 
+		// TWO-FACTOR ENROLLMENT of the caller
+		twoFactorRoutes := map[string]func(map[string]interface{}, map[string]interface{}) map[string]interface{}{
+			"/2fa/enroll": func(claims, _ map[string]interface{}) map[string]interface{} {
+				return helpers.EnrollTwoFactor(claims)
+			},
+			"/2fa/confirm": helpers.ConfirmTwoFactor,
+			"/2fa/disable": helpers.DisableTwoFactor,
+		}
+		for route, handler := range twoFactorRoutes {
+			h := handler
+			mysql.POST(route, helpers.AuthMiddleware("2fa-"+strings.TrimPrefix(route, "/2fa/")), func(c *gin.Context) {
+				message, ok := decryptAndValidate(c)
+				if !ok {
+					return
+				}
+				response := h(callerClaims(c), message)
+				c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
+			})
+		}
+
 		// SINGLE-OBJECT ROUTES
 		singleRoutes := map[string]func(map[string]interface{}) map[string]interface{}{
 			"/read":            controllers.Read,
@@ -112,8 +262,16 @@ func Router_mysql(router *gin.Engine) {
 			"/delete":          controllers.Delete,
 			"/search":          controllers.Search,
 			"/search-between":  controllers.SearchBetween,
+			"/aggregate":       controllers.Aggregate,
 			"/query":           controllers.Query,
 			"/database-handle": controllers.DatabaseHandler,
+			"/api-key-list":    helpers.ListAPIKeys,
+			"/api-key-revoke":  helpers.RevokeAPIKey,
+			"/meter-register":  helpers.RegisterMeter,
+			"/meter-list":      helpers.ListMeters,
+			"/meter-debt":      helpers.SetMeterDebt,
+			"/tariff-set":      helpers.SetTariff,
+			"/tariff-list":     helpers.ListTariffs,
 		}
 
 		for route, handler := range singleRoutes {
@@ -124,18 +282,41 @@ func Router_mysql(router *gin.Engine) {
 				if !ok {
 					return
 				}
+				if forbidden(c, func(roles []string) error {
+					return helpers.CheckRequest(roles, strings.TrimPrefix(r, "/"), message)
+				}) {
+					return
+				}
+				helpers.WithTenant(message, callerClaims(c))
 				response := h(message)
-				c.JSON(determineStatus(response), helpers.Encript(response))
+				c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
 			})
 		}
 
+		// API KEYS are limited to the permissions of their creator
+		mysql.POST("/api-key-create", helpers.AuthMiddleware(), func(c *gin.Context) {
+			message, ok := decryptAndValidate(c)
+			if !ok {
+				return
+			}
+			if forbidden(c, func(roles []string) error {
+				return helpers.CheckRequest(roles, "api-key-create", message)
+			}) {
+				return
+			}
+			helpers.WithTenant(message, callerClaims(c))
+			response := helpers.CreateAPIKey(callerClaims(c), message)
+			c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
+		})
+
 		// BULK ROUTES
 		bulkRoutes := map[string]func([]map[string]interface{}) map[string]interface{}{
 			"/read-bulk":   controllers.ReadBulk,
-			"/create-bulk": func(msgs []map[string]interface{}) map[string]interface{} { return controllers.CreateBulk(msgs[0]) }, // adjust if controller expects array
+			"/create-bulk": controllers.CreateBulk,
 			"/update-bulk": controllers.UpdateBulk,
 			"/delete-bulk": controllers.DelateBulk,
 			"/bulk-count":  controllers.CountBulk,
+			"/transaction": controllers.Transaction,
 		}
 
 		for route, handler := range bulkRoutes {
@@ -144,19 +325,19 @@ func Router_mysql(router *gin.Engine) {
 			mysql.POST(r, helpers.AuthMiddleware(), func(c *gin.Context) {
 				var body map[string]interface{}
 				if err := c.ShouldBindJSON(&body); err != nil {
-					c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+					c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 						"success": false,
 						"message": "Invalid JSON body",
-					}))
+					}, payloadClaims(c)))
 					return
 				}
 
-				options := helpers.Decript(body)
+				options := helpers.DecriptFor(body, payloadClaims(c))
 				if success, ok := options["success"].(bool); !ok || !success {
-					c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+					c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 						"success": false,
 						"message": "Failed to decrypt data. Check encryption keys.",
-					}))
+					}, payloadClaims(c)))
 					return
 				}
 
@@ -169,25 +350,33 @@ func Router_mysql(router *gin.Engine) {
 						if m, ok := item.(map[string]interface{}); ok {
 							message = append(message, m)
 						} else {
-							c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+							c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 								"success": false,
 								"message": "Invalid array element type",
-							}))
+							}, payloadClaims(c)))
 							return
 						}
 					}
 				case map[string]interface{}:
 					message = append(message, v)
 				default:
-					c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+					c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 						"success": false,
 						"message": "Invalid decrypted payload type",
-					}))
+					}, payloadClaims(c)))
 					return
 				}
 
+				if forbidden(c, func(roles []string) error {
+					return helpers.CheckBulkRequest(roles, strings.TrimPrefix(r, "/"), message)
+				}) {
+					return
+				}
+				for _, item := range message {
+					helpers.WithTenant(item, callerClaims(c))
+				}
 				response := h(message)
-				c.JSON(determineStatus(response), helpers.Encript(response))
+				c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
 			})
 		}
 
@@ -195,33 +384,36 @@ func Router_mysql(router *gin.Engine) {
 		mysql.POST("/backup", helpers.AuthMiddleware(), func(c *gin.Context) {
 			var options map[string]interface{}
 			if err := c.ShouldBindJSON(&options); err != nil {
-				c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+				c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 					"success": false,
 					"message": "Invalid JSON body",
-				}))
+				}, payloadClaims(c)))
+				return
+			}
+			if forbidden(c, func(roles []string) error { return helpers.CheckRoute(roles, "backup") }) {
 				return
 			}
 			response := controllers.Backup(options)
-			c.JSON(determineStatus(response), helpers.Encript(response))
+			c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
 		})
 
 		// COUNT ROUTE: supports single and bulk
 		mysql.POST("/count", helpers.AuthMiddleware(), func(c *gin.Context) {
 			var body map[string]interface{}
 			if err := c.ShouldBindJSON(&body); err != nil {
-				c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+				c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 					"success": false,
 					"message": "Invalid JSON body",
-				}))
+				}, payloadClaims(c)))
 				return
 			}
 
-			options := helpers.Decript(body)
+			options := helpers.DecriptFor(body, payloadClaims(c))
 			if success, ok := options["success"].(bool); !ok || !success {
-				c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+				c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 					"success": false,
 					"message": "Failed to decrypt data. Check encryption keys.",
-				}))
+				}, payloadClaims(c)))
 				return
 			}
 
@@ -230,6 +422,10 @@ func Router_mysql(router *gin.Engine) {
 
 			switch v := messageRaw.(type) {
 			case map[string]interface{}:
+				if forbidden(c, func(roles []string) error { return helpers.CheckRequest(roles, "count", v) }) {
+					return
+				}
+				helpers.WithTenant(v, callerClaims(c))
 				response = controllers.Count(v)
 			case []interface{}:
 				var bulk []map[string]interface{}
@@ -237,23 +433,29 @@ func Router_mysql(router *gin.Engine) {
 					if m, ok := item.(map[string]interface{}); ok {
 						bulk = append(bulk, m)
 					} else {
-						c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+						c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 							"success": false,
 							"message": "Invalid array element type",
-						}))
+						}, payloadClaims(c)))
 						return
 					}
 				}
+				if forbidden(c, func(roles []string) error { return helpers.CheckBulkRequest(roles, "count-bulk", bulk) }) {
+					return
+				}
+				for _, item := range bulk {
+					helpers.WithTenant(item, callerClaims(c))
+				}
 				response = controllers.CountBulk(bulk)
 			default:
-				c.JSON(http.StatusBadRequest, helpers.Encript(map[string]interface{}{
+				c.JSON(http.StatusBadRequest, helpers.EncriptFor(map[string]interface{}{
 					"success": false,
 					"message": "Invalid decrypted payload type",
-				}))
+				}, payloadClaims(c)))
 				return
 			}
 
-			c.JSON(determineStatus(response), helpers.Encript(response))
+			c.JSON(determineStatus(response), helpers.EncriptFor(response, payloadClaims(c)))
 		})
 	}
 }
@@ -1,6 +1,7 @@
 package route
 
 import (
+	"io"
 	"net/http"
 	"vartrick/controllers"
 	"vartrick/helpers"
@@ -18,24 +19,45 @@ func sendResponse(c *gin.Context, response map[string]interface{}) {
 	//c.JSON(status, helpers.Encript(response))
 }
 
+// Claims of the authorized caller, set by helpers.AuthMiddleware
+func callerClaims(c *gin.Context) map[string]interface{} {
+	claims, _ := c.Get("claims")
+	claimsMap, _ := claims.(map[string]interface{})
+	return claimsMap
+}
+
 // Generic binder + handler
-func bindAndHandle(c *gin.Context, handler func(map[string]interface{}) map[string]interface{}) {
+func bindAndHandle(c *gin.Context, route string, handler func(map[string]interface{}) map[string]interface{}) {
 	var body map[string]interface{}
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
 		return
 	}
+	claims := callerClaims(c)
+	if err := helpers.CheckRequest(helpers.RolesFromClaims(claims), route, body); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	helpers.WithTenant(body, claims)
 	response := handler(body)
 	sendResponse(c, response)
 }
 
 // Generic binder + handler for bulk requests
-func bindAndHandleBulk(c *gin.Context, handler func([]map[string]interface{}) map[string]interface{}) {
+func bindAndHandleBulk(c *gin.Context, route string, handler func([]map[string]interface{}) map[string]interface{}) {
 	var body []map[string]interface{}
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
 		return
 	}
+	claims := callerClaims(c)
+	if err := helpers.CheckBulkRequest(helpers.RolesFromClaims(claims), route, body); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	for _, item := range body {
+		helpers.WithTenant(item, claims)
+	}
 	response := handler(body)
 	sendResponse(c, response)
 }
@@ -61,7 +83,7 @@ func handleLogin(c *gin.Context) {
 			return
 		}*/
 
-	response := controllers.Read(options)
+	response := controllers.Login(options)
 
 	// Attach metadata and generate JWT if user found
 	if messages, ok := response["message"].([]map[string]interface{}); ok && len(messages) > 0 {
@@ -72,13 +94,19 @@ func handleLogin(c *gin.Context) {
 			"os":         c.Request.UserAgent(),
 		}
 
-		authResult := helpers.Authenticate(map[string]interface{}{
+		// Users with two-factor authentication get a challenge instead of tokens
+		if challenge := helpers.TwoFactorChallenge(user); challenge != nil {
+			sendResponse(c, challenge)
+			return
+		}
+
+		_, usernameColumn, _ := helpers.AuthColumns()
+		if !attachTokens(user, map[string]interface{}{
 			"id":        user["id"],
-			"user_name": user["user_name"],
-		})
-		if successToken, ok := authResult["success"].(bool); ok && successToken {
-			user["token"] = authResult["message"]
-		} else {
+			"user_name": user[usernameColumn],
+			"roles":     helpers.UserRoles(user),
+			"tenant":    helpers.UserTenant(user),
+		}) {
 			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to generate token"})
 			return
 		}
@@ -89,6 +117,81 @@ func handleLogin(c *gin.Context) {
 	sendResponse(c, response)
 }
 
+// attachTokens issues a session for the authenticated user and adds its tokens to the user row
+func attachTokens(user map[string]interface{}, subject map[string]interface{}) bool {
+	authResult := helpers.Authenticate(subject)
+	if successToken, ok := authResult["success"].(bool); !ok || !successToken {
+		return false
+	}
+	user["token"] = authResult["message"]
+	user["refresh_token"] = authResult["refresh_token"]
+	user["expires_in"] = authResult["expires_in"]
+	return true
+}
+
+// Second login step: verifies the TOTP, recovery code or sent OTP of a login challenge
+func handleLoginVerify(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
+		return
+	}
+	subject, err := helpers.VerifyTwoFactor(body)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	user := map[string]interface{}{"id": subject["id"], "user_name": subject["user_name"]}
+	if !attachTokens(user, subject) {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to generate token"})
+		return
+	}
+	sendResponse(c, map[string]interface{}{"success": true, "message": []map[string]interface{}{user}})
+}
+
+// Sends the email or SMS code of a login challenge
+func handleLoginOTP(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
+		return
+	}
+	sendResponse(c, controllers.SendLoginOTP(body))
+}
+
+// Two-factor enrollment of the caller: confirm and disable take {"code": "..."}
+func handleTwoFactor(action func(map[string]interface{}, map[string]interface{}) map[string]interface{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := map[string]interface{}{}
+		if err := c.ShouldBindJSON(&body); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
+			return
+		}
+		sendResponse(c, action(callerClaims(c), body))
+	}
+}
+
+// Refresh handler: swaps a refresh token for a new access and refresh token
+func handleRefresh(c *gin.Context) {
+	var body map[string]interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
+		return
+	}
+	refreshToken, _ := body["refresh_token"].(string)
+	response := helpers.RefreshSession(refreshToken)
+	if success, ok := response["success"].(bool); !ok || !success {
+		c.JSON(http.StatusUnauthorized, response)
+		return
+	}
+	sendResponse(c, response)
+}
+
+// Logout handler: revokes the access token and its refresh token family
+func handleLogout(c *gin.Context) {
+	sendResponse(c, helpers.RevokeSession(callerClaims(c)))
+}
+
 func Router_mysql(router *gin.Engine) {
 	mysql := router.Group("/api/v1")
 	{
@@ -99,6 +202,17 @@ func Router_mysql(router *gin.Engine) {
 
 		// Login
 		mysql.POST("/login", handleLogin)
+		mysql.POST("/refresh", handleRefresh)
+		mysql.POST("/logout", helpers.AuthMiddleware(), handleLogout)
+		mysql.POST("/login/verify", handleLoginVerify)
+		mysql.POST("/login/otp", handleLoginOTP)
+
+		// Two-factor authentication
+		mysql.POST("/2fa/enroll", helpers.AuthMiddleware("2fa-enroll"), handleTwoFactor(func(claims, _ map[string]interface{}) map[string]interface{} {
+			return helpers.EnrollTwoFactor(claims)
+		}))
+		mysql.POST("/2fa/confirm", helpers.AuthMiddleware("2fa-confirm"), handleTwoFactor(helpers.ConfirmTwoFactor))
+		mysql.POST("/2fa/disable", helpers.AuthMiddleware("2fa-disable"), handleTwoFactor(helpers.DisableTwoFactor))
 
 		// Single item routes
 		singleRoutes := []struct {
@@ -115,16 +229,31 @@ func Router_mysql(router *gin.Engine) {
 			{"search", controllers.Search},
 			{"search-between", controllers.SearchBetween},
 			{"count", controllers.Count},
+			{"aggregate", controllers.Aggregate},
 			{"backup", controllers.Backup},
 			{"query", controllers.Query},
 			{"database-handle", controllers.DatabaseHandler},
+			{"api-key-list", helpers.ListAPIKeys},
+			{"api-key-revoke", helpers.RevokeAPIKey},
+			{"meter-register", helpers.RegisterMeter},
+			{"meter-list", helpers.ListMeters},
+			{"meter-debt", helpers.SetMeterDebt},
+			{"tariff-set", helpers.SetTariff},
+			{"tariff-list", helpers.ListTariffs},
 		}
 		for _, r := range singleRoutes {
 			route := r
 			mysql.POST("/"+route.route, helpers.AuthMiddleware(), func(c *gin.Context) {
-				bindAndHandle(c, route.handler)
+				bindAndHandle(c, route.route, route.handler)
 			})
 		}
+		// Keys are limited to the permissions of their creator
+		mysql.POST("/api-key-create", helpers.AuthMiddleware(), func(c *gin.Context) {
+			claims := callerClaims(c)
+			bindAndHandle(c, "api-key-create", func(body map[string]interface{}) map[string]interface{} {
+				return helpers.CreateAPIKey(claims, body)
+			})
+		})
 
 		// Bulk routes
 		bulkRoutes := []struct {
@@ -136,11 +265,12 @@ func Router_mysql(router *gin.Engine) {
 			{"create-bulk", controllers.CreateBulk},
 			{"delete-bulk", controllers.DelateBulk},
 			{"count-bulk", controllers.CountBulk},
+			{"transaction", controllers.Transaction},
 		}
 		for _, r := range bulkRoutes {
 			route := r
 			mysql.POST("/"+route.route, helpers.AuthMiddleware(), func(c *gin.Context) {
-				bindAndHandleBulk(c, route.handler)
+				bindAndHandleBulk(c, route.route, route.handler)
 			})
 		}
 	}
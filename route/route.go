@@ -14,6 +14,11 @@ import (
 )
 
 func Router_main(router *gin.Engine) {
+	// Public keys verifying our access tokens (empty with HS256)
+	router.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, helpers.JWKS())
+	})
+
 	routes := router.Group("/api")
 	{
 		// Base route for testing if the server is running
@@ -62,24 +67,53 @@ func Router_main(router *gin.Engine) {
 				"message": message,
 			})
 		})
-		//this router encript -token , helpers.AuthMiddleware()
-		routes.GET("/encript-token", func(c *gin.Context) {
-			amount := c.Query("amount")
-			result := controllers.EncriptToken(map[string]interface{}{
-				"amount": amount,
-			})
+		// Issue a token, recorded in the vending ledger under the caller
+		routes.GET("/encript-token", helpers.AuthMiddleware(), func(c *gin.Context) {
+			options := tokenOptions(c)
+			if _, ok := options["request_id"]; !ok && c.GetHeader("X-Request-ID") != "" {
+				options["request_id"] = c.GetHeader("X-Request-ID")
+			}
+			result := controllers.EncriptToken(callerClaims(c), options)
 			if success, ok := result["success"].(bool); ok && success {
 				c.JSON(http.StatusOK, result)
 			} else {
 				c.JSON(http.StatusInternalServerError, result)
 			}
 		})
-		// This route decript-token helpers.AuthMiddleware()
-		routes.GET("/decript-token", func(c *gin.Context) {
-			token := c.Query("token")
-			result := controllers.DecriptToken(map[string]interface{}{
-				"token": token,
-			})
+		// Sell units for a payment with the tariff of the meter, the response carries the receipt
+		routes.GET("/vend", helpers.AuthMiddleware(), func(c *gin.Context) {
+			options := tokenOptions(c)
+			if _, ok := options["request_id"]; !ok && c.GetHeader("X-Request-ID") != "" {
+				options["request_id"] = c.GetHeader("X-Request-ID")
+			}
+			result := controllers.VendPayment(callerClaims(c), options)
+			if success, ok := result["success"].(bool); ok && success {
+				c.JSON(http.StatusOK, result)
+			} else {
+				c.JSON(http.StatusInternalServerError, result)
+			}
+		})
+		// Decrypt a token and look it up in the vending ledger, redeem=true marks it as used
+		routes.GET("/decript-token", helpers.AuthMiddleware(), func(c *gin.Context) {
+			result := controllers.DecriptToken(tokenOptions(c))
+			if success, ok := result["success"].(bool); ok && success {
+				c.JSON(http.StatusOK, result)
+			} else {
+				c.JSON(http.StatusInternalServerError, result)
+			}
+		})
+		// Reprint a past token by id, request_id or meter_number and token
+		routes.GET("/reprint-token", helpers.AuthMiddleware(), func(c *gin.Context) {
+			result := helpers.ReprintToken(tokenOptions(c))
+			if success, ok := result["success"].(bool); ok && success {
+				c.JSON(http.StatusOK, result)
+			} else {
+				c.JSON(http.StatusInternalServerError, result)
+			}
+		})
+		// Vending history: meter_number, operator, request_id, type, from, to, limit and offset
+		routes.GET("/tokens", helpers.AuthMiddleware(), func(c *gin.Context) {
+			result := helpers.ListVendTokens(tokenOptions(c))
 			if success, ok := result["success"].(bool); ok && success {
 				c.JSON(http.StatusOK, result)
 			} else {
@@ -105,16 +139,33 @@ func Router_main(router *gin.Engine) {
 			phone := c.Query("phone")
 
 			result := controllers.SendOTP(map[string]interface{}{
-				"length": length,
-				"email":  email,
-				"phone":  phone,
+				"length":  length,
+				"email":   email,
+				"phone":   phone,
+				"purpose": c.Query("purpose"),
 			})
 			if success, ok := result["success"].(bool); ok && success {
 				c.JSON(http.StatusOK, result)
+			} else if _, ok := result["retry_after"]; ok {
+				c.JSON(http.StatusTooManyRequests, result)
 			} else {
 				c.JSON(http.StatusInternalServerError, result)
 			}
 		})
+		// This route checks a code sent by /send-otp: {"purpose": "...", "email"|"phone": "...", "code": "..."}
+		routes.POST("/verify-otp", helpers.AuthMiddleware(), func(c *gin.Context) {
+			var body map[string]interface{}
+			if err := c.ShouldBindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON body"})
+				return
+			}
+			result := controllers.VerifyOTP(body)
+			if success, ok := result["success"].(bool); ok && success {
+				c.JSON(http.StatusOK, result)
+			} else {
+				c.JSON(http.StatusUnauthorized, result)
+			}
+		})
 		//send sms routers
 		routes.GET("/send-sms-local", helpers.AuthMiddleware(), func(c *gin.Context) {
 			to := c.Query("to")
@@ -166,7 +217,7 @@ func Router_main(router *gin.Engine) {
 	files := router.Group("/api/files")
 	{
 		// Single file upload
-		files.POST("/upload", helpers.AuthMiddleware(), func(c *gin.Context) {
+		files.POST("/upload", helpers.AuthMiddleware("file-upload"), func(c *gin.Context) {
 			result := controllers.UploadFile(map[string]interface{}{
 				"context":   c,
 				"file_name": "myfile", // must match <input name="myfile">
@@ -180,7 +231,7 @@ func Router_main(router *gin.Engine) {
 		})
 
 		// Multiple files upload
-		files.POST("/upload-multiple", helpers.AuthMiddleware(), func(c *gin.Context) {
+		files.POST("/upload-multiple", helpers.AuthMiddleware("file-upload-multiple"), func(c *gin.Context) {
 			result := controllers.UploadMultipleFiles(map[string]interface{}{
 				"context": c,
 			})
@@ -193,7 +244,7 @@ func Router_main(router *gin.Engine) {
 		})
 
 		// Download file
-		files.GET("/download/:filename", helpers.AuthMiddleware(), func(c *gin.Context) {
+		files.GET("/download/:filename", helpers.AuthMiddleware("file-download"), func(c *gin.Context) {
 			filename := c.Param("filename")
 			if filename == "" {
 				c.JSON(http.StatusBadRequest, gin.H{
@@ -219,7 +270,7 @@ func Router_main(router *gin.Engine) {
 		})
 
 		// Delete file
-		files.DELETE("/delete/:filename", helpers.AuthMiddleware(), func(c *gin.Context) {
+		files.DELETE("/delete/:filename", helpers.AuthMiddleware("file-delete"), func(c *gin.Context) {
 			result := controllers.DeleteFile(map[string]interface{}{
 				"context": c,
 			})
@@ -233,3 +284,14 @@ func Router_main(router *gin.Engine) {
 	}
 
 }
+
+// tokenOptions passes the query parameters of the token routes (amount, meter_number, class, subclass, ...)
+// and the tenant of the caller
+func tokenOptions(c *gin.Context) map[string]interface{} {
+	options := map[string]interface{}{}
+	for key := range c.Request.URL.Query() {
+		options[key] = c.Query(key)
+	}
+	helpers.WithTenant(options, callerClaims(c))
+	return options
+}